@@ -11,13 +11,13 @@ func AdminUserDetails(userService ewserver.UserService, logService ewserver.LogS
 		userName := c.Param("user")
 		user, err := userService.User(ewserver.UserName(userName))
 		if err != nil {
-			c.JSON(500, gin.H{"error": err})
+			respond(c, 500, gin.H{"error": err})
 		}
 
 		// Just incase
 		user.Password = []byte{}
 
-		c.JSON(200, gin.H{"status": "OK", "user": user})
+		respond(c, 200, gin.H{"status": "OK", "user": user})
 	}
 }
 
@@ -26,7 +26,7 @@ func AdminUsersDetails(userService ewserver.UserService, logService ewserver.Log
 	return func(c *gin.Context) {
 		users, err := userService.Users()
 		if err != nil {
-			c.JSON(500, gin.H{"error": err})
+			respond(c, 500, gin.H{"error": err})
 		}
 
 		for _, user := range users {
@@ -34,7 +34,7 @@ func AdminUsersDetails(userService ewserver.UserService, logService ewserver.Log
 			user.Password = []byte{}
 		}
 
-		c.JSON(200, gin.H{"status": "OK", "users": users})
+		respond(c, 200, gin.H{"status": "OK", "users": users})
 	}
 }
 
@@ -50,16 +50,17 @@ func AdminCreateUser(userService ewserver.UserService, roleService ewserver.Role
 
 	return func(c *gin.Context) {
 		user := &newUser{}
-		if err := c.BindJSON(user); err != nil {
-			c.JSON(500, gin.H{"error": err})
+		if err := bind(c, user); err != nil {
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
 		if err := roleService.AddSubjectToRole(string(user.UserName), user.Role); err != nil {
-			c.JSON(500, gin.H{"error": err})
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
+		c.Set(adminSubjectKey, string(user.UserName))
 		err := userService.Create(&user.User, user.Password)
 		defaultReturn(err, c)
 	}
@@ -75,8 +76,8 @@ func AdminResetPassword(userService ewserver.UserService, logService ewserver.Lo
 	return func(c *gin.Context) {
 		passwordRequest := &passwordReset{}
 
-		if err := c.BindJSON(passwordRequest); err != nil {
-			c.JSON(500, gin.H{"error": err})
+		if err := bind(c, passwordRequest); err != nil {
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
@@ -90,35 +91,73 @@ func AdminDeleteUser(userService ewserver.UserService, logService ewserver.LogSe
 
 	return func(c *gin.Context) {
 		userName := c.Param("user")
+		c.Set(adminSubjectKey, userName)
 		err := userService.Delete(ewserver.UserName(userName))
 		defaultReturn(err, c)
 	}
 }
 
-// AdminAPIUserDetails returns the details of an API User
-func AdminAPIUserDetails(apiUserService ewserver.APIUserService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+// AdminAPIUserDetails returns the details of an API User, LastAddress is where the device was last seen from
+func AdminAPIUserDetails(apiUserService ewserver.APIUserService, presenceService ewserver.PresenceService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 		id := c.Param("id")
 		user, err := apiUserService.APIUserByID([]byte(id))
 		if err != nil {
-			c.JSON(500, gin.H{"error": err})
+			respond(c, 500, gin.H{"error": err})
+			return
+		}
+
+		presence, err := presenceService.Presence(user.ID)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
 		}
 
-		c.JSON(200, gin.H{"status": "OK", "user": user})
+		if presence.Address != "" {
+			user.LastAddress = presence.Address
+		}
+		respond(c, 200, gin.H{"status": "OK", "user": user})
 	}
 }
 
-// AdminAPIUsersDetails returns the details of all API Users
-func AdminAPIUsersDetails(apiUserService ewserver.APIUserService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+// AdminAPIUsersDetails returns the details of all API Users with their presence, LastAddress is where
+// the device was last seen from. The q parameter filters them by metadata and tags, such as
+// site=berlin AND hw>=3 AND tag=outdoor.
+func AdminAPIUsersDetails(apiUserService ewserver.APIUserService, presenceService ewserver.PresenceService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type apiUserPresence struct {
+		*ewserver.APIUser
+		Presence *ewserver.Presence `json:"presence"`
+	}
 
 	return func(c *gin.Context) {
-		apiUsers, err := apiUserService.APIUsers()
+		query, err := ewserver.ParseDeviceQuery(c.Query("q"))
 		if err != nil {
-			c.JSON(500, gin.H{"error": err})
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
 		}
 
-		c.JSON(200, gin.H{"status": "OK", "api_users": apiUsers})
+		apiUsers, err := apiUserService.Search(query)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err})
+			return
+		}
+
+		details := make([]*apiUserPresence, 0, len(apiUsers))
+		for _, apiUser := range apiUsers {
+			presence, err := presenceService.Presence(apiUser.ID)
+			if err != nil {
+				respond(c, 500, gin.H{"error": err})
+				return
+			}
+
+			if presence.Address != "" {
+				apiUser.LastAddress = presence.Address
+			}
+			details = append(details, &apiUserPresence{APIUser: apiUser, Presence: presence})
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "api_users": details})
 	}
 }
 
@@ -127,36 +166,79 @@ func AdminCreateAPIUser(apiUserService ewserver.APIUserService, logService ewser
 
 	return func(c *gin.Context) {
 		apiUser := &ewserver.APIUser{}
-		if err := c.BindJSON(apiUser); err != nil {
-			c.JSON(500, gin.H{"error": err})
+		if err := bind(c, apiUser); err != nil {
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
 		key, err := ewserver.GenerateAPIKey()
 		if err != nil {
-			c.JSON(500, gin.H{"error": err})
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
 		apiUser.Key = key
 
+		c.Set(adminSubjectKey, apiUser.Name)
 		err = apiUserService.Create(apiUser)
 		defaultReturn(err, c)
 	}
 }
 
-// AdminDeleteAPIUser deletes the API key by first looking up the ID to get the APIKey.
-func AdminDeleteAPIUser(apiUserService ewserver.APIUserService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+// AdminUpdateAPIUserAttributes replaces the metadata and/or tags of the device's API user, fields that
+// are not given are kept.
+func AdminUpdateAPIUserAttributes(apiUserService ewserver.APIUserService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type attributesRequest struct {
+		Device   string            `json:"device"`
+		Metadata map[string]string `json:"metadata"`
+		Tags     []string          `json:"tags"`
+	}
+
+	return func(c *gin.Context) {
+		request := &attributesRequest{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidMetadata.Error()})
+			return
+		}
+
+		apiUser, err := apiUserService.APIUserByID([]byte(request.Device))
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if request.Metadata != nil {
+			apiUser.Metadata = request.Metadata
+		}
+
+		if request.Tags != nil {
+			apiUser.Tags = request.Tags
+		}
+
+		if err := apiUserService.Update(apiUser); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("api user attributes updated", "api_user", apiUser.Name, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK", "api_user": apiUser})
+	}
+}
+
+// AdminDeleteAPIUser deletes the API key by first looking up the ID to get the APIKey. The API user's roles,
+// permissions and device state are deleted with it.
+func AdminDeleteAPIUser(apiUserService ewserver.APIUserService, deviceRemover ewserver.DeviceRemover, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 		id := c.Param("id")
 		apiUser, err := apiUserService.APIUserByID([]byte(id))
 		if err != nil {
-			c.JSON(500, gin.H{"error": err})
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
-		err = apiUserService.Delete(apiUser.Key)
+		c.Set(adminSubjectKey, apiUser.Name)
+		err = deviceRemover.Remove(apiUser)
 		defaultReturn(err, c)
 	}
 }
@@ -1,8 +1,12 @@
 package v1
 
 import (
+	"errors"
+
 	"github.com/gin-gonic/gin"
 	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/authz"
+	"github.com/wirepair/ewserver/internal/session"
 )
 
 const (
@@ -12,17 +16,121 @@ const (
 
 func defaultReturn(err error, c *gin.Context) {
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		respond(c, 500, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(200, gin.H{"status": "OK"})
+	respond(c, 200, gin.H{"status": "OK"})
+}
+
+var (
+	// errMissingAPIKey when a device route is called without an API key
+	errMissingAPIKey = errors.New("missing " + ewserver.APIKeyHeader + " header")
+	// errMissingDevice when a user calls a device route without specifying the device
+	errMissingDevice = errors.New("missing device parameter")
+	// errNotAuthorized when a handler's own authorization check of a resource fails
+	errNotAuthorized = errors.New("not authorized")
+	// errUnknownEvent when subscribing to an event kind that does not exist
+	errUnknownEvent = errors.New("unknown event kind")
+	// errNoTopics when subscribing without any streams or events
+	errNoTopics = errors.New("no streams or events requested")
+)
+
+// errorStatus maps service errors caused by bad input to 400, anything else is a server error.
+func errorStatus(err error) int {
+	switch err {
+	case ewserver.ErrInvalidStream, ewserver.ErrInvalidDataPoint, ewserver.ErrInvalidQuery, ewserver.ErrInvalidCommand, ewserver.ErrInvalidFirmware, ewserver.ErrInvalidShadow, ewserver.ErrInvalidRetention, ewserver.ErrInvalidRule, ewserver.ErrInvalidWebhook, ewserver.ErrInvalidEnrollment, ewserver.ErrInvalidCSR, ewserver.ErrInvalidRateLimit, ewserver.ErrInvalidSearch, ewserver.ErrInvalidMetadata, ewserver.ErrInvalidGroup, ewserver.ErrInvalidBulkJob, ewserver.ErrInvalidBatch, ewserver.ErrInvalidSequence, ewserver.ErrInvalidBlob, ewserver.ErrBlobChecksum, ewserver.ErrInvalidDeviceLog, errMissingDevice:
+		return 400
+	case errMissingAPIKey, ewserver.ErrEnrollmentDenied:
+		return 401
+	case ewserver.ErrUserNotFound, ewserver.ErrCommandNotFound, ewserver.ErrFirmwareNotFound, ewserver.ErrRuleNotFound, ewserver.ErrAlertNotFound, ewserver.ErrWebhookNotFound, ewserver.ErrDeliveryNotFound, ewserver.ErrTokenNotFound, ewserver.ErrCertNotFound, ewserver.ErrLimitNotFound, ewserver.ErrGroupNotFound, ewserver.ErrJobNotFound, ewserver.ErrKeysNotAvailable, ewserver.ErrBlobNotFound:
+		return 404
+	case ewserver.ErrCommandState, ewserver.ErrFirmwareExists, ewserver.ErrVersionConflict, ewserver.ErrDeliveryState, ewserver.ErrUserAlreadyExists, ewserver.ErrCertRevoked, ewserver.ErrGroupExists, ewserver.ErrUploadInFlight, ewserver.ErrStaleSequence, ewserver.ErrBlobOffset, ewserver.ErrBlobIncomplete, ewserver.ErrBlobQuota:
+		return 409
+	case ewserver.ErrRateLimited:
+		return 429
+	}
+	return 500
+}
+
+// requestAPIUser returns the API user the authorizer identified the request by, from their API key, the key ID
+// of a signed request or their verified client certificate.
+func requestAPIUser(c *gin.Context) (*ewserver.APIUser, error) {
+	if value, ok := c.Get(ewserver.APIUserContextKey); ok {
+		if apiUser, ok := value.(*ewserver.APIUser); ok {
+			return apiUser, nil
+		}
+	}
+	return nil, errMissingAPIKey
+}
+
+// isAPIUserRequest returns true if the request was authorized for an API user, with an API key, signature or client certificate
+func isAPIUserRequest(c *gin.Context) bool {
+	_, err := requestAPIUser(c)
+	return err == nil
+}
+
+// requestDeviceID returns the ID of the device the request refers to. API users always refer to
+// themselves, other users must supply the device's base64 ID in the device query parameter, which is
+// found through the API user ID index. Devices are not authorized individually, access to a route
+// taking a device parameter is access to every device through it, so only grant such routes to roles
+// trusted with the whole fleet. The default policy grants them to admin only.
+func requestDeviceID(apiUserService ewserver.APIUserService, c *gin.Context) ([]byte, error) {
+	if isAPIUserRequest(c) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			return nil, err
+		}
+		return apiUser.ID, nil
+	}
+
+	id := c.Query("device")
+	if id == "" {
+		return nil, errMissingDevice
+	}
+
+	apiUser, err := apiUserService.APIUserByID([]byte(id))
+	if err != nil {
+		return nil, err
+	}
+	return apiUser.ID, nil
+}
+
+// sessionUserName returns the name of the user logged in to the request's session, empty if there is none.
+func sessionUserName(c *gin.Context) ewserver.UserName {
+	sessions, ok := c.Get("sessions")
+	if !ok {
+		return ""
+	}
+
+	user := &ewserver.User{}
+	if err := sessions.(session.Manager).Load(c.Request, "user", user); err != nil {
+		return ""
+	}
+	return user.UserName
+}
+
+// authorizeObject checks if the caller of the request may access a different object (path) with the method,
+// allowing handlers to apply casbin policies to the resources they serve.
+func authorizeObject(authorizer authz.Authorizer, c *gin.Context, object, method string) bool {
+	// the API user was already authenticated, signed requests can not be verified twice
+	if apiUser, err := requestAPIUser(c); err == nil {
+		return authorizer.Enforce(apiUser.Name, object, method)
+	}
+
+	r := c.Request.WithContext(c.Request.Context())
+	url := *c.Request.URL
+	url.Path = object
+	url.RawPath = ""
+	r.URL = &url
+	r.Method = method
+	return authorizer.Authorize(r)
 }
 
 // RegisterAdminRoutes for managing the system
 func RegisterAdminRoutes(services *ewserver.Services, e *gin.Engine) {
 	// setup admin routes
-	apiRoutes := e.Group("api/v1")
+	apiRoutes := e.Group("api/v1", publishAdminEvents(services.EventService))
 	userRoutes := apiRoutes.Group("/admin/users")
 	userRoutes.GET("/details/:user", AdminUserDetails(services.UserService, services.LogService, e))
 	userRoutes.GET("/list", AdminUsersDetails(services.UserService, services.LogService, e))
@@ -31,10 +139,11 @@ func RegisterAdminRoutes(services *ewserver.Services, e *gin.Engine) {
 	userRoutes.DELETE("/delete/:user", AdminDeleteUser(services.UserService, services.LogService, e))
 
 	apiAdminRoutes := apiRoutes.Group("/admin/api_users")
-	apiAdminRoutes.GET("/details/:id", AdminAPIUserDetails(services.APIUserService, services.LogService, e))
-	apiAdminRoutes.GET("/list", AdminAPIUsersDetails(services.APIUserService, services.LogService, e))
+	apiAdminRoutes.GET("/details/:id", AdminAPIUserDetails(services.APIUserService, services.PresenceService, services.LogService, e))
+	apiAdminRoutes.GET("/list", AdminAPIUsersDetails(services.APIUserService, services.PresenceService, services.LogService, e))
 	apiAdminRoutes.PUT("/create", AdminCreateAPIUser(services.APIUserService, services.LogService, e))
-	apiAdminRoutes.DELETE("/delete/:id", AdminDeleteAPIUser(services.APIUserService, services.LogService, e))
+	apiAdminRoutes.POST("/attributes", AdminUpdateAPIUserAttributes(services.APIUserService, services.LogService, e))
+	apiAdminRoutes.DELETE("/delete/:id", AdminDeleteAPIUser(services.APIUserService, services.DeviceRemover, services.LogService, e))
 
 	roleRoutes := apiRoutes.Group("/admin/roles")
 	roleRoutes.GET("/list", AdminRoleList(services.RoleService, services.LogService, e))
@@ -42,6 +151,172 @@ func RegisterAdminRoutes(services *ewserver.Services, e *gin.Engine) {
 	roleRoutes.DELETE("/permissions", AdminDeletePermission(services.RoleService, services.LogService, e))
 	roleRoutes.POST("/role", AdminAddSubjectToRole(services.RoleService, services.LogService, e))
 	roleRoutes.DELETE("/role", AdminDeleteSubjectFromRole(services.RoleService, services.LogService, e))
+
+	commandRoutes := apiRoutes.Group("/admin/commands")
+	commandRoutes.GET("/list", AdminListCommands(services.APIUserService, services.CommandService, services.LogService, e))
+	commandRoutes.PUT("/create", AdminCreateCommand(services.APIUserService, services.CommandService, services.LogService, e))
+
+	firmwareRoutes := apiRoutes.Group("/admin/firmware")
+	firmwareRoutes.GET("/list", AdminListFirmware(services.FirmwareService, services.LogService, e))
+	firmwareRoutes.GET("/status", AdminFirmwareStatus(services.FirmwareService, services.LogService, e))
+	firmwareRoutes.PUT("/upload/:version", AdminUploadFirmware(services.FirmwareService, services.LogService, e))
+	firmwareRoutes.POST("/rollout/:version", AdminRolloutFirmware(services.FirmwareService, services.LogService, e))
+	firmwareRoutes.DELETE("/delete/:version", AdminDeleteFirmware(services.FirmwareService, services.LogService, e))
+
+	shadowRoutes := apiRoutes.Group("/admin/shadow")
+	shadowRoutes.GET("/details", AdminShadowDetails(services.APIUserService, services.ShadowService, services.LogService, e))
+	shadowRoutes.POST("/desired", AdminUpdateShadow(services.APIUserService, services.ShadowService, services.LogService, e))
+	shadowRoutes.DELETE("/delete", AdminDeleteShadow(services.APIUserService, services.ShadowService, services.LogService, e))
+
+	storageRoutes := apiRoutes.Group("/admin/storage")
+	storageRoutes.GET("/stats", AdminStorageStats(services.StorageService, services.LogService, e))
+	storageRoutes.POST("/schedule_compaction", AdminScheduleCompaction(services.StorageService, services.LogService, e))
+
+	retentionRoutes := apiRoutes.Group("/admin/retention")
+	retentionRoutes.GET("/list", AdminRetentionList(services.RetentionService, services.LogService, e))
+	retentionRoutes.PUT("/policy", AdminSetRetention(services.APIUserService, services.RetentionService, services.LogService, e))
+	retentionRoutes.DELETE("/policy", AdminDeleteRetention(services.APIUserService, services.RetentionService, services.LogService, e))
+	retentionRoutes.POST("/run", AdminRunRetention(services.RetentionService, services.LogService, e))
+
+	ruleRoutes := apiRoutes.Group("/admin/rules")
+	ruleRoutes.GET("/list", AdminListRules(services.RuleService, services.LogService, e))
+	ruleRoutes.GET("/details/:id", AdminRuleDetails(services.RuleService, services.LogService, e))
+	ruleRoutes.PUT("/create", AdminCreateRule(services.APIUserService, services.RuleService, services.LogService, e))
+	ruleRoutes.POST("/update/:id", AdminUpdateRule(services.APIUserService, services.RuleService, services.LogService, e))
+	ruleRoutes.DELETE("/delete/:id", AdminDeleteRule(services.RuleService, services.LogService, e))
+
+	alertRoutes := apiRoutes.Group("/admin/alerts")
+	alertRoutes.GET("/list", AdminListAlerts(services.RuleService, services.LogService, e))
+
+	webhookRoutes := apiRoutes.Group("/admin/webhooks")
+	webhookRoutes.GET("/list", AdminListWebhooks(services.WebhookService, services.LogService, e))
+	webhookRoutes.PUT("/create", AdminCreateWebhook(services.WebhookService, services.LogService, e))
+	webhookRoutes.DELETE("/delete/:id", AdminDeleteWebhook(services.WebhookService, services.LogService, e))
+	webhookRoutes.GET("/deliveries", AdminWebhookDeliveries(services.WebhookService, services.LogService, e))
+	webhookRoutes.POST("/deliveries/:id/retry", AdminRetryWebhookDelivery(services.WebhookService, services.LogService, e))
+
+	enrollmentRoutes := apiRoutes.Group("/admin/enrollment")
+	enrollmentRoutes.GET("/list", AdminListEnrollmentTokens(services.EnrollmentService, services.LogService, e))
+	enrollmentRoutes.PUT("/create", AdminCreateEnrollmentToken(services.EnrollmentService, services.LogService, e))
+	enrollmentRoutes.DELETE("/delete/:id", AdminDeleteEnrollmentToken(services.EnrollmentService, services.LogService, e))
+
+	certificateRoutes := apiRoutes.Group("/admin/certificates")
+	certificateRoutes.GET("/list", AdminListCertificates(services.APIUserService, services.CertificateService, services.LogService, e))
+	certificateRoutes.PUT("/issue", AdminIssueCertificate(services.APIUserService, services.CertificateService, services.LogService, e))
+	certificateRoutes.POST("/renew/:serial", AdminRenewCertificate(services.CertificateService, services.LogService, e))
+	certificateRoutes.POST("/revoke/:serial", AdminRevokeCertificate(services.CertificateService, services.LogService, e))
+
+	rateLimitRoutes := apiRoutes.Group("/admin/rate_limits")
+	rateLimitRoutes.GET("/list", AdminListRateLimits(services.RateLimitService, services.LogService, e))
+	rateLimitRoutes.PUT("/limit", AdminSetRateLimit(services.RateLimitService, services.LogService, e))
+	rateLimitRoutes.DELETE("/limit", AdminDeleteRateLimit(services.RateLimitService, services.LogService, e))
+
+	groupRoutes := apiRoutes.Group("/admin/groups")
+	groupRoutes.GET("/list", AdminListGroups(services.GroupService, services.RoleService, services.LogService, e))
+	groupRoutes.PUT("/create", AdminCreateGroup(services.GroupService, services.LogService, e))
+	groupRoutes.DELETE("/delete/:name", AdminDeleteGroup(services.GroupService, services.RoleService, services.LogService, e))
+	groupRoutes.GET("/members", AdminGroupMembers(services.GroupService, services.APIUserService, services.RoleService, services.LogService, e))
+	groupRoutes.POST("/members", AdminAddGroupMembers(services.GroupService, services.APIUserService, services.RoleService, services.LogService, e))
+	groupRoutes.DELETE("/members", AdminRemoveGroupMembers(services.GroupService, services.APIUserService, services.RoleService, services.LogService, e))
+
+	bulkJobRoutes := apiRoutes.Group("/admin/bulk_jobs")
+	bulkJobRoutes.GET("/list", AdminListBulkJobs(services.BulkJobService, services.LogService, e))
+	bulkJobRoutes.GET("/details/:id", AdminBulkJobDetails(services.BulkJobService, services.LogService, e))
+	bulkJobRoutes.PUT("/create", AdminStartBulkJob(services.BulkJobRunner, services.LogService, e))
+	bulkJobRoutes.GET("/keys/:id", AdminBulkJobKeys(services.BulkJobRunner, services.LogService, e))
+
+	uploadRoutes := apiRoutes.Group("/admin/uploads")
+	uploadRoutes.GET("/sequence", UploadSequence(services.APIUserService, services.UploadService, services.LogService, e))
+	uploadRoutes.DELETE("/sequence", AdminResetUploadSequence(services.APIUserService, services.UploadService, services.LogService, e))
+
+	blobAdminRoutes := apiRoutes.Group("/admin/blobs")
+	blobAdminRoutes.DELETE("/delete/:id", AdminDeleteBlob(services.BlobService, services.LogService, e))
+
+	deviceLogRoutes := apiRoutes.Group("/admin/logs")
+	deviceLogRoutes.GET("/search", AdminSearchDeviceLogs(services.APIUserService, services.DeviceLogService, services.LogService, e))
+	deviceLogRoutes.GET("/tail", AdminTailDeviceLogs(services.APIUserService, services.DeviceLogEvents, services.LogService, e))
+	deviceLogRoutes.DELETE("/delete", AdminDeleteDeviceLogs(services.APIUserService, services.DeviceLogService, services.LogService, e))
+
+	exportRoutes := apiRoutes.Group("/admin/export")
+	exportRoutes.GET("/users", AdminExportUsers(services.UserService, services.LogService, e))
+	exportRoutes.GET("/api_users", AdminExportAPIUsers(services.APIUserService, services.PresenceService, services.LogService, e))
+	exportRoutes.GET("/permissions", AdminExportPermissions(services.RoleService, services.LogService, e))
+}
+
+// RegisterDataRoutes for API users to publish device data and for users to query it
+func RegisterDataRoutes(services *ewserver.Services, e *gin.Engine) {
+	upload := idempotentUpload(services.UploadService, services.LogService)
+	dataRoutes := e.Group("api/v1/data")
+	dataRoutes.POST("", upload, PublishBatch(services.TelemetryService, services.LogService, e))
+	dataRoutes.GET("/:stream", QueryData(services.APIUserService, services.TelemetryService, services.LogService, e))
+	dataRoutes.POST("/:stream", upload, PublishData(services.TelemetryService, services.LogService, e))
+	dataRoutes.GET("/:stream/export", ExportData(services.APIUserService, services.TelemetryService, services.LogService, e))
+}
+
+// RegisterCommandRoutes for API users to fetch and acknowledge their commands
+func RegisterCommandRoutes(services *ewserver.Services, e *gin.Engine) {
+	commandRoutes := e.Group("api/v1/commands")
+	commandRoutes.GET("", FetchCommands(services.CommandService, services.EventService, services.LogService, e))
+	commandRoutes.POST("/:command/ack", idempotentUpload(services.UploadService, services.LogService), AckCommand(services.CommandService, services.LogService, e))
+}
+
+// RegisterBlobRoutes for API users to upload blobs in resumable chunks and for users to download them
+func RegisterBlobRoutes(services *ewserver.Services, e *gin.Engine) {
+	blobRoutes := e.Group("api/v1/blobs")
+	blobRoutes.GET("/list", ListBlobs(services.APIUserService, services.BlobService, services.LogService, e))
+	blobRoutes.POST("/create", CreateBlob(services.BlobService, services.LogService, e))
+	blobRoutes.GET("/upload/:id", BlobUploadStatus(services.BlobService, services.LogService, e))
+	blobRoutes.PUT("/upload/:id", UploadBlobChunk(services.BlobService, services.LogService, e))
+	blobRoutes.POST("/finalize/:id", FinalizeBlob(services.BlobService, services.LogService, e))
+	blobRoutes.GET("/download/:id", DownloadBlob(services.BlobService, services.LogService, e))
+}
+
+// RegisterDeviceLogRoutes for API users to ship their logs
+func RegisterDeviceLogRoutes(services *ewserver.Services, e *gin.Engine) {
+	deviceLogRoutes := e.Group("api/v1/logs")
+	deviceLogRoutes.POST("", ShipDeviceLogs(services.DeviceLogService, services.LogService, e))
+}
+
+// RegisterUploadRoutes for API users to find which of their sequence numbered uploads were received
+func RegisterUploadRoutes(services *ewserver.Services, e *gin.Engine) {
+	uploadRoutes := e.Group("api/v1/uploads")
+	uploadRoutes.GET("/sequence", UploadSequence(services.APIUserService, services.UploadService, services.LogService, e))
+}
+
+// RegisterFirmwareRoutes for API users to check for, download and report on firmware updates, manifests link to externalURL
+func RegisterFirmwareRoutes(services *ewserver.Services, externalURL string, e *gin.Engine) {
+	firmwareRoutes := e.Group("api/v1/firmware")
+	firmwareRoutes.GET("/check", CheckFirmware(services.RoleService, services.FirmwareService, externalURL, services.LogService, e))
+	firmwareRoutes.GET("/download/:version", DownloadFirmware(services.RoleService, services.FirmwareService, services.LogService, e))
+	firmwareRoutes.POST("/status", ReportFirmwareStatus(services.FirmwareService, services.LogService, e))
+	firmwareRoutes.GET("/key", FirmwareKey(services.FirmwareService, e))
+}
+
+// RegisterShadowRoutes for API users to read their shadow, wait for deltas and report their state
+func RegisterShadowRoutes(services *ewserver.Services, e *gin.Engine) {
+	shadowRoutes := e.Group("api/v1/shadow")
+	shadowRoutes.GET("", GetShadow(services.ShadowService, services.LogService, e))
+	shadowRoutes.GET("/delta", ShadowDelta(services.ShadowService, services.EventService, services.LogService, e))
+	shadowRoutes.POST("/reported", ReportShadow(services.ShadowService, services.LogService, e))
+}
+
+// RegisterStreamRoutes for subscribing to live device streams and system events
+func RegisterStreamRoutes(services *ewserver.Services, authorizer authz.Authorizer, e *gin.Engine) {
+	streamRoutes := e.Group("api/v1/stream")
+	streamRoutes.GET("/ws", StreamSubscribe(services.APIUserService, services.EventService, services.PresenceService, authorizer, services.LogService, e))
+
+	eventRoutes := e.Group("api/v1/events")
+	eventRoutes.GET("", EventFeed(services.APIUserService, services.EventService, services.PresenceService, authorizer, services.LogService, e))
+}
+
+// RegisterCertificateRoutes for devices to renew their client certificate and fetch the CA and CRL
+func RegisterCertificateRoutes(services *ewserver.Services, e *gin.Engine) {
+	certificateRoutes := e.Group("api/v1/certificates")
+	certificateRoutes.POST("/renew", RenewCertificate(services.CertificateService, services.LogService, e))
+
+	pkiRoutes := e.Group("api/v1/pki")
+	pkiRoutes.GET("/ca", CertificateAuthority(services.CertificateService, e))
+	pkiRoutes.GET("/crl", CertificateRevocationList(services.CertificateService, services.LogService, e))
 }
 
 // RegisterUserRoutes application specific code goes here.
@@ -50,11 +325,18 @@ func RegisterUserRoutes(services *ewserver.Services, e *gin.Engine) {
 	userRoutes.GET("/profile", UserProfile(services.UserService, e))
 }
 
+// RegisterEnrollmentRoutes for devices to exchange an enrollment token for their API user. The token is
+// their only credential, so these must be registered before the session and authorization middleware.
+func RegisterEnrollmentRoutes(services *ewserver.Services, e *gin.Engine) {
+	enrollRoutes := e.Group("api/v1/enroll")
+	enrollRoutes.POST("", Enroll(services.EnrollmentService, services.APIUserService, services.UserService, services.RoleService, services.LogService, e))
+}
+
 // RegisterAuthnRoutes registers the authentication (login/logout) routes under /user
-func RegisterAuthnRoutes(authnService ewserver.AuthnService, logService ewserver.LogService, e *gin.Engine) {
+func RegisterAuthnRoutes(authnService ewserver.AuthnService, eventService ewserver.EventService, logService ewserver.LogService, e *gin.Engine) {
 	routes := e.Group("/")
 	e.LoadHTMLGlob("../../web/templates/**/*")
 	routes.GET(LoginPath, LoginPage(e))
-	routes.POST(LoginPath, Authenticate(authnService, logService, e))
+	routes.POST(LoginPath, Authenticate(authnService, eventService, logService, e))
 	routes.GET("/logout", Logout(authnService, logService, e))
 }
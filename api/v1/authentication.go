@@ -19,7 +19,8 @@ func LoginPage(e *gin.Engine) gin.HandlerFunc {
 }
 
 // Authenticate a user to create a session, add the user to the session and update the user's last ip address if successful.
-func Authenticate(authnService ewserver.AuthnService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+// Every attempt is published to the AuthTopic.
+func Authenticate(authnService ewserver.AuthnService, eventService ewserver.EventService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
 	type login struct {
 		UserName ewserver.UserName
 		Password string
@@ -29,15 +30,16 @@ func Authenticate(authnService ewserver.AuthnService, logService ewserver.LogSer
 		sessions := c.MustGet("sessions").(session.Manager)
 		attempt := &login{}
 
-		if err := c.BindJSON(attempt); err != nil {
-			c.JSON(500, gin.H{"error": err})
+		if err := bind(c, attempt); err != nil {
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
 		user, err := authnService.Authenticate(attempt.UserName, attempt.Password)
+		eventService.Publish(ewserver.AuthTopic, &ewserver.AuthEvent{UserName: attempt.UserName, Client: c.ClientIP(), Success: err == nil})
 		if err != nil {
 			logService.Info("authentication failure", "user", attempt.UserName, "client", c.ClientIP())
-			c.JSON(401, gin.H{"error": err})
+			respond(c, 401, gin.H{"error": err})
 			return
 		}
 		logService.Info("authentication success", "user", attempt.UserName, "client", c.ClientIP())
@@ -48,7 +50,7 @@ func Authenticate(authnService ewserver.AuthnService, logService ewserver.LogSer
 		// Renew session token and add user details to the session
 		sessions.Renew(c.Writer, c.Request)
 		sessions.Add(c.Writer, c.Request, "user", user)
-		c.JSON(200, gin.H{"status": "OK"})
+		respond(c, 200, gin.H{"status": "OK"})
 	}
 }
 
@@ -57,6 +59,6 @@ func Logout(authnService ewserver.AuthnService, logService ewserver.LogService,
 	return func(c *gin.Context) {
 		sessions := c.MustGet("sessions").(session.Manager)
 		sessions.Destroy(c.Writer, c.Request)
-		c.JSON(200, gin.H{"status": "OK"})
+		respond(c, 200, gin.H{"status": "OK"})
 	}
 }
@@ -0,0 +1,219 @@
+package v1
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// CreateBlob starts a chunked upload of a blob by the calling API user, the body gives its name,
+// content_type and size in bytes. The chunks are then PUT to /api/v1/blobs/upload/:id.
+func CreateBlob(blobService ewserver.BlobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		blob := &ewserver.Blob{}
+		if err := bind(c, blob); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+		blob.DeviceID = apiUser.ID
+
+		if err := blobService.Create(blob); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("blob upload created", "api_user", apiUser.Name, "blob", blob.ID, "name", blob.Name, "size", blob.Size)
+		respond(c, 200, gin.H{"status": "OK", "blob": blob})
+	}
+}
+
+// BlobUploadStatus returns one of the calling API user's blobs, its offset is where an interrupted upload resumes.
+func BlobUploadStatus(blobService ewserver.BlobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		blob, _, err := requestOwnBlob(blobService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "blob": blob})
+	}
+}
+
+// UploadBlobChunk writes the request body to the calling API user's blob at the offset query parameter. Resent
+// chunks overlapping the committed offset are accepted, a chunk past it is refused with the offset to resume from.
+func UploadBlobChunk(blobService ewserver.BlobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		blob, apiUser, err := requestOwnBlob(blobService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+		if err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidBlob.Error()})
+			return
+		}
+
+		chunk, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, ewserver.MaxBlobChunkSize))
+		if err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidBlob.Error()})
+			return
+		}
+
+		blob, err = blobService.WriteChunk(blob.ID, offset, chunk)
+		if err == ewserver.ErrBlobOffset {
+			respond(c, 409, gin.H{"error": err.Error(), "offset": blob.Offset})
+			return
+		}
+
+		if err != nil {
+			logService.Error("blob chunk failure", "api_user", apiUser.Name, "blob", c.Param("id"), "offset", offset, "error", err)
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "blob": blob})
+	}
+}
+
+// FinalizeBlob completes the calling API user's upload if the sha256 in the body matches the uploaded bytes.
+// On a mismatch the upload restarts from offset 0.
+func FinalizeBlob(blobService ewserver.BlobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type finalize struct {
+		SHA256 string `json:"sha256"`
+	}
+
+	return func(c *gin.Context) {
+		blob, apiUser, err := requestOwnBlob(blobService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		request := &finalize{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		blob, err = blobService.Finalize(blob.ID, request.SHA256)
+		if err == ewserver.ErrBlobChecksum || err == ewserver.ErrBlobIncomplete {
+			logService.Info("blob finalize failure", "api_user", apiUser.Name, "blob", blob.ID, "error", err)
+			respond(c, errorStatus(err), gin.H{"error": err.Error(), "offset": blob.Offset})
+			return
+		}
+
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("blob uploaded", "api_user", apiUser.Name, "blob", blob.ID, "name", blob.Name, "size", blob.Size)
+		respond(c, 200, gin.H{"status": "OK", "blob": blob})
+	}
+}
+
+// DownloadBlob serves a complete blob with support for Range requests. Access to the route is decided
+// by casbin for users and API users alike, API users may only download their own blobs. The content type
+// is chosen by the device, so browsers are told not to sniff or render it.
+func DownloadBlob(blobService ewserver.BlobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var blob *ewserver.Blob
+		var err error
+		if isAPIUserRequest(c) {
+			blob, _, err = requestOwnBlob(blobService, c)
+		} else {
+			blob, err = blobService.Blob(c.Param("id"))
+		}
+
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		blob, file, err := blobService.Open(blob.ID)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+
+		contentType := blob.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		c.Header("Content-Type", contentType)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Content-Security-Policy", "sandbox")
+		c.Header("Content-Disposition", `attachment; filename="`+blob.Name+`"`)
+		c.Header("ETag", `"`+blob.SHA256+`"`)
+		http.ServeContent(c.Writer, c.Request, blob.Name, blob.CompletedAt, file)
+	}
+}
+
+// ListBlobs returns the calling API user's blobs, or for other users those of the device given in
+// the device query parameter, or of all devices without it.
+func ListBlobs(apiUserService ewserver.APIUserService, blobService ewserver.BlobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var deviceID []byte
+		if isAPIUserRequest(c) || c.Query("device") != "" {
+			var err error
+			if deviceID, err = requestDeviceID(apiUserService, c); err != nil {
+				respond(c, errorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		blobs, err := blobService.Blobs(deviceID)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "blobs": blobs})
+	}
+}
+
+// AdminDeleteBlob deletes a blob and its file, complete or not
+func AdminDeleteBlob(blobService ewserver.BlobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if err := blobService.Delete(id); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("blob deleted", "blob", id, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
+
+// requestOwnBlob returns the blob of the id route parameter if it belongs to the calling API user,
+// ErrBlobNotFound if it belongs to another device so their IDs are not revealed.
+func requestOwnBlob(blobService ewserver.BlobService, c *gin.Context) (*ewserver.Blob, *ewserver.APIUser, error) {
+	apiUser, err := requestAPIUser(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blob, err := blobService.Blob(c.Param("id"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if string(blob.DeviceID) != string(apiUser.ID) {
+		return nil, nil, ewserver.ErrBlobNotFound
+	}
+	return blob, apiUser, nil
+}
@@ -0,0 +1,167 @@
+package v1
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// certificateRequest is the body for issuing and renewing certificates. csr is a PEM encoded certificate
+// request, if it is empty the server generates the key and returns it once with the certificate.
+type certificateRequest struct {
+	Device   string            `json:"device"`
+	CSR      string            `json:"csr"`
+	Validity ewserver.Duration `json:"validity"`
+}
+
+// AdminListCertificates returns the certificates issued to the device, or to every device if none is given
+func AdminListCertificates(apiUserService ewserver.APIUserService, certificateService ewserver.CertificateService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var deviceID []byte
+		if id := c.Query("device"); id != "" {
+			apiUser, err := apiUserService.APIUserByID([]byte(id))
+			if err != nil {
+				respond(c, errorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			deviceID = apiUser.ID
+		}
+
+		certificates, err := certificateService.Certificates(deviceID)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "certificates": certificates})
+	}
+}
+
+// AdminIssueCertificate issues a client certificate to the device, validity defaults to a year
+func AdminIssueCertificate(apiUserService ewserver.APIUserService, certificateService ewserver.CertificateService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request := &certificateRequest{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidCSR.Error()})
+			return
+		}
+
+		apiUser, err := apiUserService.APIUserByID([]byte(request.Device))
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		certificate, err := certificateService.Issue(apiUser, []byte(request.CSR), time.Duration(request.Validity), string(sessionUserName(c)))
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("certificate issued", "api_user", apiUser.Name, "serial", certificate.Serial, "not_after", certificate.NotAfter, "created_by", certificate.CreatedBy)
+		respond(c, 200, gin.H{"status": "OK", "certificate": certificate})
+	}
+}
+
+// AdminRenewCertificate issues a new certificate for the device of the certificate with the serial. The
+// previous certificate stays valid until it expires or is revoked.
+func AdminRenewCertificate(certificateService ewserver.CertificateService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// the body is optional, renewing reuses the certificate's key
+		request := &certificateRequest{}
+		if c.Request.ContentLength != 0 {
+			if err := bind(c, request); err != nil {
+				respond(c, 400, gin.H{"error": ewserver.ErrInvalidCSR.Error()})
+				return
+			}
+		}
+
+		certificate, err := certificateService.Renew(c.Param("serial"), []byte(request.CSR), time.Duration(request.Validity), string(sessionUserName(c)))
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("certificate renewed", "serial", certificate.Serial, "renewed_from", certificate.RenewedFrom, "created_by", certificate.CreatedBy)
+		respond(c, 200, gin.H{"status": "OK", "certificate": certificate})
+	}
+}
+
+// AdminRevokeCertificate revokes the certificate, it is rejected from the next handshake on
+func AdminRevokeCertificate(certificateService ewserver.CertificateService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		certificate, err := certificateService.Revoke(c.Param("serial"), time.Now().UTC())
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("certificate revoked", "serial", certificate.Serial, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK", "certificate": certificate})
+	}
+}
+
+// RenewCertificate lets a device renew the client certificate it authenticated with before it expires.
+// Devices authenticating with their API key are issued a new certificate instead.
+func RenewCertificate(certificateService ewserver.CertificateService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type renewRequest struct {
+		CSR string `json:"csr"`
+	}
+
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		request := &renewRequest{}
+		if c.Request.ContentLength != 0 {
+			if err := bind(c, request); err != nil {
+				respond(c, 400, gin.H{"error": ewserver.ErrInvalidCSR.Error()})
+				return
+			}
+		}
+
+		var certificate *ewserver.DeviceCertificate
+		if _, ok := ewserver.PeerDeviceID(c.Request); ok {
+			serial := hex.EncodeToString(c.Request.TLS.VerifiedChains[0][0].SerialNumber.Bytes())
+			certificate, err = certificateService.Renew(serial, []byte(request.CSR), 0, apiUser.Name)
+		} else {
+			certificate, err = certificateService.Issue(apiUser, []byte(request.CSR), 0, apiUser.Name)
+		}
+
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("certificate renewed", "api_user", apiUser.Name, "serial", certificate.Serial, "renewed_from", certificate.RenewedFrom)
+		respond(c, 200, gin.H{"status": "OK", "certificate": certificate})
+	}
+}
+
+// CertificateAuthority returns the PEM encoded CA certificate devices are issued certificates by
+func CertificateAuthority(certificateService ewserver.CertificateService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateService.CA().Raw})
+		c.Data(200, "application/x-pem-file", ca)
+	}
+}
+
+// CertificateRevocationList returns the DER encoded CRL of the CA
+func CertificateRevocationList(certificateService ewserver.CertificateService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		crl, err := certificateService.CRL(time.Now().UTC())
+		if err != nil {
+			logService.Error("error creating CRL", "error", err)
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Data(200, "application/pkix-crl", crl)
+	}
+}
@@ -0,0 +1,81 @@
+package v1
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/wirepair/ewserver/internal/codec"
+)
+
+// respond writes obj in the format the client accepts: JSON, CBOR or MessagePack. If the Accept header
+// is missing or only has wildcards the format of the request body is used, so devices only need to set
+// Content-Type.
+func respond(c *gin.Context, code int, obj interface{}) {
+	contentType := c.NegotiateFormat(codec.JSON, codec.CBOR, codec.MsgPack, codec.MsgPack2)
+	if (contentType == "" || c.GetHeader("Accept") == "") && codec.Supported(c.ContentType()) {
+		contentType = c.ContentType()
+	}
+
+	switch contentType {
+	case codec.CBOR, codec.MsgPack, codec.MsgPack2:
+		c.Render(code, encodedRender{contentType: contentType, data: obj})
+	default:
+		c.JSON(code, obj)
+	}
+}
+
+// bind decodes the request body into obj from CBOR or MessagePack if that is its Content-Type,
+// JSON otherwise. Like c.BindJSON it aborts the request with a 400 if the body is invalid.
+func bind(c *gin.Context, obj interface{}) error {
+	return c.MustBindWith(obj, bodyBinding{contentType: c.ContentType()})
+}
+
+// encodedRender renders data using the codec for contentType
+type encodedRender struct {
+	contentType string
+	data        interface{}
+}
+
+func (r encodedRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	encoded, err := codec.Marshal(r.contentType, r.data)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(encoded)
+	return err
+}
+
+func (r encodedRender) WriteContentType(w http.ResponseWriter) {
+	if header := w.Header(); len(header["Content-Type"]) == 0 {
+		header["Content-Type"] = []string{r.contentType}
+	}
+}
+
+// bodyBinding binds request bodies using the codec for contentType
+type bodyBinding struct {
+	contentType string
+}
+
+func (b bodyBinding) Name() string {
+	return b.contentType
+}
+
+func (b bodyBinding) Bind(req *http.Request, obj interface{}) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := codec.Unmarshal(b.contentType, body, obj); err != nil {
+		return err
+	}
+
+	if binding.Validator == nil {
+		return nil
+	}
+	return binding.Validator.ValidateStruct(obj)
+}
@@ -0,0 +1,175 @@
+package v1
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	// defaultCommandWait is how long a device's fetch waits for a command if it does not set wait
+	defaultCommandWait = 30 * time.Second
+	// maxCommandWait limits how long a fetch may be held open
+	maxCommandWait = 60 * time.Second
+)
+
+// FetchCommands long polls for the calling API user's pending commands. If none are pending the
+// request is held open for up to wait (a duration or seconds, default 30s) until one is queued.
+// Returned commands are marked delivered and must be acknowledged once they ran.
+func FetchCommands(commandService ewserver.CommandService, eventService ewserver.EventService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		wait := defaultCommandWait
+		if value := c.Query("wait"); value != "" {
+			if wait, err = parseDuration(value); err != nil || wait < 0 || wait > maxCommandWait {
+				respond(c, 400, gin.H{"error": ewserver.ErrInvalidQuery.Error()})
+				return
+			}
+		}
+
+		// subscribe before checking the queue so a command queued in between wakes us
+		subscription := eventService.Subscribe(ewserver.CommandTopic(apiUser.ID))
+		defer subscription.Close()
+
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+
+		for {
+			commands, err := commandService.Deliver(apiUser.ID, apiUser.Name)
+			if err != nil {
+				logService.Error("fetch commands failure", "api_user", apiUser.Name, "error", err)
+				respond(c, errorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+
+			if len(commands) > 0 {
+				logService.Info("commands delivered", "api_user", apiUser.Name, "count", len(commands))
+				respond(c, 200, gin.H{"status": "OK", "commands": commands})
+				return
+			}
+
+			select {
+			case <-subscription.Events():
+			case <-timeout.C:
+				respond(c, 200, gin.H{"status": "OK", "commands": commands})
+				return
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// AckCommand records the result of a command the calling API user ran. The body's state must be
+// succeeded or failed, result is optional JSON describing the outcome.
+func AckCommand(commandService ewserver.CommandService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type commandAck struct {
+		State  ewserver.CommandState `json:"state"`
+		Result json.RawMessage       `json:"result"`
+	}
+
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		id, err := strconv.ParseUint(c.Param("command"), 10, 64)
+		if err != nil {
+			respond(c, 404, gin.H{"error": ewserver.ErrCommandNotFound.Error()})
+			return
+		}
+
+		ack := &commandAck{}
+		if err := bind(c, ack); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		command, err := commandService.Ack(apiUser.ID, id, ack.State, ack.Result, apiUser.Name)
+		if err != nil {
+			logService.Info("ack command failure", "api_user", apiUser.Name, "command", id, "error", err)
+			respond(c, errorStatus(err), gin.H{"error": err.Error(), "command": command})
+			return
+		}
+
+		logService.Info("command acknowledged", "api_user", apiUser.Name, "command", id, "state", string(command.State))
+		respond(c, 200, gin.H{"status": "OK", "command": command})
+	}
+}
+
+// AdminCreateCommand queues a command for the device identified by its ID. ttl is a duration
+// or seconds, defaulting to ewserver.DefaultCommandTTL.
+func AdminCreateCommand(apiUserService ewserver.APIUserService, commandService ewserver.CommandService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type newCommand struct {
+		Device string          `json:"device"`
+		Name   string          `json:"name"`
+		Args   json.RawMessage `json:"args"`
+		TTL    string          `json:"ttl"`
+	}
+
+	return func(c *gin.Context) {
+		request := &newCommand{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		apiUser, err := apiUserService.APIUserByID([]byte(request.Device))
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		var ttl time.Duration
+		if request.TTL != "" {
+			if ttl, err = parseDuration(request.TTL); err != nil {
+				respond(c, 400, gin.H{"error": ewserver.ErrInvalidCommand.Error()})
+				return
+			}
+		}
+
+		command := ewserver.NewCommand()
+		command.DeviceID = apiUser.ID
+		command.Name = request.Name
+		command.Args = request.Args
+		command.CreatedBy = string(sessionUserName(c))
+
+		if err := commandService.Enqueue(command, ttl); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("command queued", "api_user", apiUser.Name, "command", command.ID, "name", command.Name, "created_by", command.CreatedBy)
+		respond(c, 200, gin.H{"status": "OK", "command": command})
+	}
+}
+
+// AdminListCommands returns all commands, including their history, of the device whose ID is
+// given in the device query parameter.
+func AdminListCommands(apiUserService ewserver.APIUserService, commandService ewserver.CommandService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		commands, err := commandService.Commands(deviceID)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "commands": commands})
+	}
+}
@@ -0,0 +1,154 @@
+package v1
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// PublishData stores a timestamped JSON data point under the calling API user's stream.
+// The timestamp is optional and defaults to the time the server received the point.
+func PublishData(telemetryService ewserver.TelemetryService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		point := ewserver.NewDataPoint()
+		if err := bind(c, point); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		stream := ewserver.StreamName(c.Param("stream"))
+		if err := telemetryService.Publish(apiUser.ID, stream, point); err != nil {
+			logService.Error("publish data failure", "api_user", apiUser.Name, "stream", stream, "error", err)
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "timestamp": point.Timestamp})
+	}
+}
+
+// PublishBatch stores a JSON array of points across the calling API user's streams, each with its
+// stream, an optional timestamp and value, such as readings buffered while the device was asleep.
+// Invalid points are rejected without failing the rest, the response has a result for each point
+// in the order they were sent.
+func PublishBatch(telemetryService ewserver.TelemetryService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		points := make([]*ewserver.BatchPoint, 0)
+		if err := bind(c, &points); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		results, err := telemetryService.PublishBatch(apiUser.ID, points)
+		if err != nil {
+			logService.Error("publish batch failure", "api_user", apiUser.Name, "points", len(points), "error", err)
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		accepted := 0
+		for _, result := range results {
+			if result.Accepted {
+				accepted++
+			}
+		}
+
+		if accepted < len(results) {
+			logService.Info("publish batch rejected points", "api_user", apiUser.Name, "accepted", accepted, "rejected", len(results)-accepted)
+		}
+		respond(c, 200, gin.H{"status": "OK", "accepted": accepted, "rejected": len(results) - accepted, "results": results})
+	}
+}
+
+// QueryData returns a downsampled series of a device stream. API users query their own streams,
+// other users must supply the device's ID in the device query parameter. The range defaults to the
+// last 24 hours in 1 minute steps averaged. from and to may be RFC3339 or unix seconds, step may be
+// a duration (30s, 5m) or seconds.
+func QueryData(apiUserService ewserver.APIUserService, telemetryService ewserver.TelemetryService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		query, err := seriesQuery(c)
+		if err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		stream := ewserver.StreamName(c.Param("stream"))
+		series, err := telemetryService.Series(deviceID, stream, query)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "stream": stream, "step": query.Step.String(), "agg": query.Aggregation, "series": series})
+	}
+}
+
+// seriesQuery parses the from, to, step and agg query parameters
+func seriesQuery(c *gin.Context) (*ewserver.SeriesQuery, error) {
+	var err error
+
+	query := &ewserver.SeriesQuery{To: time.Now().UTC(), Step: time.Minute, Aggregation: ewserver.AggregateAvg}
+
+	if to := c.Query("to"); to != "" {
+		if query.To, err = parseTime(to); err != nil {
+			return nil, err
+		}
+	}
+
+	query.From = query.To.Add(-24 * time.Hour)
+	if from := c.Query("from"); from != "" {
+		if query.From, err = parseTime(from); err != nil {
+			return nil, err
+		}
+	}
+
+	if step := c.Query("step"); step != "" {
+		if query.Step, err = parseDuration(step); err != nil {
+			return nil, err
+		}
+	}
+
+	if agg := c.Query("agg"); agg != "" {
+		query.Aggregation = ewserver.Aggregation(agg)
+	}
+
+	return query, query.Valid()
+}
+
+// parseTime parses either an RFC3339 time or unix seconds.
+func parseTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, ewserver.ErrInvalidQuery
+	}
+	return ts, nil
+}
+
+// parseDuration parses either a go duration string, days or seconds.
+func parseDuration(value string) (time.Duration, error) {
+	return ewserver.ParseDuration(value)
+}
@@ -0,0 +1,255 @@
+package v1
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// ShipDeviceLogs stores log entries of the calling API user. A text/plain body holds syslog lines (RFC 5424
+// or RFC 3164), one per line, otherwise the body is an array of entries with a message, severity (name or
+// number) and optionally the timestamp, host, app and fields.
+func ShipDeviceLogs(deviceLogService ewserver.DeviceLogService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		entries, err := requestDeviceLogs(c, time.Now().UTC())
+		if err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := deviceLogService.Append(apiUser.ID, entries); err != nil {
+			logService.Error("ship device logs failure", "api_user", apiUser.Name, "entries", len(entries), "error", err)
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "accepted": len(entries)})
+	}
+}
+
+// requestDeviceLogs parses and normalizes the entries of the request body, between 1 and MaxDeviceLogBatch of them
+func requestDeviceLogs(c *gin.Context, received time.Time) ([]*ewserver.DeviceLog, error) {
+	entries := make([]*ewserver.DeviceLog, 0)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, ewserver.MaxDeviceLogBody)
+	if c.ContentType() == "text/plain" {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, ewserver.ErrInvalidDeviceLog
+		}
+
+		for _, line := range strings.Split(string(body), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			entry, err := ewserver.ParseSyslogLine(line, received)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		if err := bind(c, &entries); err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry == nil {
+				return nil, ewserver.ErrInvalidDeviceLog
+			}
+
+			if err := entry.Normalize(received); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(entries) == 0 || len(entries) > ewserver.MaxDeviceLogBatch {
+		return nil, ewserver.ErrInvalidDeviceLog
+	}
+	return entries, nil
+}
+
+// AdminSearchDeviceLogs returns the latest log entries matching the device (ID), severity (entries at least
+// as severe), from, to (RFC3339 or unix seconds), q (substring) and limit query parameters, newest first.
+func AdminSearchDeviceLogs(apiUserService ewserver.APIUserService, deviceLogService ewserver.DeviceLogService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, err := deviceLogQuery(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		entries, err := deviceLogService.Search(query)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "entries": entries})
+	}
+}
+
+// AdminTailDeviceLogs streams log entries as Server-Sent Events as they are shipped, from the device given
+// in the device query parameter or from all devices without it. The severity and q query parameters filter
+// the entries like a search. Clients resuming with a Last-Event-ID header are first sent the buffered
+// entries they missed. Clients too slow to keep up are sent a dropped event with how many entries they missed.
+func AdminTailDeviceLogs(apiUserService ewserver.APIUserService, eventService ewserver.EventService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, err := deviceLogQuery(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		topic := "log:*"
+		if query.DeviceID != nil {
+			topic = ewserver.LogTopic(query.DeviceID)
+		}
+
+		subscription := eventService.Subscribe(topic)
+		defer subscription.Close()
+		logService.Info("device log tail subscribe", "client", c.ClientIP(), "topic", topic)
+
+		c.Header("Content-Type", sse.ContentType)
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(200)
+
+		// live events up to the last replayed one were already sent
+		var replayedID uint64
+		if since, err := strconv.ParseUint(c.Request.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+			for _, event := range eventService.Replay(since, topic) {
+				if err := writeDeviceLogEvent(c.Writer, query, event); err != nil {
+					return
+				}
+				replayedID = event.ID
+			}
+		}
+		c.Writer.Flush()
+
+		ticker := time.NewTicker(eventHeartbeatInterval)
+		defer ticker.Stop()
+
+		var dropped uint64
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, ok := <-subscription.Events():
+				if !ok {
+					return false
+				}
+
+				if event.ID <= replayedID {
+					return true
+				}
+
+				if err := writeDropped(w, subscription, &dropped); err != nil {
+					return false
+				}
+				return writeDeviceLogEvent(w, query, event) == nil
+			case <-ticker.C:
+				if err := writeDropped(w, subscription, &dropped); err != nil {
+					return false
+				}
+				_, err := io.WriteString(w, ": ping\n\n")
+				return err == nil
+			case <-c.Request.Context().Done():
+				logService.Info("device log tail unsubscribe", "client", c.ClientIP(), "dropped", subscription.Dropped())
+				return false
+			}
+		})
+	}
+}
+
+// writeDropped tells the client how many entries it missed since the last time, if any
+func writeDropped(w io.Writer, subscription ewserver.Subscription, reported *uint64) error {
+	dropped := subscription.Dropped()
+	if dropped == *reported {
+		return nil
+	}
+
+	missed := dropped - *reported
+	*reported = dropped
+	return sse.Encode(w, sse.Event{Event: "dropped", Data: gin.H{"dropped": missed}})
+}
+
+// writeDeviceLogEvent writes the event if its entry matches the query
+func writeDeviceLogEvent(w io.Writer, query *ewserver.DeviceLogQuery, event *ewserver.Event) error {
+	entry, ok := event.Data.(*ewserver.DeviceLog)
+	if !ok || !query.Match(entry) {
+		return nil
+	}
+	return writeEvent(w, event)
+}
+
+// AdminDeleteDeviceLogs deletes all log entries of the device given in the device query parameter
+func AdminDeleteDeviceLogs(apiUserService ewserver.APIUserService, deviceLogService ewserver.DeviceLogService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := deviceLogService.Delete(deviceID); err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("device logs deleted", "device", c.Query("device"), "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
+
+// deviceLogQuery parses the device, severity, from, to, q and limit query parameters
+func deviceLogQuery(apiUserService ewserver.APIUserService, c *gin.Context) (*ewserver.DeviceLogQuery, error) {
+	var err error
+
+	query := ewserver.NewDeviceLogQuery()
+	query.Contains = c.Query("q")
+
+	if c.Query("device") != "" {
+		if query.DeviceID, err = requestDeviceID(apiUserService, c); err != nil {
+			return nil, err
+		}
+	}
+
+	if severity := c.Query("severity"); severity != "" {
+		if query.Severity, err = ewserver.ParseLogSeverity(severity); err != nil {
+			return nil, ewserver.ErrInvalidQuery
+		}
+	}
+
+	if from := c.Query("from"); from != "" {
+		if query.From, err = parseTime(from); err != nil {
+			return nil, err
+		}
+	}
+
+	if to := c.Query("to"); to != "" {
+		if query.To, err = parseTime(to); err != nil {
+			return nil, err
+		}
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, ewserver.ErrInvalidQuery
+		}
+	}
+	return query, query.Valid()
+}
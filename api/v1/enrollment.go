@@ -0,0 +1,198 @@
+package v1
+
+import (
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// enrollmentNameSize is the number of random bytes named devices get when they do not supply a name
+const enrollmentNameSize = 6
+
+// AdminListEnrollmentTokens returns all enrollment tokens, their secrets are not stored
+func AdminListEnrollmentTokens(enrollmentService ewserver.EnrollmentService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokens, err := enrollmentService.EnrollmentTokens()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "tokens": tokens})
+	}
+}
+
+// AdminCreateEnrollmentToken mints a token devices exchange for their own API user. max_uses defaults to
+// 1 and ttl to a day, the token is only returned here.
+func AdminCreateEnrollmentToken(enrollmentService ewserver.EnrollmentService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type enrollmentRequest struct {
+		NamePrefix string            `json:"name_prefix"`
+		Role       string            `json:"role"`
+		Metadata   map[string]string `json:"metadata"`
+		MaxUses    int               `json:"max_uses"`
+		TTL        ewserver.Duration `json:"ttl"`
+	}
+
+	return func(c *gin.Context) {
+		request := &enrollmentRequest{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidEnrollment.Error()})
+			return
+		}
+
+		token := ewserver.NewEnrollmentToken()
+		token.NamePrefix, token.Role, token.Metadata = request.NamePrefix, request.Role, request.Metadata
+		if request.MaxUses != 0 {
+			token.MaxUses = request.MaxUses
+		}
+
+		if request.TTL != 0 {
+			token.ExpiresAt = time.Now().UTC().Add(time.Duration(request.TTL))
+		}
+		token.CreatedBy = string(sessionUserName(c))
+
+		if err := enrollmentService.Create(token); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("enrollment token created", "token", token.ID, "role", token.Role, "max_uses", token.MaxUses, "created_by", token.CreatedBy)
+		respond(c, 200, gin.H{"status": "OK", "token": token})
+	}
+}
+
+// AdminDeleteEnrollmentToken revokes a token, devices already enrolled with it are kept
+func AdminDeleteEnrollmentToken(enrollmentService ewserver.EnrollmentService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			respond(c, 404, gin.H{"error": ewserver.ErrTokenNotFound.Error()})
+			return
+		}
+
+		if err := enrollmentService.Delete(id); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("enrollment token deleted", "token", id, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
+
+// Enroll exchanges an enrollment token for a new API user and key. The device's name is the token's
+// prefix followed by the name it supplies (such as its serial number) or a random one, it must not be
+// the name of a user or of any casbin subject so devices can not enroll into another's permissions. The token's
+// metadata is added to, and takes precedence over, the metadata the device supplies.
+func Enroll(enrollmentService ewserver.EnrollmentService, apiUserService ewserver.APIUserService, userService ewserver.UserService, roleService ewserver.RoleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type enrollRequest struct {
+		Token    string            `json:"token"`
+		Name     string            `json:"name"`
+		Metadata map[string]string `json:"metadata"`
+	}
+
+	var lock sync.Mutex
+	return func(c *gin.Context) {
+		request := &enrollRequest{}
+		if err := bind(c, request); err != nil || request.Token == "" {
+			respond(c, 401, gin.H{"error": ewserver.ErrEnrollmentDenied.Error()})
+			return
+		}
+
+		now := time.Now().UTC()
+		token, err := enrollmentService.Lookup(request.Token, now)
+		if err != nil {
+			logService.Error("enrollment denied", "ipaddr", c.ClientIP(), "error", err)
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		// enrollments are serialized so two devices can not both pass the name check before either is created
+		lock.Lock()
+		defer lock.Unlock()
+
+		// a device retrying with a name that is taken must not use up the token
+		apiUser, err := enrollAPIUser(apiUserService, userService, roleService, token, request.Name, request.Metadata)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := apiUserService.Create(apiUser); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := roleService.AddSubjectToRole(apiUser.Name, token.Role); err != nil {
+			logService.Error("enrollment failure", "api_user", apiUser.Name, "role", token.Role, "error", err)
+			apiUserService.Delete(apiUser.Key)
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		// the token is only used once the device can authenticate with its role
+		if token, err = enrollmentService.Redeem(request.Token, now); err != nil {
+			logService.Error("enrollment denied", "ipaddr", c.ClientIP(), "error", err)
+			roleService.DeleteSubject(apiUser.Name)
+			apiUserService.Delete(apiUser.Key)
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("device enrolled", "api_user", apiUser.Name, "token", token.ID, "role", token.Role, "ipaddr", c.ClientIP())
+		respond(c, 200, gin.H{"status": "OK", "api_user": apiUser})
+	}
+}
+
+// enrollAPIUser builds the API user of a device enrolling with the token and generates its key. Names must
+// be unique among API users, users and casbin subjects as they are the subject of the device's role.
+func enrollAPIUser(apiUserService ewserver.APIUserService, userService ewserver.UserService, roleService ewserver.RoleService, token *ewserver.EnrollmentToken, name string, metadata map[string]string) (*ewserver.APIUser, error) {
+	if name == "" {
+		random, err := ewserver.GenerateRandomBytes(enrollmentNameSize)
+		if err != nil {
+			return nil, err
+		}
+		name = hex.EncodeToString(random)
+	}
+
+	deviceName, err := token.DeviceName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := userService.User(ewserver.UserName(deviceName)); err == nil || roleService.SubjectExists(deviceName) {
+		return nil, ewserver.ErrUserAlreadyExists
+	}
+
+	apiUser := ewserver.NewAPIUser()
+	apiUser.Name = deviceName
+	apiUser.Metadata = make(map[string]string, len(metadata)+len(token.Metadata))
+	for key, value := range metadata {
+		apiUser.Metadata[key] = value
+	}
+
+	for key, value := range token.Metadata {
+		apiUser.Metadata[key] = value
+	}
+
+	if err := apiUser.ValidAttributes(); err != nil {
+		return nil, err
+	}
+
+	err = apiUserService.ForEachAPIUser(func(existing *ewserver.APIUser) error {
+		if existing.Name == apiUser.Name {
+			return ewserver.ErrUserAlreadyExists
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	apiUser.Key, err = ewserver.GenerateAPIKey()
+	return apiUser, err
+}
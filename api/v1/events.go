@@ -0,0 +1,175 @@
+package v1
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/authz"
+)
+
+// eventHeartbeatInterval is how often a comment is sent to keep proxies from closing idle feeds
+const eventHeartbeatInterval = 15 * time.Second
+
+// adminSubjectKey is where admin handlers set the name of the user or API user they changed
+const adminSubjectKey = "admin_subject"
+
+// eventTopics maps the system event kinds that may be requested to their topics. Access to
+// a kind is authorized by casbin as GET /api/v1/events/<kind>.
+var eventTopics = map[string]string{
+	"admin":   ewserver.AdminTopic,
+	"devices": ewserver.DeviceTopic(nil) + "*",
+}
+
+// EventFeed streams events as Server-Sent Events. Data points are requested with the streams
+// query parameter (and device for non API users), system events with events=admin,devices.
+// Clients resuming with a Last-Event-ID header (or last_event_id query parameter) are first
+// sent the buffered events they missed. An API user's open feed is activity of its device.
+func EventFeed(apiUserService ewserver.APIUserService, eventService ewserver.EventService, presenceService ewserver.PresenceService, authorizer authz.Authorizer, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		topics, status, err := requestEventTopics(apiUserService, authorizer, c)
+		if err != nil {
+			respond(c, status, gin.H{"error": err.Error()})
+			return
+		}
+
+		lastEventID := c.Request.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = c.Query("last_event_id")
+		}
+
+		// subscribe before replaying so nothing is missed in between, duplicates are skipped by ID.
+		subscription := eventService.Subscribe(topics...)
+		defer subscription.Close()
+		logService.Info("event feed subscribe", "client", c.ClientIP(), "topics", strings.Join(topics, ","))
+
+		c.Header("Content-Type", sse.ContentType)
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(200)
+
+		// live events up to the last replayed one were already sent
+		var replayedID uint64
+		if since, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+			for _, event := range eventService.Replay(since, topics...) {
+				if err := writeEvent(c.Writer, event); err != nil {
+					return
+				}
+				replayedID = event.ID
+			}
+		}
+		c.Writer.Flush()
+
+		ticker := time.NewTicker(eventHeartbeatInterval)
+		defer ticker.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, ok := <-subscription.Events():
+				if !ok {
+					return false
+				}
+
+				if event.ID <= replayedID {
+					return true
+				}
+				return writeEvent(w, event) == nil
+			case <-ticker.C:
+				if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+					return false
+				}
+				streamSeen(presenceService, logService, c)
+				return true
+			case <-c.Request.Context().Done():
+				logService.Info("event feed unsubscribe", "client", c.ClientIP(), "dropped", subscription.Dropped())
+				return false
+			}
+		})
+	}
+}
+
+// requestEventTopics builds and authorizes the topics requested by the streams and events query parameters.
+func requestEventTopics(apiUserService ewserver.APIUserService, authorizer authz.Authorizer, c *gin.Context) ([]string, int, error) {
+	topics := make([]string, 0)
+
+	if c.Query("streams") != "" {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			return nil, errorStatus(err), err
+		}
+
+		streams, err := requestStreams(c)
+		if err != nil {
+			return nil, 400, err
+		}
+
+		for _, stream := range streams {
+			if !authorizeObject(authorizer, c, dataObject(stream), "GET") {
+				return nil, 403, errNotAuthorized
+			}
+			topics = append(topics, ewserver.DataTopic(deviceID, stream))
+		}
+	}
+
+	if c.Query("events") != "" {
+		for _, kind := range strings.Split(c.Query("events"), ",") {
+			topic, ok := eventTopics[kind]
+			if !ok {
+				return nil, 400, errUnknownEvent
+			}
+
+			if !authorizeObject(authorizer, c, "/api/v1/events/"+kind, "GET") {
+				return nil, 403, errNotAuthorized
+			}
+			topics = append(topics, topic)
+		}
+	}
+
+	if len(topics) == 0 {
+		return nil, 400, errNoTopics
+	}
+	return topics, 200, nil
+}
+
+// writeEvent encodes the event as an SSE message named after the topic's kind (data, device or admin).
+func writeEvent(w io.Writer, event *ewserver.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return sse.Encode(w, sse.Event{
+		Id:    strconv.FormatUint(event.ID, 10),
+		Event: strings.SplitN(event.Topic, ":", 2)[0],
+		Data:  string(data),
+	})
+}
+
+// publishAdminEvents publishes an AdminEvent after every successful admin request that is not a GET,
+// with the subject the handler set under adminSubjectKey.
+func publishAdminEvents(eventService ewserver.EventService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if c.Request.Method == "GET" || c.Writer.Status() >= 400 {
+			return
+		}
+
+		event := &ewserver.AdminEvent{
+			UserName: sessionUserName(c),
+			Method:   c.Request.Method,
+			Path:     c.Request.URL.Path,
+			Status:   c.Writer.Status(),
+			Client:   c.ClientIP(),
+			Subject:  c.GetString(adminSubjectKey),
+		}
+
+		eventService.Publish(ewserver.AdminTopic, event)
+	}
+}
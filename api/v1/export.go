@@ -0,0 +1,269 @@
+package v1
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// export formats selected by the format query parameter
+const (
+	exportCSV   = "csv"
+	exportJSONL = "jsonl"
+
+	exportFlushRows = 500 // rows written between flushes to the client
+)
+
+// exporter streams rows to the response as CSV or JSON Lines, gzipped if the client accepts it.
+type exporter struct {
+	gz      *gzip.Writer
+	csv     *csv.Writer
+	json    *json.Encoder
+	flusher http.Flusher
+	rows    int
+}
+
+// newExporter writes the response headers of an export named name, and the CSV header row of columns.
+// Returns ErrInvalidQuery if the format query parameter is not csv (the default) or jsonl.
+func newExporter(c *gin.Context, name string, columns []string) (*exporter, error) {
+	format := c.DefaultQuery("format", exportCSV)
+	if format != exportCSV && format != exportJSONL {
+		return nil, ewserver.ErrInvalidQuery
+	}
+
+	x := &exporter{}
+	x.flusher, _ = c.Writer.(http.Flusher)
+
+	header := c.Writer.Header()
+	header.Set("Content-Disposition", "attachment; filename="+name+"."+format)
+	header.Set("Vary", "Accept-Encoding")
+	if format == exportCSV {
+		header.Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		header.Set("Content-Type", "application/x-ndjson")
+	}
+
+	var w io.Writer = c.Writer
+	if strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+		header.Set("Content-Encoding", "gzip")
+		x.gz = gzip.NewWriter(c.Writer)
+		w = x.gz
+	}
+	c.Status(200)
+
+	if format == exportJSONL {
+		x.json = json.NewEncoder(w)
+		return x, nil
+	}
+
+	x.csv = csv.NewWriter(w)
+	return x, x.csv.Write(columns)
+}
+
+// Write a row, as fields for CSV or obj encoded as a JSON line.
+func (x *exporter) Write(fields []string, obj interface{}) error {
+	var err error
+	if x.csv != nil {
+		err = x.csv.Write(fields)
+	} else {
+		err = x.json.Encode(obj)
+	}
+
+	if x.rows++; err == nil && x.rows%exportFlushRows == 0 {
+		err = x.flush()
+	}
+	return err
+}
+
+// flush buffered rows through to the client
+func (x *exporter) flush() error {
+	if x.csv != nil {
+		x.csv.Flush()
+		if err := x.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	if x.gz != nil {
+		if err := x.gz.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if x.flusher != nil {
+		x.flusher.Flush()
+	}
+	return nil
+}
+
+// Close flushes the remaining rows and ends the gzip stream.
+func (x *exporter) Close() error {
+	if err := x.flush(); err != nil {
+		return err
+	}
+
+	if x.gz != nil {
+		return x.gz.Close()
+	}
+	return nil
+}
+
+// finish closes the export, logging why it was cut short. Headers were already sent so the client
+// only sees a truncated response.
+func (x *exporter) finish(err error, name string, logService ewserver.LogService) {
+	if err == nil {
+		err = x.Close()
+	}
+
+	if err != nil {
+		logService.Error("export failure", "export", name, "rows", x.rows, "error", err)
+	}
+}
+
+// ExportData streams the raw points of a device stream as CSV or JSON Lines straight from a single read of
+// the database. API users export their own streams, other users must supply the device's ID in the device
+// query parameter. from and to are optional and may be RFC3339 or unix seconds, format is csv or jsonl.
+func ExportData(apiUserService ewserver.APIUserService, telemetryService ewserver.TelemetryService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		stream := ewserver.StreamName(c.Param("stream"))
+		if !stream.Valid() {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidStream.Error()})
+			return
+		}
+
+		var from, to time.Time
+		if value := c.Query("from"); value != "" {
+			if from, err = parseTime(value); err != nil {
+				respond(c, 400, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if value := c.Query("to"); value != "" {
+			if to, err = parseTime(value); err != nil {
+				respond(c, 400, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		x, err := newExporter(c, string(stream), []string{"timestamp", "value"})
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		err = telemetryService.ForEachPoint(deviceID, stream, from, to, func(point *ewserver.DataPoint) error {
+			return x.Write([]string{point.Timestamp.Format(time.RFC3339Nano), string(point.Value)}, point)
+		})
+		x.finish(err, string(stream), logService)
+	}
+}
+
+// AdminExportUsers streams all users as CSV or JSON Lines
+func AdminExportUsers(userService ewserver.UserService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		x, err := newExporter(c, "users", []string{"username", "first_name", "last_name", "last_address"})
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		err = userService.ForEachUser(func(user *ewserver.User) error {
+			return x.Write([]string{string(user.UserName), user.FirstName, user.LastName, user.LastAddress}, user)
+		})
+		x.finish(err, "users", logService)
+	}
+}
+
+// AdminExportAPIUsers streams all API users as CSV or JSON Lines with the address each was last seen from.
+// API keys are not exported.
+func AdminExportAPIUsers(apiUserService ewserver.APIUserService, presenceService ewserver.PresenceService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type apiUserRow struct {
+		Name        string `json:"name"`
+		ID          []byte `json:"id"`
+		LastAddress string `json:"last_address"`
+	}
+
+	return func(c *gin.Context) {
+		// read before the API users, so the lookups are not made inside their read
+		presences, err := presenceService.Presences()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		addresses := make(map[string]string, len(presences))
+		for _, presence := range presences {
+			addresses[string(presence.DeviceID)] = presence.Address
+		}
+
+		x, err := newExporter(c, "api_users", []string{"name", "id", "last_address"})
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		err = apiUserService.ForEachAPIUser(func(apiUser *ewserver.APIUser) error {
+			row := &apiUserRow{Name: apiUser.Name, ID: apiUser.ID, LastAddress: apiUser.LastAddress}
+			if address := addresses[string(apiUser.ID)]; address != "" {
+				row.LastAddress = address
+			}
+			return x.Write([]string{row.Name, base64.StdEncoding.EncodeToString(row.ID), row.LastAddress}, row)
+		})
+		x.finish(err, "api_users", logService)
+	}
+}
+
+// AdminExportPermissions streams every permission and role membership as CSV or JSON Lines. Permissions
+// have a type of permission with the subject's object and method, memberships a type of role with the role
+// as the object.
+func AdminExportPermissions(roleService ewserver.RoleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type permissionRow struct {
+		Type    string `json:"type"`
+		Subject string `json:"subject"`
+		Object  string `json:"object"`
+		Method  string `json:"method,omitempty"`
+	}
+
+	return func(c *gin.Context) {
+		x, err := newExporter(c, "permissions", []string{"type", "subject", "object", "method"})
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		rows := make([]*permissionRow, 0)
+		for _, permission := range roleService.Permissions() {
+			if len(permission) >= 3 {
+				rows = append(rows, &permissionRow{Type: "permission", Subject: permission[0], Object: permission[1], Method: permission[2]})
+			}
+		}
+
+		for _, membership := range roleService.RoleMap() {
+			if len(membership) >= 2 {
+				rows = append(rows, &permissionRow{Type: "role", Subject: membership[0], Object: membership[1]})
+			}
+		}
+
+		for _, row := range rows {
+			if err = x.Write([]string{row.Type, row.Subject, row.Object, row.Method}, row); err != nil {
+				break
+			}
+		}
+		x.finish(err, "permissions", logService)
+	}
+}
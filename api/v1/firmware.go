@@ -0,0 +1,197 @@
+package v1
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// firmwareDownloadPath is where devices download firmware images from, followed by the version
+const firmwareDownloadPath = "/api/v1/firmware/download/"
+
+// CheckFirmware tells the calling API user if it should update from the version it runs (the version
+// query parameter). If so the response contains a manifest signed with the server's Ed25519 key whose
+// URL is on the server's external URL, such as https://ewserver.example.com.
+func CheckFirmware(roleService ewserver.RoleService, firmwareService ewserver.FirmwareService, externalURL string, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		current := ewserver.FirmwareVersion(c.Query("version"))
+		firmware, err := firmwareService.Update(apiUser.ID, roleService.RolesForSubject(apiUser.Name), current)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		if firmware == nil {
+			respond(c, 200, gin.H{"status": "OK", "update": false})
+			return
+		}
+
+		manifest := &ewserver.FirmwareManifest{
+			Version: firmware.Version,
+			URL:     externalURL + firmwareDownloadPath + string(firmware.Version),
+			SHA256:  firmware.SHA256,
+			Size:    firmware.Size,
+		}
+
+		if err := firmwareService.Sign(manifest); err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("firmware update offered", "api_user", apiUser.Name, "current", string(current), "version", string(firmware.Version))
+		respond(c, 200, gin.H{"status": "OK", "update": true, "manifest": manifest})
+	}
+}
+
+// DownloadFirmware serves a firmware image with support for Range requests so interrupted downloads
+// can resume. API users may only download versions rolled out to them.
+func DownloadFirmware(roleService ewserver.RoleService, firmwareService ewserver.FirmwareService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version := ewserver.FirmwareVersion(c.Param("version"))
+		firmware, file, err := firmwareService.Open(version)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+
+		if isAPIUserRequest(c) {
+			apiUser, err := requestAPIUser(c)
+			if err != nil {
+				respond(c, 401, gin.H{"error": err.Error()})
+				return
+			}
+
+			if !firmware.Rollout.Targets(version, apiUser.ID, roleService.RolesForSubject(apiUser.Name)) {
+				respond(c, 404, gin.H{"error": ewserver.ErrFirmwareNotFound.Error()})
+				return
+			}
+		}
+
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("ETag", `"`+firmware.SHA256+`"`)
+		http.ServeContent(c.Writer, c.Request, string(version)+".bin", firmware.UploadedAt, file)
+	}
+}
+
+// ReportFirmwareStatus stores the calling API user's progress updating to a version.
+func ReportFirmwareStatus(firmwareService ewserver.FirmwareService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		status := ewserver.NewFirmwareStatus()
+		if err := bind(c, status); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+		status.DeviceID = apiUser.ID
+
+		if err := firmwareService.ReportStatus(status); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("firmware status", "api_user", apiUser.Name, "version", string(status.Version), "state", string(status.State))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
+
+// FirmwareKey returns the base64 encoded Ed25519 public key manifests are signed with.
+func FirmwareKey(firmwareService ewserver.FirmwareService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		publicKey := base64.StdEncoding.EncodeToString(firmwareService.PublicKey())
+		respond(c, 200, gin.H{"status": "OK", "public_key": publicKey})
+	}
+}
+
+// AdminUploadFirmware stores the request body as the firmware image of the version.
+func AdminUploadFirmware(firmwareService ewserver.FirmwareService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		image, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, ewserver.MaxFirmwareSize))
+		if err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidFirmware.Error()})
+			return
+		}
+
+		firmware := ewserver.NewFirmware()
+		firmware.Version = ewserver.FirmwareVersion(c.Param("version"))
+		firmware.UploadedBy = string(sessionUserName(c))
+
+		if err := firmwareService.Upload(firmware, image); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("firmware uploaded", "version", string(firmware.Version), "size", firmware.Size, "uploaded_by", firmware.UploadedBy)
+		respond(c, 200, gin.H{"status": "OK", "firmware": firmware})
+	}
+}
+
+// AdminListFirmware returns the metadata and rollouts of all firmware versions
+func AdminListFirmware(firmwareService ewserver.FirmwareService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		firmwares, err := firmwareService.Firmwares()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "firmware": firmwares})
+	}
+}
+
+// AdminRolloutFirmware replaces the rollout of a version. The body lists the base64 device IDs
+// and groups to target (the whole fleet if both are empty) and the percentage of them to update.
+func AdminRolloutFirmware(firmwareService ewserver.FirmwareService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rollout := &ewserver.Rollout{}
+		if err := bind(c, rollout); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+		rollout.UpdatedBy = string(sessionUserName(c))
+
+		version := ewserver.FirmwareVersion(c.Param("version"))
+		if err := firmwareService.SetRollout(version, rollout); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("firmware rollout", "version", string(version), "percentage", rollout.Percentage, "updated_by", rollout.UpdatedBy)
+		respond(c, 200, gin.H{"status": "OK", "rollout": rollout})
+	}
+}
+
+// AdminFirmwareStatus returns the update status devices reported, filtered by the version query parameter if set.
+func AdminFirmwareStatus(firmwareService ewserver.FirmwareService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		statuses, err := firmwareService.Statuses(ewserver.FirmwareVersion(c.Query("version")))
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "statuses": statuses})
+	}
+}
+
+// AdminDeleteFirmware deletes a firmware version and its image
+func AdminDeleteFirmware(firmwareService ewserver.FirmwareService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := firmwareService.Delete(ewserver.FirmwareVersion(c.Param("version")))
+		defaultReturn(err, c)
+	}
+}
@@ -0,0 +1,289 @@
+package v1
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// AdminListGroups returns all device groups with their number of members
+func AdminListGroups(groupService ewserver.GroupService, roleService ewserver.RoleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type groupMembers struct {
+		*ewserver.DeviceGroup
+		Members int `json:"members"`
+	}
+
+	return func(c *gin.Context) {
+		groups, err := groupService.Groups()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		details := make([]*groupMembers, 0, len(groups))
+		for _, group := range groups {
+			members := len(roleService.SubjectsForRole(ewserver.GroupRole(group.Name)))
+			details = append(details, &groupMembers{DeviceGroup: group, Members: members})
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "groups": details})
+	}
+}
+
+// AdminCreateGroup creates an empty device group. Permissions added to the role group:<name> apply to its members.
+func AdminCreateGroup(groupService ewserver.GroupService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type newGroup struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	return func(c *gin.Context) {
+		request := &newGroup{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidGroup.Error()})
+			return
+		}
+
+		group := &ewserver.DeviceGroup{
+			Name:        request.Name,
+			Description: request.Description,
+			CreatedBy:   string(sessionUserName(c)),
+			CreatedAt:   time.Now().UTC(),
+		}
+
+		if err := groupService.Create(group); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("device group created", "group", group.Name, "created_by", group.CreatedBy)
+		respond(c, 200, gin.H{"status": "OK", "group": group})
+	}
+}
+
+// AdminDeleteGroup deletes the group, removing its members from it and deleting its permissions.
+// The devices themselves are kept.
+func AdminDeleteGroup(groupService ewserver.GroupService, roleService ewserver.RoleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		if err := groupService.Delete(name); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := roleService.DeleteRole(ewserver.GroupRole(name)); err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("device group deleted", "group", name, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
+
+// AdminGroupMembers returns the API users that are members of the group given in the group query parameter
+func AdminGroupMembers(groupService ewserver.GroupService, apiUserService ewserver.APIUserService, roleService ewserver.RoleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group, err := groupService.Group(c.Query("group"))
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		names := make(map[string]struct{})
+		for _, subject := range roleService.SubjectsForRole(ewserver.GroupRole(group.Name)) {
+			names[subject] = struct{}{}
+		}
+
+		members := make([]*ewserver.APIUser, 0, len(names))
+		err = apiUserService.ForEachAPIUser(func(apiUser *ewserver.APIUser) error {
+			if _, ok := names[apiUser.Name]; ok {
+				members = append(members, apiUser)
+			}
+			return nil
+		})
+
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "group": group, "api_users": members})
+	}
+}
+
+// AdminAddGroupMembers adds devices to a group, either those listed by ID in devices or all those
+// matching the device query q, such as `site=berlin AND tag=outdoor`.
+func AdminAddGroupMembers(groupService ewserver.GroupService, apiUserService ewserver.APIUserService, roleService ewserver.RoleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return updateGroupMembers(groupService, apiUserService, logService, "added to", func(subject, role string) error {
+		// adding a member twice is not an error, it is already in the group
+		if contains(roleService.RolesForSubject(subject), role) {
+			return nil
+		}
+		return roleService.AddSubjectToRole(subject, role)
+	})
+}
+
+// AdminRemoveGroupMembers removes devices, listed by ID or matching the query as for AdminAddGroupMembers,
+// from a group. As with roles, removing the last member also deletes the group's permissions.
+func AdminRemoveGroupMembers(groupService ewserver.GroupService, apiUserService ewserver.APIUserService, roleService ewserver.RoleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return updateGroupMembers(groupService, apiUserService, logService, "removed from", func(subject, role string) error {
+		if !contains(roleService.RolesForSubject(subject), role) {
+			return nil
+		}
+		return roleService.DeleteSubjectFromRole(subject, role)
+	})
+}
+
+// updateGroupMembers applies update to the group role of each device selected by the request
+func updateGroupMembers(groupService ewserver.GroupService, apiUserService ewserver.APIUserService, logService ewserver.LogService, verb string, update func(subject, role string) error) gin.HandlerFunc {
+	type membersRequest struct {
+		Group   string   `json:"group"`
+		Devices []string `json:"devices"`
+		Query   string   `json:"q"`
+	}
+
+	return func(c *gin.Context) {
+		request := &membersRequest{}
+		if err := bind(c, request); err != nil || len(request.Devices) == 0 && request.Query == "" {
+			respond(c, 400, gin.H{"error": errMissingDevice.Error()})
+			return
+		}
+
+		group, err := groupService.Group(request.Group)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		var apiUsers []*ewserver.APIUser
+		if request.Query != "" {
+			query, err := ewserver.ParseDeviceQuery(request.Query)
+			if err != nil {
+				respond(c, 400, gin.H{"error": err.Error()})
+				return
+			}
+
+			if apiUsers, err = apiUserService.Search(query); err != nil {
+				respond(c, 500, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		for _, id := range request.Devices {
+			apiUser, err := apiUserService.APIUserByID([]byte(id))
+			if err != nil {
+				respond(c, errorStatus(err), gin.H{"error": err.Error(), "device": id})
+				return
+			}
+			apiUsers = append(apiUsers, apiUser)
+		}
+
+		role := ewserver.GroupRole(group.Name)
+		for _, apiUser := range apiUsers {
+			if err := update(apiUser.Name, role); err != nil {
+				respond(c, 500, gin.H{"error": err.Error(), "device": apiUser.ID})
+				return
+			}
+		}
+
+		logService.Info("devices "+verb+" group", "group", group.Name, "devices", len(apiUsers), "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK", "devices": len(apiUsers)})
+	}
+}
+
+// AdminStartBulkJob starts a job applying an action to every device of a group: command (args
+// {"name", "args", "ttl"}), firmware ({"version", "percentage"}), rotate_key, disable, enable or delete.
+// The job runs in the background, its progress and each device's result are in its details.
+func AdminStartBulkJob(bulkJobRunner ewserver.BulkJobRunner, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type newJob struct {
+		Group  string              `json:"group"`
+		Action ewserver.BulkAction `json:"action"`
+		Args   json.RawMessage     `json:"args"`
+	}
+
+	return func(c *gin.Context) {
+		request := &newJob{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidBulkJob.Error()})
+			return
+		}
+
+		job := ewserver.NewBulkJob(request.Group, request.Action, request.Args)
+		job.CreatedBy = string(sessionUserName(c))
+		if err := bulkJobRunner.Start(job); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "job": job.ID, "total": job.Total})
+	}
+}
+
+// AdminListBulkJobs returns all bulk jobs newest first, without their results
+func AdminListBulkJobs(bulkJobService ewserver.BulkJobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jobs, err := bulkJobService.Jobs()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, job := range jobs {
+			job.Results = nil
+		}
+		respond(c, 200, gin.H{"status": "OK", "jobs": jobs})
+	}
+}
+
+// AdminBulkJobDetails returns a bulk job with the result of each device processed so far
+func AdminBulkJobDetails(bulkJobService ewserver.BulkJobService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			respond(c, 404, gin.H{"error": ewserver.ErrJobNotFound.Error()})
+			return
+		}
+
+		job, err := bulkJobService.Job(id)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "job": job})
+	}
+}
+
+// AdminBulkJobKeys returns the new keys of a completed rotate_key job by device name. The keys are not
+// stored, they are only returned once and are lost if the server restarts before they are collected.
+func AdminBulkJobKeys(bulkJobRunner ewserver.BulkJobRunner, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			respond(c, 404, gin.H{"error": ewserver.ErrJobNotFound.Error()})
+			return
+		}
+
+		keys, err := bulkJobRunner.Keys(id)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("bulk job keys collected", "job", id, "keys", len(keys), "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK", "keys": keys})
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
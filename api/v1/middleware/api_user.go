@@ -0,0 +1,16 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// requestAPIUser returns the API user that Require authorized the request for, nil for other requests.
+func requestAPIUser(c *gin.Context) *ewserver.APIUser {
+	if value, ok := c.Get(ewserver.APIUserContextKey); ok {
+		if apiUser, ok := value.(*ewserver.APIUser); ok {
+			return apiUser
+		}
+	}
+	return nil
+}
@@ -3,13 +3,17 @@ package middleware
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/wirepair/ewserver/api/v1"
+	"github.com/wirepair/ewserver/ewserver"
 	"github.com/wirepair/ewserver/internal/authz"
 )
 
-// Require authorization token (api or session)
+// Require authorization token (api or session), the authorized API user is stored in the context for handlers.
 func Require(authorizer authz.Authorizer) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if authorizer.Authorize(c.Request) {
+		if apiUser, ok := authorizer.AuthorizeRequest(c.Request); ok {
+			if apiUser != nil {
+				c.Set(ewserver.APIUserContextKey, apiUser)
+			}
 			c.Next()
 			return
 		}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// TrackPresence records every authorized API key, signed or client certificate request as activity of the device, with the
+// client's address and user agent. It must come after Require so only authenticated requests count.
+func TrackPresence(presenceService ewserver.PresenceService, logService ewserver.LogService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiUser := requestAPIUser(c); apiUser != nil {
+			if err := presenceService.Seen(apiUser.ID, c.ClientIP(), c.Request.UserAgent(), time.Now().UTC()); err != nil {
+				logService.Error("error tracking presence", "error", err)
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrustProxies replaces the remote address of requests from the trusted reverse proxies with the client
+// address they forwarded in X-Forwarded-For, so ClientIP can not be spoofed by clients sending the header
+// themselves. The engine must not trust the forwarded headers itself. It must come before LimitAddress.
+func TrustProxies(proxies []*net.IPNet) gin.HandlerFunc {
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		for _, proxy := range proxies {
+			if ip != nil && proxy.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(c *gin.Context) {
+		host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if err != nil || !trusted(host) {
+			c.Next()
+			return
+		}
+
+		// the rightmost address not added by one of our proxies is the client
+		forwarded := strings.Split(c.Request.Header.Get("X-Forwarded-For"), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(forwarded[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+
+			if !trusted(addr) || i == 0 {
+				c.Request.RemoteAddr = net.JoinHostPort(addr, "0")
+				break
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/ratelimit"
+	"github.com/wirepair/ewserver/internal/session"
+)
+
+// LimitAddress limits requests per client address. It should come before any other middleware so
+// rejected requests are cheap, which also covers login attempts.
+func LimitAddress(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, retryAfter := limiter.AllowAddress(c.ClientIP(), time.Now()); !ok {
+			tooManyRequests(c, retryAfter)
+			return
+		}
+		c.Next()
+	}
+}
+
+// LimitIdentity limits requests per API user and logged in user. It must come after Require so a
+// client can not use up another identity's limit, anonymous requests are only limited by address.
+func LimitIdentity(limiter *ratelimit.Limiter, sessions session.Manager, logService ewserver.LogService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope, name := ewserver.RateLimitScopeAPIUser, ""
+		if apiUser := requestAPIUser(c); apiUser != nil {
+			name = apiUser.Name
+		} else {
+			user := &ewserver.User{}
+			if err := sessions.Load(c.Request, "user", user); err == nil && user.UserName != "anonymous" {
+				scope, name = ewserver.RateLimitScopeUser, string(user.UserName)
+			}
+		}
+
+		if name == "" {
+			c.Next()
+			return
+		}
+
+		if ok, retryAfter := limiter.AllowIdentity(scope, name, time.Now()); !ok {
+			logService.Info("rate limited", "scope", scope, "subject", name, "ipaddr", c.ClientIP())
+			tooManyRequests(c, retryAfter)
+			return
+		}
+		c.Next()
+	}
+}
+
+// tooManyRequests aborts with 429 and how many whole seconds until the client may retry
+func tooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(429, gin.H{"error": ewserver.ErrRateLimited.Error()})
+}
@@ -0,0 +1,71 @@
+package v1
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// AdminListRateLimits returns all rate limits
+func AdminListRateLimits(rateLimitService ewserver.RateLimitService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limits, err := rateLimitService.Limits()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "limits": limits})
+	}
+}
+
+// AdminSetRateLimit creates or replaces the limit of a scope (api_user, user, role or ip) and subject,
+// a subject of * is the default for the scope. It applies from the next request.
+func AdminSetRateLimit(rateLimitService ewserver.RateLimitService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type rateLimitRequest struct {
+		Scope   string  `json:"scope"`
+		Subject string  `json:"subject"`
+		Rate    float64 `json:"rate"`
+		Burst   int     `json:"burst"`
+	}
+
+	return func(c *gin.Context) {
+		request := &rateLimitRequest{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidRateLimit.Error()})
+			return
+		}
+
+		limit := &ewserver.RateLimit{
+			Scope:     request.Scope,
+			Subject:   request.Subject,
+			Rate:      request.Rate,
+			Burst:     request.Burst,
+			UpdatedBy: string(sessionUserName(c)),
+			UpdatedAt: time.Now().UTC(),
+		}
+
+		if err := rateLimitService.SetLimit(limit); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("rate limit set", "scope", limit.Scope, "subject", limit.Subject, "rate", limit.Rate, "burst", limit.Burst, "updated_by", limit.UpdatedBy)
+		respond(c, 200, gin.H{"status": "OK", "limit": limit})
+	}
+}
+
+// AdminDeleteRateLimit deletes the limit identified by the scope and subject query parameters
+func AdminDeleteRateLimit(rateLimitService ewserver.RateLimitService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope, subject := c.Query("scope"), c.Query("subject")
+		if err := rateLimitService.DeleteLimit(scope, subject); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("rate limit deleted", "scope", scope, "subject", subject, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
@@ -12,7 +12,7 @@ func AdminRoleList(roleService ewserver.RoleService, logService ewserver.LogServ
 		roleNames := roleService.RoleNames()
 		roleMap := roleService.RoleMap()
 		permissions := roleService.Permissions()
-		c.JSON(200, gin.H{"status": "OK", "role_names": roleNames, "role_map": roleMap, "permissions": permissions})
+		respond(c, 200, gin.H{"status": "OK", "role_names": roleNames, "role_map": roleMap, "permissions": permissions})
 	}
 }
 
@@ -26,14 +26,14 @@ func AdminAddPermission(roleService ewserver.RoleService, logService ewserver.Lo
 
 	return func(c *gin.Context) {
 		perm := &permission{}
-		if err := c.BindJSON(perm); err != nil {
-			c.JSON(500, gin.H{"error": err})
+		if err := bind(c, perm); err != nil {
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
 		regex := converter.ActionsRegex(perm.Action)
 		if regex == "" {
-			c.JSON(500, gin.H{"error": "invalid action specified"})
+			respond(c, 500, gin.H{"error": "invalid action specified"})
 			return
 		}
 		err := roleService.AddPermission(perm.Subject, perm.Resource, regex)
@@ -51,8 +51,8 @@ func AdminDeletePermission(roleService ewserver.RoleService, logService ewserver
 
 	return func(c *gin.Context) {
 		perm := &permission{}
-		if err := c.BindJSON(perm); err != nil {
-			c.JSON(500, gin.H{"error": err})
+		if err := bind(c, perm); err != nil {
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
@@ -71,8 +71,8 @@ func AdminAddSubjectToRole(roleService ewserver.RoleService, logService ewserver
 
 	return func(c *gin.Context) {
 		addRole := &role{}
-		if err := c.BindJSON(addRole); err != nil {
-			c.JSON(500, gin.H{"error": err})
+		if err := bind(c, addRole); err != nil {
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
@@ -90,8 +90,8 @@ func AdminDeleteSubjectFromRole(roleService ewserver.RoleService, logService ews
 
 	return func(c *gin.Context) {
 		deleteRole := &role{}
-		if err := c.BindJSON(deleteRole); err != nil {
-			c.JSON(500, gin.H{"error": err})
+		if err := bind(c, deleteRole); err != nil {
+			respond(c, 500, gin.H{"error": err})
 			return
 		}
 
@@ -0,0 +1,166 @@
+package v1
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// ruleRequest creates or updates a rule, Device is the optional base64 ID of the only device it applies to.
+type ruleRequest struct {
+	Name              string                `json:"name"`
+	Device            string                `json:"device"`
+	Stream            ewserver.StreamName   `json:"stream"`
+	Expression        string                `json:"expression"`
+	ResolveExpression string                `json:"resolve_expression"`
+	For               ewserver.Duration     `json:"for"`
+	Actions           []ewserver.RuleAction `json:"actions"`
+	Disabled          bool                  `json:"disabled"`
+}
+
+// requestRule binds the request to a new rule, looking up its device.
+func requestRule(apiUserService ewserver.APIUserService, c *gin.Context) (*ewserver.Rule, error) {
+	request := &ruleRequest{}
+	if err := bind(c, request); err != nil {
+		return nil, ewserver.ErrInvalidRule
+	}
+
+	rule := ewserver.NewRule()
+	rule.Name, rule.Stream, rule.Expression, rule.ResolveExpression = request.Name, request.Stream, request.Expression, request.ResolveExpression
+	rule.For, rule.Actions, rule.Disabled = request.For, request.Actions, request.Disabled
+
+	if request.Device != "" {
+		apiUser, err := apiUserService.APIUserByID([]byte(request.Device))
+		if err != nil {
+			return nil, err
+		}
+		rule.DeviceID = apiUser.ID
+	}
+	return rule, nil
+}
+
+// ruleID parses the id route parameter, an invalid ID can not exist.
+func ruleID(c *gin.Context) (uint64, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, ewserver.ErrRuleNotFound
+	}
+	return id, nil
+}
+
+// AdminListRules returns all rules
+func AdminListRules(ruleService ewserver.RuleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rules, err := ruleService.Rules()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "rules": rules})
+	}
+}
+
+// AdminRuleDetails returns the rule and its state for every device it was evaluated for
+func AdminRuleDetails(ruleService ewserver.RuleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := ruleID(c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		rule, err := ruleService.Rule(id)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		states, err := ruleService.States(id)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "rule": rule, "states": states})
+	}
+}
+
+// AdminCreateRule creates a rule, the expression may end in a "for <duration>" clause.
+func AdminCreateRule(apiUserService ewserver.APIUserService, ruleService ewserver.RuleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rule, err := requestRule(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		rule.CreatedBy = string(sessionUserName(c))
+		if err := ruleService.Create(rule); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("rule created", "rule", rule.ID, "name", rule.Name, "created_by", rule.CreatedBy)
+		respond(c, 200, gin.H{"status": "OK", "rule": rule})
+	}
+}
+
+// AdminUpdateRule replaces the rule, its state is kept so a firing rule resolves against the new expressions.
+func AdminUpdateRule(apiUserService ewserver.APIUserService, ruleService ewserver.RuleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := ruleID(c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		rule, err := requestRule(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		rule.ID = id
+		if err := ruleService.Update(rule); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("rule updated", "rule", rule.ID, "name", rule.Name, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK", "rule": rule})
+	}
+}
+
+// AdminDeleteRule deletes the rule and its states, alerts it raised are kept.
+func AdminDeleteRule(ruleService ewserver.RuleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := ruleID(c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := ruleService.Delete(id); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("rule deleted", "rule", id, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
+
+// AdminListAlerts returns the alerts in the state query parameter (firing or resolved), all alerts if it is empty.
+func AdminListAlerts(ruleService ewserver.RuleService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		alerts, err := ruleService.Alerts(ewserver.AlertState(c.Query("state")))
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "alerts": alerts})
+	}
+}
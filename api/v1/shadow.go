@@ -0,0 +1,180 @@
+package v1
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// shadowUpdate is the body of desired and reported state updates. If Version is set it must match
+// the shadow's current version, otherwise the update fails with 409 so the writer can re-read it.
+type shadowUpdate struct {
+	Version uint64               `json:"version"`
+	State   ewserver.ShadowState `json:"state"`
+}
+
+// GetShadow returns the calling API user's shadow document and its delta.
+func GetShadow(shadowService ewserver.ShadowService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		shadow, err := shadowService.Shadow(apiUser.ID)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "shadow": shadow, "delta": shadow.Delta()})
+	}
+}
+
+// ShadowDelta long polls for the calling API user's delta. If the shadow's version is not newer than
+// the version query parameter the request is held open for up to wait (a duration or seconds, default
+// 30s) until it changes, so devices only need to remember the last version they acted on.
+func ShadowDelta(shadowService ewserver.ShadowService, eventService ewserver.EventService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		var version uint64
+		if value := c.Query("version"); value != "" {
+			if version, err = strconv.ParseUint(value, 10, 64); err != nil {
+				respond(c, 400, gin.H{"error": ewserver.ErrInvalidQuery.Error()})
+				return
+			}
+		}
+
+		wait := defaultCommandWait
+		if value := c.Query("wait"); value != "" {
+			if wait, err = parseDuration(value); err != nil || wait < 0 || wait > maxCommandWait {
+				respond(c, 400, gin.H{"error": ewserver.ErrInvalidQuery.Error()})
+				return
+			}
+		}
+
+		// subscribe before reading the shadow so an update in between wakes us
+		subscription := eventService.Subscribe(ewserver.ShadowTopic(apiUser.ID))
+		defer subscription.Close()
+
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+
+		for {
+			shadow, err := shadowService.Shadow(apiUser.ID)
+			if err != nil {
+				respond(c, 500, gin.H{"error": err.Error()})
+				return
+			}
+
+			if shadow.Version > version {
+				respond(c, 200, gin.H{"status": "OK", "version": shadow.Version, "delta": shadow.Delta()})
+				return
+			}
+
+			select {
+			case <-subscription.Events():
+			case <-timeout.C:
+				respond(c, 200, gin.H{"status": "OK", "version": shadow.Version, "delta": shadow.Delta()})
+				return
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// ReportShadow merges the body's state into the calling API user's reported state and returns the
+// updated shadow and delta.
+func ReportShadow(shadowService ewserver.ShadowService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			respond(c, 401, gin.H{"error": err.Error()})
+			return
+		}
+
+		update := &shadowUpdate{}
+		if err := bind(c, update); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		shadow, err := shadowService.UpdateReported(apiUser.ID, update.State, update.Version)
+		if err != nil {
+			logService.Info("report shadow failure", "api_user", apiUser.Name, "version", update.Version, "error", err)
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "shadow": shadow, "delta": shadow.Delta()})
+	}
+}
+
+// AdminShadowDetails returns the shadow and delta of the device whose ID is given in the device query parameter.
+func AdminShadowDetails(apiUserService ewserver.APIUserService, shadowService ewserver.ShadowService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		shadow, err := shadowService.Shadow(deviceID)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "shadow": shadow, "delta": shadow.Delta()})
+	}
+}
+
+// AdminUpdateShadow merges the body's state into the desired state of the device whose ID is given
+// in the device query parameter.
+func AdminUpdateShadow(apiUserService ewserver.APIUserService, shadowService ewserver.ShadowService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		update := &shadowUpdate{}
+		if err := bind(c, update); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		shadow, err := shadowService.UpdateDesired(deviceID, update.State, update.Version)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("shadow desired state updated", "version", shadow.Version, "updated_by", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK", "shadow": shadow, "delta": shadow.Delta()})
+	}
+}
+
+// AdminDeleteShadow deletes the shadow of the device whose ID is given in the device query parameter.
+func AdminDeleteShadow(apiUserService ewserver.APIUserService, shadowService ewserver.ShadowService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		err = shadowService.Delete(deviceID)
+		defaultReturn(err, c)
+	}
+}
@@ -0,0 +1,126 @@
+package v1
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// AdminStorageStats returns the size of the database and if a compaction is pending
+func AdminStorageStats(storageService ewserver.StorageService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats, err := storageService.Stats()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "storage": stats})
+	}
+}
+
+// AdminScheduleCompaction schedules the database file to be compacted. The database is only compacted when the
+// server starts, until then the stats report the compaction as pending.
+func AdminScheduleCompaction(storageService ewserver.StorageService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := storageService.ScheduleCompaction(); err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("storage compaction scheduled", "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK", "compaction": "pending restart"})
+	}
+}
+
+// AdminRetentionList returns all retention policies and the outcome of the last retention run
+func AdminRetentionList(retentionService ewserver.RetentionService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policies, err := retentionService.Policies()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		lastRun, err := retentionService.LastRun()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "policies": policies, "last_run": lastRun})
+	}
+}
+
+// AdminSetRetention adds or replaces the retention policy of a device's stream. The device (base64 ID)
+// and stream are optional, a policy without either is the default for all data.
+func AdminSetRetention(apiUserService ewserver.APIUserService, retentionService ewserver.RetentionService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type retentionRequest struct {
+		Device string                   `json:"device"`
+		Stream ewserver.StreamName      `json:"stream"`
+		Tiers  []ewserver.RetentionTier `json:"tiers"`
+	}
+
+	return func(c *gin.Context) {
+		request := &retentionRequest{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		policy := ewserver.NewRetentionPolicy()
+		policy.Stream = request.Stream
+		policy.Tiers = request.Tiers
+		policy.UpdatedBy = string(sessionUserName(c))
+
+		if request.Device != "" {
+			apiUser, err := apiUserService.APIUserByID([]byte(request.Device))
+			if err != nil {
+				respond(c, errorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			policy.DeviceID = apiUser.ID
+		}
+
+		if err := retentionService.SetPolicy(policy); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("retention policy set", "device", request.Device, "stream", string(policy.Stream), "updated_by", policy.UpdatedBy)
+		respond(c, 200, gin.H{"status": "OK", "policy": policy})
+	}
+}
+
+// AdminDeleteRetention deletes the retention policy identified by the device and stream query parameters
+func AdminDeleteRetention(apiUserService ewserver.APIUserService, retentionService ewserver.RetentionService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var deviceID []byte
+		if device := c.Query("device"); device != "" {
+			apiUser, err := apiUserService.APIUserByID([]byte(device))
+			if err != nil {
+				respond(c, errorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			deviceID = apiUser.ID
+		}
+
+		err := retentionService.DeletePolicy(deviceID, ewserver.StreamName(c.Query("stream")))
+		defaultReturn(err, c)
+	}
+}
+
+// AdminRunRetention applies the retention policies immediately instead of waiting for the background worker
+func AdminRunRetention(retentionService ewserver.RetentionService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		run, err := retentionService.Apply(time.Now().UTC())
+		if err != nil {
+			logService.Error("retention run failure", "error", err)
+			respond(c, 500, gin.H{"error": err.Error(), "run": run})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "run": run})
+	}
+}
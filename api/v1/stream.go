@@ -0,0 +1,132 @@
+package v1
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/authz"
+	"github.com/wirepair/ewserver/internal/websocket"
+)
+
+const (
+	streamPingInterval = 30 * time.Second // how often subscribers are pinged to detect dead connections
+	streamWriteTimeout = 10 * time.Second // how long a write to a subscriber may block before disconnecting it
+)
+
+// StreamSubscribe upgrades the request to a websocket and pushes new points of the streams
+// listed in the streams query parameter (comma separated) as they are ingested. Each stream
+// must be readable by the caller, as decided by casbin for GET /api/v1/data/:stream. An API
+// user's open stream is activity of its device.
+func StreamSubscribe(apiUserService ewserver.APIUserService, eventService ewserver.EventService, presenceService ewserver.PresenceService, authorizer authz.Authorizer, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		streams, err := requestStreams(c)
+		if err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		topics := make([]string, 0, len(streams))
+		for _, stream := range streams {
+			if !authorizeObject(authorizer, c, dataObject(stream), "GET") {
+				respond(c, 403, gin.H{"error": "not authorized to read stream", "stream": stream})
+				return
+			}
+			topics = append(topics, ewserver.DataTopic(deviceID, stream))
+		}
+
+		conn, err := websocket.Upgrade(c.Writer, c.Request)
+		if err != nil {
+			logService.Error("websocket upgrade failure", "client", c.ClientIP(), "error", err)
+			return
+		}
+		defer conn.Close()
+
+		subscription := eventService.Subscribe(topics...)
+		defer subscription.Close()
+		logService.Info("stream subscribe", "client", c.ClientIP(), "streams", strings.Join(topics, ","))
+
+		// the read loop only exists to answer pings and notice when the client goes away
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(streamPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case event, ok := <-subscription.Events():
+				if !ok {
+					return
+				}
+
+				data, err := json.Marshal(event)
+				if err != nil {
+					logService.Error("stream event encode failure", "topic", event.Topic, "error", err)
+					continue
+				}
+
+				conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+				if err := conn.WriteText(data); err != nil {
+					logService.Info("stream subscriber write failure", "client", c.ClientIP(), "error", err)
+					return
+				}
+			case <-ticker.C:
+				conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+				if err := conn.Ping(); err != nil {
+					return
+				}
+				streamSeen(presenceService, logService, c)
+			case <-closed:
+				logService.Info("stream unsubscribe", "client", c.ClientIP(), "dropped", subscription.Dropped())
+				return
+			}
+		}
+	}
+}
+
+// streamSeen records an API user's open stream as activity, so a device that only holds a stream open
+// stays online
+func streamSeen(presenceService ewserver.PresenceService, logService ewserver.LogService, c *gin.Context) {
+	apiUser, err := requestAPIUser(c)
+	if err != nil {
+		return
+	}
+
+	if err := presenceService.Seen(apiUser.ID, c.ClientIP(), c.Request.UserAgent(), time.Now().UTC()); err != nil {
+		logService.Error("error tracking presence", "error", err)
+	}
+}
+
+// requestStreams parses and validates the comma separated streams query parameter
+func requestStreams(c *gin.Context) ([]ewserver.StreamName, error) {
+	streams := make([]ewserver.StreamName, 0)
+	for _, name := range strings.Split(c.Query("streams"), ",") {
+		stream := ewserver.StreamName(strings.TrimSpace(name))
+		if !stream.Valid() {
+			return nil, ewserver.ErrInvalidStream
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+// dataObject returns the casbin object used to authorize access to a stream
+func dataObject(stream ewserver.StreamName) string {
+	return "/api/v1/data/" + string(stream)
+}
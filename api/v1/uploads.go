@@ -0,0 +1,261 @@
+package v1
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// uploadGuard tracks the sequence numbers and keys of uploads being applied, so a retry arriving
+// while the original is still being applied is not applied twice.
+type uploadGuard struct {
+	lock     sync.Mutex
+	inFlight map[string]struct{}
+}
+
+// inFlightUploads is shared by every upload route, sequence numbers are per device not per route
+var inFlightUploads = &uploadGuard{inFlight: make(map[string]struct{})}
+
+// claim marks the identifiers in flight, returning false if any already is
+func (g *uploadGuard) claim(ids []string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, id := range ids {
+		if _, ok := g.inFlight[id]; ok {
+			return false
+		}
+	}
+
+	for _, id := range ids {
+		g.inFlight[id] = struct{}{}
+	}
+	return true
+}
+
+func (g *uploadGuard) release(ids []string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, id := range ids {
+		delete(g.inFlight, id)
+	}
+}
+
+// bufferedResponse holds the body of an upload's response, so it is only sent once the upload is recorded.
+// The status is kept by the response writer underneath until the body is written.
+type bufferedResponse struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bufferedResponse) WriteHeaderNow()                      {}
+func (w *bufferedResponse) Write(data []byte) (int, error)       { return w.body.Write(data) }
+func (w *bufferedResponse) WriteString(data string) (int, error) { return w.body.WriteString(data) }
+func (w *bufferedResponse) Size() int                            { return w.body.Len() }
+func (w *bufferedResponse) Written() bool                        { return w.body.Len() > 0 }
+func (w *bufferedResponse) Flush()                               {}
+
+// idempotentUpload drops uploads the calling API user already made, identified by their sequence number
+// (SequenceHeader, in the epoch of SequenceEpochHeader) or idempotency key (IdempotencyKeyHeader), answering
+// them as successful without applying them again. Numbers too old to tell are rejected with a 409. Uploads
+// are only recorded once the handler succeeds, so failed uploads may be retried, and the handler's response
+// is held until they are so a device is never told an upload succeeded that would not be recognized when
+// retried. The response headers tell the device its high water mark and the sequence numbers it skipped.
+func idempotentUpload(uploadService ewserver.UploadService, logService ewserver.LogService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sequenceValue := c.Request.Header.Get(ewserver.SequenceHeader)
+		key := c.Request.Header.Get(ewserver.IdempotencyKeyHeader)
+		if sequenceValue == "" && key == "" {
+			c.Next()
+			return
+		}
+
+		apiUser, err := requestAPIUser(c)
+		if err != nil {
+			// the upload's handler rejects requests without an API user
+			c.Next()
+			return
+		}
+
+		var epoch, number uint64
+		if sequenceValue != "" {
+			if number, err = strconv.ParseUint(sequenceValue, 10, 64); err != nil || number == 0 {
+				respond(c, 400, gin.H{"error": ewserver.ErrInvalidSequence.Error()})
+				c.Abort()
+				return
+			}
+
+			if epochValue := c.Request.Header.Get(ewserver.SequenceEpochHeader); epochValue != "" {
+				if epoch, err = strconv.ParseUint(epochValue, 10, 64); err != nil {
+					respond(c, 400, gin.H{"error": ewserver.ErrInvalidSequence.Error()})
+					c.Abort()
+					return
+				}
+			}
+		}
+
+		if len(key) > ewserver.MaxIdempotencyKeyLength {
+			respond(c, 400, gin.H{"error": ewserver.ErrInvalidSequence.Error()})
+			c.Abort()
+			return
+		}
+
+		ids := make([]string, 0, 2)
+		if number > 0 {
+			ids = append(ids, "sequence:"+string(apiUser.ID)+":"+strconv.FormatUint(epoch, 10)+":"+sequenceValue)
+		}
+		if key != "" {
+			ids = append(ids, "key:"+string(apiUser.ID)+":"+key)
+		}
+
+		if !inFlightUploads.claim(ids) {
+			respond(c, 409, gin.H{"error": ewserver.ErrUploadInFlight.Error()})
+			c.Abort()
+			return
+		}
+		defer inFlightUploads.release(ids)
+
+		err = checkUpload(uploadService, c, apiUser, epoch, number, key)
+		switch err {
+		case nil:
+		case ewserver.ErrDuplicateUpload:
+			logService.Info("duplicate upload dropped", "api_user", apiUser.Name, "path", c.Request.URL.Path, "sequence", number, "key", key)
+			respond(c, 200, gin.H{"status": "OK", "duplicate": true})
+			c.Abort()
+			return
+		default:
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+
+		writer := c.Writer
+		buffered := &bufferedResponse{ResponseWriter: writer}
+		c.Writer = buffered
+		c.Next()
+		c.Writer = writer
+
+		if writer.Status() < 300 {
+			if err := acceptUpload(uploadService, logService, apiUser, epoch, number, key); err != nil {
+				logService.Error("error recording upload", "api_user", apiUser.Name, "sequence", number, "key", key, "error", err)
+				respond(c, 500, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		writer.WriteHeaderNow()
+		writer.Write(buffered.body.Bytes())
+	}
+}
+
+// checkUpload returns ErrDuplicateUpload if the upload was already received, or ErrStaleSequence if its
+// number is too old to tell. If it has a sequence number the high water mark and gaps there will be once
+// it is accepted are set in the response headers.
+func checkUpload(uploadService ewserver.UploadService, c *gin.Context, apiUser *ewserver.APIUser, epoch, number uint64, key string) error {
+	if number > 0 {
+		sequence, err := uploadService.Sequence(apiUser.ID)
+		if err != nil {
+			return err
+		}
+
+		err = sequence.Check(epoch, number)
+		if err == nil {
+			sequence.Accept(epoch, number, time.Now().UTC())
+		}
+
+		c.Header(ewserver.SequenceHighWaterHeader, strconv.FormatUint(sequence.HighWater, 10))
+		if len(sequence.Gaps) > 0 {
+			c.Header(ewserver.SequenceGapsHeader, formatGaps(sequence.Gaps))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if key != "" {
+		seen, err := uploadService.KeySeen(apiUser.ID, key)
+		if err != nil {
+			return err
+		}
+
+		if seen {
+			return ewserver.ErrDuplicateUpload
+		}
+	}
+	return nil
+}
+
+// acceptUpload records the upload's sequence number and key as received
+func acceptUpload(uploadService ewserver.UploadService, logService ewserver.LogService, apiUser *ewserver.APIUser, epoch, number uint64, key string) error {
+	if number > 0 {
+		sequence, err := uploadService.AcceptSequence(apiUser.ID, epoch, number)
+		if err != nil {
+			return err
+		}
+
+		if len(sequence.Gaps) > 0 && number == sequence.HighWater {
+			logService.Info("upload sequence gaps", "api_user", apiUser.Name, "high_water", sequence.HighWater, "gaps", formatGaps(sequence.Gaps))
+		}
+	}
+
+	if key != "" {
+		return uploadService.AcceptKey(apiUser.ID, key, time.Now().UTC())
+	}
+	return nil
+}
+
+// formatGaps formats the gaps as comma separated ranges, like 3-5,9-9
+func formatGaps(gaps []*ewserver.SequenceGap) string {
+	ranges := make([]string, 0, len(gaps))
+	for _, gap := range gaps {
+		ranges = append(ranges, strconv.FormatUint(gap.From, 10)+"-"+strconv.FormatUint(gap.To, 10))
+	}
+	return strings.Join(ranges, ",")
+}
+
+// UploadSequence returns the upload sequence of the calling API user, or of the device given in the
+// device query parameter for other users, with the gaps of sequence numbers never received.
+func UploadSequence(apiUserService ewserver.APIUserService, uploadService ewserver.UploadService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		sequence, err := uploadService.Sequence(deviceID)
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "sequence": sequence})
+	}
+}
+
+// AdminResetUploadSequence forgets the upload sequence of the device given in the device query parameter,
+// such as after it was factory reset and starts counting again.
+func AdminResetUploadSequence(apiUserService ewserver.APIUserService, uploadService ewserver.UploadService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceID, err := requestDeviceID(apiUserService, c)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := uploadService.ResetSequence(deviceID); err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("upload sequence reset", "device", c.Query("device"), "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
@@ -16,6 +16,6 @@ func UserProfile(userService ewserver.UserService, e *gin.Engine) gin.HandlerFun
 			return
 		}
 
-		c.JSON(200, gin.H{"status": "OK", "user": user})
+		respond(c, 200, gin.H{"status": "OK", "user": user})
 	}
 }
@@ -0,0 +1,116 @@
+package v1
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// AdminListWebhooks returns all webhook subscriptions without their secrets
+func AdminListWebhooks(webhookService ewserver.WebhookService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subscriptions, err := webhookService.Subscriptions()
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, subscription := range subscriptions {
+			subscription.Secret = ""
+		}
+		respond(c, 200, gin.H{"status": "OK", "webhooks": subscriptions})
+	}
+}
+
+// AdminCreateWebhook subscribes a URL to system events. The signing secret is generated unless one is given
+// and is only returned here.
+func AdminCreateWebhook(webhookService ewserver.WebhookService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	type webhookRequest struct {
+		URL    string                      `json:"url"`
+		Secret string                      `json:"secret"`
+		Events []ewserver.WebhookEventType `json:"events"`
+	}
+
+	return func(c *gin.Context) {
+		request := &webhookRequest{}
+		if err := bind(c, request); err != nil {
+			respond(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		subscription := ewserver.NewWebhookSubscription()
+		subscription.URL, subscription.Secret, subscription.Events = request.URL, request.Secret, request.Events
+		subscription.CreatedBy = string(sessionUserName(c))
+
+		if err := webhookService.Create(subscription); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("webhook created", "webhook", subscription.ID, "url", subscription.URL, "created_by", subscription.CreatedBy)
+		respond(c, 200, gin.H{"status": "OK", "webhook": subscription})
+	}
+}
+
+// AdminDeleteWebhook deletes the subscription, its pending deliveries are dead lettered
+func AdminDeleteWebhook(webhookService ewserver.WebhookService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			respond(c, 404, gin.H{"error": ewserver.ErrWebhookNotFound.Error()})
+			return
+		}
+
+		if err := webhookService.Delete(id); err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("webhook deleted", "webhook", id, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK"})
+	}
+}
+
+// AdminWebhookDeliveries returns the delivery log, filtered by the webhook (ID) and state
+// (pending, delivered or dead) query parameters if they are set.
+func AdminWebhookDeliveries(webhookService ewserver.WebhookService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var subscriptionID uint64
+		if value := c.Query("webhook"); value != "" {
+			var err error
+			if subscriptionID, err = strconv.ParseUint(value, 10, 64); err != nil {
+				respond(c, 400, gin.H{"error": ewserver.ErrInvalidQuery.Error()})
+				return
+			}
+		}
+
+		deliveries, err := webhookService.Deliveries(subscriptionID, ewserver.WebhookDeliveryState(c.Query("state")))
+		if err != nil {
+			respond(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		respond(c, 200, gin.H{"status": "OK", "deliveries": deliveries})
+	}
+}
+
+// AdminRetryWebhookDelivery requeues a dead delivery for an immediate attempt
+func AdminRetryWebhookDelivery(webhookService ewserver.WebhookService, logService ewserver.LogService, e *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			respond(c, 404, gin.H{"error": ewserver.ErrDeliveryNotFound.Error()})
+			return
+		}
+
+		delivery, err := webhookService.Retry(id)
+		if err != nil {
+			respond(c, errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		logService.Info("webhook delivery retried", "delivery", id, "user", string(sessionUserName(c)))
+		respond(c, 200, gin.H{"status": "OK", "delivery": delivery})
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/wirepair/bolt-adapter"
@@ -19,8 +23,17 @@ import (
 	"github.com/wirepair/ewserver/api/v1/middleware"
 	"github.com/wirepair/ewserver/ewserver"
 	"github.com/wirepair/ewserver/internal/authz/casbinauth"
+	"github.com/wirepair/ewserver/internal/bulk"
+	"github.com/wirepair/ewserver/internal/coap"
+	"github.com/wirepair/ewserver/internal/device"
+	"github.com/wirepair/ewserver/internal/hub"
 	"github.com/wirepair/ewserver/internal/logger"
+	"github.com/wirepair/ewserver/internal/mqtt"
+	"github.com/wirepair/ewserver/internal/presence"
+	"github.com/wirepair/ewserver/internal/ratelimit"
+	"github.com/wirepair/ewserver/internal/rules"
 	"github.com/wirepair/ewserver/internal/session/scssession"
+	"github.com/wirepair/ewserver/internal/webhook"
 	"github.com/wirepair/ewserver/store/boltdb"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -53,6 +66,88 @@ func main() {
 	if err := apiUserService.Init(); err != nil {
 		log.Fatalf("error initializing APIUserService: %s\n", err)
 	}
+
+	telemetryService := boltdb.NewTelemetryService(db.DB())
+	telemetryService.BatchSize = serverConfig.BatchChunkSize
+	if err := telemetryService.Init(); err != nil {
+		log.Fatalf("error initializing TelemetryService: %s\n", err)
+	}
+
+	commandService := boltdb.NewCommandService(db.DB())
+	if err := commandService.Init(); err != nil {
+		log.Fatalf("error initializing CommandService: %s\n", err)
+	}
+
+	firmwareService := boltdb.NewFirmwareService(db.DB(), serverConfig.FirmwareDir)
+	if err := firmwareService.Init(); err != nil {
+		log.Fatalf("error initializing FirmwareService: %s\n", err)
+	}
+
+	shadowService := boltdb.NewShadowService(db.DB())
+	if err := shadowService.Init(); err != nil {
+		log.Fatalf("error initializing ShadowService: %s\n", err)
+	}
+
+	retentionService := boltdb.NewRetentionService(db.DB())
+	if err := retentionService.Init(); err != nil {
+		log.Fatalf("error initializing RetentionService: %s\n", err)
+	}
+
+	ruleService := boltdb.NewRuleService(db.DB())
+	if err := ruleService.Init(); err != nil {
+		log.Fatalf("error initializing RuleService: %s\n", err)
+	}
+
+	webhookService := boltdb.NewWebhookService(db.DB())
+	if err := webhookService.Init(); err != nil {
+		log.Fatalf("error initializing WebhookService: %s\n", err)
+	}
+
+	presenceService := boltdb.NewPresenceService(db.DB())
+	if err := presenceService.Init(); err != nil {
+		log.Fatalf("error initializing PresenceService: %s\n", err)
+	}
+
+	enrollmentService := boltdb.NewEnrollmentService(db.DB())
+	if err := enrollmentService.Init(); err != nil {
+		log.Fatalf("error initializing EnrollmentService: %s\n", err)
+	}
+
+	certificateService := boltdb.NewCertificateService(db.DB(), serverConfig.Host)
+	if err := certificateService.Init(); err != nil {
+		log.Fatalf("error initializing CertificateService: %s\n", err)
+	}
+
+	rateLimitService := boltdb.NewRateLimitService(db.DB())
+	if err := rateLimitService.Init(); err != nil {
+		log.Fatalf("error initializing RateLimitService: %s\n", err)
+	}
+
+	groupService := boltdb.NewGroupService(db.DB())
+	if err := groupService.Init(); err != nil {
+		log.Fatalf("error initializing GroupService: %s\n", err)
+	}
+
+	bulkJobService := boltdb.NewBulkJobService(db.DB())
+	if err := bulkJobService.Init(); err != nil {
+		log.Fatalf("error initializing BulkJobService: %s\n", err)
+	}
+
+	uploadService := boltdb.NewUploadService(db.DB())
+	if err := uploadService.Init(); err != nil {
+		log.Fatalf("error initializing UploadService: %s\n", err)
+	}
+
+	blobService := boltdb.NewBlobService(db.DB(), serverConfig.BlobDir)
+	if err := blobService.Init(); err != nil {
+		log.Fatalf("error initializing BlobService: %s\n", err)
+	}
+
+	deviceLogService := boltdb.NewDeviceLogService(db.DB(), serverConfig.DeviceLogEntries)
+	if err := deviceLogService.Init(); err != nil {
+		log.Fatalf("error initializing DeviceLogService: %s\n", err)
+	}
+
 	// initialize logging
 	logService := logger.New(os.Stdout)
 
@@ -68,15 +163,91 @@ func main() {
 
 	roleService := casbinauth.NewRoleService(enforcer)
 	services := ewserver.NewServices(userService, apiUserService, roleService, logService)
+	services.FirmwareService = firmwareService
+	services.RetentionService = retentionService
+	services.StorageService = db
+	services.EnrollmentService = enrollmentService
+	services.CertificateService = certificateService
+	go applyRetention(retentionService, logService)
+
+	// publish ingested points to live stream subscribers
+	eventHub := hub.New(hub.DefaultBufferSize, hub.DefaultReplaySize)
+	// deliver admin, login and alert events to webhook subscriptions
+	dispatcher := webhook.New(webhookService, eventHub, logService)
+	services.EventService = dispatcher
+	services.WebhookService = webhookService
+	go dispatcher.Run()
+	services.CommandService = hub.NewCommandService(commandService, eventHub)
+	go expireCommands(commandService, commandRetention(serverConfig), logService)
+	// evaluate rules against points after they are stored and published
+	ruleEngine := rules.New(hub.NewTelemetryService(telemetryService, eventHub), ruleService, services.CommandService, dispatcher, logService)
+	services.RuleService = rules.NewRuleService(ruleEngine)
+	services.TelemetryService = ruleEngine
+	services.ShadowService = hub.NewShadowService(shadowService, eventHub)
+	// coalesce device activity and publish online/offline changes
+	presenceTracker, err := presence.New(presenceService, eventHub, presenceTimeout(serverConfig), logService)
+	if err != nil {
+		log.Fatalf("error loading presence: %s\n", err)
+	}
+	services.PresenceService = presenceTracker
+	go presenceTracker.Run(presence.FlushInterval)
+	// limit requests per address and identity with buckets in memory
+	limiter, err := ratelimit.New(rateLimitService, roleService, serverConfig.PersistRateLimits, logService)
+	if err != nil {
+		log.Fatalf("error loading rate limits: %s\n", err)
+	}
+	services.RateLimitService = limiter
+	go limiter.Run(ratelimit.FlushInterval)
+	// drop retried device uploads by their sequence number or idempotency key
+	services.UploadService = uploadService
+	go expireUploadKeys(uploadService, logService)
+	// store files devices upload in resumable chunks
+	services.BlobService = blobService
+	go expireBlobs(blobService, blobTTL(serverConfig), logService)
+	// keep the latest log entries of each device and publish them to tails
+	services.DeviceLogEvents = hub.New(hub.DeviceLogBufferSize, hub.DeviceLogReplaySize)
+	services.DeviceLogService = hub.NewDeviceLogService(deviceLogService, services.DeviceLogEvents)
+	// delete API users with their roles and everything stored for their device
+	services.DeviceRemover = device.New(apiUserService, roleService, services.CommandService, services.ShadowService, services.PresenceService, uploadService, certificateService, services.DeviceLogService, blobService, logService)
+	// run actions on every device of a group as tracked jobs
+	services.GroupService = groupService
+	services.BulkJobService = bulkJobService
+	bulkRunner, err := bulk.New(bulkJobService, groupService, roleService, apiUserService, services.CommandService, firmwareService, services.DeviceRemover, logService)
+	if err != nil {
+		log.Fatalf("error loading bulk jobs: %s\n", err)
+	}
+	services.BulkJobRunner = bulkRunner
 
 	// setup server
 	e := gin.Default()
+	// client addresses are only taken from forwarded headers set by our own proxies
+	e.ForwardedByClientIP = false
 
 	if debug {
 		gin.SetMode(gin.DebugMode)
 		// allow admin access to everything
 		enforcer.AddPolicy("admin", "/", ".*")
 		enforcer.AddPolicy("apiuser", "/api/v1/:", ".*")
+		enforcer.AddPolicy("apiuser", "/api/v1/data/:stream", "(GET|POST)")
+		enforcer.AddPolicy("apiuser", "^/api/v1/data$", "POST")
+		enforcer.AddPolicy("apiuser", "/api/v1/data/:stream/export", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/stream/ws$", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/events$", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/commands$", "GET")
+		enforcer.AddPolicy("apiuser", "/api/v1/commands/:command/ack", "POST")
+		enforcer.AddPolicy("apiuser", "^/api/v1/firmware/(check|key)$", "GET")
+		enforcer.AddPolicy("apiuser", "/api/v1/firmware/download/:version", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/firmware/status$", "POST")
+		enforcer.AddPolicy("apiuser", "^/api/v1/shadow(/delta)?$", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/shadow/reported$", "POST")
+		enforcer.AddPolicy("apiuser", "^/api/v1/certificates/renew$", "POST")
+		enforcer.AddPolicy("apiuser", "^/api/v1/pki/(ca|crl)$", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/uploads/sequence$", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/blobs/(create|finalize/[0-9a-f]+)$", "POST")
+		enforcer.AddPolicy("apiuser", "/api/v1/blobs/upload/:id", "(GET|PUT)")
+		enforcer.AddPolicy("apiuser", "/api/v1/blobs/download/:id", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/blobs/list$", "GET")
+		enforcer.AddPolicy("apiuser", "^/api/v1/logs$", "POST")
 		// only allow anonymous to access the top folder
 		enforcer.AddPolicy("anonymous", "/:", "(GET|POST)")
 		// add root to the admin role
@@ -86,32 +257,231 @@ func main() {
 		userService.Create(root, "password")
 	}
 
-	e.Use(middleware.EnsureSession(sessions), middleware.Require(authorizer))
+	// limit every route by address, including login and enrollment
+	e.Use(middleware.TrustProxies(trustedProxies(serverConfig)), middleware.LimitAddress(limiter))
 
-	v1.RegisterAuthnRoutes(userService, logService, e)
+	// devices enrolling only have their token, register before sessions and authorization are required
+	v1.RegisterEnrollmentRoutes(services, e)
+
+	e.Use(middleware.EnsureSession(sessions), middleware.Require(authorizer), middleware.LimitIdentity(limiter, sessions, logService), middleware.TrackPresence(presenceTracker, logService))
+
+	v1.RegisterAuthnRoutes(userService, services.EventService, logService, e)
 	v1.RegisterAdminRoutes(services, e)
 	v1.RegisterUserRoutes(services, e)
+	v1.RegisterDataRoutes(services, e)
+	v1.RegisterStreamRoutes(services, authorizer, e)
+	v1.RegisterCommandRoutes(services, e)
+	v1.RegisterUploadRoutes(services, e)
+	v1.RegisterBlobRoutes(services, e)
+	v1.RegisterDeviceLogRoutes(services, e)
+	v1.RegisterFirmwareRoutes(services, externalURL(serverConfig), e)
+	v1.RegisterShadowRoutes(services, e)
+	v1.RegisterCertificateRoutes(services, e)
+
+	if serverConfig.MQTTAddr != "" {
+		mqttServer := mqtt.New(apiUserService, services.TelemetryService, eventHub, services.PresenceService, authorizer, logService)
+		go func() { log.Fatal(mqttServer.ListenAndServe(serverConfig.MQTTAddr)) }()
+	}
+
+	if serverConfig.CoAPAddr != "" {
+		coapServer := coap.New(apiUserService, services.TelemetryService, eventHub, services.PresenceService, authorizer, logService)
+		go func() { log.Fatal(coapServer.ListenAndServe(serverConfig.CoAPAddr)) }()
+	}
 
 	if serverConfig.EnableHTTPS {
-		go log.Fatal(runWithManager(e, serverConfig))
+		go func() { log.Fatal(runWithManager(e, serverConfig, certificateService)) }()
 	}
 
 	log.Fatal(e.Run(serverConfig.HTTPAddr))
 }
 
-// runWithManager starts an https server with lets encrypt / acme support.
+// applyRetention periodically rolls up and deletes data according to the retention policies
+func applyRetention(retentionService ewserver.RetentionService, logService ewserver.LogService) {
+	for range time.Tick(time.Minute) {
+		run, err := retentionService.Apply(time.Now().UTC())
+		if err != nil {
+			logService.Error("error applying retention", "error", err)
+			continue
+		}
+
+		if run.RolledUp > 0 || run.Deleted > 0 {
+			logService.Info("retention applied", "streams", run.Streams, "rolled_up", run.RolledUp, "deleted", run.Deleted)
+		}
+	}
+}
+
+// expireCommands periodically expires commands whose TTL passed so their state is accurate
+// even for devices that never fetch them, and deletes finished commands older than retention.
+func expireCommands(commandService ewserver.CommandService, retention time.Duration, logService ewserver.LogService) {
+	for range time.Tick(time.Minute) {
+		if expired, err := commandService.Expire(); err != nil {
+			logService.Error("error expiring commands", "error", err)
+		} else if expired > 0 {
+			logService.Info("commands expired", "count", expired)
+		}
+
+		if pruned, err := commandService.Prune(time.Now().UTC().Add(-retention)); err != nil {
+			logService.Error("error pruning commands", "error", err)
+		} else if pruned > 0 {
+			logService.Info("commands pruned", "count", pruned)
+		}
+	}
+}
+
+// expireUploadKeys periodically forgets idempotency keys older than ewserver.IdempotencyKeyTTL
+func expireUploadKeys(uploadService ewserver.UploadService, logService ewserver.LogService) {
+	for range time.Tick(time.Hour) {
+		expired, err := uploadService.ExpireKeys(time.Now().UTC().Add(-ewserver.IdempotencyKeyTTL))
+		if err != nil {
+			logService.Error("error expiring upload keys", "error", err)
+			continue
+		}
+
+		if expired > 0 {
+			logService.Info("upload keys expired", "count", expired)
+		}
+	}
+}
+
+// expireBlobs periodically deletes blob uploads abandoned for longer than ewserver.BlobUploadTTL and
+// complete blobs older than ttl
+func expireBlobs(blobService ewserver.BlobService, ttl time.Duration, logService ewserver.LogService) {
+	for range time.Tick(time.Hour) {
+		now := time.Now().UTC()
+		if expired, err := blobService.ExpireUploads(now.Add(-ewserver.BlobUploadTTL)); err != nil {
+			logService.Error("error expiring blob uploads", "error", err)
+		} else if expired > 0 {
+			logService.Info("blob uploads expired", "count", expired)
+		}
+
+		if expired, err := blobService.ExpireComplete(now.Add(-ttl)); err != nil {
+			logService.Error("error expiring blobs", "error", err)
+		} else if expired > 0 {
+			logService.Info("blobs expired", "count", expired)
+		}
+	}
+}
+
+// blobTTL returns how long complete blobs are kept as configured, or the default if it is not set
+func blobTTL(serverConfig *ServerConfig) time.Duration {
+	if serverConfig.BlobTTL == "" {
+		return ewserver.DefaultBlobTTL
+	}
+
+	ttl, err := ewserver.ParseDuration(serverConfig.BlobTTL)
+	if err != nil || ttl <= 0 {
+		log.Fatalf("invalid blob_ttl: %s\n", serverConfig.BlobTTL)
+	}
+	return ttl
+}
+
+// commandRetention returns how long finished commands are kept as configured, or the default if it is not set
+func commandRetention(serverConfig *ServerConfig) time.Duration {
+	if serverConfig.CommandRetention == "" {
+		return ewserver.DefaultCommandRetention
+	}
+
+	retention, err := ewserver.ParseDuration(serverConfig.CommandRetention)
+	if err != nil || retention <= 0 {
+		log.Fatalf("invalid command_retention: %s\n", serverConfig.CommandRetention)
+	}
+	return retention
+}
+
+// externalURL returns the configured URL devices reach the server on without a trailing slash, or if it
+// is not set one on the configured host and the port of the https or http address.
+func externalURL(serverConfig *ServerConfig) string {
+	if serverConfig.ExternalURL != "" {
+		external, err := url.Parse(serverConfig.ExternalURL)
+		if err != nil || (external.Scheme != "http" && external.Scheme != "https") || external.Host == "" {
+			log.Fatalf("invalid external_url: %s\n", serverConfig.ExternalURL)
+		}
+		return strings.TrimRight(serverConfig.ExternalURL, "/")
+	}
+
+	scheme, addr, defaultPort := "http", serverConfig.HTTPAddr, "80"
+	if serverConfig.EnableHTTPS {
+		scheme, addr, defaultPort = "https", serverConfig.HTTPSAddr, "443"
+	}
+
+	host := serverConfig.Host
+	if _, port, err := net.SplitHostPort(addr); err == nil && port != "" && port != defaultPort {
+		host = net.JoinHostPort(host, port)
+	}
+	return scheme + "://" + host
+}
+
+// presenceTimeout returns the configured heartbeat timeout, or the default if it is not set
+func presenceTimeout(serverConfig *ServerConfig) time.Duration {
+	if serverConfig.PresenceTimeout == "" {
+		return ewserver.DefaultPresenceTimeout
+	}
+
+	timeout, err := ewserver.ParseDuration(serverConfig.PresenceTimeout)
+	if err != nil || timeout <= 0 {
+		log.Fatalf("invalid presence_timeout: %s\n", serverConfig.PresenceTimeout)
+	}
+	return timeout
+}
+
+// trustedProxies parses the configured reverse proxy addresses, single addresses are treated as a /32 or /128
+func trustedProxies(serverConfig *ServerConfig) []*net.IPNet {
+	proxies := make([]*net.IPNet, 0, len(serverConfig.TrustedProxies))
+	for _, proxy := range serverConfig.TrustedProxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip)
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Fatalf("invalid trusted_proxies address: %s\n", proxy)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// runWithManager starts an https server with lets encrypt / acme support, or the configured certificate.
+// Devices may authenticate with a client certificate issued by our CA, which is checked for revocation
+// on each handshake.
 // Note TLS port *must* be 443 if lets encrypt.
-func runWithManager(e *gin.Engine, serverConfig *ServerConfig) error {
-	m := autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(serverConfig.Host),
-		Cache:      autocert.DirCache(serverConfig.CacheDir),
+func runWithManager(e *gin.Engine, serverConfig *ServerConfig, certificateService ewserver.CertificateService) error {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(certificateService.CA())
+
+	tlsConfig := &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  clientCAs,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				revoked, err := certificateService.Revoked(chain[0].SerialNumber)
+				if err != nil {
+					return err
+				}
+
+				if revoked {
+					return ewserver.ErrCertRevoked
+				}
+			}
+			return nil
+		},
+	}
+
+	if serverConfig.UseLetsEncrypt {
+		m := autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(serverConfig.Host),
+			Cache:      autocert.DirCache(serverConfig.CacheDir),
+		}
+		tlsConfig.GetCertificate = m.GetCertificate
 	}
 
 	s := &http.Server{
 		Addr:      serverConfig.HTTPSAddr,
-		TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
+		TLSConfig: tlsConfig,
 		Handler:   e,
 	}
-	return s.ListenAndServeTLS("", "")
+	return s.ListenAndServeTLS(serverConfig.TLSCertFile, serverConfig.TLSKeyFile)
 }
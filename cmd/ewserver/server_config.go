@@ -11,14 +11,28 @@ import (
 
 // ServerConfig holds various configuration data for the top level service
 type ServerConfig struct {
-	CacheDir       string        `json:"cache_dir"`       // for lets encrypt
-	StoreConfig    *store.Config `json:"store_config"`    // the store configuration options
-	Host           string        `json:"host"`            // Our hostname or IP address
-	AuthPolicyPath string        `json:"auth_policy"`     // path to our authorization policy
-	UseLetsEncrypt bool          `json:"use_letsencrypt"` // use lets encrypt based TLS.
-	EnableHTTPS    bool          `json:"enable_https"`    // if we want to enable https + letsencrypt
-	HTTPAddr       string        `json:"http_addr"`       // the http address to bind to, like :8080
-	HTTPSAddr      string        `json:"https_addr"`      // the https address to bind to, like :8443
+	CacheDir          string        `json:"cache_dir"`           // for lets encrypt
+	StoreConfig       *store.Config `json:"store_config"`        // the store configuration options
+	Host              string        `json:"host"`                // Our hostname or IP address
+	ExternalURL       string        `json:"external_url"`        // the URL devices reach us on, like https://ewserver.example.com, empty to use host
+	AuthPolicyPath    string        `json:"auth_policy"`         // path to our authorization policy
+	UseLetsEncrypt    bool          `json:"use_letsencrypt"`     // use lets encrypt based TLS.
+	EnableHTTPS       bool          `json:"enable_https"`        // if we want to enable https + letsencrypt
+	TLSCertFile       string        `json:"tls_cert"`            // the certificate https uses if not lets encrypt
+	TLSKeyFile        string        `json:"tls_key"`             // the key of the https certificate if not lets encrypt
+	HTTPAddr          string        `json:"http_addr"`           // the http address to bind to, like :8080
+	HTTPSAddr         string        `json:"https_addr"`          // the https address to bind to, like :8443
+	MQTTAddr          string        `json:"mqtt_addr"`           // the mqtt address to bind to, like :1883, empty to disable
+	CoAPAddr          string        `json:"coap_addr"`           // the coap (udp) address to bind to, like :5683, empty to disable
+	PresenceTimeout   string        `json:"presence_timeout"`    // how long until an unseen device is offline, like 5m, 300 or 1d
+	PersistRateLimits bool          `json:"persist_rate_limits"` // save rate limit buckets so restarts do not reset them
+	BatchChunkSize    int           `json:"batch_chunk_size"`    // points of a batch written per transaction, 0 for the whole batch
+	BlobDir           string        `json:"blob_dir"`            // where uploaded blobs are stored, empty for blobs next to the database
+	BlobTTL           string        `json:"blob_ttl"`            // how long complete blobs are kept, like 30d, empty for the default of 30 days
+	FirmwareDir       string        `json:"firmware_dir"`        // where firmware images are stored, empty for images next to the database
+	CommandRetention  string        `json:"command_retention"`   // how long finished commands are kept, like 90d, empty for the default of 90 days
+	DeviceLogEntries  int           `json:"device_log_entries"`  // log entries kept per device, 0 for the default of 10000
+	TrustedProxies    []string      `json:"trusted_proxies"`     // addresses or CIDRs of reverse proxies whose X-Forwarded-For is used
 }
 
 // ReadServerConfig reads the server config from a json file.
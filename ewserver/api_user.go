@@ -3,11 +3,15 @@ package ewserver
 import (
 	"bytes"
 	"encoding/gob"
+	"strings"
 )
 
 // APIKeyHeader is the name of the api key required for API requests
 const APIKeyHeader = "x-api-key"
 
+// APIUserContextKey is the key the API user that made a request is stored under once it is authorized
+const APIUserContextKey = "apiuser"
+
 // APIKey represents an API Key
 type APIKey string
 
@@ -16,12 +20,16 @@ func (k APIKey) Bytes() []byte {
 	return []byte(k)
 }
 
-// APIUser represents an api user
+// APIUser represents an api user, Metadata and Tags describe the device for searching. Disabled
+// API users are denied access until they are enabled.
 type APIUser struct {
 	Key         APIKey
 	Name        string
 	ID          []byte
 	LastAddress string
+	Metadata    map[string]string
+	Tags        []string
+	Disabled    bool
 }
 
 // NewAPIUser from bytes
@@ -29,6 +37,23 @@ func NewAPIUser() *APIUser {
 	return &APIUser{}
 }
 
+// ValidAttributes returns ErrInvalidMetadata if a metadata key or tag is empty, or any of them
+// contain a NUL byte which separates values in the search index.
+func (a *APIUser) ValidAttributes() error {
+	for key, value := range a.Metadata {
+		if key == "" || strings.ContainsRune(key, 0) || strings.ContainsRune(value, 0) {
+			return ErrInvalidMetadata
+		}
+	}
+
+	for _, tag := range a.Tags {
+		if tag == "" || strings.ContainsRune(tag, 0) {
+			return ErrInvalidMetadata
+		}
+	}
+	return nil
+}
+
 // Encode encodes the APIUser to a slice of bytes
 func (a *APIUser) Encode() ([]byte, error) {
 	var buf bytes.Buffer
@@ -56,5 +81,15 @@ type APIUserService interface {
 	APIUser(Key APIKey) (*APIUser, error)
 	APIUserByID(ID []byte) (*APIUser, error)
 	APIUsers() ([]*APIUser, error)
+	ForEachAPIUser(fn func(*APIUser) error) error  // ForEachAPIUser calls fn with every API user from a single read, stopping at the first error
+	Update(u *APIUser) error                       // Update replaces the stored API user with the same key, such as its metadata and tags
+	RotateKey(u *APIUser, key APIKey) error        // RotateKey replaces the API user's key, the old key stops working
+	SetDisabled(Key APIKey, disabled bool) error   // SetDisabled changes only whether the API user is disabled
+	Search(query *DeviceQuery) ([]*APIUser, error) // Search returns the API users matching the query using the attribute index
 	Delete(Key APIKey) error
 }
+
+// DeviceRemover deletes API users together with their roles, permissions and everything stored for their device
+type DeviceRemover interface {
+	Remove(apiUser *APIUser) error // Remove the API user, if a step fails its roles and permissions are restored and it is enabled again
+}
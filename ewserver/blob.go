@@ -0,0 +1,102 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	// MaxBlobSize limits the size of a blob uploaded by a device
+	MaxBlobSize = 256 * 1024 * 1024
+	// MaxBlobChunkSize limits the size of each chunk of a blob upload
+	MaxBlobChunkSize = 8 * 1024 * 1024
+	// BlobUploadTTL is how long an upload may go without a chunk before it is deleted
+	BlobUploadTTL = 7 * 24 * time.Hour
+	// DefaultBlobTTL is how long a complete blob is kept if no other time is configured
+	DefaultBlobTTL = 30 * 24 * time.Hour
+	// MaxBlobUploads limits how many uploads a device may have in progress
+	MaxBlobUploads = 8
+	// MaxDeviceBlobBytes limits the total size of a device's blobs, complete or not
+	MaxDeviceBlobBytes = 4 * MaxBlobSize
+)
+
+var (
+	blobNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	blobIDPattern   = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// ValidBlobID returns true if the ID is one generated for a blob, so it is safe to use as a file name
+func ValidBlobID(id string) bool {
+	return blobIDPattern.MatchString(id)
+}
+
+// BlobState is the state of a blob upload
+type BlobState string
+
+const (
+	// BlobUploading blobs are receiving chunks, Offset bytes of them are committed
+	BlobUploading BlobState = "uploading"
+	// BlobComplete blobs were finalized with a matching SHA-256 and may be downloaded
+	BlobComplete BlobState = "complete"
+)
+
+// Blob is a file, such as an image or log archive, uploaded by a device in chunks. Offset is how
+// many bytes are committed, the next chunk continues from there.
+type Blob struct {
+	ID          string    `json:"id"`
+	DeviceID    []byte    `json:"device_id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Offset      int64     `json:"offset"`
+	SHA256      string    `json:"sha256,omitempty"` // hex encoded SHA-256, set once complete
+	State       BlobState `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// Valid returns ErrInvalidBlob if the name is not a safe file name or the size is not between 1 and MaxBlobSize
+func (b *Blob) Valid() error {
+	if !blobNamePattern.MatchString(b.Name) || b.Size <= 0 || b.Size > MaxBlobSize || len(b.ContentType) > 128 {
+		return ErrInvalidBlob
+	}
+	return nil
+}
+
+// Encode the Blob into a gob of bytes.
+func (b *Blob) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBlob from bytes using gob decoder and return a Blob.
+func DecodeBlob(blobBytes []byte) (*Blob, error) {
+	buf := bytes.NewBuffer(blobBytes)
+	dec := gob.NewDecoder(buf)
+	b := &Blob{}
+	err := dec.Decode(b)
+	return b, err
+}
+
+// BlobService stores blobs uploaded by devices in chunks, so uploads over unreliable links resume
+// from the committed offset instead of starting over.
+type BlobService interface {
+	Init() error                                                     // Init the blob service (prepare the tables/bucket and directory)
+	Create(blob *Blob) error                                         // Create starts an upload, assigning the blob's ID, ErrBlobQuota if the device has too many uploads or bytes
+	Blob(id string) (*Blob, error)                                   // Blob returns a single blob
+	Blobs(deviceID []byte) ([]*Blob, error)                          // Blobs returns the device's blobs newest first, all devices' if deviceID is nil
+	WriteChunk(id string, offset int64, chunk []byte) (*Blob, error) // WriteChunk commits the chunk at offset, ErrBlobOffset if offset is past the committed offset
+	Finalize(id string, sha256 string) (*Blob, error)                // Finalize completes the upload if the SHA-256 matches, otherwise resets it with ErrBlobChecksum
+	Open(id string) (*Blob, *os.File, error)                         // Open returns a complete blob's file for reading, the caller closes it
+	Delete(id string) error                                          // Delete the blob and its file
+	ExpireUploads(before time.Time) (int, error)                     // ExpireUploads deletes uploads without a chunk since before, returning how many
+	ExpireComplete(before time.Time) (int, error)                    // ExpireComplete deletes blobs completed before before, returning how many
+}
@@ -0,0 +1,104 @@
+package ewserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/gob"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCertificateValidity is how long device certificates are valid if no validity is given
+	DefaultCertificateValidity = 365 * 24 * time.Hour
+	// CertificateTrustDomain is the host of the SPIFFE-style URIs identifying devices in their certificates
+	CertificateTrustDomain = "ewserver"
+
+	deviceIdentityPath = "/device/"
+)
+
+// DeviceCertificate is a client certificate issued to a device by the server's CA. Certificate is
+// PEM encoded, PrivateKey is only set when the server generated the key and is never stored.
+type DeviceCertificate struct {
+	Serial      string    `json:"serial"`
+	DeviceID    []byte    `json:"device_id"`
+	Subject     string    `json:"subject"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Revoked     bool      `json:"revoked"`
+	RevokedAt   time.Time `json:"revoked_at,omitempty"`
+	RenewedFrom string    `json:"renewed_from,omitempty"`
+	CreatedBy   string    `json:"created_by"`
+	Certificate []byte    `json:"certificate"`
+	PrivateKey  []byte    `json:"private_key,omitempty"`
+}
+
+// Encode the DeviceCertificate into a gob of bytes, without the private key.
+func (d *DeviceCertificate) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	stored := *d
+	stored.PrivateKey = nil
+	if err := enc.Encode(&stored); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeDeviceCertificate from bytes using gob decoder and return a DeviceCertificate.
+func DecodeDeviceCertificate(certificateBytes []byte) (*DeviceCertificate, error) {
+	buf := bytes.NewBuffer(certificateBytes)
+	dec := gob.NewDecoder(buf)
+	d := &DeviceCertificate{}
+	err := dec.Decode(d)
+	return d, err
+}
+
+// DeviceIdentity returns the SPIFFE-style URI identifying the device in its certificates,
+// spiffe://ewserver/device/<url safe base64 device id>
+func DeviceIdentity(deviceID []byte) *url.URL {
+	return &url.URL{Scheme: "spiffe", Host: CertificateTrustDomain, Path: deviceIdentityPath + base64.RawURLEncoding.EncodeToString(deviceID)}
+}
+
+// CertificateDeviceID returns the ID of the device identified by the certificate's URI SANs
+func CertificateDeviceID(cert *x509.Certificate) ([]byte, bool) {
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" || uri.Host != CertificateTrustDomain || !strings.HasPrefix(uri.Path, deviceIdentityPath) {
+			continue
+		}
+
+		deviceID, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(uri.Path, deviceIdentityPath))
+		if err == nil && len(deviceID) > 0 {
+			return deviceID, true
+		}
+	}
+	return nil, false
+}
+
+// PeerDeviceID returns the ID of the device that authenticated the request with a client certificate
+// the TLS handshake verified.
+func PeerDeviceID(r *http.Request) ([]byte, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return CertificateDeviceID(r.TLS.VerifiedChains[0][0])
+}
+
+// CertificateService is the CA issuing, renewing and revoking device certificates
+type CertificateService interface {
+	Init() error                                                                                              // Init the certificate service (prepare the tables/bucket and CA)
+	CA() *x509.Certificate                                                                                    // CA certificate device certificates are issued by
+	Issue(apiUser *APIUser, csr []byte, validity time.Duration, createdBy string) (*DeviceCertificate, error) // Issue a certificate for the PEM CSR's key, or a generated key if csr is empty
+	Renew(serial string, csr []byte, validity time.Duration, createdBy string) (*DeviceCertificate, error)    // Renew issues a new certificate for the same device, reusing its key if csr is empty
+	Revoke(serial string, at time.Time) (*DeviceCertificate, error)                                           // Revoke the certificate so it is rejected and listed in the CRL
+	Certificate(serial string) (*DeviceCertificate, error)                                                    // Certificate returns a single certificate
+	Certificates(deviceID []byte) ([]*DeviceCertificate, error)                                               // Certificates of the device, or of every device if deviceID is nil
+	Revoked(serial *big.Int) (bool, error)                                                                    // Revoked returns true if the serial was revoked, checked on each handshake
+	CRL(now time.Time) ([]byte, error)                                                                        // CRL returns the DER encoded revocation list signed by the CA
+}
@@ -0,0 +1,136 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"regexp"
+	"time"
+)
+
+const (
+	// DefaultCommandTTL is how long a command waits to be run if no TTL is given
+	DefaultCommandTTL = 24 * time.Hour
+	// MaxCommandTTL is the longest a command may wait to be run
+	MaxCommandTTL = 30 * 24 * time.Hour
+	// DefaultCommandRetention is how long finished commands and their history are kept
+	DefaultCommandRetention = 90 * 24 * time.Hour
+
+	maxCommandNameLength = 64
+)
+
+var commandNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// CommandState is the lifecycle state of a command
+type CommandState string
+
+// command states, a command starts pending, is delivered when a device fetches it and ends
+// succeeded or failed when the device acknowledges it, or expired if its TTL passes first.
+const (
+	CommandPending   CommandState = "pending"
+	CommandDelivered CommandState = "delivered"
+	CommandSucceeded CommandState = "succeeded"
+	CommandFailed    CommandState = "failed"
+	CommandExpired   CommandState = "expired"
+)
+
+// Final returns true if the command can no longer change state
+func (s CommandState) Final() bool {
+	return s == CommandSucceeded || s == CommandFailed || s == CommandExpired
+}
+
+// CommandHistory is an entry of a command's audit trail
+type CommandHistory struct {
+	State   CommandState `json:"state"`
+	Time    time.Time    `json:"time"`
+	Actor   string       `json:"actor"` // who caused the change, an admin's username, the device's name or system
+	Message string       `json:"message,omitempty"`
+}
+
+// Command is an instruction queued for a device, such as reboot or set_interval
+type Command struct {
+	ID        uint64            `json:"id"`
+	DeviceID  []byte            `json:"device_id"`
+	Name      string            `json:"name"`
+	Args      json.RawMessage   `json:"args,omitempty"`
+	State     CommandState      `json:"state"`
+	CreatedBy string            `json:"created_by"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	Result    json.RawMessage   `json:"result,omitempty"` // Result reported by the device when acknowledging
+	History   []*CommandHistory `json:"history"`
+}
+
+// NewCommand creates a new command
+func NewCommand() *Command {
+	return &Command{}
+}
+
+// Valid returns ErrInvalidCommand unless the command has a valid name and any args are valid JSON
+func (c *Command) Valid() error {
+	if len(c.Name) == 0 || len(c.Name) > maxCommandNameLength || !commandNameRegex.MatchString(c.Name) {
+		return ErrInvalidCommand
+	}
+
+	if len(c.Args) > 0 && !json.Valid(c.Args) {
+		return ErrInvalidCommand
+	}
+	return nil
+}
+
+// Transition changes the command's state and records the change in its history. Returns
+// ErrCommandState if the command already reached a final state.
+func (c *Command) Transition(state CommandState, actor, message string, now time.Time) error {
+	if c.State.Final() {
+		return ErrCommandState
+	}
+
+	c.State = state
+	c.History = append(c.History, &CommandHistory{State: state, Time: now, Actor: actor, Message: message})
+	return nil
+}
+
+// Expired returns true if the command is not final and its TTL has passed
+func (c *Command) Expired(now time.Time) bool {
+	return !c.State.Final() && !c.ExpiresAt.IsZero() && now.After(c.ExpiresAt)
+}
+
+// Encode the Command into a gob of bytes
+func (c *Command) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeCommand from bytes using gob decoder and return a Command.
+func DecodeCommand(commandBytes []byte) (*Command, error) {
+	buf := bytes.NewBuffer(commandBytes)
+	dec := gob.NewDecoder(buf)
+	c := NewCommand()
+	err := dec.Decode(c)
+	return c, err
+}
+
+// CommandTopic returns the topic changes to a device's commands are published to.
+func CommandTopic(deviceID []byte) string {
+	return "command:" + base64.StdEncoding.EncodeToString(deviceID)
+}
+
+// CommandService manages a persistent queue of commands per device
+type CommandService interface {
+	Init() error                                                                                                // Init the command service (prepare the tables/bucket whatever)
+	Enqueue(command *Command, ttl time.Duration) error                                                          // Enqueue a pending command for command.DeviceID, assigning its ID
+	Command(deviceID []byte, id uint64) (*Command, error)                                                       // Command returns a single command of the device
+	Commands(deviceID []byte) ([]*Command, error)                                                               // Commands returns all of the device's commands oldest first
+	Deliver(deviceID []byte, actor string) ([]*Command, error)                                                  // Deliver marks the device's pending commands delivered and returns them
+	Ack(deviceID []byte, id uint64, state CommandState, result json.RawMessage, actor string) (*Command, error) // Ack records the device's result of running a command
+	Expire() (int, error)                                                                                       // Expire marks all commands past their TTL expired, returning how many
+	Prune(before time.Time) (int, error)                                                                        // Prune deletes finished commands queued before the time, returning how many
+	Delete(deviceID []byte) error                                                                               // Delete all of the device's commands
+}
@@ -0,0 +1,382 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultDeviceLogEntries is how many log entries are kept per device, older entries are dropped first
+	DefaultDeviceLogEntries = 10000
+	// MaxDeviceLogBatch limits how many entries a device may ship in one request
+	MaxDeviceLogBatch = 1000
+	// MaxDeviceLogMessage limits the length of a message, longer messages are truncated
+	MaxDeviceLogMessage = 8192
+	// MaxDeviceLogSearch limits how many entries a search returns
+	MaxDeviceLogSearch = 1000
+	// MaxDeviceLogBody limits the size of a request shipping log entries
+	MaxDeviceLogBody = MaxDeviceLogBatch * MaxDeviceLogMessage
+	// MaxDeviceLogName limits the length of an entry's host and app, longer names are truncated
+	MaxDeviceLogName = 255
+	// MaxDeviceLogFields limits how many fields an entry may have
+	MaxDeviceLogFields = 32
+	// MaxDeviceLogField limits the length of a field's name and value, longer values are truncated
+	MaxDeviceLogField = 1024
+)
+
+// LogSeverity is the syslog severity of a log entry, lower is more severe
+type LogSeverity int
+
+// syslog severities
+const (
+	SeverityEmergency LogSeverity = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+)
+
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// severityAliases are the other names devices commonly use for severities
+var severityAliases = map[string]LogSeverity{
+	"emergency": SeverityEmergency,
+	"panic":     SeverityEmergency,
+	"critical":  SeverityCritical,
+	"fatal":     SeverityCritical,
+	"error":     SeverityError,
+	"warn":      SeverityWarning,
+	"trace":     SeverityDebug,
+}
+
+// ParseLogSeverity parses a severity name (err, error, warn...) in any case or its number 0 to 7
+func ParseLogSeverity(value string) (LogSeverity, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if number, err := strconv.Atoi(value); err == nil {
+		if severity := LogSeverity(number); severity.Valid() {
+			return severity, nil
+		}
+		return 0, ErrInvalidDeviceLog
+	}
+
+	for i, name := range severityNames {
+		if name == value {
+			return LogSeverity(i), nil
+		}
+	}
+
+	if severity, ok := severityAliases[value]; ok {
+		return severity, nil
+	}
+	return 0, ErrInvalidDeviceLog
+}
+
+// Valid returns true for the syslog severities 0 to 7
+func (s LogSeverity) Valid() bool {
+	return s >= SeverityEmergency && s <= SeverityDebug
+}
+
+func (s LogSeverity) String() string {
+	if !s.Valid() {
+		return strconv.Itoa(int(s))
+	}
+	return severityNames[s]
+}
+
+// MarshalJSON encodes the severity as its name
+func (s LogSeverity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON decodes a severity name or number
+func (s *LogSeverity) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	var err error
+	switch v := value.(type) {
+	case string:
+		*s, err = ParseLogSeverity(v)
+	case float64:
+		*s, err = ParseLogSeverity(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		err = ErrInvalidDeviceLog
+	}
+	return err
+}
+
+// DeviceLog is a log entry shipped by a device. Sequence orders the device's entries as they
+// were received, Timestamp is when the device logged it.
+type DeviceLog struct {
+	Sequence   uint64            `json:"sequence"`
+	DeviceID   []byte            `json:"device_id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	ReceivedAt time.Time         `json:"received_at"`
+	Severity   LogSeverity       `json:"severity"`
+	Host       string            `json:"host,omitempty"`
+	App        string            `json:"app,omitempty"`
+	Message    string            `json:"message"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// Normalize sets when the entry was received, and when it was logged if the device did not say, and
+// truncates its message, host, app and field values. ErrInvalidDeviceLog if it has no message, an unknown
+// severity, more than MaxDeviceLogFields fields or a field name longer than MaxDeviceLogField.
+func (l *DeviceLog) Normalize(received time.Time) error {
+	if l.Message == "" || !l.Severity.Valid() || len(l.Fields) > MaxDeviceLogFields {
+		return ErrInvalidDeviceLog
+	}
+
+	for name, value := range l.Fields {
+		if name == "" || len(name) > MaxDeviceLogField {
+			return ErrInvalidDeviceLog
+		}
+		l.Fields[name] = truncate(value, MaxDeviceLogField)
+	}
+
+	l.ReceivedAt = received
+	if l.Timestamp.IsZero() {
+		l.Timestamp = received
+	}
+
+	l.Host = truncate(l.Host, MaxDeviceLogName)
+	l.App = truncate(l.App, MaxDeviceLogName)
+	l.Message = truncate(l.Message, MaxDeviceLogMessage)
+	return nil
+}
+
+// truncate the value to at most size bytes without splitting a UTF-8 encoded rune
+func truncate(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+
+	for size > 0 && !utf8.RuneStart(value[size]) {
+		size--
+	}
+	return value[:size]
+}
+
+// Encode the DeviceLog into a gob of bytes.
+func (l *DeviceLog) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(l); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeDeviceLog from bytes using gob decoder and return a DeviceLog.
+func DecodeDeviceLog(logBytes []byte) (*DeviceLog, error) {
+	buf := bytes.NewBuffer(logBytes)
+	dec := gob.NewDecoder(buf)
+	l := &DeviceLog{}
+	err := dec.Decode(l)
+	return l, err
+}
+
+// ParseSyslogLine parses an RFC 5424 or RFC 3164 syslog line into a normalized entry. Lines without a
+// priority are kept whole as the message with the notice severity, as RFC 3164 relays do.
+func ParseSyslogLine(line string, received time.Time) (*DeviceLog, error) {
+	entry := &DeviceLog{Severity: SeverityNotice, Message: strings.TrimRight(line, "\r\n")}
+
+	rest := entry.Message
+	if end := strings.IndexByte(rest, '>'); strings.HasPrefix(rest, "<") && end > 1 && end <= 4 {
+		if priority, err := strconv.Atoi(rest[1:end]); err == nil && priority >= 0 && priority <= 191 {
+			entry.Severity = LogSeverity(priority % 8)
+			rest = rest[end+1:]
+
+			if strings.HasPrefix(rest, "1 ") {
+				parseRFC5424(entry, rest[2:])
+			} else {
+				parseRFC3164(entry, rest, received)
+			}
+		}
+	}
+
+	if err := entry.Normalize(received); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// parseRFC5424 parses TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG, "-" marks a missing value
+func parseRFC5424(entry *DeviceLog, rest string) {
+	fields := strings.SplitN(rest, " ", 6)
+	if len(fields) != 6 {
+		entry.Message = rest
+		return
+	}
+
+	if ts, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		entry.Timestamp = ts.UTC()
+	}
+	entry.Host = syslogValue(fields[1])
+	entry.App = syslogValue(fields[2])
+
+	data := fields[5]
+	if strings.HasPrefix(data, "-") {
+		data = data[1:]
+	} else {
+		data = parseStructuredData(entry, data)
+	}
+	entry.Message = strings.TrimPrefix(strings.TrimPrefix(data, " "), "\ufeff")
+}
+
+// parseStructuredData adds the params of the [id name="value" ...] elements to the entry's fields and
+// returns what follows them
+func parseStructuredData(entry *DeviceLog, data string) string {
+	for strings.HasPrefix(data, "[") {
+		end := 1
+		params := make([]string, 0)
+		var current strings.Builder
+		quoted := false
+		for ; end < len(data); end++ {
+			ch := data[end]
+			if quoted && ch == '\\' && end+1 < len(data) {
+				end++
+				current.WriteByte(data[end])
+				continue
+			}
+
+			if ch == '"' {
+				quoted = !quoted
+				continue
+			}
+
+			if !quoted && (ch == ' ' || ch == ']') {
+				params = append(params, current.String())
+				current.Reset()
+				if ch == ']' {
+					break
+				}
+				continue
+			}
+			current.WriteByte(ch)
+		}
+
+		// the first param is the element's ID
+		for i := 1; i < len(params); i++ {
+			param := params[i]
+			if separator := strings.IndexByte(param, '='); separator > 0 {
+				if entry.Fields == nil {
+					entry.Fields = make(map[string]string)
+				}
+				entry.Fields[param[:separator]] = param[separator+1:]
+			}
+		}
+
+		if end >= len(data) {
+			return ""
+		}
+		data = data[end+1:]
+	}
+	return data
+}
+
+// parseRFC3164 parses Mmm dd hh:mm:ss HOSTNAME TAG: MSG, the year is assumed to be the one received in
+func parseRFC3164(entry *DeviceLog, rest string, received time.Time) {
+	entry.Message = rest
+	if len(rest) < len(time.Stamp)+1 {
+		return
+	}
+
+	ts, err := time.Parse(time.Stamp, rest[:len(time.Stamp)])
+	if err != nil {
+		return
+	}
+
+	entry.Timestamp = time.Date(received.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, time.UTC)
+	// a December entry received in January was logged last year
+	if entry.Timestamp.After(received.Add(24 * time.Hour)) {
+		entry.Timestamp = entry.Timestamp.AddDate(-1, 0, 0)
+	}
+
+	fields := strings.SplitN(strings.TrimLeft(rest[len(time.Stamp):], " "), " ", 2)
+	entry.Host = fields[0]
+	entry.Message = ""
+	if len(fields) == 2 {
+		entry.Message = fields[1]
+	}
+
+	if colon := strings.Index(entry.Message, ": "); colon > 0 && !strings.Contains(entry.Message[:colon], " ") {
+		entry.App = entry.Message[:colon]
+		if bracket := strings.IndexByte(entry.App, '['); bracket > 0 {
+			entry.App = entry.App[:bracket]
+		}
+		entry.Message = entry.Message[colon+2:]
+	}
+}
+
+func syslogValue(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+// LogTopic returns the topic a device's log entries are published to as they are shipped.
+func LogTopic(deviceID []byte) string {
+	return "log:" + base64.StdEncoding.EncodeToString(deviceID)
+}
+
+// DeviceLogQuery filters device log entries. Severity includes entries at least that severe, From and To
+// bound when they were logged unless zero and Contains matches the message or app in any case.
+type DeviceLogQuery struct {
+	DeviceID []byte      `json:"device_id"` // nil for every device
+	Severity LogSeverity `json:"severity"`
+	From     time.Time   `json:"from"`
+	To       time.Time   `json:"to"`
+	Contains string      `json:"contains"`
+	Limit    int         `json:"limit"`
+}
+
+// NewDeviceLogQuery returns a query of the latest 100 entries of every device and severity
+func NewDeviceLogQuery() *DeviceLogQuery {
+	return &DeviceLogQuery{Severity: SeverityDebug, Limit: 100}
+}
+
+// Valid returns ErrInvalidQuery if the severity is unknown or the limit is not between 1 and MaxDeviceLogSearch
+func (q *DeviceLogQuery) Valid() error {
+	if !q.Severity.Valid() || q.Limit < 1 || q.Limit > MaxDeviceLogSearch {
+		return ErrInvalidQuery
+	}
+	return nil
+}
+
+// Match returns true if the entry meets the query's severity, time range and substring
+func (q *DeviceLogQuery) Match(entry *DeviceLog) bool {
+	if entry.Severity > q.Severity {
+		return false
+	}
+
+	if (!q.From.IsZero() && entry.Timestamp.Before(q.From)) || (!q.To.IsZero() && entry.Timestamp.After(q.To)) {
+		return false
+	}
+
+	if q.Contains != "" {
+		contains := strings.ToLower(q.Contains)
+		return strings.Contains(strings.ToLower(entry.Message), contains) || strings.Contains(strings.ToLower(entry.App), contains)
+	}
+	return true
+}
+
+// DeviceLogService stores the log entries devices ship, keeping only the latest of each device.
+type DeviceLogService interface {
+	Init() error                                        // Init the device log service (prepare the tables/bucket)
+	Append(deviceID []byte, entries []*DeviceLog) error // Append stores normalized entries, assigning their sequence and dropping the oldest beyond the bound
+	Search(query *DeviceLogQuery) ([]*DeviceLog, error) // Search returns the matching entries, newest received first
+	Delete(deviceID []byte) error                       // Delete all of the device's entries
+}
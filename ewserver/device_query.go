@@ -0,0 +1,137 @@
+package ewserver
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DeviceTagAttribute is the attribute device queries use to match tags instead of metadata
+const DeviceTagAttribute = "tag"
+
+// deviceQueryOperators are the operators of a condition, two character operators first so they match before their prefix
+var deviceQueryOperators = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// DeviceCondition compares a device's metadata value, or one of its tags, with Value. Values are
+// compared as numbers if both are numbers, otherwise as strings.
+type DeviceCondition struct {
+	Attribute string `json:"attribute"`
+	Operator  string `json:"operator"`
+	Value     string `json:"value"`
+}
+
+// DeviceQuery matches devices meeting all of its conditions, such as `site=berlin AND hw>=3 AND tag=outdoor`
+type DeviceQuery struct {
+	Conditions []*DeviceCondition `json:"conditions"`
+}
+
+// ParseDeviceQuery parses conditions of the form attribute operator value joined by AND. An empty
+// query matches every device.
+func ParseDeviceQuery(query string) (*DeviceQuery, error) {
+	q := &DeviceQuery{Conditions: make([]*DeviceCondition, 0)}
+	if strings.TrimSpace(query) == "" {
+		return q, nil
+	}
+
+	for _, clause := range splitDeviceQuery(query) {
+		condition, err := parseDeviceCondition(clause)
+		if err != nil {
+			return nil, err
+		}
+		q.Conditions = append(q.Conditions, condition)
+	}
+	return q, nil
+}
+
+// splitDeviceQuery splits the query on the AND keyword, in any case, surrounded by whitespace
+func splitDeviceQuery(query string) []string {
+	fields := strings.Fields(query)
+	clauses := make([]string, 0, 1)
+	clause := make([]string, 0, 1)
+	for _, field := range fields {
+		if strings.EqualFold(field, "AND") {
+			clauses = append(clauses, strings.Join(clause, " "))
+			clause = clause[:0]
+			continue
+		}
+		clause = append(clause, field)
+	}
+	return append(clauses, strings.Join(clause, " "))
+}
+
+func parseDeviceCondition(clause string) (*DeviceCondition, error) {
+	for _, operator := range deviceQueryOperators {
+		index := strings.Index(clause, operator)
+		if index < 0 {
+			continue
+		}
+
+		attribute := strings.TrimSpace(clause[:index])
+		value := strings.TrimSpace(clause[index+len(operator):])
+		if attribute == "" || value == "" || strings.ContainsAny(attribute, "=<>!") {
+			return nil, ErrInvalidSearch
+		}
+		return &DeviceCondition{Attribute: attribute, Operator: operator, Value: value}, nil
+	}
+	return nil, ErrInvalidSearch
+}
+
+// Match returns true if the value meets the condition
+func (c *DeviceCondition) Match(value string) bool {
+	compared := compareDeviceValues(value, c.Value)
+	switch c.Operator {
+	case "=":
+		return compared == 0
+	case "!=":
+		return compared != 0
+	case ">":
+		return compared > 0
+	case ">=":
+		return compared >= 0
+	case "<":
+		return compared < 0
+	case "<=":
+		return compared <= 0
+	}
+	return false
+}
+
+// MatchDevice returns true if the API user's metadata or tags meet all the conditions of the query
+func (q *DeviceQuery) MatchDevice(apiUser *APIUser) bool {
+	for _, condition := range q.Conditions {
+		if !condition.matchDevice(apiUser) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchDevice returns true if any of the device's values for the attribute meets the condition
+func (c *DeviceCondition) matchDevice(apiUser *APIUser) bool {
+	if c.Attribute == DeviceTagAttribute {
+		for _, tag := range apiUser.Tags {
+			if c.Match(tag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	value, ok := apiUser.Metadata[c.Attribute]
+	return ok && c.Match(value)
+}
+
+func compareDeviceValues(a, b string) int {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
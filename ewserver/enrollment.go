@@ -0,0 +1,135 @@
+package ewserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"regexp"
+	"time"
+)
+
+const (
+	// EnrollmentTokenSize is the number of random bytes in an enrollment token
+	EnrollmentTokenSize = 32
+	// DefaultEnrollmentTTL is how long an enrollment token is valid if no expiry is given
+	DefaultEnrollmentTTL = 24 * time.Hour
+	// DefaultEnrollmentRole is the role enrolled devices are added to if the token has none
+	DefaultEnrollmentRole = "apiuser"
+	// DefaultEnrollmentPrefix is the prefix of enrolled devices' names if the token has none
+	DefaultEnrollmentPrefix = "device-"
+)
+
+var (
+	// enrollmentPrefixPattern keeps prefixes to a safe charset, starting with a letter
+	enrollmentPrefixPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]{0,31}$`)
+	// enrollmentNamePattern limits the names devices supply to a safe charset
+	enrollmentNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+)
+
+// EnrollmentToken lets devices enroll themselves at most MaxUses times before ExpiresAt. Each enrolled
+// device gets its own API user named NamePrefix and the name it supplies, added to Role and carrying
+// Metadata. The prefix is required so devices can not choose the casbin subject they enroll as. Only the Hash of the token is stored, Token is returned when it is created.
+type EnrollmentToken struct {
+	ID         uint64            `json:"id"`
+	Token      string            `json:"token,omitempty"`
+	Hash       []byte            `json:"-"`
+	NamePrefix string            `json:"name_prefix"`
+	Role       string            `json:"role"`
+	Metadata   map[string]string `json:"metadata"`
+	MaxUses    int               `json:"max_uses"`
+	Uses       int               `json:"uses"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+	CreatedBy  string            `json:"created_by"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// NewEnrollmentToken creates a single use token expiring after the DefaultEnrollmentTTL
+func NewEnrollmentToken() *EnrollmentToken {
+	return &EnrollmentToken{MaxUses: 1, ExpiresAt: time.Now().UTC().Add(DefaultEnrollmentTTL)}
+}
+
+// Valid ensures the token can be used at least once, has not expired and has a safe name prefix,
+// defaulting the role and prefix and generating the token's secret.
+func (t *EnrollmentToken) Valid() error {
+	if t.NamePrefix == "" {
+		t.NamePrefix = DefaultEnrollmentPrefix
+	}
+
+	if t.MaxUses < 1 || !t.ExpiresAt.After(time.Now()) || !enrollmentPrefixPattern.MatchString(t.NamePrefix) {
+		return ErrInvalidEnrollment
+	}
+
+	if t.Role == "" {
+		t.Role = DefaultEnrollmentRole
+	}
+
+	token, err := GenerateRandomBytes(EnrollmentTokenSize)
+	if err != nil {
+		return err
+	}
+	t.Token = hex.EncodeToString(token)
+	t.Hash = HashEnrollmentToken(t.Token)
+	return nil
+}
+
+// DeviceName returns the name of a device enrolling with the token, its prefix followed by the
+// name the device supplied. ErrInvalidEnrollment if the name has characters other than letters,
+// digits, '.', '_' and '-'.
+func (t *EnrollmentToken) DeviceName(name string) (string, error) {
+	prefix := t.NamePrefix
+	// tokens created before prefixes were required
+	if prefix == "" {
+		prefix = DefaultEnrollmentPrefix
+	}
+
+	if !enrollmentNamePattern.MatchString(name) {
+		return "", ErrInvalidEnrollment
+	}
+	return prefix + name, nil
+}
+
+// Usable returns true if the token has uses left and has not expired at the time
+func (t *EnrollmentToken) Usable(at time.Time) bool {
+	return t.Uses < t.MaxUses && at.Before(t.ExpiresAt)
+}
+
+// HashEnrollmentToken returns the hash tokens are stored and looked up by
+func HashEnrollmentToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// Encode the EnrollmentToken into a gob of bytes, the token itself is never stored.
+func (t *EnrollmentToken) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	stored := *t
+	stored.Token = ""
+	if err := enc.Encode(&stored); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeEnrollmentToken from bytes using gob decoder and return an EnrollmentToken.
+func DecodeEnrollmentToken(tokenBytes []byte) (*EnrollmentToken, error) {
+	buf := bytes.NewBuffer(tokenBytes)
+	dec := gob.NewDecoder(buf)
+	t := &EnrollmentToken{}
+	err := dec.Decode(t)
+	return t, err
+}
+
+// EnrollmentService manages enrollment tokens
+type EnrollmentService interface {
+	Init() error                                                 // Init the enrollment service (prepare the tables/bucket whatever)
+	Create(token *EnrollmentToken) error                         // Create validates and stores a new token, setting its ID and secret
+	EnrollmentToken(id uint64) (*EnrollmentToken, error)         // EnrollmentToken returns a single token
+	EnrollmentTokens() ([]*EnrollmentToken, error)               // EnrollmentTokens returns all tokens
+	Delete(id uint64) error                                      // Delete revokes the token
+	Lookup(token string, at time.Time) (*EnrollmentToken, error) // Lookup returns the token if it can be redeemed, ErrEnrollmentDenied if it is unknown, used up or expired
+	Redeem(token string, at time.Time) (*EnrollmentToken, error) // Redeem uses the token once, ErrEnrollmentDenied if it is unknown, used up or expired
+}
@@ -13,4 +13,54 @@ const (
 	ErrInvalidUser       = Error("invalid username or fields")
 	ErrUserAlreadyExists = Error("user already exists")
 	ErrInvalidPassword   = Error("invalid password for user")
+	ErrInvalidStream     = Error("invalid stream name")
+	ErrInvalidDataPoint  = Error("invalid data point")
+	ErrInvalidQuery      = Error("invalid query")
+	ErrPointNotFound     = Error("data point not found")
+	ErrInvalidCommand    = Error("invalid command name or arguments")
+	ErrCommandNotFound   = Error("command not found")
+	ErrCommandState      = Error("command can not change to the requested state")
+	ErrInvalidFirmware   = Error("invalid firmware version, image or rollout")
+	ErrFirmwareNotFound  = Error("firmware not found")
+	ErrFirmwareExists    = Error("firmware version already exists")
+	ErrInvalidShadow     = Error("invalid shadow state")
+	ErrVersionConflict   = Error("version does not match the current version")
+	ErrInvalidRetention  = Error("invalid retention policy")
+	ErrInvalidRule       = Error("invalid rule name, stream, expression or action")
+	ErrRuleNotFound      = Error("rule not found")
+	ErrAlertNotFound     = Error("alert not found")
+	ErrInvalidWebhook    = Error("invalid webhook url or events")
+	ErrWebhookNotFound   = Error("webhook subscription not found")
+	ErrDeliveryNotFound  = Error("webhook delivery not found")
+	ErrDeliveryState     = Error("webhook delivery can not be retried in its state")
+	ErrInvalidEnrollment = Error("invalid enrollment token uses, expiry or device name")
+	ErrTokenNotFound     = Error("enrollment token not found")
+	ErrEnrollmentDenied  = Error("enrollment token is invalid, used up or expired")
+	ErrInvalidCSR        = Error("invalid certificate signing request or validity")
+	ErrCertNotFound      = Error("certificate not found")
+	ErrCertRevoked       = Error("certificate was revoked")
+	ErrInvalidRateLimit  = Error("invalid rate limit scope, subject, rate or burst")
+	ErrLimitNotFound     = Error("rate limit not found")
+	ErrRateLimited       = Error("rate limit exceeded, retry later")
+	ErrInvalidSearch     = Error("invalid device search, expected conditions like site=berlin AND hw>=3")
+	ErrInvalidMetadata   = Error("invalid device metadata or tags")
+	ErrInvalidBatch      = Error("invalid batch, it must have between 1 and 5000 points")
+	ErrInvalidSequence   = Error("invalid upload sequence number or idempotency key")
+	ErrDuplicateUpload   = Error("upload was already received")
+	ErrUploadInFlight    = Error("upload with the same sequence number or key is in progress")
+	ErrStaleSequence     = Error("upload sequence number is older than the numbers still tracked")
+	ErrInvalidGroup      = Error("invalid group name, use letters, digits, '.', '_' and '-'")
+	ErrGroupNotFound     = Error("device group not found")
+	ErrGroupExists       = Error("device group already exists")
+	ErrInvalidBulkJob    = Error("invalid bulk job action or arguments")
+	ErrJobNotFound       = Error("bulk job not found")
+	ErrKeysNotAvailable  = Error("bulk job keys were already collected or the job has not completed")
+	ErrUserDisabled      = Error("api user is disabled")
+	ErrInvalidBlob       = Error("invalid blob name, size or chunk")
+	ErrBlobNotFound      = Error("blob not found")
+	ErrBlobOffset        = Error("chunk offset is past the blob's committed offset")
+	ErrBlobIncomplete    = Error("blob upload is not complete")
+	ErrBlobChecksum      = Error("blob sha256 does not match the uploaded bytes")
+	ErrBlobQuota         = Error("device has too many blob uploads in progress or bytes stored")
+	ErrInvalidDeviceLog  = Error("invalid device log, entries need a message and a known severity")
 )
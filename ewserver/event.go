@@ -0,0 +1,61 @@
+package ewserver
+
+import (
+	"encoding/base64"
+	"time"
+)
+
+// Event is a message published to a topic, such as a newly ingested data point.
+type Event struct {
+	ID    uint64      `json:"id"`
+	Topic string      `json:"topic"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// StreamEvent is the Data of events published to a DataTopic when a point is ingested.
+type StreamEvent struct {
+	DeviceID []byte     `json:"device_id"`
+	Stream   StreamName `json:"stream"`
+	Point    *DataPoint `json:"point"`
+}
+
+// AdminTopic is where successful changes made through the admin API are published as AdminEvents
+const AdminTopic = "admin"
+
+// AdminEvent is the Data of events published to the AdminTopic, Subject is the name of the user or
+// API user the change was made to if the handler sets it.
+type AdminEvent struct {
+	UserName UserName `json:"username"`
+	Method   string   `json:"method"`
+	Path     string   `json:"path"`
+	Status   int      `json:"status"`
+	Client   string   `json:"client"`
+	Subject  string   `json:"subject,omitempty"`
+}
+
+// DeviceTopic returns the topic a device's online/offline changes are published to.
+func DeviceTopic(deviceID []byte) string {
+	return "device:" + base64.StdEncoding.EncodeToString(deviceID)
+}
+
+// DataTopic returns the topic points for the device's stream are published to.
+func DataTopic(deviceID []byte, stream StreamName) string {
+	return "data:" + base64.StdEncoding.EncodeToString(deviceID) + ":" + string(stream)
+}
+
+// Subscription receives events for the topics it subscribed to. Events are dropped rather
+// than blocking the publisher if the subscriber does not keep up.
+type Subscription interface {
+	Events() <-chan *Event // Events channel, closed when the subscription is closed
+	Dropped() uint64       // Dropped returns how many events were dropped because the subscriber was too slow
+	Close()                // Close the subscription
+}
+
+// EventService fans out published events to subscribers in process. Topics passed to Subscribe
+// and Replay may end in * to match all topics with that prefix.
+type EventService interface {
+	Publish(topic string, data interface{}) *Event  // Publish the data to all subscribers of the topic
+	Subscribe(topics ...string) Subscription        // Subscribe to one or more topics
+	Replay(since uint64, topics ...string) []*Event // Replay recently published events with an ID after since
+}
@@ -0,0 +1,302 @@
+package ewserver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxFirmwareSize limits the size of uploaded firmware images
+const MaxFirmwareSize = 64 * 1024 * 1024
+
+const maxFirmwareVersionLength = 64
+
+var firmwareVersionRegex = regexp.MustCompile(`^[A-Za-z0-9_.+\-]+$`)
+
+// FirmwareVersion identifies a firmware image, such as 1.2.0
+type FirmwareVersion string
+
+// Valid returns true if the version is non-empty, not too long and safe to use in URLs
+func (v FirmwareVersion) Valid() bool {
+	return len(v) > 0 && len(v) <= maxFirmwareVersionLength && firmwareVersionRegex.MatchString(string(v))
+}
+
+// Compare returns -1, 0 or 1 if v is lower, equal to or higher than other. Versions are compared by
+// their dot separated fields, numeric fields as numbers, and a pre-release after a '-' is lower than the
+// release itself, so 1.10.0 > 1.9.0 > 1.9.0-rc1. Build metadata after a '+' is ignored, 1.9.0+2 equals 1.9.0.
+func (v FirmwareVersion) Compare(other FirmwareVersion) int {
+	release, preRelease := splitVersion(v)
+	otherRelease, otherPreRelease := splitVersion(other)
+
+	if c := compareVersionFields(release, otherRelease); c != 0 {
+		return c
+	}
+
+	switch {
+	case preRelease == otherPreRelease:
+	case preRelease == "":
+		return 1
+	case otherPreRelease == "":
+		return -1
+	default:
+		return compareVersionFields(preRelease, otherPreRelease)
+	}
+	return 0
+}
+
+// splitVersion returns the release and pre-release of the version without any build metadata
+func splitVersion(v FirmwareVersion) (string, string) {
+	version := string(v)
+	if i := strings.IndexByte(version, '+'); i >= 0 {
+		version = version[:i]
+	}
+
+	if i := strings.IndexByte(version, '-'); i >= 0 {
+		return version[:i], version[i+1:]
+	}
+	return version, ""
+}
+
+// compareVersionFields compares dot separated fields in order, numeric fields are lower than others
+// and a version with fewer fields is lower if the fields it has are equal.
+func compareVersionFields(a, b string) int {
+	aFields, bFields := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aFields) && i < len(bFields); i++ {
+		aNumber, bNumber := isVersionNumber(aFields[i]), isVersionNumber(bFields[i])
+
+		var c int
+		switch {
+		case aNumber && bNumber:
+			// compare by length first so numbers of any size compare without overflowing
+			aField, bField := strings.TrimLeft(aFields[i], "0"), strings.TrimLeft(bFields[i], "0")
+			if c = len(aField) - len(bField); c == 0 {
+				c = strings.Compare(aField, bField)
+			}
+		case aNumber:
+			c = -1
+		case bNumber:
+			c = 1
+		default:
+			c = strings.Compare(aFields[i], bFields[i])
+		}
+
+		if c != 0 {
+			if c < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case len(aFields) < len(bFields):
+		return -1
+	case len(aFields) > len(bFields):
+		return 1
+	}
+	return 0
+}
+
+func isVersionNumber(field string) bool {
+	if field == "" {
+		return false
+	}
+
+	for _, r := range field {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Firmware describes an uploaded firmware image and which devices it is rolled out to
+type Firmware struct {
+	Version    FirmwareVersion `json:"version"`
+	Size       int64           `json:"size"`
+	SHA256     string          `json:"sha256"` // hex encoded SHA-256 of the image
+	UploadedBy string          `json:"uploaded_by"`
+	UploadedAt time.Time       `json:"uploaded_at"`
+	Rollout    *Rollout        `json:"rollout"` // nil until the firmware is rolled out
+}
+
+// NewFirmware creates new firmware metadata
+func NewFirmware() *Firmware {
+	return &Firmware{}
+}
+
+// Encode the Firmware into a gob of bytes
+func (f *Firmware) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeFirmware from bytes using gob decoder and return a Firmware.
+func DecodeFirmware(firmwareBytes []byte) (*Firmware, error) {
+	buf := bytes.NewBuffer(firmwareBytes)
+	dec := gob.NewDecoder(buf)
+	f := NewFirmware()
+	err := dec.Decode(f)
+	return f, err
+}
+
+// Rollout assigns firmware to devices. Devices and Groups (roles the device's API user belongs to)
+// select the targeted devices, the whole fleet if both are empty. Percentage then stages the rollout
+// to a stable share of the targeted devices, raising it only ever adds devices.
+type Rollout struct {
+	Devices    [][]byte  `json:"devices"`
+	Groups     []string  `json:"groups"`
+	Percentage int       `json:"percentage"`
+	UpdatedBy  string    `json:"updated_by"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Valid returns ErrInvalidFirmware if the percentage is not between 0 and 100
+func (r *Rollout) Valid() error {
+	if r.Percentage < 0 || r.Percentage > 100 {
+		return ErrInvalidFirmware
+	}
+	return nil
+}
+
+// Targets returns true if the device (a member of groups) is included in the rollout of version.
+func (r *Rollout) Targets(version FirmwareVersion, deviceID []byte, groups []string) bool {
+	if r == nil {
+		return false
+	}
+
+	if len(r.Devices) > 0 || len(r.Groups) > 0 {
+		if !r.selects(deviceID, groups) {
+			return false
+		}
+	}
+	return rolloutBucket(version, deviceID) < r.Percentage
+}
+
+// selects returns true if the device is listed or in one of the groups
+func (r *Rollout) selects(deviceID []byte, groups []string) bool {
+	for _, id := range r.Devices {
+		if bytes.Equal(id, deviceID) {
+			return true
+		}
+	}
+
+	for _, group := range r.Groups {
+		for _, deviceGroup := range groups {
+			if group == deviceGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rolloutBucket deterministically places the device in one of 100 buckets for the version,
+// so each version's rollout reaches a different slice of the fleet first.
+func rolloutBucket(version FirmwareVersion, deviceID []byte) int {
+	sum := sha256.Sum256(append([]byte(version+":"), deviceID...))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
+// FirmwareManifest tells a device which firmware to install, signed with the server's Ed25519 key.
+type FirmwareManifest struct {
+	Version   FirmwareVersion `json:"version"`
+	URL       string          `json:"url"`
+	SHA256    string          `json:"sha256"`
+	Size      int64           `json:"size"`
+	Signature []byte          `json:"signature"`
+}
+
+// SigningBytes returns the bytes that are signed, the version, URL, SHA-256 and size each followed by a newline.
+func (m *FirmwareManifest) SigningBytes() []byte {
+	return []byte(string(m.Version) + "\n" + m.URL + "\n" + m.SHA256 + "\n" + strconv.FormatInt(m.Size, 10) + "\n")
+}
+
+// Verify the manifest's signature with the public key
+func (m *FirmwareManifest) Verify(publicKey ed25519.PublicKey) bool {
+	return len(publicKey) == ed25519.PublicKeySize && ed25519.Verify(publicKey, m.SigningBytes(), m.Signature)
+}
+
+// FirmwareState is the progress of a device updating its firmware
+type FirmwareState string
+
+// firmware update states reported by devices
+const (
+	FirmwareDownloading FirmwareState = "downloading"
+	FirmwareInstalling  FirmwareState = "installing"
+	FirmwareInstalled   FirmwareState = "installed"
+	FirmwareFailed      FirmwareState = "failed"
+)
+
+// Valid returns true for the known states
+func (s FirmwareState) Valid() bool {
+	switch s {
+	case FirmwareDownloading, FirmwareInstalling, FirmwareInstalled, FirmwareFailed:
+		return true
+	}
+	return false
+}
+
+// FirmwareStatus is the last update status a device reported
+type FirmwareStatus struct {
+	DeviceID  []byte          `json:"device_id"`
+	Version   FirmwareVersion `json:"version"`
+	State     FirmwareState   `json:"state"`
+	Message   string          `json:"message,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// NewFirmwareStatus creates a new firmware status
+func NewFirmwareStatus() *FirmwareStatus {
+	return &FirmwareStatus{}
+}
+
+// Encode the FirmwareStatus into a gob of bytes
+func (s *FirmwareStatus) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeFirmwareStatus from bytes using gob decoder and return a FirmwareStatus.
+func DecodeFirmwareStatus(statusBytes []byte) (*FirmwareStatus, error) {
+	buf := bytes.NewBuffer(statusBytes)
+	dec := gob.NewDecoder(buf)
+	s := NewFirmwareStatus()
+	err := dec.Decode(s)
+	return s, err
+}
+
+// FirmwareService stores firmware images, their rollouts and the update status of devices
+type FirmwareService interface {
+	Init() error                                                                         // Init the firmware service (prepare the tables/bucket and signing key)
+	Upload(firmware *Firmware, image []byte) error                                       // Upload stores the image, setting the firmware's size and SHA-256
+	Firmware(version FirmwareVersion) (*Firmware, error)                                 // Firmware returns the metadata of a version
+	Firmwares() ([]*Firmware, error)                                                     // Firmwares returns the metadata of all versions
+	Open(version FirmwareVersion) (*Firmware, *os.File, error)                           // Open returns a version and its image's file for reading, the caller closes it
+	Delete(version FirmwareVersion) error                                                // Delete the firmware image and metadata
+	SetRollout(version FirmwareVersion, rollout *Rollout) error                          // SetRollout replaces the rollout of a version
+	Update(deviceID []byte, groups []string, current FirmwareVersion) (*Firmware, error) // Update returns the firmware the device should run, nil if it is up to date
+	Sign(manifest *FirmwareManifest) error                                               // Sign the manifest with the server's key
+	PublicKey() ed25519.PublicKey                                                        // PublicKey devices use to verify manifests
+	ReportStatus(status *FirmwareStatus) error                                           // ReportStatus stores the device's update status
+	Statuses(version FirmwareVersion) ([]*FirmwareStatus, error)                         // Statuses of devices updating to version, all devices if empty
+}
@@ -0,0 +1,182 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"regexp"
+	"time"
+)
+
+// GroupRolePrefix prefixes the casbin role of a device group, so groups and roles do not collide
+const GroupRolePrefix = "group:"
+
+// groupNamePattern limits group names to what is safe in routes and casbin policies
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// GroupRole returns the casbin role devices are added to as members of the group. Policies for
+// the role apply to every member and firmware rollouts may target it.
+func GroupRole(name string) string {
+	return GroupRolePrefix + name
+}
+
+// DeviceGroup is a named set of devices, its members are the subjects of its casbin role.
+type DeviceGroup struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Valid returns ErrInvalidGroup if the name is empty, too long or has characters other than letters,
+// digits, '.', '_' and '-'.
+func (g *DeviceGroup) Valid() error {
+	if !groupNamePattern.MatchString(g.Name) {
+		return ErrInvalidGroup
+	}
+	return nil
+}
+
+// Encode the DeviceGroup into a gob of bytes.
+func (g *DeviceGroup) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeDeviceGroup from bytes using gob decoder and return a DeviceGroup.
+func DecodeDeviceGroup(groupBytes []byte) (*DeviceGroup, error) {
+	buf := bytes.NewBuffer(groupBytes)
+	dec := gob.NewDecoder(buf)
+	g := &DeviceGroup{}
+	err := dec.Decode(g)
+	return g, err
+}
+
+// GroupService stores device groups, membership is managed with the RoleService and GroupRole.
+type GroupService interface {
+	Init() error                             // Init the group service (prepare the tables/bucket)
+	Create(group *DeviceGroup) error         // Create a group, ErrGroupExists if the name is taken
+	Group(name string) (*DeviceGroup, error) // Group returns a single group
+	Groups() ([]*DeviceGroup, error)         // Groups returns all groups ordered by name
+	Delete(name string) error                // Delete the group, its members must be removed separately
+}
+
+// BulkAction is what a bulk job does to each device of a group
+type BulkAction string
+
+const (
+	// BulkCommand queues a command for each device, Args is {"name", "args", "ttl"}
+	BulkCommand BulkAction = "command"
+	// BulkFirmware adds the group to a firmware version's rollout, Args is {"version", "percentage"}
+	BulkFirmware BulkAction = "firmware"
+	// BulkRotateKey generates a new API key for each device, the keys are returned once by the runner's Keys
+	// when the job completes and are not stored with its results
+	BulkRotateKey BulkAction = "rotate_key"
+	// BulkDisable denies each device access until it is enabled
+	BulkDisable BulkAction = "disable"
+	// BulkEnable allows disabled devices access again
+	BulkEnable BulkAction = "enable"
+	// BulkDelete deletes each device's API user and removes it from all roles and groups
+	BulkDelete BulkAction = "delete"
+)
+
+// Valid returns true if the action is known
+func (a BulkAction) Valid() bool {
+	switch a {
+	case BulkCommand, BulkFirmware, BulkRotateKey, BulkDisable, BulkEnable, BulkDelete:
+		return true
+	}
+	return false
+}
+
+// BulkJobState is the state of a bulk job
+type BulkJobState string
+
+const (
+	// BulkRunning jobs are applying their action to the group's devices
+	BulkRunning BulkJobState = "running"
+	// BulkCompleted jobs applied their action to every device, see the results for failures
+	BulkCompleted BulkJobState = "completed"
+	// BulkInterrupted jobs were running when the server stopped, devices without a result were not processed
+	BulkInterrupted BulkJobState = "interrupted"
+)
+
+// BulkResult is the outcome of a bulk job's action on a device
+type BulkResult struct {
+	DeviceID []byte          `json:"device_id"`
+	Name     string          `json:"name"`
+	OK       bool            `json:"ok"`
+	Error    string          `json:"error,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+}
+
+// BulkJob applies an action to the devices that were members of a group when it started
+type BulkJob struct {
+	ID         uint64          `json:"id"`
+	Group      string          `json:"group"`
+	Action     BulkAction      `json:"action"`
+	Args       json.RawMessage `json:"args,omitempty"`
+	State      BulkJobState    `json:"state"`
+	Total      int             `json:"total"`
+	Succeeded  int             `json:"succeeded"`
+	Failed     int             `json:"failed"`
+	Results    []*BulkResult   `json:"results"`
+	CreatedBy  string          `json:"created_by"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt time.Time       `json:"finished_at,omitempty"`
+}
+
+// NewBulkJob returns a running job of the action for the group
+func NewBulkJob(group string, action BulkAction, args json.RawMessage) *BulkJob {
+	return &BulkJob{Group: group, Action: action, Args: args, State: BulkRunning, Results: make([]*BulkResult, 0), CreatedAt: time.Now().UTC()}
+}
+
+// AddResult records the outcome for a device, err nil is a success with the optional result
+func (j *BulkJob) AddResult(apiUser *APIUser, result json.RawMessage, err error) {
+	r := &BulkResult{DeviceID: apiUser.ID, Name: apiUser.Name, OK: err == nil, Result: result}
+	if err != nil {
+		r.Error = err.Error()
+		j.Failed++
+	} else {
+		j.Succeeded++
+	}
+	j.Results = append(j.Results, r)
+}
+
+// Encode the BulkJob into a gob of bytes.
+func (j *BulkJob) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(j); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBulkJob from bytes using gob decoder and return a BulkJob.
+func DecodeBulkJob(jobBytes []byte) (*BulkJob, error) {
+	buf := bytes.NewBuffer(jobBytes)
+	dec := gob.NewDecoder(buf)
+	j := &BulkJob{}
+	err := dec.Decode(j)
+	return j, err
+}
+
+// BulkJobService stores bulk jobs and their results
+type BulkJobService interface {
+	Init() error                     // Init the bulk job service (prepare the tables/bucket)
+	Create(job *BulkJob) error       // Create stores a new job, assigning its ID
+	Save(job *BulkJob) error         // Save replaces the stored job with its progress
+	Job(id uint64) (*BulkJob, error) // Job returns a single job with its results
+	Jobs() ([]*BulkJob, error)       // Jobs returns all jobs newest first
+}
+
+// BulkJobRunner starts bulk jobs, applying their action to the group's devices in the background
+type BulkJobRunner interface {
+	Start(job *BulkJob) error                  // Start validates and stores the job, assigning its ID, then runs it
+	Keys(id uint64) (map[string]APIKey, error) // Keys returns the new keys of a completed rotate_key job by device name, only once
+}
@@ -0,0 +1,65 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
+// DefaultPresenceTimeout is how long after it was last seen a device is considered offline
+const DefaultPresenceTimeout = 5 * time.Minute
+
+// Presence is when and from where a device was last seen. Online is derived from LastSeen and the
+// heartbeat timeout, Since is when it last changed.
+type Presence struct {
+	DeviceID  []byte    `json:"device_id"`
+	LastSeen  time.Time `json:"last_seen"`
+	Address   string    `json:"address"`
+	UserAgent string    `json:"user_agent"`
+	Online    bool      `json:"online"`
+	Since     time.Time `json:"since"`
+}
+
+// NewPresence creates the presence of a device that was never seen
+func NewPresence(deviceID []byte) *Presence {
+	return &Presence{DeviceID: deviceID}
+}
+
+// Encode the Presence into a gob of bytes
+func (p *Presence) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(p); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodePresence from bytes using gob decoder and return a Presence.
+func DecodePresence(presenceBytes []byte) (*Presence, error) {
+	buf := bytes.NewBuffer(presenceBytes)
+	dec := gob.NewDecoder(buf)
+	p := &Presence{}
+	err := dec.Decode(p)
+	return p, err
+}
+
+// PresenceEvent is the Data of events published to a DeviceTopic when the device goes online or offline
+type PresenceEvent struct {
+	DeviceID []byte    `json:"device_id"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen"`
+	Address  string    `json:"address"`
+}
+
+// PresenceService tracks when devices were last seen
+type PresenceService interface {
+	Init() error                                                         // Init the presence service (prepare the tables/bucket whatever)
+	Seen(deviceID []byte, address, userAgent string, at time.Time) error // Seen records activity of the device
+	Presence(deviceID []byte) (*Presence, error)                         // Presence returns the device's presence, never seen and offline if unknown
+	Presences() ([]*Presence, error)                                     // Presences returns the presence of every device that was seen
+	Save(presences []*Presence) error                                    // Save stores a batch of presences
+	Delete(deviceID []byte) error                                        // Delete the device's presence
+}
@@ -0,0 +1,144 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"time"
+)
+
+const (
+	// RateLimitScopeAPIUser limits an API user by name
+	RateLimitScopeAPIUser = "api_user"
+	// RateLimitScopeUser limits a UI user by user name
+	RateLimitScopeUser = "user"
+	// RateLimitScopeRole limits each API or UI user in the role that has no limit of its own
+	RateLimitScopeRole = "role"
+	// RateLimitScopeIP limits each client address
+	RateLimitScopeIP = "ip"
+	// RateLimitDefault is the subject of a scope's limit for identities without a more specific one
+	RateLimitDefault = "*"
+)
+
+// RateLimit is a token bucket limit, requests take a token from a bucket holding up to Burst tokens
+// that refills at Rate tokens per second.
+type RateLimit struct {
+	Scope     string    `json:"scope"`
+	Subject   string    `json:"subject"`
+	Rate      float64   `json:"rate"`
+	Burst     int       `json:"burst"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Valid returns ErrInvalidRateLimit if the scope is unknown, the subject is missing or it would never refill
+func (l *RateLimit) Valid() error {
+	switch l.Scope {
+	case RateLimitScopeAPIUser, RateLimitScopeUser, RateLimitScopeRole, RateLimitScopeIP:
+	default:
+		return ErrInvalidRateLimit
+	}
+
+	if l.Subject == "" || l.Rate <= 0 || math.IsInf(l.Rate, 0) || l.Burst < 1 {
+		return ErrInvalidRateLimit
+	}
+	return nil
+}
+
+// Key identifies the limit by its scope and subject
+func (l *RateLimit) Key() string {
+	return RateLimitKey(l.Scope, l.Subject)
+}
+
+// RateLimitKey returns the key of the limit, or the bucket, of the subject in the scope
+func RateLimitKey(scope, subject string) string {
+	return scope + ":" + subject
+}
+
+// Encode the RateLimit into a gob of bytes.
+func (l *RateLimit) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(l); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeRateLimit from bytes using gob decoder and return a RateLimit.
+func DecodeRateLimit(limitBytes []byte) (*RateLimit, error) {
+	buf := bytes.NewBuffer(limitBytes)
+	dec := gob.NewDecoder(buf)
+	l := &RateLimit{}
+	err := dec.Decode(l)
+	return l, err
+}
+
+// RateBucket is the state of an identity's token bucket, the limit it is taken from can change.
+type RateBucket struct {
+	Key     string    `json:"key"`
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// NewRateBucket returns a full bucket for the limit
+func NewRateBucket(key string, limit *RateLimit, now time.Time) *RateBucket {
+	return &RateBucket{Key: key, Tokens: float64(limit.Burst), Updated: now}
+}
+
+// Take refills the bucket since it was last updated and takes a token. If the bucket is empty it
+// returns false and how long until a token is available.
+func (b *RateBucket) Take(limit *RateLimit, now time.Time) (bool, time.Duration) {
+	b.refill(limit, now)
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second))
+}
+
+// Full returns true if the bucket refilled to the limit's burst, so it is the same as a new bucket
+func (b *RateBucket) Full(limit *RateLimit, now time.Time) bool {
+	b.refill(limit, now)
+	return b.Tokens >= float64(limit.Burst)
+}
+
+func (b *RateBucket) refill(limit *RateLimit, now time.Time) {
+	if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens += elapsed * limit.Rate
+		b.Updated = now
+	}
+
+	if b.Tokens > float64(limit.Burst) {
+		b.Tokens = float64(limit.Burst)
+	}
+}
+
+// Encode the RateBucket into a gob of bytes.
+func (b *RateBucket) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeRateBucket from bytes using gob decoder and return a RateBucket.
+func DecodeRateBucket(bucketBytes []byte) (*RateBucket, error) {
+	buf := bytes.NewBuffer(bucketBytes)
+	dec := gob.NewDecoder(buf)
+	b := &RateBucket{}
+	err := dec.Decode(b)
+	return b, err
+}
+
+// RateLimitService stores the rate limits and, optionally, the state of their buckets
+type RateLimitService interface {
+	Init() error                             // Init the rate limit service (prepare the tables/bucket)
+	SetLimit(limit *RateLimit) error         // SetLimit creates or replaces the limit of the scope and subject
+	DeleteLimit(scope, subject string) error // DeleteLimit removes the limit of the scope and subject
+	Limits() ([]*RateLimit, error)           // Limits returns all limits
+	Buckets() ([]*RateBucket, error)         // Buckets returns the saved bucket state
+	SaveBuckets(buckets []*RateBucket) error // SaveBuckets replaces the saved bucket state
+}
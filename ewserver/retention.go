@@ -0,0 +1,260 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxRetentionTiers limits how many tiers a retention policy may have.
+const MaxRetentionTiers = 8
+
+// Duration is a time.Duration encoded in JSON as a string such as "90s", "1h" or "7d".
+type Duration time.Duration
+
+// ParseDuration parses a go duration string, a number of days ("7d") or seconds.
+func ParseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(value, "d"), 10, 64)
+		if err != nil {
+			return 0, ErrInvalidQuery
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, ErrInvalidQuery
+	}
+	return duration, nil
+}
+
+// MarshalJSON encodes the duration as a go duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration string (see ParseDuration) or a number of seconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(time.Duration(v) * time.Second)
+	case string:
+		duration, err := ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return ErrInvalidRetention
+	}
+	return nil
+}
+
+// RetentionTier keeps a stream's data at a resolution for a period. A Resolution of 0 is the raw
+// points, otherwise points are rolled up into one Rollup per Resolution window. A Keep of 0 keeps the data forever.
+type RetentionTier struct {
+	Resolution Duration `json:"resolution"`
+	Keep       Duration `json:"keep"`
+}
+
+// RetentionPolicy describes how long a stream's data is kept. A policy may be for a single stream of
+// a device, all streams of a device, a stream name across all devices or, with neither set, the default.
+// The most specific policy applies, streams without any policy are kept forever.
+type RetentionPolicy struct {
+	DeviceID  []byte          `json:"device_id"`
+	Stream    StreamName      `json:"stream"`
+	Tiers     []RetentionTier `json:"tiers"`
+	UpdatedBy string          `json:"updated_by"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// NewRetentionPolicy creates a new empty retention policy
+func NewRetentionPolicy() *RetentionPolicy {
+	return &RetentionPolicy{}
+}
+
+// Valid returns ErrInvalidRetention unless the first tier is the raw points and each following tier is
+// coarser, a multiple of the previous resolution and only starts once the previous one is rolled up:
+// data is never deleted before the next tier's window it belongs to is complete.
+func (p *RetentionPolicy) Valid() error {
+	if p.Stream != "" && !p.Stream.Valid() {
+		return ErrInvalidRetention
+	}
+
+	if len(p.Tiers) == 0 || len(p.Tiers) > MaxRetentionTiers || p.Tiers[0].Resolution != 0 {
+		return ErrInvalidRetention
+	}
+
+	for i, tier := range p.Tiers {
+		if tier.Keep < 0 || (tier.Keep != 0 && tier.Keep < tier.Resolution) {
+			return ErrInvalidRetention
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		previous := p.Tiers[i-1]
+		if tier.Resolution < Duration(time.Second) || tier.Resolution <= previous.Resolution {
+			return ErrInvalidRetention
+		}
+
+		if previous.Resolution != 0 && tier.Resolution%previous.Resolution != 0 {
+			return ErrInvalidRetention
+		}
+
+		if previous.Keep != 0 && previous.Keep < tier.Resolution {
+			return ErrInvalidRetention
+		}
+	}
+	return nil
+}
+
+// Rollups returns the resolutions of the rollup tiers
+func (p *RetentionPolicy) Rollups() []time.Duration {
+	rollups := make([]time.Duration, 0, len(p.Tiers))
+	for _, tier := range p.Tiers[1:] {
+		rollups = append(rollups, time.Duration(tier.Resolution))
+	}
+	return rollups
+}
+
+// Encode the RetentionPolicy into a gob of bytes
+func (p *RetentionPolicy) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(p); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeRetentionPolicy from bytes using gob decoder and return a RetentionPolicy.
+func DecodeRetentionPolicy(policyBytes []byte) (*RetentionPolicy, error) {
+	buf := bytes.NewBuffer(policyBytes)
+	dec := gob.NewDecoder(buf)
+	p := NewRetentionPolicy()
+	err := dec.Decode(p)
+	return p, err
+}
+
+// Rollup summarizes the points of a window. Count includes every point, the remaining fields only
+// the points that were JSON numbers, so any aggregation can still be computed from it.
+type Rollup struct {
+	Count   int     `json:"count"`
+	Numbers int     `json:"numbers"`
+	Sum     float64 `json:"sum"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Last    float64 `json:"last"`
+}
+
+// Add a point's JSON value to the rollup
+func (r *Rollup) Add(value json.RawMessage) {
+	r.Count++
+
+	var number float64
+	if err := json.Unmarshal(value, &number); err != nil {
+		return
+	}
+	r.Merge(&Rollup{Numbers: 1, Sum: number, Min: number, Max: number, Last: number})
+}
+
+// Merge a later rollup into this one
+func (r *Rollup) Merge(other *Rollup) {
+	r.Count += other.Count
+	if other.Numbers == 0 {
+		return
+	}
+
+	if r.Numbers == 0 {
+		r.Min, r.Max = other.Min, other.Max
+	} else {
+		r.Min, r.Max = math.Min(r.Min, other.Min), math.Max(r.Max, other.Max)
+	}
+
+	r.Numbers += other.Numbers
+	r.Sum += other.Sum
+	r.Last = other.Last
+}
+
+// RetentionRun records the outcome of applying the retention policies
+type RetentionRun struct {
+	Started  time.Time `json:"started"`
+	Duration Duration  `json:"duration"`
+	Streams  int       `json:"streams"`
+	RolledUp int       `json:"rolled_up"`
+	Deleted  int       `json:"deleted"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Encode the RetentionRun into a gob of bytes
+func (r *RetentionRun) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(r); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeRetentionRun from bytes using gob decoder and return a RetentionRun.
+func DecodeRetentionRun(runBytes []byte) (*RetentionRun, error) {
+	buf := bytes.NewBuffer(runBytes)
+	dec := gob.NewDecoder(buf)
+	r := &RetentionRun{}
+	err := dec.Decode(r)
+	return r, err
+}
+
+// RetentionService manages retention policies and applies them to the stored telemetry.
+type RetentionService interface {
+	Init() error                                                         // Init the retention service (prepare the tables/bucket whatever)
+	SetPolicy(policy *RetentionPolicy) error                             // SetPolicy adds or replaces the policy for its device and stream
+	DeletePolicy(deviceID []byte, stream StreamName) error               // DeletePolicy removes the policy for the device and stream
+	Policies() ([]*RetentionPolicy, error)                               // Policies returns all policies
+	Policy(deviceID []byte, stream StreamName) (*RetentionPolicy, error) // Policy returns the policy that applies to the stream, nil if there is none
+	Apply(now time.Time) (*RetentionRun, error)                          // Apply rolls up and deletes data as of now
+	LastRun() (*RetentionRun, error)                                     // LastRun returns the outcome of the last Apply, nil if it never ran
+}
+
+// StorageStats describes the size of the database
+type StorageStats struct {
+	Path              string         `json:"path"`
+	FileSize          int64          `json:"file_size"`
+	FreeSize          int64          `json:"free_size"`
+	Buckets           map[string]int `json:"buckets"` // number of keys in each top level bucket, including nested buckets
+	CompactionPending bool           `json:"compaction_pending"`
+	LastCompaction    *Compaction    `json:"last_compaction,omitempty"`
+}
+
+// Compaction records the outcome of rewriting the database file
+type Compaction struct {
+	Time       time.Time `json:"time"`
+	SizeBefore int64     `json:"size_before"`
+	SizeAfter  int64     `json:"size_after"`
+}
+
+// StorageService reports on and maintains the underlying database
+type StorageService interface {
+	Stats() (*StorageStats, error) // Stats returns the current size of the database
+	ScheduleCompaction() error     // ScheduleCompaction rewrites the database file, reclaiming free space, the next time the server starts
+}
@@ -4,10 +4,14 @@ package ewserver
 type RoleService interface {
 	RoleNames() []string                                   // lists role names
 	RoleMap() [][]string                                   // lists subject to role mapping
+	RolesForSubject(subject string) []string               // lists the roles a subject was added to
+	SubjectsForRole(roleName string) []string              // lists the subjects added to a role
+	SubjectExists(subject string) bool                     // returns true if the subject has permissions, roles or subjects of its own
 	Permissions() [][]string                               // lists permissions for roles
 	DeleteRole(roleName string) error                      // deletes all permissions related to this role
 	AddSubjectToRole(subject, roleName string) error       // adds a subject to a role, creating the role if it does not exist
 	DeleteSubjectFromRole(subject, roleName string) error  // deletes a subject from a role, if the only subject in the role, it deletes the role.
+	DeleteSubject(subject string) error                    // deletes the subject from all roles and its own permissions, roles are kept
 	AddPermission(subject, object, method string) error    // adds a new permission for a subject/role
 	DeletePermission(subject, object, method string) error // deletes the permission
 }
@@ -0,0 +1,294 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+const (
+	maxRuleNameLength = 64
+	// MaxRuleFor limits how long a rule's condition may have to hold before it fires
+	MaxRuleFor = 7 * 24 * time.Hour
+)
+
+// ruleForRegex matches an expression ending in a "for <duration>" clause, e.g. "temperature > 80 for 5m"
+var ruleForRegex = regexp.MustCompile(`^(.+?)\s+for\s+(\S+)$`)
+
+// AlertTopic is where alerts are published when they fire and resolve
+const AlertTopic = "alert"
+
+// RuleActionType is what a rule does when it fires
+type RuleActionType string
+
+// supported rule actions
+const (
+	RuleActionAlert   RuleActionType = "alert"   // record an Alert, resolved when the rule resolves
+	RuleActionCommand RuleActionType = "command" // queue a command for the device
+	RuleActionWebhook RuleActionType = "webhook" // POST the RuleNotification to URL when firing and resolving
+)
+
+// RuleAction is a single action of a rule, Command and Args are for command actions and URL for webhooks.
+type RuleAction struct {
+	Type    RuleActionType  `json:"type"`
+	Command string          `json:"command,omitempty"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	URL     string          `json:"url,omitempty"`
+}
+
+// Valid returns ErrInvalidRule if the action is missing what its type requires
+func (a *RuleAction) Valid() error {
+	switch a.Type {
+	case RuleActionAlert:
+		return nil
+	case RuleActionCommand:
+		if err := (&Command{Name: a.Command, Args: a.Args}).Valid(); err != nil {
+			return ErrInvalidRule
+		}
+		return nil
+	case RuleActionWebhook:
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrInvalidRule
+		}
+		return nil
+	}
+	return ErrInvalidRule
+}
+
+// Rule is evaluated against every point published to Stream, by any device or only DeviceID if set.
+// Expression is a govaluate expression that fires the rule once it held for For. The point's value
+// is available as value and as the stream's name, fields of object values by their name:
+// "temperature > 80" or "battery < 3.3 && charging == false". A firing rule resolves once
+// ResolveExpression is true, or Expression is false if it is empty, so a rule firing at
+// "value > 80" may resolve at "value < 75" instead of flapping around 80.
+type Rule struct {
+	ID                uint64       `json:"id"`
+	Name              string       `json:"name"`
+	DeviceID          []byte       `json:"device_id"`
+	Stream            StreamName   `json:"stream"`
+	Expression        string       `json:"expression"`
+	ResolveExpression string       `json:"resolve_expression"`
+	For               Duration     `json:"for"`
+	Actions           []RuleAction `json:"actions"`
+	Disabled          bool         `json:"disabled"`
+	CreatedBy         string       `json:"created_by"`
+	CreatedAt         time.Time    `json:"created_at"`
+	UpdatedAt         time.Time    `json:"updated_at"`
+}
+
+// NewRule creates a new empty rule
+func NewRule() *Rule {
+	return &Rule{}
+}
+
+// Valid returns ErrInvalidRule unless the rule has a name, stream, valid expressions and actions.
+// An expression ending in "for <duration>" is split into Expression and For.
+func (r *Rule) Valid() error {
+	if len(r.Name) == 0 || len(r.Name) > maxRuleNameLength || !r.Stream.Valid() {
+		return ErrInvalidRule
+	}
+
+	if match := ruleForRegex.FindStringSubmatch(strings.TrimSpace(r.Expression)); match != nil {
+		duration, err := ParseDuration(match[2])
+		if err != nil {
+			return ErrInvalidRule
+		}
+		r.Expression, r.For = match[1], Duration(duration)
+	}
+
+	if _, err := govaluate.NewEvaluableExpression(r.Expression); err != nil {
+		return ErrInvalidRule
+	}
+
+	if r.ResolveExpression != "" {
+		if _, err := govaluate.NewEvaluableExpression(r.ResolveExpression); err != nil {
+			return ErrInvalidRule
+		}
+	}
+
+	if r.For < 0 || time.Duration(r.For) > MaxRuleFor {
+		return ErrInvalidRule
+	}
+
+	for i := range r.Actions {
+		if err := r.Actions[i].Valid(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the rule is enabled and evaluates points of the device's stream
+func (r *Rule) Matches(deviceID []byte, stream StreamName) bool {
+	return !r.Disabled && r.Stream == stream && (len(r.DeviceID) == 0 || bytes.Equal(r.DeviceID, deviceID))
+}
+
+// Encode the Rule into a gob of bytes
+func (r *Rule) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(r); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeRule from bytes using gob decoder and return a Rule.
+func DecodeRule(ruleBytes []byte) (*Rule, error) {
+	buf := bytes.NewBuffer(ruleBytes)
+	dec := gob.NewDecoder(buf)
+	r := NewRule()
+	err := dec.Decode(r)
+	return r, err
+}
+
+// RuleParameters returns the expression parameters for a point of the stream: the decoded value as
+// value and the stream's name, and the fields of object values.
+func RuleParameters(stream StreamName, point *DataPoint) (map[string]interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(point.Value, &value); err != nil {
+		return nil, err
+	}
+
+	parameters := make(map[string]interface{})
+	if fields, ok := value.(map[string]interface{}); ok {
+		for name, field := range fields {
+			parameters[name] = field
+		}
+	}
+
+	parameters[string(stream)] = value
+	parameters["value"] = value
+	return parameters, nil
+}
+
+// RuleStatus is the state of a rule for a single device
+type RuleStatus string
+
+// rule statuses
+const (
+	RuleOK      RuleStatus = "ok"      // the expression is false, or the rule resolved
+	RulePending RuleStatus = "pending" // the expression is true but has not been for the rule's For yet
+	RuleFiring  RuleStatus = "firing"  // the rule fired and has not resolved
+)
+
+// RuleState tracks a rule for a single device. Since is when it changed to Status, AlertID is the
+// open alert while firing.
+type RuleState struct {
+	RuleID   uint64          `json:"rule_id"`
+	DeviceID []byte          `json:"device_id"`
+	Status   RuleStatus      `json:"status"`
+	Since    time.Time       `json:"since"`
+	Value    json.RawMessage `json:"value"`
+	AlertID  uint64          `json:"alert_id,omitempty"`
+}
+
+// NewRuleState creates the initial ok state of the rule for the device
+func NewRuleState(ruleID uint64, deviceID []byte) *RuleState {
+	return &RuleState{RuleID: ruleID, DeviceID: deviceID, Status: RuleOK}
+}
+
+// Encode the RuleState into a gob of bytes
+func (s *RuleState) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeRuleState from bytes using gob decoder and return a RuleState.
+func DecodeRuleState(stateBytes []byte) (*RuleState, error) {
+	buf := bytes.NewBuffer(stateBytes)
+	dec := gob.NewDecoder(buf)
+	s := &RuleState{}
+	err := dec.Decode(s)
+	return s, err
+}
+
+// AlertState is whether an alert is still firing
+type AlertState string
+
+// alert states
+const (
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+// Alert records a rule firing for a device until it resolves.
+type Alert struct {
+	ID         uint64          `json:"id"`
+	RuleID     uint64          `json:"rule_id"`
+	RuleName   string          `json:"rule_name"`
+	DeviceID   []byte          `json:"device_id"`
+	Stream     StreamName      `json:"stream"`
+	State      AlertState      `json:"state"`
+	Value      json.RawMessage `json:"value"`
+	FiredAt    time.Time       `json:"fired_at"`
+	ResolvedAt time.Time       `json:"resolved_at"`
+}
+
+// NewAlert creates a new empty alert
+func NewAlert() *Alert {
+	return &Alert{}
+}
+
+// Encode the Alert into a gob of bytes
+func (a *Alert) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(a); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeAlert from bytes using gob decoder and return an Alert.
+func DecodeAlert(alertBytes []byte) (*Alert, error) {
+	buf := bytes.NewBuffer(alertBytes)
+	dec := gob.NewDecoder(buf)
+	a := NewAlert()
+	err := dec.Decode(a)
+	return a, err
+}
+
+// RuleNotification is sent to webhook actions when a rule fires or resolves
+type RuleNotification struct {
+	Rule     string          `json:"rule"`
+	RuleID   uint64          `json:"rule_id"`
+	DeviceID []byte          `json:"device_id"`
+	Stream   StreamName      `json:"stream"`
+	Status   RuleStatus      `json:"status"`
+	Value    json.RawMessage `json:"value"`
+	Time     time.Time       `json:"time"`
+}
+
+// RuleService stores rules, their state per device and the alerts they raised
+type RuleService interface {
+	Init() error                                                                 // Init the rule service (prepare the tables/bucket whatever)
+	Create(rule *Rule) error                                                     // Create validates and stores a new rule, setting its ID
+	Update(rule *Rule) error                                                     // Update replaces an existing rule
+	Rule(id uint64) (*Rule, error)                                               // Rule returns a single rule
+	Rules() ([]*Rule, error)                                                     // Rules returns all rules
+	Delete(id uint64) error                                                      // Delete the rule and its states
+	State(ruleID uint64, deviceID []byte) (*RuleState, error)                    // State returns the rule's state for the device, ok if it was never evaluated
+	States(ruleID uint64) ([]*RuleState, error)                                  // States returns the rule's state for every device it was evaluated for
+	SetState(state *RuleState) error                                             // SetState stores the rule's state for the device
+	CreateAlert(alert *Alert) error                                              // CreateAlert stores a new firing alert, setting its ID
+	ResolveAlert(id uint64, value json.RawMessage, at time.Time) (*Alert, error) // ResolveAlert marks the alert resolved
+	Alerts(state AlertState) ([]*Alert, error)                                   // Alerts returns the alerts in the state, all alerts if it is empty
+}
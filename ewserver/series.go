@@ -0,0 +1,175 @@
+package ewserver
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// MaxSeriesBuckets limits how many buckets a single series query may produce.
+const MaxSeriesBuckets = 10000
+
+// Aggregation is the function used to reduce the points in a bucket to a single value
+type Aggregation string
+
+// supported aggregations
+const (
+	AggregateAvg   Aggregation = "avg"
+	AggregateMin   Aggregation = "min"
+	AggregateMax   Aggregation = "max"
+	AggregateSum   Aggregation = "sum"
+	AggregateCount Aggregation = "count"
+	AggregateLast  Aggregation = "last"
+)
+
+// Valid returns true if the aggregation is supported
+func (a Aggregation) Valid() bool {
+	switch a {
+	case AggregateAvg, AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateLast:
+		return true
+	}
+	return false
+}
+
+// SeriesQuery describes a time range of a stream to be downsampled into buckets of Step
+// width, each reduced to a single value by the Aggregation.
+type SeriesQuery struct {
+	From        time.Time
+	To          time.Time
+	Step        time.Duration
+	Aggregation Aggregation
+}
+
+// Valid returns an error if the query has an empty range, an invalid step or aggregation,
+// or would produce more than MaxSeriesBuckets buckets.
+func (q *SeriesQuery) Valid() error {
+	if q.From.IsZero() || q.To.IsZero() || !q.From.Before(q.To) {
+		return ErrInvalidQuery
+	}
+
+	if q.Step <= 0 || !q.Aggregation.Valid() {
+		return ErrInvalidQuery
+	}
+
+	if q.To.Sub(q.From)/q.Step >= MaxSeriesBuckets {
+		return ErrInvalidQuery
+	}
+	return nil
+}
+
+// BucketStart returns the start of the bucket the timestamp belongs to. Buckets are aligned to From.
+func (q *SeriesQuery) BucketStart(ts time.Time) time.Time {
+	return q.From.Add(ts.Sub(q.From) / q.Step * q.Step)
+}
+
+// SeriesBucket is a single downsampled value of a series. Count is the number of points
+// that were aggregated into the bucket.
+type SeriesBucket struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+	Count     int       `json:"count"`
+}
+
+// Aggregator reduces the values of the points added to it. Points that are not JSON numbers
+// are only included in the count aggregation.
+type Aggregator struct {
+	aggregation Aggregation
+	count       int
+	numbers     int
+	value       float64
+}
+
+// NewAggregator for the supplied aggregation function
+func NewAggregator(aggregation Aggregation) *Aggregator {
+	return &Aggregator{aggregation: aggregation}
+}
+
+// Add the point's JSON value to the aggregate
+func (a *Aggregator) Add(value json.RawMessage) {
+	a.count++
+
+	var number float64
+	if err := json.Unmarshal(value, &number); err != nil {
+		return
+	}
+	a.AddNumber(number)
+}
+
+// AddNumber adds an already decoded numeric value to the aggregate
+func (a *Aggregator) AddNumber(number float64) {
+	if a.numbers == 0 {
+		a.value = number
+		a.numbers++
+		return
+	}
+	a.numbers++
+
+	switch a.aggregation {
+	case AggregateMin:
+		a.value = math.Min(a.value, number)
+	case AggregateMax:
+		a.value = math.Max(a.value, number)
+	case AggregateSum, AggregateAvg:
+		a.value += number
+	case AggregateLast:
+		a.value = number
+	}
+}
+
+// AddRollup adds the points summarized by a rollup to the aggregate
+func (a *Aggregator) AddRollup(rollup *Rollup) {
+	a.count += rollup.Count
+	if rollup.Numbers == 0 {
+		return
+	}
+
+	value := rollup.Sum
+	switch a.aggregation {
+	case AggregateMin:
+		value = rollup.Min
+	case AggregateMax:
+		value = rollup.Max
+	case AggregateLast:
+		value = rollup.Last
+	}
+
+	if a.numbers == 0 {
+		a.value = value
+		a.numbers = rollup.Numbers
+		return
+	}
+	a.numbers += rollup.Numbers
+
+	switch a.aggregation {
+	case AggregateMin:
+		a.value = math.Min(a.value, value)
+	case AggregateMax:
+		a.value = math.Max(a.value, value)
+	case AggregateSum, AggregateAvg:
+		a.value += value
+	case AggregateLast:
+		a.value = value
+	}
+}
+
+// Empty returns true if nothing has been added that contributes to the aggregate
+func (a *Aggregator) Empty() bool {
+	if a.aggregation == AggregateCount {
+		return a.count == 0
+	}
+	return a.numbers == 0
+}
+
+// Bucket returns the aggregated value as a bucket starting at ts.
+func (a *Aggregator) Bucket(ts time.Time) *SeriesBucket {
+	bucket := &SeriesBucket{Timestamp: ts, Value: a.value, Count: a.numbers}
+
+	switch a.aggregation {
+	case AggregateCount:
+		bucket.Value = float64(a.count)
+		bucket.Count = a.count
+	case AggregateAvg:
+		bucket.Value = a.value / float64(a.numbers)
+	}
+	return bucket
+}
@@ -2,10 +2,31 @@ package ewserver
 
 // Services is a simple container of our various domain services
 type Services struct {
-	UserService    UserService
-	APIUserService APIUserService
-	RoleService    RoleService
-	LogService     LogService
+	UserService        UserService
+	APIUserService     APIUserService
+	DeviceRemover      DeviceRemover
+	RoleService        RoleService
+	LogService         LogService
+	TelemetryService   TelemetryService
+	EventService       EventService
+	CommandService     CommandService
+	FirmwareService    FirmwareService
+	ShadowService      ShadowService
+	RetentionService   RetentionService
+	StorageService     StorageService
+	RuleService        RuleService
+	WebhookService     WebhookService
+	PresenceService    PresenceService
+	EnrollmentService  EnrollmentService
+	CertificateService CertificateService
+	RateLimitService   RateLimitService
+	GroupService       GroupService
+	BulkJobService     BulkJobService
+	BulkJobRunner      BulkJobRunner
+	UploadService      UploadService
+	BlobService        BlobService
+	DeviceLogService   DeviceLogService
+	DeviceLogEvents    EventService
 }
 
 // NewServices adds the various services to the Services container
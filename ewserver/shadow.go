@@ -0,0 +1,158 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// MaxShadowSize limits the combined size of a shadow's desired and reported values
+const MaxShadowSize = 64 * 1024
+
+// ShadowState maps top level fields of a shadow section to their JSON values
+type ShadowState map[string]json.RawMessage
+
+// ShadowMetadata records when each field of the desired and reported sections last changed
+type ShadowMetadata struct {
+	Desired  map[string]time.Time `json:"desired"`
+	Reported map[string]time.Time `json:"reported"`
+}
+
+// Shadow is a device's state document. Operators set the Desired state, the device sets the
+// Reported state and the Delta between them tells the device what it still has to change.
+// Version is incremented on every update so writers can detect concurrent changes.
+type Shadow struct {
+	DeviceID  []byte         `json:"device_id"`
+	Desired   ShadowState    `json:"desired"`
+	Reported  ShadowState    `json:"reported"`
+	Metadata  ShadowMetadata `json:"metadata"`
+	Version   uint64         `json:"version"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// NewShadow creates a new empty shadow for the device
+func NewShadow(deviceID []byte) *Shadow {
+	return &Shadow{
+		DeviceID: deviceID,
+		Desired:  make(ShadowState),
+		Reported: make(ShadowState),
+		Metadata: ShadowMetadata{Desired: make(map[string]time.Time), Reported: make(map[string]time.Time)},
+	}
+}
+
+// Delta returns the desired fields whose value differs from the reported value. Values are
+// compared after decoding so formatting and object key order do not matter.
+func (s *Shadow) Delta() ShadowState {
+	delta := make(ShadowState)
+	for field, desired := range s.Desired {
+		reported, ok := s.Reported[field]
+		if !ok || !jsonEqual(desired, reported) {
+			delta[field] = desired
+		}
+	}
+	return delta
+}
+
+// UpdateDesired merges state into the desired section, see update
+func (s *Shadow) UpdateDesired(state ShadowState, version uint64, now time.Time) error {
+	return s.update(s.Desired, s.Metadata.Desired, state, version, now)
+}
+
+// UpdateReported merges state into the reported section, see update
+func (s *Shadow) UpdateReported(state ShadowState, version uint64, now time.Time) error {
+	return s.update(s.Reported, s.Metadata.Reported, state, version, now)
+}
+
+// update merges the fields of state into section, a null value deletes the field. If version is
+// not 0 it must match the shadow's current version or ErrVersionConflict is returned.
+func (s *Shadow) update(section ShadowState, metadata map[string]time.Time, state ShadowState, version uint64, now time.Time) error {
+	if version != 0 && version != s.Version {
+		return ErrVersionConflict
+	}
+
+	for field, value := range state {
+		if field == "" || !json.Valid(value) {
+			return ErrInvalidShadow
+		}
+	}
+
+	for field, value := range state {
+		if string(value) == "null" {
+			delete(section, field)
+			delete(metadata, field)
+			continue
+		}
+		section[field] = value
+		metadata[field] = now
+	}
+
+	if s.size() > MaxShadowSize {
+		return ErrInvalidShadow
+	}
+
+	s.Version++
+	s.UpdatedAt = now
+	return nil
+}
+
+// size returns the combined length of all field names and values
+func (s *Shadow) size() int {
+	size := 0
+	for _, section := range []ShadowState{s.Desired, s.Reported} {
+		for field, value := range section {
+			size += len(field) + len(value)
+		}
+	}
+	return size
+}
+
+// jsonEqual returns true if both documents decode to the same value
+func jsonEqual(a, b json.RawMessage) bool {
+	var av, bv interface{}
+	if err := json.Unmarshal(a, &av); err != nil {
+		return false
+	}
+
+	if err := json.Unmarshal(b, &bv); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// Encode the Shadow into a gob of bytes
+func (s *Shadow) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeShadow from bytes using gob decoder and return a Shadow.
+func DecodeShadow(shadowBytes []byte) (*Shadow, error) {
+	buf := bytes.NewBuffer(shadowBytes)
+	dec := gob.NewDecoder(buf)
+	s := NewShadow(nil)
+	err := dec.Decode(s)
+	return s, err
+}
+
+// ShadowTopic returns the topic a device's shadow is published to when it changes.
+func ShadowTopic(deviceID []byte) string {
+	return "shadow:" + base64.StdEncoding.EncodeToString(deviceID)
+}
+
+// ShadowService stores a shadow document per device
+type ShadowService interface {
+	Init() error                                                                        // Init the shadow service (prepare the tables/bucket whatever)
+	Shadow(deviceID []byte) (*Shadow, error)                                            // Shadow returns the device's shadow, an empty one at version 0 if it has none
+	UpdateDesired(deviceID []byte, state ShadowState, version uint64) (*Shadow, error)  // UpdateDesired merges state into the desired section
+	UpdateReported(deviceID []byte, state ShadowState, version uint64) (*Shadow, error) // UpdateReported merges state into the reported section
+	Delete(deviceID []byte) error                                                       // Delete the device's shadow
+}
@@ -0,0 +1,64 @@
+package ewserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureKeyIDHeader is the ID of the API user that signed the request, base64 encoded
+	SignatureKeyIDHeader = "x-key-id"
+	// SignatureHeader is the base64 HMAC-SHA256 of the request's signature string, keyed with the API key
+	SignatureHeader = "x-signature"
+	// SignatureTimestampHeader is the unix time in seconds the request was signed at
+	SignatureTimestampHeader = "x-timestamp"
+	// SignatureNonceHeader is a value unique to each request, so signed requests can not be replayed
+	SignatureNonceHeader = "x-nonce"
+	// DefaultSignatureSkew is how far a signed request's timestamp may be from the server's clock
+	DefaultSignatureSkew = 5 * time.Minute
+	// SignatureNonceSize is the number of random bytes in nonces generated by SignRequest
+	SignatureNonceSize = 16
+	// MaxSignedBodySize limits the body of a signed request, it is read into memory to verify the signature
+	MaxSignedBodySize = MaxBlobChunkSize
+)
+
+// SignatureString returns the string API users sign: the method, path with query, hex encoded SHA-256 of
+// the body, timestamp and nonce, separated by newlines.
+func SignatureString(method, uri string, body []byte, timestamp, nonce string) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{strings.ToUpper(method), uri, hex.EncodeToString(bodyHash[:]), timestamp, nonce}, "\n")
+}
+
+// Sign returns the base64 HMAC-SHA256 of the signature string keyed with the API key
+func Sign(key APIKey, signatureString string) string {
+	mac := hmac.New(sha256.New, key.Bytes())
+	mac.Write([]byte(signatureString))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature returns true if the signature was made with the API key, in constant time
+func VerifySignature(key APIKey, signatureString, signature string) bool {
+	return hmac.Equal([]byte(Sign(key, signatureString)), []byte(signature))
+}
+
+// SignRequest adds the signature headers to the request of the API user, body must be the request's body.
+func SignRequest(r *http.Request, apiUser *APIUser, body []byte, at time.Time) error {
+	nonce, err := GenerateRandomBytes(SignatureNonceSize)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	encodedNonce := hex.EncodeToString(nonce)
+	r.Header.Set(SignatureKeyIDHeader, base64.StdEncoding.EncodeToString(apiUser.ID))
+	r.Header.Set(SignatureTimestampHeader, timestamp)
+	r.Header.Set(SignatureNonceHeader, encodedNonce)
+	r.Header.Set(SignatureHeader, Sign(apiUser.Key, SignatureString(r.Method, r.URL.RequestURI(), body, timestamp, encodedNonce)))
+	return nil
+}
@@ -0,0 +1,84 @@
+package ewserver
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+)
+
+// maxStreamNameLength limits how long a stream name may be.
+const maxStreamNameLength = 64
+
+// MaxBatchSize is the most points a single batch may publish
+const MaxBatchSize = 5000
+
+var streamNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// StreamName identifies a series of data points published by an API user
+type StreamName string
+
+func (s StreamName) String() string {
+	return string(s)
+}
+
+// Bytes returns the stream name as a byte slice.
+func (s StreamName) Bytes() []byte {
+	return []byte(s)
+}
+
+// Valid returns true if the stream name is non-empty, not too long and only contains
+// letters, digits, '_', '.' or '-' so it is safe to use in URLs and topics.
+func (s StreamName) Valid() bool {
+	return len(s) > 0 && len(s) <= maxStreamNameLength && streamNameRegex.MatchString(string(s))
+}
+
+// DataPoint is a single timestamped JSON value published to a stream
+type DataPoint struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// NewDataPoint creates a new data point
+func NewDataPoint() *DataPoint {
+	return &DataPoint{}
+}
+
+// DecodeDataPoint decodes a payload sent by a device. If the payload is a data point
+// ({"timestamp": ..., "value": ...}) it is used as is, otherwise the whole payload is the value.
+func DecodeDataPoint(payload []byte) *DataPoint {
+	point := NewDataPoint()
+	if err := json.Unmarshal(payload, point); err == nil && len(point.Value) > 0 {
+		return point
+	}
+
+	point = NewDataPoint()
+	point.Value = append(json.RawMessage{}, payload...)
+	return point
+}
+
+// BatchPoint is a data point of one of the streams published in a batch
+type BatchPoint struct {
+	Stream StreamName `json:"stream"`
+	DataPoint
+}
+
+// BatchResult tells if the point at Index of a batch was stored, or why it was rejected
+type BatchResult struct {
+	Index     int        `json:"index"`
+	Stream    StreamName `json:"stream"`
+	Timestamp time.Time  `json:"timestamp"`
+	Accepted  bool       `json:"accepted"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// TelemetryService stores data points published by API users, keyed by the APIUser.ID of the device.
+type TelemetryService interface {
+	Init() error                                                                                          // Init the telemetry service (prepare the tables/bucket whatever)
+	Publish(deviceID []byte, stream StreamName, point *DataPoint) error                                   // Publish stores the point for the device's stream
+	PublishBatch(deviceID []byte, points []*BatchPoint) ([]*BatchResult, error)                           // PublishBatch stores the valid points across the device's streams, returning a result for each
+	Points(deviceID []byte, stream StreamName, from, to time.Time) ([]*DataPoint, error)                  // Points returns all points in the range [from, to)
+	ForEachPoint(deviceID []byte, stream StreamName, from, to time.Time, fn func(*DataPoint) error) error // ForEachPoint calls fn with the points in the range [from, to) from a single read
+	Latest(deviceID []byte, stream StreamName) (*DataPoint, error)                                        // Latest returns the most recent point of the stream
+	Streams(deviceID []byte) ([]StreamName, error)                                                        // Streams returns the names of all streams for the device
+	Series(deviceID []byte, stream StreamName, query *SeriesQuery) ([]*SeriesBucket, error)               // Series returns the downsampled points of the stream
+}
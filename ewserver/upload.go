@@ -0,0 +1,159 @@
+package ewserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
+const (
+	// SequenceHeader carries the upload's sequence number, devices increment it for every upload starting at 1
+	SequenceHeader = "x-sequence"
+	// SequenceEpochHeader carries a counter devices increment when their sequence starts over, such as on boot
+	SequenceEpochHeader = "x-sequence-epoch"
+	// IdempotencyKeyHeader carries a unique key of the upload for devices that do not keep a sequence
+	IdempotencyKeyHeader = "x-idempotency-key"
+	// SequenceHighWaterHeader returns the highest sequence number received from the device
+	SequenceHighWaterHeader = "x-sequence-high-water"
+	// SequenceGapsHeader returns the sequence numbers the device skipped, as ranges like 3-5,9-9
+	SequenceGapsHeader = "x-sequence-gaps"
+)
+
+const (
+	// MaxSequenceGaps is how many gaps are tracked per device, the oldest are forgotten first
+	MaxSequenceGaps = 100
+	// MaxIdempotencyKeyLength limits how long an idempotency key may be
+	MaxIdempotencyKeyLength = 128
+	// IdempotencyKeyTTL is how long an idempotency key is remembered
+	IdempotencyKeyTTL = 24 * time.Hour
+)
+
+// SequenceGap is a range of sequence numbers, From to To inclusive, that were skipped by a device
+type SequenceGap struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// UploadSequence tracks the sequence numbers of a device's uploads in its current epoch. HighWater is the
+// highest received, Gaps are the lower numbers never received. The first upload of an epoch sets the starting
+// point, numbers up to Floor that are not in a gap are before it or in gaps that were forgotten.
+type UploadSequence struct {
+	DeviceID  []byte         `json:"device_id"`
+	Epoch     uint64         `json:"epoch"`
+	HighWater uint64         `json:"high_water"`
+	Floor     uint64         `json:"floor"`
+	Gaps      []*SequenceGap `json:"gaps"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// NewUploadSequence returns the sequence of a device that has not uploaded with a sequence number
+func NewUploadSequence(deviceID []byte) *UploadSequence {
+	return &UploadSequence{DeviceID: deviceID, Gaps: make([]*SequenceGap, 0)}
+}
+
+// Check returns ErrDuplicateUpload if the number was already received in the epoch, and ErrStaleSequence
+// if the epoch is older or the number is at or below the floor, so it is unknown if it was received.
+// A newer epoch starts the sequence over.
+func (s *UploadSequence) Check(epoch, sequence uint64) error {
+	switch {
+	case epoch < s.Epoch:
+		return ErrStaleSequence
+	case epoch > s.Epoch || s.HighWater == 0 || sequence > s.HighWater:
+		return nil
+	}
+
+	for _, gap := range s.Gaps {
+		if sequence >= gap.From && sequence <= gap.To {
+			return nil
+		}
+	}
+
+	if sequence <= s.Floor {
+		return ErrStaleSequence
+	}
+	return ErrDuplicateUpload
+}
+
+// Accept records the sequence number as received, it must have passed Check. A newer epoch starts the
+// sequence over, a number past the high water mark starts a gap of the numbers skipped and a late number
+// in a gap fills it.
+func (s *UploadSequence) Accept(epoch, sequence uint64, at time.Time) {
+	s.UpdatedAt = at
+	if epoch > s.Epoch {
+		s.Epoch, s.HighWater, s.Floor, s.Gaps = epoch, 0, 0, make([]*SequenceGap, 0)
+	}
+
+	if s.HighWater == 0 {
+		s.HighWater, s.Floor = sequence, sequence-1
+		return
+	}
+
+	if sequence > s.HighWater {
+		if sequence > s.HighWater+1 {
+			s.Gaps = append(s.Gaps, &SequenceGap{From: s.HighWater + 1, To: sequence - 1})
+			s.forgetGaps()
+		}
+		s.HighWater = sequence
+		return
+	}
+
+	for i, gap := range s.Gaps {
+		if sequence < gap.From || sequence > gap.To {
+			continue
+		}
+
+		switch {
+		case gap.From == gap.To:
+			s.Gaps = append(s.Gaps[:i], s.Gaps[i+1:]...)
+		case sequence == gap.From:
+			gap.From++
+		case sequence == gap.To:
+			gap.To--
+		default:
+			split := &SequenceGap{From: sequence + 1, To: gap.To}
+			gap.To = sequence - 1
+			s.Gaps = append(s.Gaps[:i+1], append([]*SequenceGap{split}, s.Gaps[i+1:]...)...)
+			s.forgetGaps()
+		}
+		return
+	}
+}
+
+// forgetGaps drops the oldest gaps over MaxSequenceGaps, raising the floor past them
+func (s *UploadSequence) forgetGaps() {
+	if forgotten := len(s.Gaps) - MaxSequenceGaps; forgotten > 0 {
+		s.Floor = s.Gaps[forgotten-1].To
+		s.Gaps = s.Gaps[forgotten:]
+	}
+}
+
+// Encode the UploadSequence into a gob of bytes.
+func (s *UploadSequence) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeUploadSequence from bytes using gob decoder and return an UploadSequence.
+func DecodeUploadSequence(sequenceBytes []byte) (*UploadSequence, error) {
+	buf := bytes.NewBuffer(sequenceBytes)
+	dec := gob.NewDecoder(buf)
+	s := NewUploadSequence(nil)
+	err := dec.Decode(s)
+	return s, err
+}
+
+// UploadService remembers the sequence numbers and idempotency keys of device uploads, so retried
+// uploads are only applied once. Uploads are checked before they are applied and accepted after.
+type UploadService interface {
+	Init() error                                                                     // Init the upload service (prepare the tables/bucket)
+	Sequence(deviceID []byte) (*UploadSequence, error)                               // Sequence returns the device's sequence, a new one if it never sent one
+	AcceptSequence(deviceID []byte, epoch, sequence uint64) (*UploadSequence, error) // AcceptSequence records the number, ErrDuplicateUpload or ErrStaleSequence if it fails Check
+	ResetSequence(deviceID []byte) error                                             // ResetSequence forgets the device's sequence, such as after a factory reset
+	KeySeen(deviceID []byte, key string) (bool, error)                               // KeySeen returns true if the device's idempotency key was accepted
+	AcceptKey(deviceID []byte, key string, at time.Time) error                       // AcceptKey records the key, ErrDuplicateUpload if it was already accepted
+	ExpireKeys(before time.Time) (int, error)                                        // ExpireKeys forgets keys accepted before the time, returning how many
+}
@@ -64,6 +64,7 @@ type UserService interface {
 	Delete(userName UserName) error                                     // Delete the user (admin only)
 	User(userName UserName) (*User, error)                              // User returns the entire user
 	Users() ([]*User, error)                                            // Users returns all users
+	ForEachUser(fn func(*User) error) error                             // ForEachUser calls fn with every user from a single read, stopping at the first error
 }
 
 // AuthnService allows a user to authenticate or change their password
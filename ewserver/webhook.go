@@ -0,0 +1,236 @@
+package ewserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// MaxWebhookAttempts before a delivery is dead lettered
+	MaxWebhookAttempts = 8
+	// WebhookBaseBackoff is the wait after the first failed attempt, doubling with every attempt after it
+	WebhookBaseBackoff = 30 * time.Second
+	// WebhookMaxBackoff limits the wait between attempts
+	WebhookMaxBackoff = time.Hour
+	// WebhookSecretSize is the number of random bytes in a generated secret
+	WebhookSecretSize = 32
+)
+
+// headers sent with every webhook delivery
+const (
+	WebhookSignatureHeader = "X-Ewserver-Signature" // sha256=<hex HMAC of "<timestamp>.<body>">
+	WebhookTimestampHeader = "X-Ewserver-Timestamp" // unix seconds the delivery attempt was signed at
+	WebhookEventHeader     = "X-Ewserver-Event"     // the WebhookEventType
+	WebhookDeliveryHeader  = "X-Ewserver-Delivery"  // the delivery ID, the same for every attempt
+)
+
+// WebhookEventType is a system event webhooks can subscribe to
+type WebhookEventType string
+
+// webhook event types
+const (
+	WebhookAll            WebhookEventType = "*"                // every event
+	WebhookUserCreated    WebhookEventType = "user.created"     // a user was created
+	WebhookUserDeleted    WebhookEventType = "user.deleted"     // a user was deleted
+	WebhookAPIUserCreated WebhookEventType = "api_user.created" // an API user was created
+	WebhookAPIUserDeleted WebhookEventType = "api_user.deleted" // an API user was deleted
+	WebhookRoleChanged    WebhookEventType = "role.changed"     // a role's permissions or members changed
+	WebhookAdminChanged   WebhookEventType = "admin.changed"    // any other successful change through the admin API
+	WebhookLoginFailed    WebhookEventType = "login.failed"     // a user failed to log in
+	WebhookAlertFired     WebhookEventType = "alert.fired"      // a rule raised an alert
+	WebhookAlertResolved  WebhookEventType = "alert.resolved"   // an alert resolved
+)
+
+var webhookEventTypes = map[WebhookEventType]bool{
+	WebhookAll: true, WebhookUserCreated: true, WebhookUserDeleted: true, WebhookAPIUserCreated: true, WebhookAPIUserDeleted: true,
+	WebhookRoleChanged: true, WebhookAdminChanged: true, WebhookLoginFailed: true, WebhookAlertFired: true, WebhookAlertResolved: true,
+}
+
+// AuthTopic is where login attempts are published as AuthEvents
+const AuthTopic = "auth"
+
+// AuthEvent is the Data of events published to the AuthTopic
+type AuthEvent struct {
+	UserName UserName `json:"username"`
+	Client   string   `json:"client"`
+	Success  bool     `json:"success"`
+}
+
+// WebhookSubscription delivers the Events to URL, signing each delivery with Secret.
+type WebhookSubscription struct {
+	ID        uint64             `json:"id"`
+	URL       string             `json:"url"`
+	Secret    string             `json:"secret,omitempty"`
+	Events    []WebhookEventType `json:"events"`
+	Disabled  bool               `json:"disabled"`
+	CreatedBy string             `json:"created_by"`
+	CreatedAt time.Time          `json:"created_at"`
+}
+
+// NewWebhookSubscription creates a new empty subscription
+func NewWebhookSubscription() *WebhookSubscription {
+	return &WebhookSubscription{}
+}
+
+// Valid returns ErrInvalidWebhook unless the subscription has an http(s) URL and known events.
+// A secret is generated if it does not have one.
+func (s *WebhookSubscription) Valid() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(s.Events) == 0 {
+		return ErrInvalidWebhook
+	}
+
+	for _, event := range s.Events {
+		if !webhookEventTypes[event] {
+			return ErrInvalidWebhook
+		}
+	}
+
+	if s.Secret == "" {
+		secret, err := GenerateRandomBytes(WebhookSecretSize)
+		if err != nil {
+			return err
+		}
+		s.Secret = hex.EncodeToString(secret)
+	}
+	return nil
+}
+
+// Subscribed returns true if the subscription is enabled and wants the event
+func (s *WebhookSubscription) Subscribed(event WebhookEventType) bool {
+	if s.Disabled {
+		return false
+	}
+
+	for _, subscribed := range s.Events {
+		if subscribed == event || subscribed == WebhookAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode the WebhookSubscription into a gob of bytes
+func (s *WebhookSubscription) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeWebhookSubscription from bytes using gob decoder and return a WebhookSubscription.
+func DecodeWebhookSubscription(subscriptionBytes []byte) (*WebhookSubscription, error) {
+	buf := bytes.NewBuffer(subscriptionBytes)
+	dec := gob.NewDecoder(buf)
+	s := NewWebhookSubscription()
+	err := dec.Decode(s)
+	return s, err
+}
+
+// SignWebhook returns the signature header value of the body signed at timestamp (unix seconds) with secret.
+// Receivers should recompute it and compare in constant time, rejecting old timestamps to prevent replays.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookPayload is the body of a webhook delivery
+type WebhookPayload struct {
+	Delivery uint64           `json:"delivery"`
+	Event    WebhookEventType `json:"event"`
+	Time     time.Time        `json:"time"`
+	Data     interface{}      `json:"data"`
+}
+
+// WebhookDeliveryState is where a delivery is in the queue
+type WebhookDeliveryState string
+
+// webhook delivery states
+const (
+	WebhookPending   WebhookDeliveryState = "pending"   // waiting for its next attempt
+	WebhookDelivered WebhookDeliveryState = "delivered" // the receiver responded with a 2xx status
+	WebhookDead      WebhookDeliveryState = "dead"      // gave up after MaxWebhookAttempts, may be retried manually
+)
+
+// WebhookDelivery is a single event queued for a subscription and the outcome of its attempts.
+type WebhookDelivery struct {
+	ID             uint64               `json:"id"`
+	SubscriptionID uint64               `json:"subscription_id"`
+	Event          WebhookEventType     `json:"event"`
+	Payload        json.RawMessage      `json:"payload"`
+	State          WebhookDeliveryState `json:"state"`
+	Attempts       int                  `json:"attempts"`
+	NextAttempt    time.Time            `json:"next_attempt"`
+	LastStatus     int                  `json:"last_status"`
+	LastError      string               `json:"last_error"`
+	CreatedAt      time.Time            `json:"created_at"`
+	UpdatedAt      time.Time            `json:"updated_at"`
+}
+
+// NewWebhookDelivery creates a new empty delivery
+func NewWebhookDelivery() *WebhookDelivery {
+	return &WebhookDelivery{}
+}
+
+// WebhookBackoff returns how long to wait before the next attempt after attempts failed attempts.
+func WebhookBackoff(attempts int) time.Duration {
+	backoff := WebhookBaseBackoff
+	for i := 1; i < attempts && backoff < WebhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > WebhookMaxBackoff {
+		return WebhookMaxBackoff
+	}
+	return backoff
+}
+
+// Encode the WebhookDelivery into a gob of bytes
+func (d *WebhookDelivery) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	if err := enc.Encode(d); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeWebhookDelivery from bytes using gob decoder and return a WebhookDelivery.
+func DecodeWebhookDelivery(deliveryBytes []byte) (*WebhookDelivery, error) {
+	buf := bytes.NewBuffer(deliveryBytes)
+	dec := gob.NewDecoder(buf)
+	d := NewWebhookDelivery()
+	err := dec.Decode(d)
+	return d, err
+}
+
+// WebhookService stores webhook subscriptions and queues their deliveries
+type WebhookService interface {
+	Init() error                                                                                // Init the webhook service (prepare the tables/bucket whatever)
+	Create(subscription *WebhookSubscription) error                                             // Create validates and stores a new subscription, setting its ID
+	Subscription(id uint64) (*WebhookSubscription, error)                                       // Subscription returns a single subscription
+	Subscriptions() ([]*WebhookSubscription, error)                                             // Subscriptions returns all subscriptions
+	Delete(id uint64) error                                                                     // Delete the subscription and dead letter its pending deliveries
+	Enqueue(event WebhookEventType, data interface{}, at time.Time) ([]*WebhookDelivery, error) // Enqueue a delivery of the event for every subscription that wants it
+	Due(now time.Time, limit int) ([]*WebhookDelivery, error)                                   // Due returns up to limit pending deliveries whose next attempt is not after now
+	Record(id uint64, status int, message string, at time.Time) (*WebhookDelivery, error)       // Record the outcome of an attempt, a 2xx status without a message is delivered
+	Retry(id uint64) (*WebhookDelivery, error)                                                  // Retry requeues a dead delivery for an immediate attempt
+	Deliveries(subscriptionID uint64, state WebhookDeliveryState) ([]*WebhookDelivery, error)   // Deliveries returns the delivery log, filtered by subscription and state if set
+	Prune(before time.Time) (int, error)                                                        // Prune deletes delivered and dead deliveries last updated before, returning how many
+}
@@ -1,10 +1,18 @@
 package authz
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
 
 // Authorizer handles authorizing HTTP requests
 type Authorizer interface {
 	Authorize(r *http.Request) bool
-	APIAuthorize(r *http.Request, apiKey string) bool    // APIAuthorize for an API User
-	UserAuthorize(r *http.Request, username string) bool // UserAuthorize for regular users
+	AuthorizeRequest(r *http.Request) (*ewserver.APIUser, bool) // AuthorizeRequest and return the API user that made it, nil for users
+	APIAuthorize(r *http.Request, apiKey string) bool           // APIAuthorize for an API User
+	UserAuthorize(r *http.Request, username string) bool        // UserAuthorize for regular users
+	CertAuthorize(r *http.Request, deviceID []byte) bool        // CertAuthorize for devices with a verified client certificate
+	SignatureAuthorize(r *http.Request, keyID string) bool      // SignatureAuthorize for API users signing requests with their key
+	Enforce(subject, object, action string) bool                // Enforce a policy directly, for protocols other than HTTP
 }
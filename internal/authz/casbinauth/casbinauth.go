@@ -1,7 +1,12 @@
 package casbinauth
 
 import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/casbin/casbin"
 	"github.com/wirepair/ewserver/ewserver"
@@ -14,42 +19,173 @@ type CasbinAuthorizer struct {
 	apiUserService ewserver.APIUserService
 	sessions       session.Manager
 	logger         ewserver.LogService
+	skew           time.Duration
+	nonces         *nonceCache
 }
 
 // NewAuthorizer returns a new CasbinAuthorizer
 func NewAuthorizer(enforcer *casbin.SyncedEnforcer, apiUserService ewserver.APIUserService, sessions session.Manager, logService ewserver.LogService) *CasbinAuthorizer {
-	return &CasbinAuthorizer{enforcer: enforcer, apiUserService: apiUserService, sessions: sessions, logger: logService}
+	return &CasbinAuthorizer{
+		enforcer:       enforcer,
+		apiUserService: apiUserService,
+		sessions:       sessions,
+		logger:         logService,
+		skew:           ewserver.DefaultSignatureSkew,
+		nonces:         newNonceCache(2 * ewserver.DefaultSignatureSkew),
+	}
 }
 
 // Authorize validates the user data from a request is authorized to access a resource
 func (a *CasbinAuthorizer) Authorize(r *http.Request) bool {
-	// Check API based auth first
+	_, ok := a.AuthorizeRequest(r)
+	return ok
+}
+
+// AuthorizeRequest authorizes the request and returns the API user that made it, or nil for session users.
+// Requests may only carry one kind of credential so the identity handlers act on is the one that was authorized.
+func (a *CasbinAuthorizer) AuthorizeRequest(r *http.Request) (*ewserver.APIUser, bool) {
+	deviceID, hasCert := ewserver.PeerDeviceID(r)
+	keyID := r.Header.Get(ewserver.SignatureKeyIDHeader)
 	apiKey := r.Header.Get(ewserver.APIKeyHeader)
 
-	// if apikey is not empty and they are authorized, return true.
-	if apiKey != "" && a.APIAuthorize(r, apiKey) {
-		return true
+	credentials := 0
+	for _, present := range []bool{hasCert, keyID != "", apiKey != ""} {
+		if present {
+			credentials++
+		}
+	}
+
+	if credentials > 1 {
+		a.logger.Error("request with more than one credential denied", "object", r.URL.Path, "ipaddr", r.RemoteAddr)
+		return nil, false
+	}
+
+	switch {
+	case hasCert:
+		// devices with a verified client certificate are identified by it
+		return a.certUser(r, deviceID)
+	case keyID != "":
+		// signed requests must verify, they do not fall back to the session
+		return a.signatureUser(r, keyID)
+	case apiKey != "":
+		if user, ok := a.apiUser(r, apiKey); ok {
+			return user, true
+		}
 	}
 
 	user := &ewserver.User{}
 	if err := a.sessions.Load(r, "user", user); err != nil {
-		return false
+		return nil, false
 	}
-	return a.UserAuthorize(r, string(user.UserName))
+	return nil, a.UserAuthorize(r, string(user.UserName))
 }
 
 // APIAuthorize for API Users
 func (a *CasbinAuthorizer) APIAuthorize(r *http.Request, apiKey string) bool {
+	_, ok := a.apiUser(r, apiKey)
+	return ok
+}
+
+// CertAuthorize for devices, the certificate's device must still be an API user.
+func (a *CasbinAuthorizer) CertAuthorize(r *http.Request, deviceID []byte) bool {
+	_, ok := a.certUser(r, deviceID)
+	return ok
+}
+
+// SignatureAuthorize for API users signing requests with their key instead of sending it. The timestamp
+// must be within the clock skew window and the nonce must not have been used in it.
+func (a *CasbinAuthorizer) SignatureAuthorize(r *http.Request, keyID string) bool {
+	_, ok := a.signatureUser(r, keyID)
+	return ok
+}
+
+// apiUser authorizes the API user with the api key
+func (a *CasbinAuthorizer) apiUser(r *http.Request, apiKey string) (*ewserver.APIUser, bool) {
 	user, err := a.apiUserService.APIUser(ewserver.APIKey(apiKey))
-	if err != nil || user.Name == "" {
-		return false
+	if err != nil || user.Name == "" || user.Disabled {
+		return nil, false
 	}
 
 	subject := user.Name
 	object := r.URL.Path
 	action := r.Method
 	a.logger.Info("apiuser authorization attempt", "subject", subject, "object", object, "action", action, "ipaddr", r.RemoteAddr)
-	return a.enforcer.Enforce(subject, object, action)
+	if !a.enforcer.Enforce(subject, object, action) {
+		return nil, false
+	}
+	return user, true
+}
+
+// certUser authorizes the API user of the device identified by its client certificate, found through the API user ID index
+func (a *CasbinAuthorizer) certUser(r *http.Request, deviceID []byte) (*ewserver.APIUser, bool) {
+	user, err := a.apiUserService.APIUserByID([]byte(base64.StdEncoding.EncodeToString(deviceID)))
+	if err != nil || user.Name == "" || user.Disabled {
+		return nil, false
+	}
+
+	subject := user.Name
+	object := r.URL.Path
+	action := r.Method
+	a.logger.Info("certificate authorization attempt", "subject", subject, "object", object, "action", action, "ipaddr", r.RemoteAddr)
+	if !a.enforcer.Enforce(subject, object, action) {
+		return nil, false
+	}
+	return user, true
+}
+
+// signatureUser authorizes the API user that signed the request. The headers and clock skew are checked
+// before the key ID is looked up so malformed and stale requests cost no database reads.
+func (a *CasbinAuthorizer) signatureUser(r *http.Request, keyID string) (*ewserver.APIUser, bool) {
+	timestamp := r.Header.Get(ewserver.SignatureTimestampHeader)
+	nonce := r.Header.Get(ewserver.SignatureNonceHeader)
+	signature := r.Header.Get(ewserver.SignatureHeader)
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || signature == "" {
+		return nil, false
+	}
+
+	now := time.Now()
+	if skew := now.Sub(time.Unix(signedAt, 0)); skew > a.skew || skew < -a.skew {
+		a.logger.Error("signed request outside the clock skew window", "key_id", keyID, "timestamp", timestamp, "ipaddr", r.RemoteAddr)
+		return nil, false
+	}
+
+	user, err := a.apiUserService.APIUserByID([]byte(keyID))
+	if err != nil || user.Name == "" || user.Disabled {
+		return nil, false
+	}
+
+	// the body is hashed for the signature and put back for the handlers, the largest a device may send
+	// is a blob chunk so anything bigger is rejected before it is buffered
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, ewserver.MaxSignedBodySize)); err != nil {
+			a.logger.Error("error reading signed request body", "subject", user.Name, "error", err, "ipaddr", r.RemoteAddr)
+			return nil, false
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if !ewserver.VerifySignature(user.Key, ewserver.SignatureString(r.Method, r.URL.RequestURI(), body, timestamp, nonce), signature) {
+		a.logger.Error("invalid request signature", "subject", user.Name, "ipaddr", r.RemoteAddr)
+		return nil, false
+	}
+
+	// only remember nonces of valid signatures so they can not be used to block a device's requests
+	if !a.nonces.Use(keyID+":"+nonce, now) {
+		a.logger.Error("replayed signed request", "subject", user.Name, "nonce", nonce, "ipaddr", r.RemoteAddr)
+		return nil, false
+	}
+
+	subject := user.Name
+	object := r.URL.Path
+	action := r.Method
+	a.logger.Info("signed apiuser authorization attempt", "subject", subject, "object", object, "action", action, "ipaddr", r.RemoteAddr)
+	if !a.enforcer.Enforce(subject, object, action) {
+		return nil, false
+	}
+	return user, true
 }
 
 // UserAuthorize for regular users
@@ -60,3 +196,10 @@ func (a *CasbinAuthorizer) UserAuthorize(r *http.Request, username string) bool
 	a.logger.Info("user authorization attempt", "subject", subject, "object", object, "action", action, "ipaddr", r.RemoteAddr)
 	return a.enforcer.Enforce(subject, object, action)
 }
+
+// Enforce the policy for the subject accessing the object with the action, used for
+// protocols other than HTTP which map their resources to objects.
+func (a *CasbinAuthorizer) Enforce(subject, object, action string) bool {
+	a.logger.Info("authorization attempt", "subject", subject, "object", object, "action", action)
+	return a.enforcer.Enforce(subject, object, action)
+}
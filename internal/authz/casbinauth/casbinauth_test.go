@@ -1,11 +1,17 @@
 package casbinauth
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/wirepair/bolt-adapter"
 
@@ -131,6 +137,211 @@ func TestCasbinAuthorizer_Authorize2(t *testing.T) {
 	}
 }
 
+func TestCasbinAuthorizer_CertAuthorize(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	adapter := boltadapter.NewAdapter(db.DB())
+	enforcer := casbin.NewSyncedEnforcer("testdata/rbac_model.conf", adapter)
+	enforcer.AddPolicy("apiusers", "/api/", "GET")
+	enforcer.AddGroupingPolicy("device1", "apiusers")
+
+	deviceID := []byte("device1 id")
+	disabled := false
+	usapi := &mock.APIUserService{}
+	usapi.APIUserByIDFn = func(ID []byte) (*ewserver.APIUser, error) {
+		if string(ID) != base64.StdEncoding.EncodeToString(deviceID) {
+			return nil, ewserver.ErrUserNotFound
+		}
+		return &ewserver.APIUser{Name: "device1", ID: deviceID, Disabled: disabled}, nil
+	}
+	auth := NewAuthorizer(enforcer, usapi, &mock.Sessions{}, &mock.Log{})
+
+	peer := func(method string, id []byte) *http.Request {
+		req := httptest.NewRequest(method, "http://ewserver/api/", nil)
+		cert := &x509.Certificate{URIs: []*url.URL{ewserver.DeviceIdentity(id)}}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+
+	if !auth.Authorize(peer("GET", deviceID)) {
+		t.Fatalf("error GET with the device's certificate should be authorized\n")
+	}
+
+	if auth.Authorize(peer("POST", deviceID)) {
+		t.Fatalf("error POST with the device's certificate should be denied\n")
+	}
+
+	if apiUser, ok := auth.AuthorizeRequest(peer("GET", deviceID)); !ok || apiUser == nil || apiUser.Name != "device1" {
+		t.Fatalf("expected the device's api user to be returned got: %v\n", apiUser)
+	}
+
+	// a second credential could be used to act as another device in the handlers
+	req := peer("GET", deviceID)
+	req.Header.Set(ewserver.SignatureKeyIDHeader, "other device id")
+	if auth.Authorize(req) {
+		t.Fatalf("error GET with a certificate and a key ID should be denied\n")
+	}
+
+	req = peer("GET", deviceID)
+	req.Header.Set(ewserver.APIKeyHeader, "other device key")
+	if auth.Authorize(req) {
+		t.Fatalf("error GET with a certificate and an API key should be denied\n")
+	}
+
+	if auth.Authorize(peer("GET", []byte("deleted device"))) {
+		t.Fatalf("error GET with a certificate of an unknown device should be denied\n")
+	}
+
+	disabled = true
+	if auth.Authorize(peer("GET", deviceID)) {
+		t.Fatalf("error GET with the certificate of a disabled device should be denied\n")
+	}
+}
+
+func TestCasbinAuthorizer_CertAuthorizeIndexed(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	adapter := boltadapter.NewAdapter(db.DB())
+	enforcer := casbin.NewSyncedEnforcer("testdata/rbac_model.conf", adapter)
+	enforcer.AddPolicy("apiusers", "/api/", "GET")
+	enforcer.AddGroupingPolicy("device1", "apiusers")
+
+	usapi := boltdb.NewAPIUserService(db.DB())
+	if err := usapi.Init(); err != nil {
+		t.Fatalf("error initializing API user service: %s\n", err)
+	}
+
+	device := &ewserver.APIUser{Key: "device1 key", Name: "device1"}
+	if err := usapi.Create(device); err != nil {
+		t.Fatalf("error creating API user: %s\n", err)
+	}
+	auth := NewAuthorizer(enforcer, usapi, &mock.Sessions{}, &mock.Log{})
+
+	req := httptest.NewRequest("GET", "http://ewserver/api/", nil)
+	cert := &x509.Certificate{URIs: []*url.URL{ewserver.DeviceIdentity(device.ID)}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	// the certificate is resolved through the ID index, which follows the device's key
+	if err := usapi.RotateKey(device, "device1 new key"); err != nil {
+		t.Fatalf("error rotating key: %s\n", err)
+	}
+
+	if apiUser, ok := auth.AuthorizeRequest(req); !ok || apiUser == nil || apiUser.Key != "device1 new key" {
+		t.Fatalf("expected the device's current API user to be returned got: %v\n", apiUser)
+	}
+
+	if err := usapi.Delete(device.Key); err != nil {
+		t.Fatalf("error deleting API user: %s\n", err)
+	}
+
+	if auth.Authorize(req) {
+		t.Fatalf("error GET with the certificate of a deleted device should be denied\n")
+	}
+}
+
+func TestCasbinAuthorizer_SignatureAuthorize(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	adapter := boltadapter.NewAdapter(db.DB())
+	enforcer := casbin.NewSyncedEnforcer("testdata/rbac_model.conf", adapter)
+	enforcer.AddPolicy("apiusers", "/api/", "(GET|POST)")
+	enforcer.AddGroupingPolicy("device1", "apiusers")
+
+	apiUser := &ewserver.APIUser{Name: "device1", ID: []byte("device1 id"), Key: "device1 key"}
+	usapi := &mock.APIUserService{}
+	usapi.APIUserByIDFn = func(ID []byte) (*ewserver.APIUser, error) {
+		if string(ID) != base64.StdEncoding.EncodeToString(apiUser.ID) {
+			return nil, ewserver.ErrUserNotFound
+		}
+		return apiUser, nil
+	}
+	auth := NewAuthorizer(enforcer, usapi, &mock.Sessions{}, &mock.Log{})
+
+	signed := func(method, body string, key ewserver.APIKey, at time.Time) *http.Request {
+		req := httptest.NewRequest(method, "http://ewserver/api/?q=1", strings.NewReader(body))
+		signer := *apiUser
+		signer.Key = key
+		if err := ewserver.SignRequest(req, &signer, []byte(body), at); err != nil {
+			t.Fatalf("error signing request: %s\n", err)
+		}
+		return req
+	}
+
+	req := signed("POST", `{"value":1}`, apiUser.Key, time.Now())
+	if !auth.Authorize(req) {
+		t.Fatalf("error POST with a valid signature should be authorized\n")
+	}
+
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != `{"value":1}` {
+		t.Fatalf("expected the body to be readable after verifying got: %s\n", body)
+	}
+
+	if auth.Authorize(req) {
+		t.Fatalf("error replaying a signed request should be denied\n")
+	}
+
+	if auth.Authorize(signed("GET", "", "wrong key", time.Now())) {
+		t.Fatalf("error GET signed with the wrong key should be denied\n")
+	}
+
+	usapi.APIUserByIDInvoked = false
+	if auth.Authorize(signed("GET", "", apiUser.Key, time.Now().Add(-2*ewserver.DefaultSignatureSkew))) {
+		t.Fatalf("error GET signed outside the skew window should be denied\n")
+	}
+
+	unsigned := httptest.NewRequest("GET", "http://ewserver/api/", nil)
+	unsigned.Header.Set(ewserver.SignatureKeyIDHeader, base64.StdEncoding.EncodeToString(apiUser.ID))
+	if auth.Authorize(unsigned) {
+		t.Fatalf("error GET with a key ID and no signature should be denied\n")
+	}
+
+	if usapi.APIUserByIDInvoked {
+		t.Fatalf("error stale and unsigned requests should be denied before the key ID is looked up\n")
+	}
+
+	tampered := signed("POST", `{"value":1}`, apiUser.Key, time.Now())
+	tampered.Body = ioutil.NopCloser(strings.NewReader(`{"value":2}`))
+	if auth.Authorize(tampered) {
+		t.Fatalf("error POST with a modified body should be denied\n")
+	}
+
+	if auth.Authorize(signed("POST", strings.Repeat("a", ewserver.MaxSignedBodySize+1), apiUser.Key, time.Now())) {
+		t.Fatalf("error POST with a body over the limit should be denied\n")
+	}
+
+	// signed requests must not fall back to the session
+	sessions := &mock.Sessions{}
+	sessions.LoadFn = func(req *http.Request, key string, val interface{}) error {
+		val.(*ewserver.User).UserName = "device1"
+		return nil
+	}
+	auth = NewAuthorizer(enforcer, usapi, sessions, &mock.Log{})
+	if auth.Authorize(signed("GET", "", "wrong key", time.Now())) {
+		t.Fatalf("error an invalid signature should be denied even with a session\n")
+	}
+}
+
 func testRemoveDbFile(dbFileName string, t *testing.T) {
 	if err := os.Remove(dbFileName); err != nil {
 		t.Fatalf("error removing file: %s\n", err)
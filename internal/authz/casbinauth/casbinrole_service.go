@@ -40,6 +40,34 @@ func (r *CasbinRoleService) RoleMap() [][]string {
 	return r.enforcer.GetNamedGroupingPolicy("g")
 }
 
+// RolesForSubject returns the roles the subject was added to
+func (r *CasbinRoleService) RolesForSubject(subject string) []string {
+	return r.enforcer.GetRolesForUser(subject)
+}
+
+// SubjectsForRole returns the subjects added to the role
+func (r *CasbinRoleService) SubjectsForRole(roleName string) []string {
+	return r.enforcer.GetUsersForRole(roleName)
+}
+
+// SubjectExists returns true if the subject is in any policy or grouping, as a user, role or group
+func (r *CasbinRoleService) SubjectExists(subject string) bool {
+	for _, policy := range r.enforcer.GetPolicy() {
+		if len(policy) > 0 && policy[0] == subject {
+			return true
+		}
+	}
+
+	for _, grouping := range r.enforcer.GetGroupingPolicy() {
+		for _, name := range grouping {
+			if name == subject {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Permissions returns all defined for this role service
 func (r *CasbinRoleService) Permissions() [][]string {
 	return r.enforcer.GetNamedPolicy("p")
@@ -72,6 +100,14 @@ func (r *CasbinRoleService) DeleteSubjectFromRole(subject, roleName string) erro
 	return nil
 }
 
+// DeleteSubject removes the subject from all of its roles and deletes its own permissions. Unlike
+// DeleteSubjectFromRole, roles left without subjects keep their permissions.
+func (r *CasbinRoleService) DeleteSubject(subject string) error {
+	r.enforcer.DeleteUser(subject)
+	r.enforcer.RemoveFilteredPolicy(0, subject)
+	return nil
+}
+
 // AddPermission adds an allow permission for either a user/group to access an object using the supplied method
 func (r *CasbinRoleService) AddPermission(subject, object, method string) error {
 	if !strings.HasPrefix(object, "/") {
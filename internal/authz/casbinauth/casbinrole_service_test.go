@@ -53,11 +53,65 @@ func TestCasbinRoleService_Groups(t *testing.T) {
 		t.Fatalf("expected roleMap to contain admin -> root mapping: got %#v\n", roleMap[0])
 	}
 
+	if roles := service.RolesForSubject("root"); !reflect.DeepEqual(roles, []string{"admin"}) {
+		t.Fatalf("expected root to be in the admin role got: %#v\n", roles)
+	}
+
 	if err := service.DeleteRole("admin"); err != nil {
 		t.Fatalf("unable to delete group: ")
 	}
 }
 
+func TestCasbinRoleService_DeleteSubject(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	adapter := boltadapter.NewAdapter(db.DB())
+	enforcer := casbin.NewSyncedEnforcer("testdata/rbac_model.conf", adapter)
+	testAddDefaultPolicy(enforcer)
+	service := NewRoleService(enforcer)
+
+	if err := service.AddSubjectToRole("device1", "apiuser"); err != nil {
+		t.Fatalf("error adding subject to role: %s\n", err)
+	}
+
+	if err := service.AddPermission("device1", "/v1/api/device1", "GET"); err != nil {
+		t.Fatalf("error adding permission: %s\n", err)
+	}
+
+	if subjects := service.SubjectsForRole("apiuser"); !reflect.DeepEqual(subjects, []string{"device1"}) {
+		t.Fatalf("expected device1 in the apiuser role got: %#v\n", subjects)
+	}
+
+	for _, subject := range []string{"device1", "apiuser", "admin", "root"} {
+		if !service.SubjectExists(subject) {
+			t.Fatalf("expected %s to exist as a subject\n", subject)
+		}
+	}
+
+	if service.SubjectExists("device2") {
+		t.Fatalf("expected device2 to not exist as a subject\n")
+	}
+
+	if err := service.DeleteSubject("device1"); err != nil {
+		t.Fatalf("error deleting subject: %s\n", err)
+	}
+
+	if roles := service.RolesForSubject("device1"); len(roles) != 0 {
+		t.Fatalf("expected device1 to have no roles got: %#v\n", roles)
+	}
+
+	if enforcer.HasPolicy("device1", "/v1/api/device1", "GET") || !enforcer.HasPolicy("apiuser", "/v1/api/", "(GET|POST)") {
+		t.Fatalf("expected only the subject's own permissions to be deleted\n")
+	}
+}
+
 func testAddDefaultPolicy(enforcer *casbin.SyncedEnforcer) {
 	enforcer.AddPolicy("admin", "/", ".*")
 	enforcer.AddPolicy("apiuser", "/v1/api/", "(GET|POST)")
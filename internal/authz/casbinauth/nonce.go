@@ -0,0 +1,42 @@
+package casbinauth
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceCache remembers the nonces of signed requests for as long as their timestamps are accepted,
+// so a captured request can not be replayed within the clock skew window.
+type nonceCache struct {
+	lock   sync.Mutex
+	ttl    time.Duration
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{ttl: ttl, nonces: make(map[string]time.Time)}
+}
+
+// Use returns true and remembers the nonce if it was not used before, expired nonces are
+// pruned at most once per ttl.
+func (n *nonceCache) Use(nonce string, now time.Time) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if now.Sub(n.pruned) > n.ttl {
+		for key, expires := range n.nonces {
+			if now.After(expires) {
+				delete(n.nonces, key)
+			}
+		}
+		n.pruned = now
+	}
+
+	if expires, ok := n.nonces[nonce]; ok && !now.After(expires) {
+		return false
+	}
+
+	n.nonces[nonce] = now.Add(n.ttl)
+	return true
+}
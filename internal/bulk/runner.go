@@ -0,0 +1,328 @@
+// Package bulk runs an action on every device of a group as a job tracking each device's result.
+package bulk
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// SaveEvery is how many device results a running job records between saving its progress
+const SaveEvery = 25
+
+// action applies a bulk action to a single device. setup, if set, runs once before the first device
+// and finish, if set, once after the last.
+type action struct {
+	setup  func() error
+	apply  func(apiUser *ewserver.APIUser) (json.RawMessage, error)
+	finish func()
+}
+
+// Runner starts bulk jobs and runs each in its own goroutine. The members of a group are read when
+// the job starts, devices added to the group while it runs are not included.
+type Runner struct {
+	jobs     ewserver.BulkJobService
+	groups   ewserver.GroupService
+	roles    ewserver.RoleService
+	apiUsers ewserver.APIUserService
+	commands ewserver.CommandService
+	firmware ewserver.FirmwareService
+	remover  ewserver.DeviceRemover
+	logger   ewserver.LogService
+
+	mu   sync.Mutex
+	keys map[uint64]map[string]ewserver.APIKey // keys of completed rotate_key jobs not yet collected
+}
+
+// New creates a runner of jobs stored in jobs. Jobs still running from before a restart are marked
+// interrupted, the devices without a result were not processed.
+func New(jobs ewserver.BulkJobService, groups ewserver.GroupService, roles ewserver.RoleService, apiUsers ewserver.APIUserService, commands ewserver.CommandService, firmware ewserver.FirmwareService, remover ewserver.DeviceRemover, logger ewserver.LogService) (*Runner, error) {
+	stored, err := jobs.Jobs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range stored {
+		if job.State != ewserver.BulkRunning {
+			continue
+		}
+
+		job.State = ewserver.BulkInterrupted
+		job.FinishedAt = time.Now().UTC()
+		if err := jobs.Save(job); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Runner{jobs: jobs, groups: groups, roles: roles, apiUsers: apiUsers, commands: commands, firmware: firmware, remover: remover, logger: logger, keys: make(map[uint64]map[string]ewserver.APIKey)}, nil
+}
+
+// Start validates the job's action and arguments, stores it with the group's current members as its
+// total and runs it in the background. The job's ID is set when Start returns.
+func (r *Runner) Start(job *ewserver.BulkJob) error {
+	if _, err := r.groups.Group(job.Group); err != nil {
+		return err
+	}
+
+	act, err := r.prepare(job)
+	if err != nil {
+		return err
+	}
+
+	members, err := r.members(job.Group)
+	if err != nil {
+		return err
+	}
+
+	job.State = ewserver.BulkRunning
+	job.Total = len(members)
+	job.Succeeded = 0
+	job.Failed = 0
+	job.Results = make([]*ewserver.BulkResult, 0, len(members))
+	job.CreatedAt = time.Now().UTC()
+	if err := r.jobs.Create(job); err != nil {
+		return err
+	}
+
+	r.logger.Info("bulk job started", "job", job.ID, "group", job.Group, "action", string(job.Action), "devices", job.Total, "created_by", job.CreatedBy)
+	go r.run(job, members, act)
+	return nil
+}
+
+// run applies the action to each member, saving the progress every SaveEvery results and when done.
+func (r *Runner) run(job *ewserver.BulkJob, members []*ewserver.APIUser, act *action) {
+	var setupErr error
+	if act.setup != nil {
+		setupErr = act.setup()
+	}
+
+	for i, member := range members {
+		if setupErr != nil {
+			job.AddResult(member, nil, setupErr)
+		} else {
+			apiUser, err := r.current(member)
+			if err != nil {
+				job.AddResult(member, nil, err)
+			} else {
+				result, err := act.apply(apiUser)
+				job.AddResult(apiUser, result, err)
+			}
+		}
+
+		if (i+1)%SaveEvery == 0 && i+1 < len(members) {
+			if err := r.jobs.Save(job); err != nil {
+				r.logger.Error("error saving bulk job progress", "job", job.ID, "error", err)
+			}
+		}
+	}
+
+	if act.finish != nil {
+		act.finish()
+	}
+
+	job.State = ewserver.BulkCompleted
+	job.FinishedAt = time.Now().UTC()
+	if err := r.jobs.Save(job); err != nil {
+		r.logger.Error("error saving bulk job", "job", job.ID, "error", err)
+		return
+	}
+	r.logger.Info("bulk job completed", "job", job.ID, "group", job.Group, "action", string(job.Action), "succeeded", job.Succeeded, "failed", job.Failed)
+}
+
+// Keys returns the new keys of a completed rotate_key job by device name and forgets them, so they are
+// only returned once. ErrKeysNotAvailable if the job is running or its keys were already collected.
+func (r *Runner) Keys(id uint64) (map[string]ewserver.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys, ok := r.keys[id]
+	if !ok {
+		return nil, ewserver.ErrKeysNotAvailable
+	}
+	delete(r.keys, id)
+	return keys, nil
+}
+
+// members returns the API users in the group's role ordered like APIUsers, subjects that are not
+// API users are ignored.
+func (r *Runner) members(group string) ([]*ewserver.APIUser, error) {
+	names := make(map[string]struct{})
+	for _, subject := range r.roles.SubjectsForRole(ewserver.GroupRole(group)) {
+		names[subject] = struct{}{}
+	}
+
+	members := make([]*ewserver.APIUser, 0, len(names))
+	if len(names) == 0 {
+		return members, nil
+	}
+
+	err := r.apiUsers.ForEachAPIUser(func(apiUser *ewserver.APIUser) error {
+		if _, ok := names[apiUser.Name]; ok {
+			members = append(members, apiUser)
+		}
+		return nil
+	})
+	return members, err
+}
+
+// current reloads the member, it may have changed since the job started
+func (r *Runner) current(member *ewserver.APIUser) (*ewserver.APIUser, error) {
+	if apiUser, err := r.apiUsers.APIUser(member.Key); err == nil {
+		return apiUser, nil
+	}
+	return r.apiUsers.APIUserByID([]byte(base64.StdEncoding.EncodeToString(member.ID)))
+}
+
+// prepare returns the job's action with its arguments, ErrInvalidBulkJob if either is invalid
+func (r *Runner) prepare(job *ewserver.BulkJob) (*action, error) {
+	switch job.Action {
+	case ewserver.BulkCommand:
+		return r.commandAction(job)
+	case ewserver.BulkFirmware:
+		return r.firmwareAction(job)
+	case ewserver.BulkRotateKey:
+		return r.rotateKeyAction(job), nil
+	case ewserver.BulkDisable:
+		return &action{apply: func(apiUser *ewserver.APIUser) (json.RawMessage, error) {
+			return nil, r.apiUsers.SetDisabled(apiUser.Key, true)
+		}}, nil
+	case ewserver.BulkEnable:
+		return &action{apply: func(apiUser *ewserver.APIUser) (json.RawMessage, error) {
+			return nil, r.apiUsers.SetDisabled(apiUser.Key, false)
+		}}, nil
+	case ewserver.BulkDelete:
+		return &action{apply: r.delete}, nil
+	}
+	return nil, ewserver.ErrInvalidBulkJob
+}
+
+// commandAction queues the command {"name", "args", "ttl"} for each device
+func (r *Runner) commandAction(job *ewserver.BulkJob) (*action, error) {
+	args := &struct {
+		Name string          `json:"name"`
+		Args json.RawMessage `json:"args"`
+		TTL  string          `json:"ttl"`
+	}{}
+	if err := json.Unmarshal(job.Args, args); err != nil {
+		return nil, ewserver.ErrInvalidBulkJob
+	}
+
+	if err := (&ewserver.Command{Name: args.Name, Args: args.Args}).Valid(); err != nil {
+		return nil, err
+	}
+
+	var ttl time.Duration
+	if args.TTL != "" {
+		var err error
+		if ttl, err = ewserver.ParseDuration(args.TTL); err != nil || ttl < 0 || ttl > ewserver.MaxCommandTTL {
+			return nil, ewserver.ErrInvalidCommand
+		}
+	}
+
+	return &action{apply: func(apiUser *ewserver.APIUser) (json.RawMessage, error) {
+		command := ewserver.NewCommand()
+		command.DeviceID = apiUser.ID
+		command.Name = args.Name
+		command.Args = args.Args
+		command.CreatedBy = job.CreatedBy
+		if err := r.commands.Enqueue(command, ttl); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]uint64{"command": command.ID})
+	}}, nil
+}
+
+// firmwareAction adds the group to the rollout of {"version", "percentage"}, raising the rollout's
+// percentage if it is lower. Each device's result tells if the rollout now targets it.
+func (r *Runner) firmwareAction(job *ewserver.BulkJob) (*action, error) {
+	args := &struct {
+		Version    ewserver.FirmwareVersion `json:"version"`
+		Percentage *int                     `json:"percentage"`
+	}{}
+	if err := json.Unmarshal(job.Args, args); err != nil {
+		return nil, ewserver.ErrInvalidBulkJob
+	}
+
+	percentage := 100
+	if args.Percentage != nil {
+		percentage = *args.Percentage
+	}
+
+	if percentage < 0 || percentage > 100 {
+		return nil, ewserver.ErrInvalidFirmware
+	}
+
+	if _, err := r.firmware.Firmware(args.Version); err != nil {
+		return nil, err
+	}
+
+	var rollout *ewserver.Rollout
+	setup := func() error {
+		firmware, err := r.firmware.Firmware(args.Version)
+		if err != nil {
+			return err
+		}
+
+		role := ewserver.GroupRole(job.Group)
+		rollout = firmware.Rollout
+		if rollout == nil {
+			rollout = &ewserver.Rollout{Devices: make([][]byte, 0), Groups: []string{role}}
+		} else if (len(rollout.Devices) > 0 || len(rollout.Groups) > 0) && !contains(rollout.Groups, role) {
+			// a rollout without devices or groups already targets the whole fleet, adding the group would narrow it
+			rollout.Groups = append(rollout.Groups, role)
+		}
+
+		if rollout.Percentage < percentage {
+			rollout.Percentage = percentage
+		}
+		rollout.UpdatedBy = job.CreatedBy
+		rollout.UpdatedAt = time.Now().UTC()
+		return r.firmware.SetRollout(args.Version, rollout)
+	}
+
+	return &action{setup: setup, apply: func(apiUser *ewserver.APIUser) (json.RawMessage, error) {
+		targeted := rollout.Targets(args.Version, apiUser.ID, r.roles.RolesForSubject(apiUser.Name))
+		return json.Marshal(map[string]bool{"targeted": targeted})
+	}}, nil
+}
+
+// rotateKeyAction replaces each device's API key. The stored results only tell a key was rotated, the
+// new keys are held until the job completes and then returned once by Keys.
+func (r *Runner) rotateKeyAction(job *ewserver.BulkJob) *action {
+	keys := make(map[string]ewserver.APIKey)
+	rotated := json.RawMessage(`{"rotated":true}`)
+
+	return &action{apply: func(apiUser *ewserver.APIUser) (json.RawMessage, error) {
+		key, err := ewserver.GenerateAPIKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := r.apiUsers.RotateKey(apiUser, key); err != nil {
+			return nil, err
+		}
+		keys[apiUser.Name] = key
+		return rotated, nil
+	}, finish: func() {
+		r.mu.Lock()
+		r.keys[job.ID] = keys
+		r.mu.Unlock()
+	}}
+}
+
+// delete removes the device's API user with its roles, groups and device state
+func (r *Runner) delete(apiUser *ewserver.APIUser) (json.RawMessage, error) {
+	return nil, r.remover.Remove(apiUser)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package bulk
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/mock"
+)
+
+func testRunner(stored []*ewserver.BulkJob, apiUsers *mock.APIUserService, t *testing.T) (*Runner, *mock.BulkJobService, chan *ewserver.BulkJob) {
+	saved := make(chan *ewserver.BulkJob, 10)
+	jobs := &mock.BulkJobService{
+		JobsFn:   func() ([]*ewserver.BulkJob, error) { return stored, nil },
+		CreateFn: func(job *ewserver.BulkJob) error { job.ID = 1; return nil },
+		SaveFn: func(job *ewserver.BulkJob) error {
+			copied := *job
+			saved <- &copied
+			return nil
+		},
+	}
+
+	groups := &mock.GroupService{
+		GroupFn: func(name string) (*ewserver.DeviceGroup, error) {
+			if name != "outdoor" {
+				return nil, ewserver.ErrGroupNotFound
+			}
+			return &ewserver.DeviceGroup{Name: name}, nil
+		},
+	}
+
+	roles := &mock.RoleService{
+		SubjectsForRoleFn: func(roleName string) []string {
+			if roleName == ewserver.GroupRole("outdoor") {
+				return []string{"device1", "device2", "root"}
+			}
+			return nil
+		},
+		DeleteSubjectFn: func(subject string) error { return nil },
+	}
+
+	runner, err := New(jobs, groups, roles, apiUsers, &mock.CommandService{}, nil, nil, &mock.Log{})
+	if err != nil {
+		t.Fatalf("error creating runner: %s\n", err)
+	}
+	return runner, jobs, saved
+}
+
+func TestNew_Interrupted(t *testing.T) {
+	stored := []*ewserver.BulkJob{{ID: 2, State: ewserver.BulkRunning}, {ID: 1, State: ewserver.BulkCompleted}}
+	_, _, saved := testRunner(stored, &mock.APIUserService{}, t)
+
+	if len(saved) != 1 {
+		t.Fatalf("expected only the running job to be saved got: %d\n", len(saved))
+	}
+
+	if job := <-saved; job.ID != 2 || job.State != ewserver.BulkInterrupted || job.FinishedAt.IsZero() {
+		t.Fatalf("expected the running job to be interrupted got: %#v\n", job)
+	}
+}
+
+func TestRunner_Start(t *testing.T) {
+	devices := map[ewserver.APIKey]*ewserver.APIUser{
+		"key1": {Key: "key1", Name: "device1", ID: []byte{1}},
+		"key2": {Key: "key2", Name: "device2", ID: []byte{2}},
+		"key3": {Key: "key3", Name: "device3", ID: []byte{3}},
+	}
+
+	updated := make(map[string]bool)
+	apiUsers := &mock.APIUserService{
+		ForEachAPIUserFn: func(fn func(*ewserver.APIUser) error) error {
+			for _, key := range []ewserver.APIKey{"key1", "key2", "key3"} {
+				copied := *devices[key]
+				if err := fn(&copied); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		APIUserFn: func(key ewserver.APIKey) (*ewserver.APIUser, error) {
+			if key == "key2" {
+				return nil, ewserver.ErrUserNotFound
+			}
+			copied := *devices[key]
+			return &copied, nil
+		},
+		APIUserByIDFn: func(ID []byte) (*ewserver.APIUser, error) { return nil, ewserver.ErrUserNotFound },
+		SetDisabledFn: func(key ewserver.APIKey, disabled bool) error {
+			updated[devices[key].Name] = disabled
+			return nil
+		},
+	}
+	runner, _, saved := testRunner(nil, apiUsers, t)
+
+	invalid := []*ewserver.BulkJob{
+		ewserver.NewBulkJob("indoor", ewserver.BulkDisable, nil),
+		ewserver.NewBulkJob("outdoor", "reboot", nil),
+		ewserver.NewBulkJob("outdoor", ewserver.BulkCommand, json.RawMessage(`{"name":""}`)),
+	}
+
+	expected := []error{ewserver.ErrGroupNotFound, ewserver.ErrInvalidBulkJob, ewserver.ErrInvalidCommand}
+	for i, job := range invalid {
+		if err := runner.Start(job); err != expected[i] {
+			t.Fatalf("expected job %d to fail with %v got: %v\n", i, expected[i], err)
+		}
+	}
+
+	job := ewserver.NewBulkJob("outdoor", ewserver.BulkDisable, nil)
+	if err := runner.Start(job); err != nil || job.ID != 1 || job.Total != 2 {
+		t.Fatalf("expected the job to start with the group's API users got: %v %d\n", err, job.Total)
+	}
+
+	var finished *ewserver.BulkJob
+	select {
+	case finished = <-saved:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the job to complete\n")
+	}
+
+	// device2 was deleted after the job started
+	if finished.State != ewserver.BulkCompleted || finished.Succeeded != 1 || finished.Failed != 1 || finished.Results[1].Error != ewserver.ErrUserNotFound.Error() {
+		t.Fatalf("expected one device disabled and one failure got: %#v\n", finished)
+	}
+
+	if len(updated) != 1 || !updated["device1"] {
+		t.Fatalf("expected only device1 to be disabled got: %#v\n", updated)
+	}
+}
+
+func TestRunner_RotateKey(t *testing.T) {
+	apiUsers := &mock.APIUserService{
+		ForEachAPIUserFn: func(fn func(*ewserver.APIUser) error) error {
+			return fn(&ewserver.APIUser{Key: "key1", Name: "device1", ID: []byte{1}})
+		},
+		APIUserFn: func(key ewserver.APIKey) (*ewserver.APIUser, error) {
+			return &ewserver.APIUser{Key: key, Name: "device1", ID: []byte{1}}, nil
+		},
+		RotateKeyFn: func(u *ewserver.APIUser, key ewserver.APIKey) error { return nil },
+	}
+	runner, _, saved := testRunner(nil, apiUsers, t)
+
+	job := ewserver.NewBulkJob("outdoor", ewserver.BulkRotateKey, nil)
+	if err := runner.Start(job); err != nil {
+		t.Fatalf("error starting job: %s\n", err)
+	}
+
+	var finished *ewserver.BulkJob
+	select {
+	case finished = <-saved:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the job to complete\n")
+	}
+
+	// the stored result must not contain the key
+	if finished.Succeeded != 1 || string(finished.Results[0].Result) != `{"rotated":true}` {
+		t.Fatalf("expected a redacted result got: %s\n", finished.Results[0].Result)
+	}
+
+	keys, err := runner.Keys(job.ID)
+	if err != nil || len(keys) != 1 || keys["device1"] == "" {
+		t.Fatalf("expected the new key of device1 got: %v %v\n", keys, err)
+	}
+
+	if _, err := runner.Keys(job.ID); err != ewserver.ErrKeysNotAvailable {
+		t.Fatalf("expected the keys to only be returned once got: %v\n", err)
+	}
+}
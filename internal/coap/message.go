@@ -0,0 +1,287 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Type of a message
+type Type uint8
+
+// message types
+const (
+	Confirmable     Type = 0
+	NonConfirmable  Type = 1
+	Acknowledgement Type = 2
+	Reset           Type = 3
+)
+
+// Code of a request method or response, the upper 3 bits are the class and the lower 5 the detail.
+type Code uint8
+
+// method and response codes we use
+const (
+	Empty               Code = 0x00 // 0.00
+	GET                 Code = 0x01 // 0.01
+	POST                Code = 0x02 // 0.02
+	Created             Code = 0x41 // 2.01
+	Changed             Code = 0x44 // 2.04
+	Content             Code = 0x45 // 2.05
+	BadRequest          Code = 0x80 // 4.00
+	Unauthorized        Code = 0x81 // 4.01
+	BadOption           Code = 0x82 // 4.02
+	Forbidden           Code = 0x83 // 4.03
+	NotFound            Code = 0x84 // 4.04
+	MethodNotAllowed    Code = 0x85 // 4.05
+	RequestEntityTooBig Code = 0x8D // 4.13
+	InternalServerError Code = 0xA0 // 5.00
+	ServiceUnavailable  Code = 0xA3 // 5.03
+	codeClassSuccess    Code = 0x40
+)
+
+// IsRequest returns true for method codes
+func (c Code) IsRequest() bool {
+	return c != Empty && c < codeClassSuccess
+}
+
+// OptionID is the number of an option
+type OptionID uint16
+
+// options we understand
+const (
+	Observe       OptionID = 6
+	URIPath       OptionID = 11
+	ContentFormat OptionID = 12
+	URIQuery      OptionID = 15
+
+	// APIKey carries the device's API key. It is from the experimental range and critical, so
+	// servers that do not understand it reject the request rather than ignoring the credentials.
+	APIKey OptionID = 65001
+)
+
+// Critical options must be understood by the receiver, they have odd numbers.
+func (o OptionID) Critical() bool {
+	return o&1 == 1
+}
+
+// FormatJSON is the application/json content format
+const FormatJSON = 50
+
+const (
+	version        = 1
+	payloadMarker  = 0xFF
+	maxTokenLength = 8
+)
+
+var (
+	// ErrMalformedMessage when a message can not be decoded
+	ErrMalformedMessage = errors.New("coap: malformed message")
+)
+
+// Option is a single option instance, repeatable options such as URIPath appear once per value.
+type Option struct {
+	ID    OptionID
+	Value []byte
+}
+
+// Message is a CoAP message as defined by RFC 7252
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Option returns the first value of the option and if it was present
+func (m *Message) Option(id OptionID) ([]byte, bool) {
+	for _, option := range m.Options {
+		if option.ID == id {
+			return option.Value, true
+		}
+	}
+	return nil, false
+}
+
+// AddOption appends an option value
+func (m *Message) AddOption(id OptionID, value []byte) {
+	m.Options = append(m.Options, Option{ID: id, Value: value})
+}
+
+// AddUint appends an option with the minimal big endian encoding of v
+func (m *Message) AddUint(id OptionID, v uint32) {
+	m.AddOption(id, encodeUint(v))
+}
+
+// Uint returns the value of an unsigned integer option
+func (m *Message) Uint(id OptionID) (uint32, bool) {
+	value, ok := m.Option(id)
+	if !ok || len(value) > 4 {
+		return 0, false
+	}
+	return decodeUint(value), true
+}
+
+// Path returns the URIPath options joined by /
+func (m *Message) Path() string {
+	segments := make([]string, 0)
+	for _, option := range m.Options {
+		if option.ID == URIPath {
+			segments = append(segments, string(option.Value))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// SetPath replaces the URIPath options with the segments of path
+func (m *Message) SetPath(path string) {
+	options := make([]Option, 0, len(m.Options))
+	for _, option := range m.Options {
+		if option.ID != URIPath {
+			options = append(options, option)
+		}
+	}
+	m.Options = options
+
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		m.AddOption(URIPath, []byte(segment))
+	}
+}
+
+// Marshal encodes the message, options are sorted by number as required for delta encoding.
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > maxTokenLength {
+		return nil, ErrMalformedMessage
+	}
+
+	buf := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+16)
+	buf[0] = version<<6 | byte(m.Type)<<4 | byte(len(m.Token))
+	buf[1] = byte(m.Code)
+	binary.BigEndian.PutUint16(buf[2:], m.MessageID)
+	buf = append(buf, m.Token...)
+
+	options := make([]Option, len(m.Options))
+	copy(options, m.Options)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].ID < options[j].ID })
+
+	var previous OptionID
+	for _, option := range options {
+		delta, deltaExt := optionNibble(int(option.ID - previous))
+		length, lengthExt := optionNibble(len(option.Value))
+		buf = append(buf, delta<<4|length)
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, option.Value...)
+		previous = option.ID
+	}
+
+	if len(m.Payload) > 0 {
+		buf = append(buf, payloadMarker)
+		buf = append(buf, m.Payload...)
+	}
+	return buf, nil
+}
+
+// Unmarshal decodes a message from data
+func Unmarshal(data []byte) (*Message, error) {
+	if len(data) < 4 || data[0]>>6 != version {
+		return nil, ErrMalformedMessage
+	}
+
+	tokenLength := int(data[0] & 0x0F)
+	if tokenLength > maxTokenLength || len(data) < 4+tokenLength {
+		return nil, ErrMalformedMessage
+	}
+
+	m := &Message{
+		Type:      Type(data[0] >> 4 & 0x03),
+		Code:      Code(data[1]),
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+		Token:     append([]byte{}, data[4:4+tokenLength]...),
+	}
+
+	data = data[4+tokenLength:]
+
+	var previous int
+	for len(data) > 0 {
+		if data[0] == payloadMarker {
+			if len(data) == 1 {
+				return nil, ErrMalformedMessage
+			}
+			m.Payload = append([]byte{}, data[1:]...)
+			break
+		}
+
+		header := data[0]
+		data = data[1:]
+
+		delta, rest, err := readOptionNibble(header>>4, data)
+		if err != nil {
+			return nil, err
+		}
+
+		length, rest, err := readOptionNibble(header&0x0F, rest)
+		if err != nil || len(rest) < length || previous+delta > 0xFFFF {
+			return nil, ErrMalformedMessage
+		}
+
+		previous += delta
+		m.Options = append(m.Options, Option{ID: OptionID(previous), Value: append([]byte{}, rest[:length]...)})
+		data = rest[length:]
+	}
+	return m, nil
+}
+
+// optionNibble returns the 4 bit value and extended bytes for an option delta or length
+func optionNibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(v-269))
+		return 14, ext
+	}
+}
+
+// readOptionNibble decodes an option delta or length, reading any extended bytes from data
+func readOptionNibble(nibble byte, data []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, ErrMalformedMessage
+		}
+		return int(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, ErrMalformedMessage
+		}
+		return int(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		return 0, nil, ErrMalformedMessage
+	}
+	return int(nibble), data, nil
+}
+
+// encodeUint returns the shortest big endian encoding of v, zero is encoded as no bytes.
+func encodeUint(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	for len(buf) > 0 && buf[0] == 0 {
+		buf = buf[1:]
+	}
+	return buf
+}
+
+func decodeUint(value []byte) uint32 {
+	var v uint32
+	for _, b := range value {
+		v = v<<8 | uint32(b)
+	}
+	return v
+}
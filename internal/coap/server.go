@@ -0,0 +1,532 @@
+package coap
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/authz"
+)
+
+const (
+	// PathPrefix of the resources devices post to and observe, data/<stream> maps to the
+	// device's stream and is authorized as the casbin object /api/v1/data/<stream>.
+	PathPrefix = "data/"
+
+	// ObserveLifetime is how long an observation lasts unless the client registers again,
+	// so observers that went away without sending a reset are eventually forgotten.
+	ObserveLifetime = 10 * time.Minute
+
+	maxMessageSize   = 1500              // the largest datagram we read
+	maxObservers     = 1024              // requests beyond this are answered without establishing an observation
+	maxExchanges     = 8192              // confirmable requests beyond this are answered with 5.03 until exchanges expire
+	exchangeLifetime = 247 * time.Second // how long responses are kept to answer retransmitted requests (RFC 7252 EXCHANGE_LIFETIME)
+	maxObserveSeq    = 1 << 24           // observe sequence numbers are 24 bits
+	workers          = 16                // datagrams handled at once
+	maxQueued        = 256               // datagrams waiting for a worker, more are dropped and left to the client to retransmit
+	sweepInterval    = 30 * time.Second  // how often expired exchanges and observations are removed
+)
+
+// understood lists the critical options we process or can safely ignore
+var understood = map[OptionID]bool{
+	3:             true, // Uri-Host
+	Observe:       true,
+	7:             true, // Uri-Port
+	URIPath:       true,
+	ContentFormat: true,
+	URIQuery:      true,
+	17:            true, // Accept
+	APIKey:        true,
+}
+
+// Server is a CoAP endpoint for constrained devices. Devices authenticate every request with
+// their API key in the APIKey option, POST data points to data/<stream> and GET (optionally
+// observing) data/<stream> to read the latest point. Every authenticated request is activity of the device.
+type Server struct {
+	apiUserService   ewserver.APIUserService
+	telemetryService ewserver.TelemetryService
+	eventService     ewserver.EventService
+	presenceService  ewserver.PresenceService
+	authorizer       authz.Authorizer
+	logger           ewserver.LogService
+
+	mu        sync.Mutex
+	conn      net.PacketConn
+	messageID uint16
+	exchanges map[exchangeKey]*exchange
+	observers map[observerKey]*observer
+}
+
+// packet is a datagram waiting to be handled
+type packet struct {
+	addr net.Addr
+	data []byte
+}
+
+// exchangeKey identifies a request from an endpoint for deduplication
+type exchangeKey struct {
+	addr      string
+	messageID uint16
+}
+
+// exchange holds the response to a confirmable request, nil while the request is processed
+type exchange struct {
+	response []byte
+	expires  time.Time
+}
+
+// observerKey identifies an observation, the token is chosen by the client
+type observerKey struct {
+	addr  string
+	token string
+}
+
+// observer receives notifications of new points of a stream until it expires or is cancelled
+type observer struct {
+	addr          net.Addr
+	token         []byte
+	subscription  ewserver.Subscription
+	seq           uint32
+	lastMessageID uint16
+	expires       time.Time
+}
+
+// New creates a new CoAP server
+func New(apiUserService ewserver.APIUserService, telemetryService ewserver.TelemetryService, eventService ewserver.EventService, presenceService ewserver.PresenceService, authorizer authz.Authorizer, logService ewserver.LogService) *Server {
+	return &Server{
+		apiUserService:   apiUserService,
+		telemetryService: telemetryService,
+		eventService:     eventService,
+		presenceService:  presenceService,
+		authorizer:       authorizer,
+		logger:           logService,
+		messageID:        uint16(rand.Intn(1 << 16)),
+		exchanges:        make(map[exchangeKey]*exchange),
+		observers:        make(map[observerKey]*observer),
+	}
+}
+
+// ListenAndServe listens on the UDP address and serves requests until closed.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve requests read from conn with a fixed number of workers until it is closed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	packets := make(chan packet, maxQueued)
+	defer close(packets)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for p := range packets {
+				s.handle(p.addr, p.data)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.sweepUntil(done)
+
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case packets <- packet{addr: addr, data: buf[:n]}:
+		default:
+			// every worker is busy, confirmable requests are retransmitted by the client
+		}
+	}
+}
+
+// Close the connection and cancel all observations
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, o := range s.observers {
+		o.subscription.Close()
+		delete(s.observers, key)
+	}
+
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// handle a single datagram
+func (s *Server) handle(addr net.Addr, data []byte) {
+	req, err := Unmarshal(data)
+	if err != nil {
+		return
+	}
+
+	switch req.Type {
+	case Reset:
+		// the client rejected a notification, it is no longer interested
+		s.cancelObservation(addr, req.MessageID)
+		return
+	case Acknowledgement:
+		return
+	}
+
+	if !req.Code.IsRequest() {
+		// an empty confirmable message is a ping, answered with a reset
+		if req.Type == Confirmable {
+			s.write(addr, &Message{Type: Reset, MessageID: req.MessageID})
+		}
+		return
+	}
+
+	key := exchangeKey{addr: addr.String(), messageID: req.MessageID}
+	if req.Type == Confirmable {
+		response, duplicate, full := s.startExchange(key)
+		if full {
+			s.write(addr, &Message{Type: Acknowledgement, Code: ServiceUnavailable, MessageID: req.MessageID, Token: req.Token})
+			return
+		}
+
+		if duplicate {
+			// a retransmission, resend the response if we have it, otherwise it is still being processed
+			if response != nil {
+				s.conn.WriteTo(response, addr)
+			}
+			return
+		}
+	}
+
+	resp := s.serve(addr, req)
+	resp.Token = req.Token
+	if req.Type == Confirmable {
+		resp.Type = Acknowledgement
+		resp.MessageID = req.MessageID
+	} else {
+		resp.Type = NonConfirmable
+		resp.MessageID = s.nextMessageID()
+	}
+
+	response := s.write(addr, resp)
+	if req.Type == Confirmable {
+		s.finishExchange(key, response)
+	}
+}
+
+// serve the request and return the response
+func (s *Server) serve(addr net.Addr, req *Message) *Message {
+	for _, option := range req.Options {
+		if option.ID.Critical() && !understood[option.ID] {
+			return &Message{Code: BadOption}
+		}
+	}
+
+	key, _ := req.Option(APIKey)
+	apiUser, err := s.apiUserService.APIUser(ewserver.APIKey(key))
+	if len(key) == 0 || err != nil || apiUser.Name == "" || apiUser.Disabled {
+		s.logger.Info("coap authentication failure", "ipaddr", addr.String())
+		return &Message{Code: Unauthorized}
+	}
+	s.seen(apiUser, addr)
+
+	stream, ok := pathStream(req.Path())
+	if !ok {
+		return &Message{Code: NotFound}
+	}
+
+	switch req.Code {
+	case POST:
+		return s.publish(apiUser, stream, req)
+	case GET:
+		return s.read(addr, apiUser, stream, req)
+	}
+	return &Message{Code: MethodNotAllowed}
+}
+
+// publish stores the payload as a data point of the stream
+func (s *Server) publish(apiUser *ewserver.APIUser, stream ewserver.StreamName, req *Message) *Message {
+	if !s.authorizer.Enforce(apiUser.Name, dataObject(stream), "POST") {
+		return &Message{Code: Forbidden}
+	}
+
+	err := s.telemetryService.Publish(apiUser.ID, stream, ewserver.DecodeDataPoint(req.Payload))
+	switch err {
+	case nil:
+		return &Message{Code: Changed}
+	case ewserver.ErrInvalidDataPoint, ewserver.ErrInvalidStream:
+		return &Message{Code: BadRequest, Payload: []byte(err.Error())}
+	}
+
+	s.logger.Error("coap publish failed", "api_user", apiUser.Name, "stream", stream.String(), "error", err)
+	return &Message{Code: InternalServerError}
+}
+
+// read returns the latest point of the stream. An Observe option of 0 registers the client
+// for notifications of new points, 1 cancels its observation.
+func (s *Server) read(addr net.Addr, apiUser *ewserver.APIUser, stream ewserver.StreamName, req *Message) *Message {
+	if !s.authorizer.Enforce(apiUser.Name, dataObject(stream), "GET") {
+		return &Message{Code: Forbidden}
+	}
+
+	register, observing := req.Uint(Observe)
+	key := observerKey{addr: addr.String(), token: string(req.Token)}
+
+	var o *observer
+	if observing && register == 0 {
+		// subscribe before reading so no point published in between is missed
+		o = s.observe(key, addr, req.Token, apiUser, stream)
+	} else if observing && register == 1 {
+		s.removeObserver(key)
+	}
+
+	point, err := s.telemetryService.Latest(apiUser.ID, stream)
+	if err != nil {
+		if o != nil {
+			s.removeObserver(key)
+		}
+
+		if err == ewserver.ErrPointNotFound {
+			return &Message{Code: NotFound}
+		}
+		s.logger.Error("coap read failed", "api_user", apiUser.Name, "stream", stream.String(), "error", err)
+		return &Message{Code: InternalServerError}
+	}
+
+	resp, err := pointMessage(point)
+	if err != nil {
+		return &Message{Code: InternalServerError}
+	}
+
+	if o != nil {
+		resp.AddUint(Observe, 0)
+	}
+	return resp
+}
+
+// observe registers (or renews) an observation of the stream and starts sending notifications.
+// Returns nil if too many clients are already observing.
+func (s *Server) observe(key observerKey, addr net.Addr, token []byte, apiUser *ewserver.APIUser, stream ewserver.StreamName) *observer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if o, exists := s.observers[key]; exists {
+		o.expires = time.Now().Add(ObserveLifetime)
+		return o
+	}
+
+	if len(s.observers) >= maxObservers {
+		return nil
+	}
+
+	o := &observer{
+		addr:         addr,
+		token:        append([]byte{}, token...),
+		subscription: s.eventService.Subscribe(ewserver.DataTopic(apiUser.ID, stream)),
+		expires:      time.Now().Add(ObserveLifetime),
+	}
+	s.observers[key] = o
+
+	s.logger.Info("coap observe", "api_user", apiUser.Name, "stream", stream.String(), "ipaddr", addr.String())
+	go s.notify(key, o)
+	return o
+}
+
+// notify sends new points to the observer as non-confirmable notifications until it is cancelled or expires.
+func (s *Server) notify(key observerKey, o *observer) {
+	for event := range o.subscription.Events() {
+		streamEvent, ok := event.Data.(*ewserver.StreamEvent)
+		if !ok {
+			continue
+		}
+
+		s.mu.Lock()
+		expired := time.Now().After(o.expires)
+		o.seq = (o.seq + 1) % maxObserveSeq
+		seq := o.seq
+		s.mu.Unlock()
+
+		if expired {
+			s.removeObserver(key)
+			return
+		}
+
+		msg, err := pointMessage(streamEvent.Point)
+		if err != nil {
+			continue
+		}
+		msg.Type = NonConfirmable
+		msg.MessageID = s.nextMessageID()
+		msg.Token = o.token
+		msg.AddUint(Observe, seq)
+
+		s.mu.Lock()
+		o.lastMessageID = msg.MessageID
+		s.mu.Unlock()
+
+		if s.write(o.addr, msg) == nil {
+			s.removeObserver(key)
+			return
+		}
+	}
+}
+
+// cancelObservation removes the observation the reset message was a reply to
+func (s *Server) cancelObservation(addr net.Addr, messageID uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, o := range s.observers {
+		if key.addr == addr.String() && o.lastMessageID == messageID {
+			o.subscription.Close()
+			delete(s.observers, key)
+		}
+	}
+}
+
+func (s *Server) removeObserver(key observerKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if o, ok := s.observers[key]; ok {
+		o.subscription.Close()
+		delete(s.observers, key)
+	}
+}
+
+// startExchange records a confirmable request, returning the stored response and true if it was already seen.
+// Returns true for full if the request can not be recorded because maxExchanges are in progress.
+func (s *Server) startExchange(key exchangeKey) (response []byte, duplicate bool, full bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.exchanges[key]; ok {
+		return e.response, true, false
+	}
+
+	if len(s.exchanges) >= maxExchanges {
+		return nil, false, true
+	}
+
+	s.exchanges[key] = &exchange{expires: time.Now().Add(exchangeLifetime)}
+	return nil, false, false
+}
+
+// finishExchange stores the response to resend for retransmissions of the request
+func (s *Server) finishExchange(key exchangeKey, response []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.exchanges[key]; ok {
+		e.response = response
+	}
+}
+
+// sweepUntil removes expired exchanges and observations every sweepInterval until done is closed
+func (s *Server) sweepUntil(done <-chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.sweep(now)
+		}
+	}
+}
+
+// sweep forgets exchanges and cancels observations that expired before now, an observation of a
+// quiet stream would otherwise hold its slot until a notification is sent.
+func (s *Server) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.exchanges {
+		if now.After(e.expires) {
+			delete(s.exchanges, key)
+		}
+	}
+
+	for key, o := range s.observers {
+		if now.After(o.expires) {
+			o.subscription.Close()
+			delete(s.observers, key)
+		}
+	}
+}
+
+func (s *Server) nextMessageID() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messageID++
+	return s.messageID
+}
+
+// write the message to addr, returning the encoded message or nil if it could not be sent.
+func (s *Server) write(addr net.Addr, msg *Message) []byte {
+	data, err := msg.Marshal()
+	if err != nil {
+		return nil
+	}
+
+	if _, err := s.conn.WriteTo(data, addr); err != nil {
+		return nil
+	}
+	return data
+}
+
+// pointMessage returns a 2.05 Content response with the point as JSON
+func pointMessage(point *ewserver.DataPoint) (*Message, error) {
+	payload, err := json.Marshal(point)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{Code: Content, Payload: payload}
+	msg.AddUint(ContentFormat, FormatJSON)
+	return msg, nil
+}
+
+// pathStream maps a request path to the device's stream
+func pathStream(path string) (ewserver.StreamName, bool) {
+	if !strings.HasPrefix(path, PathPrefix) {
+		return "", false
+	}
+
+	stream := ewserver.StreamName(strings.TrimPrefix(path, PathPrefix))
+	return stream, stream.Valid()
+}
+
+// dataObject returns the casbin object used to authorize access to a stream, the same as the HTTP API.
+func dataObject(stream ewserver.StreamName) string {
+	return "/api/v1/data/" + string(stream)
+}
+
+// seen records the request as activity of the API user's device
+func (s *Server) seen(apiUser *ewserver.APIUser, addr net.Addr) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	if err := s.presenceService.Seen(apiUser.ID, host, "coap", time.Now().UTC()); err != nil {
+		s.logger.Error("error tracking presence", "error", err)
+	}
+}
@@ -0,0 +1,372 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/hub"
+	"github.com/wirepair/ewserver/mock"
+)
+
+const testAPIKey = "devicekey"
+
+var testDeviceID = []byte("device1")
+
+func TestMessage_MarshalUnmarshal(t *testing.T) {
+	msg := &Message{Type: Confirmable, Code: POST, MessageID: 0x1234, Token: []byte{1, 2, 3, 4}, Payload: []byte(`21.5`)}
+	msg.AddOption(APIKey, []byte(testAPIKey))
+	msg.SetPath("/data/temperature/")
+	msg.AddUint(ContentFormat, FormatJSON)
+	msg.AddOption(URIQuery, bytes.Repeat([]byte("q"), 300))
+
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatalf("error marshalling message: %s\n", err)
+	}
+
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("error unmarshalling message: %s\n", err)
+	}
+
+	if decoded.Type != Confirmable || decoded.Code != POST || decoded.MessageID != 0x1234 || !bytes.Equal(decoded.Token, msg.Token) {
+		t.Fatalf("header did not round trip: %#v\n", decoded)
+	}
+
+	if decoded.Path() != "data/temperature" {
+		t.Fatalf("expected path data/temperature got: %s\n", decoded.Path())
+	}
+
+	if key, _ := decoded.Option(APIKey); string(key) != testAPIKey {
+		t.Fatalf("expected api key option got: %s\n", key)
+	}
+
+	if format, ok := decoded.Uint(ContentFormat); !ok || format != FormatJSON {
+		t.Fatalf("expected json content format got: %d\n", format)
+	}
+
+	if query, _ := decoded.Option(URIQuery); len(query) != 300 {
+		t.Fatalf("expected extended length option of 300 bytes got: %d\n", len(query))
+	}
+
+	if string(decoded.Payload) != "21.5" {
+		t.Fatalf("expected payload 21.5 got: %s\n", decoded.Payload)
+	}
+
+	if _, err := Unmarshal([]byte{0x40, 0x01}); err != ErrMalformedMessage {
+		t.Fatalf("expected malformed message for short message got: %v\n", err)
+	}
+}
+
+func TestServer_Publish(t *testing.T) {
+	var mu sync.Mutex
+	published := make([]*ewserver.DataPoint, 0)
+
+	telemetry := &mock.TelemetryService{}
+	telemetry.PublishFn = func(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+		if len(point.Value) == 0 {
+			return ewserver.ErrInvalidDataPoint
+		}
+		mu.Lock()
+		published = append(published, point)
+		mu.Unlock()
+		return nil
+	}
+
+	seen := 0
+	presence := &mock.PresenceService{}
+	presence.SeenFn = func(deviceID []byte, address, userAgent string, at time.Time) error {
+		mu.Lock()
+		seen++
+		mu.Unlock()
+		return nil
+	}
+
+	server, conn := testServer(telemetry, presence, t)
+	defer server.Close()
+	defer conn.Close()
+
+	resp := testRequest(conn, POST, "data/temperature", "wrongkey", []byte(`1`), t)
+	if resp.Code != Unauthorized {
+		t.Fatalf("expected unauthorized for bad key got: %#x\n", resp.Code)
+	}
+
+	mu.Lock()
+	count := seen
+	mu.Unlock()
+	if count != 0 {
+		t.Fatalf("expected unauthenticated requests not to be seen\n")
+	}
+
+	resp = testRequest(conn, POST, "data/secret", testAPIKey, []byte(`1`), t)
+	if resp.Code != Forbidden {
+		t.Fatalf("expected forbidden for stream got: %#x\n", resp.Code)
+	}
+
+	mu.Lock()
+	count = seen
+	mu.Unlock()
+	if count != 1 {
+		t.Fatalf("expected the authenticated device to be seen\n")
+	}
+
+	req := testMessage(POST, "data/temperature", testAPIKey, []byte(`{"value": 21.5}`))
+	resp = testExchange(conn, req, t)
+	if resp.Type != Acknowledgement || resp.Code != Changed || resp.MessageID != req.MessageID || !bytes.Equal(resp.Token, req.Token) {
+		t.Fatalf("expected piggybacked changed response got: %#v\n", resp)
+	}
+
+	// a retransmission is answered with the same response without publishing again
+	resp = testExchange(conn, req, t)
+	if resp.Code != Changed {
+		t.Fatalf("expected changed response for duplicate got: %#x\n", resp.Code)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(published) != 1 || string(published[0].Value) != "21.5" {
+		t.Fatalf("expected one point to be published got: %d\n", len(published))
+	}
+}
+
+func TestServer_Observe(t *testing.T) {
+	var mu sync.Mutex
+	var latest *ewserver.DataPoint
+
+	telemetry := &mock.TelemetryService{}
+	telemetry.PublishFn = func(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+		mu.Lock()
+		latest = point
+		mu.Unlock()
+		return nil
+	}
+	telemetry.LatestFn = func(deviceID []byte, stream ewserver.StreamName) (*ewserver.DataPoint, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if latest == nil {
+			return nil, ewserver.ErrPointNotFound
+		}
+		return latest, nil
+	}
+
+	server, conn := testServer(telemetry, nil, t)
+	defer server.Close()
+	defer conn.Close()
+
+	resp := testRequest(conn, GET, "data/temperature", testAPIKey, nil, t)
+	if resp.Code != NotFound {
+		t.Fatalf("expected not found for empty stream got: %#x\n", resp.Code)
+	}
+
+	testRequest(conn, POST, "data/temperature", testAPIKey, []byte(`1`), t)
+
+	req := testMessage(GET, "data/temperature", testAPIKey, nil)
+	req.AddUint(Observe, 0)
+	resp = testExchange(conn, req, t)
+	if resp.Code != Content || !testHasObserve(resp) {
+		t.Fatalf("expected content with observe option got: %#x\n", resp.Code)
+	}
+	testPointValue(resp, "1", t)
+
+	// a newly published point is sent to the observer as a notification
+	testRequest(conn, POST, "data/temperature", testAPIKey, []byte(`2`), t)
+
+	notification := testReadNotification(conn, t)
+	if notification.Type != NonConfirmable || !bytes.Equal(notification.Token, req.Token) || !testHasObserve(notification) {
+		t.Fatalf("expected non confirmable notification with the observe token got: %#v\n", notification)
+	}
+	testPointValue(notification, "2", t)
+
+	// resetting the notification cancels the observation
+	testWrite(conn, &Message{Type: Reset, MessageID: notification.MessageID}, t)
+	time.Sleep(50 * time.Millisecond)
+
+	server.mu.Lock()
+	observers := len(server.observers)
+	server.mu.Unlock()
+	if observers != 0 {
+		t.Fatalf("expected observation to be cancelled got: %d observers\n", observers)
+	}
+}
+
+func TestServer_Sweep(t *testing.T) {
+	telemetry := &mock.TelemetryService{}
+	telemetry.LatestFn = func(deviceID []byte, stream ewserver.StreamName) (*ewserver.DataPoint, error) {
+		return &ewserver.DataPoint{Value: json.RawMessage("1")}, nil
+	}
+
+	server, conn := testServer(telemetry, nil, t)
+	defer server.Close()
+	defer conn.Close()
+
+	req := testMessage(GET, "data/temperature", testAPIKey, nil)
+	req.AddUint(Observe, 0)
+	if resp := testExchange(conn, req, t); !testHasObserve(resp) {
+		t.Fatalf("expected the observation to be established\n")
+	}
+
+	// a quiet stream never sends a notification that would notice the observation expired
+	server.sweep(time.Now().Add(ObserveLifetime + time.Second))
+
+	server.mu.Lock()
+	observers, exchanges := len(server.observers), len(server.exchanges)
+	server.mu.Unlock()
+	if observers != 0 || exchanges != 0 {
+		t.Fatalf("expected expired observations and exchanges to be swept got: %d %d\n", observers, exchanges)
+	}
+}
+
+func TestServer_MaxExchanges(t *testing.T) {
+	server, conn := testServer(nil, nil, t)
+	defer server.Close()
+	defer conn.Close()
+
+	server.mu.Lock()
+	for i := 0; i < maxExchanges; i++ {
+		server.exchanges[exchangeKey{addr: "spoofed", messageID: uint16(i)}] = &exchange{expires: time.Now().Add(exchangeLifetime)}
+	}
+	server.mu.Unlock()
+
+	if resp := testRequest(conn, POST, "data/temperature", testAPIKey, []byte(`1`), t); resp.Code != ServiceUnavailable {
+		t.Fatalf("expected service unavailable with too many exchanges got: %#x\n", resp.Code)
+	}
+
+	server.mu.Lock()
+	exchanges := len(server.exchanges)
+	server.mu.Unlock()
+	if exchanges != maxExchanges {
+		t.Fatalf("expected no exchange to be added got: %d\n", exchanges)
+	}
+}
+
+func TestServer_Ping(t *testing.T) {
+	server, conn := testServer(nil, nil, t)
+	defer server.Close()
+	defer conn.Close()
+
+	resp := testExchange(conn, &Message{Type: Confirmable, Code: Empty, MessageID: 99}, t)
+	if resp.Type != Reset || resp.MessageID != 99 {
+		t.Fatalf("expected reset for ping got: %#v\n", resp)
+	}
+}
+
+func testServer(telemetry *mock.TelemetryService, presence *mock.PresenceService, t *testing.T) (*Server, net.Conn) {
+	apiUsers := &mock.APIUserService{}
+	apiUsers.APIUserFn = func(key ewserver.APIKey) (*ewserver.APIUser, error) {
+		if key != testAPIKey {
+			return nil, ewserver.ErrUserNotFound
+		}
+		return &ewserver.APIUser{Key: key, Name: "device1", ID: testDeviceID}, nil
+	}
+
+	authorizer := &mock.Authorizer{}
+	authorizer.EnforceFn = func(subject, object, action string) bool {
+		return subject == "device1" && object == "/api/v1/data/temperature"
+	}
+
+	if telemetry == nil {
+		telemetry = &mock.TelemetryService{}
+	}
+
+	if presence == nil {
+		presence = &mock.PresenceService{}
+		presence.SeenFn = func(deviceID []byte, address, userAgent string, at time.Time) error { return nil }
+	}
+
+	events := hub.New(hub.DefaultBufferSize, hub.DefaultReplaySize)
+	server := New(apiUsers, hub.NewTelemetryService(telemetry, events), events, presence, authorizer, &mock.Log{})
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	go server.Serve(listener)
+
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+	return server, conn
+}
+
+var testMessageID uint16
+
+// testMessage creates a confirmable request with a new message id and token
+func testMessage(code Code, path, key string, payload []byte) *Message {
+	testMessageID++
+	msg := &Message{Type: Confirmable, Code: code, MessageID: testMessageID, Token: []byte{byte(testMessageID >> 8), byte(testMessageID)}, Payload: payload}
+	msg.SetPath(path)
+	msg.AddOption(APIKey, []byte(key))
+	return msg
+}
+
+func testRequest(conn net.Conn, code Code, path, key string, payload []byte, t *testing.T) *Message {
+	return testExchange(conn, testMessage(code, path, key, payload), t)
+}
+
+// testExchange sends the message and returns the response with the same message id
+func testExchange(conn net.Conn, msg *Message, t *testing.T) *Message {
+	testWrite(conn, msg, t)
+	for {
+		resp := testRead(conn, t)
+		if resp.MessageID == msg.MessageID {
+			return resp
+		}
+	}
+}
+
+func testWrite(conn net.Conn, msg *Message, t *testing.T) {
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatalf("error marshalling message: %s\n", err)
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("error writing message: %s\n", err)
+	}
+}
+
+func testRead(conn net.Conn, t *testing.T) *Message {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("error reading message: %s\n", err)
+	}
+
+	msg, err := Unmarshal(buf[:n])
+	if err != nil {
+		t.Fatalf("error unmarshalling message: %s\n", err)
+	}
+	return msg
+}
+
+// testReadNotification skips responses until a non-confirmable message arrives
+func testReadNotification(conn net.Conn, t *testing.T) *Message {
+	for {
+		if msg := testRead(conn, t); msg.Type == NonConfirmable {
+			return msg
+		}
+	}
+}
+
+func testHasObserve(msg *Message) bool {
+	_, ok := msg.Option(Observe)
+	return ok
+}
+
+func testPointValue(msg *Message, expected string, t *testing.T) {
+	point := ewserver.NewDataPoint()
+	if err := json.Unmarshal(msg.Payload, point); err != nil {
+		t.Fatalf("error decoding point: %s\n", err)
+	}
+
+	if string(point.Value) != expected {
+		t.Fatalf("expected point value %s got: %s\n", expected, point.Value)
+	}
+}
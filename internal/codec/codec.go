@@ -0,0 +1,109 @@
+// Package codec converts API payloads between JSON and the compact binary formats CBOR and
+// MessagePack. Values are transcoded through their JSON encoding so the json struct tags,
+// json.RawMessage values and time formats of the ewserver types apply to every format.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Supported content types
+const (
+	JSON     = "application/json"
+	CBOR     = "application/cbor"
+	MsgPack  = "application/msgpack"
+	MsgPack2 = "application/x-msgpack"
+)
+
+var (
+	cborHandle    = &codec.CborHandle{}
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true, RawToString: true}
+)
+
+func init() {
+	// decoded maps must be convertible to JSON objects
+	mapType := reflect.TypeOf(map[string]interface{}(nil))
+	cborHandle.MapType = mapType
+	msgpackHandle.MapType = mapType
+}
+
+// Supported returns true if the content type is one of the supported formats
+func Supported(contentType string) bool {
+	return contentType == JSON || handle(contentType) != nil
+}
+
+// Marshal encodes v as the content type, anything unsupported is encoded as JSON.
+func Marshal(contentType string, v interface{}) ([]byte, error) {
+	jsonBytes, err := json.Marshal(v)
+	h := handle(contentType)
+	if err != nil || h == nil {
+		return jsonBytes, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	err = codec.NewEncoderBytes(&out, h).Encode(numbers(value))
+	return out, err
+}
+
+// Unmarshal decodes data in the content type into v, anything unsupported is decoded as JSON.
+func Unmarshal(contentType string, data []byte, v interface{}) error {
+	h := handle(contentType)
+	if h == nil {
+		return json.Unmarshal(data, v)
+	}
+
+	var value interface{}
+	if err := codec.NewDecoderBytes(data, h).Decode(&value); err != nil {
+		return err
+	}
+
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonBytes, v)
+}
+
+func handle(contentType string) codec.Handle {
+	switch contentType {
+	case CBOR:
+		return cborHandle
+	case MsgPack, MsgPack2:
+		return msgpackHandle
+	}
+	return nil
+}
+
+// numbers replaces json.Numbers with integers where possible, floats otherwise, so the binary
+// formats use their compact integer encodings.
+func numbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = numbers(field)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = numbers(element)
+		}
+	}
+	return value
+}
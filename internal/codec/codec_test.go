@@ -0,0 +1,69 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+	point := &ewserver.DataPoint{
+		Timestamp: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+		Value:     json.RawMessage(`{"temp":21.5,"count":3,"tags":["a","b"]}`),
+	}
+
+	for _, contentType := range []string{JSON, CBOR, MsgPack, MsgPack2} {
+		data, err := Marshal(contentType, point)
+		if err != nil {
+			t.Fatalf("error marshaling %s: %s\n", contentType, err)
+		}
+
+		decoded := ewserver.NewDataPoint()
+		if err := Unmarshal(contentType, data, decoded); err != nil {
+			t.Fatalf("error unmarshaling %s: %s\n", contentType, err)
+		}
+
+		if !decoded.Timestamp.Equal(point.Timestamp) {
+			t.Fatalf("expected %s timestamp %s got: %s\n", contentType, point.Timestamp, decoded.Timestamp)
+		}
+
+		if string(decoded.Value) != `{"count":3,"tags":["a","b"],"temp":21.5}` && string(decoded.Value) != string(point.Value) {
+			t.Fatalf("expected %s value to round trip got: %s\n", contentType, decoded.Value)
+		}
+	}
+}
+
+func TestMarshal_Compact(t *testing.T) {
+	value := map[string]interface{}{"value": 1}
+
+	jsonBytes, _ := Marshal(JSON, value)
+	cborBytes, err := Marshal(CBOR, value)
+	if err != nil {
+		t.Fatalf("error marshaling cbor: %s\n", err)
+	}
+
+	// a map of one item, a 5 byte text string and the integer 1
+	expected := []byte{0xa1, 0x65, 'v', 'a', 'l', 'u', 'e', 0x01}
+	if !bytes.Equal(cborBytes, expected) {
+		t.Fatalf("expected cbor %x got: %x\n", expected, cborBytes)
+	}
+
+	msgpackBytes, _ := Marshal(MsgPack, value)
+	if len(msgpackBytes) >= len(jsonBytes) {
+		t.Fatalf("expected msgpack to be smaller than json got: %d >= %d\n", len(msgpackBytes), len(jsonBytes))
+	}
+}
+
+func TestUnmarshal_Invalid(t *testing.T) {
+	point := ewserver.NewDataPoint()
+	if err := Unmarshal(CBOR, []byte{0xff, 0x00}, point); err == nil {
+		t.Fatalf("expected error decoding invalid cbor")
+	}
+
+	if Supported("text/plain") || !Supported(CBOR) || !Supported(JSON) {
+		t.Fatalf("expected only json, cbor and msgpack to be supported")
+	}
+}
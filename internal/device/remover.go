@@ -0,0 +1,132 @@
+// Package device removes API users together with everything stored for their device.
+package device
+
+import (
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// Remover is a DeviceRemover deleting the API user's casbin subject and per-device state before the
+// API user itself, so a new API user created with the same name starts without its permissions.
+type Remover struct {
+	apiUsers     ewserver.APIUserService
+	roles        ewserver.RoleService
+	commands     ewserver.CommandService
+	shadows      ewserver.ShadowService
+	presence     ewserver.PresenceService
+	uploads      ewserver.UploadService
+	certificates ewserver.CertificateService
+	logs         ewserver.DeviceLogService
+	blobs        ewserver.BlobService
+	logger       ewserver.LogService
+}
+
+// New creates a remover of the API users stored in apiUsers and of their device's state
+func New(apiUsers ewserver.APIUserService, roles ewserver.RoleService, commands ewserver.CommandService, shadows ewserver.ShadowService, presence ewserver.PresenceService, uploads ewserver.UploadService, certificates ewserver.CertificateService, logs ewserver.DeviceLogService, blobs ewserver.BlobService, logger ewserver.LogService) *Remover {
+	return &Remover{apiUsers: apiUsers, roles: roles, commands: commands, shadows: shadows, presence: presence, uploads: uploads, certificates: certificates, logs: logs, blobs: blobs, logger: logger}
+}
+
+// Remove disables the API user, deletes its subject from all roles and its permissions, then its
+// commands, shadow, presence, upload sequence, logs and blobs, revokes its certificates and finally
+// deletes the API user. If a step fails its roles and permissions are restored and it is enabled
+// again, state already deleted is not.
+func (r *Remover) Remove(apiUser *ewserver.APIUser) error {
+	roles := r.roles.RolesForSubject(apiUser.Name)
+	permissions := make([][]string, 0)
+	for _, permission := range r.roles.Permissions() {
+		if len(permission) == 3 && permission[0] == apiUser.Name {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	if err := r.apiUsers.SetDisabled(apiUser.Key, true); err != nil {
+		return err
+	}
+
+	err := r.remove(apiUser)
+	if err == nil {
+		return nil
+	}
+
+	for _, role := range roles {
+		if err := r.roles.AddSubjectToRole(apiUser.Name, role); err != nil {
+			r.logger.Error("error restoring role of api user", "api_user", apiUser.Name, "role", role, "error", err)
+		}
+	}
+
+	for _, permission := range permissions {
+		if err := r.roles.AddPermission(permission[0], permission[1], permission[2]); err != nil {
+			r.logger.Error("error restoring permission of api user", "api_user", apiUser.Name, "object", permission[1], "error", err)
+		}
+	}
+
+	if !apiUser.Disabled {
+		if err := r.apiUsers.SetDisabled(apiUser.Key, false); err != nil {
+			r.logger.Error("error enabling api user", "api_user", apiUser.Name, "error", err)
+		}
+	}
+	return err
+}
+
+// remove the API user's subject and device state, then the API user
+func (r *Remover) remove(apiUser *ewserver.APIUser) error {
+	if err := r.roles.DeleteSubject(apiUser.Name); err != nil {
+		return err
+	}
+
+	if len(apiUser.ID) != 0 {
+		if err := r.removeState(apiUser.ID); err != nil {
+			return err
+		}
+	}
+	return r.apiUsers.Delete(apiUser.Key)
+}
+
+// removeState deletes the device's state and revokes its certificates, deviceID must not be empty as
+// some services treat that as every device.
+func (r *Remover) removeState(deviceID []byte) error {
+	if err := r.commands.Delete(deviceID); err != nil {
+		return err
+	}
+
+	if err := r.shadows.Delete(deviceID); err != nil {
+		return err
+	}
+
+	if err := r.presence.Delete(deviceID); err != nil {
+		return err
+	}
+
+	if err := r.uploads.ResetSequence(deviceID); err != nil {
+		return err
+	}
+
+	if err := r.logs.Delete(deviceID); err != nil {
+		return err
+	}
+
+	blobs, err := r.blobs.Blobs(deviceID)
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		if err := r.blobs.Delete(blob.ID); err != nil {
+			return err
+		}
+	}
+
+	certificates, err := r.certificates.Certificates(deviceID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, certificate := range certificates {
+		if _, err := r.certificates.Revoke(certificate.Serial, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/mock"
+	"github.com/wirepair/ewserver/store"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestRemover_Remove(t *testing.T) {
+	dbFileName, err := testTempDbFileName("")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer os.Remove(dbFileName)
+
+	db := testOpenDb(dbFileName, t)
+	defer db.Close()
+
+	blobDir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatalf("error creating blob dir: %s\n", err)
+	}
+	defer os.RemoveAll(blobDir)
+
+	shadows := boltdb.NewShadowService(db.DB())
+	uploads := boltdb.NewUploadService(db.DB())
+	certificates := boltdb.NewCertificateService(db.DB(), "localhost")
+	logs := boltdb.NewDeviceLogService(db.DB(), 10)
+	blobs := boltdb.NewBlobService(db.DB(), blobDir)
+	for _, service := range []interface{ Init() error }{shadows, uploads, certificates, logs, blobs} {
+		if err := service.Init(); err != nil {
+			t.Fatalf("error initializing service: %s\n", err)
+		}
+	}
+
+	apiUser := &ewserver.APIUser{Key: "key1", Name: "device1", ID: []byte{1}}
+	if _, err := shadows.UpdateReported(apiUser.ID, ewserver.ShadowState{"led": json.RawMessage(`"on"`)}, 0); err != nil {
+		t.Fatalf("error updating shadow: %s\n", err)
+	}
+
+	if _, err := uploads.AcceptSequence(apiUser.ID, 1, 1); err != nil {
+		t.Fatalf("error accepting sequence: %s\n", err)
+	}
+
+	certificate, err := certificates.Issue(apiUser, nil, time.Hour, "admin")
+	if err != nil {
+		t.Fatalf("error issuing certificate: %s\n", err)
+	}
+
+	disabled := make([]bool, 0)
+	apiUsers := &mock.APIUserService{
+		SetDisabledFn: func(key ewserver.APIKey, d bool) error {
+			disabled = append(disabled, d)
+			return nil
+		},
+		DeleteFn: func(key ewserver.APIKey) error { return nil },
+	}
+
+	restored := make([]string, 0)
+	roles := &mock.RoleService{
+		RolesForSubjectFn: func(subject string) []string { return []string{"apiuser", ewserver.GroupRole("outdoor")} },
+		PermissionsFn: func() [][]string {
+			return [][]string{{"device1", "/api/v1/devices", "GET"}, {"apiuser", "/api/v1/telemetry", "POST"}}
+		},
+		DeleteSubjectFn: func(subject string) error { return nil },
+		AddSubjectToRoleFn: func(subject, roleName string) error {
+			restored = append(restored, roleName)
+			return nil
+		},
+		AddPermissionFn: func(subject, object, method string) error {
+			restored = append(restored, subject+" "+object)
+			return nil
+		},
+	}
+
+	errCommands := errors.New("commands failed")
+	commands := &mock.CommandService{DeleteFn: func(deviceID []byte) error { return errCommands }}
+	presence := &mock.PresenceService{DeleteFn: func(deviceID []byte) error { return nil }}
+	remover := New(apiUsers, roles, commands, shadows, presence, uploads, certificates, logs, blobs, &mock.Log{})
+
+	if err := remover.Remove(apiUser); err != errCommands || apiUsers.DeleteInvoked {
+		t.Fatalf("expected the API user to be kept if a step fails got: %v\n", err)
+	}
+
+	if len(restored) != 3 || restored[0] != "apiuser" || restored[2] != "device1 /api/v1/devices" {
+		t.Fatalf("expected the roles and own permissions to be restored got: %v\n", restored)
+	}
+
+	if len(disabled) != 2 || !disabled[0] || disabled[1] {
+		t.Fatalf("expected the API user to be disabled then enabled again got: %v\n", disabled)
+	}
+
+	commands.DeleteFn = func(deviceID []byte) error { return nil }
+	if err := remover.Remove(apiUser); err != nil || !roles.DeleteSubjectInvoked || !presence.DeleteInvoked || !apiUsers.DeleteInvoked {
+		t.Fatalf("expected the subject, device state and API user to be deleted got: %v\n", err)
+	}
+
+	if shadow, err := shadows.Shadow(apiUser.ID); err != nil || shadow.Version != 0 {
+		t.Fatalf("expected the shadow to be deleted got: %#v %v\n", shadow, err)
+	}
+
+	if sequence, err := uploads.Sequence(apiUser.ID); err != nil || sequence.HighWater != 0 {
+		t.Fatalf("expected the upload sequence to be reset got: %#v %v\n", sequence, err)
+	}
+
+	if revoked, err := certificates.Certificate(certificate.Serial); err != nil || !revoked.Revoked {
+		t.Fatalf("expected the certificate to be revoked got: %#v %v\n", revoked, err)
+	}
+}
+
+func testOpenDb(dbFileName string, t *testing.T) *boltdb.BoltStore {
+	config := store.NewConfig()
+	config.Options["database"] = dbFileName
+
+	db := boltdb.NewBoltStore()
+	if err := db.Open(config); err != nil {
+		t.Fatalf("error opening database file: %s\n", err)
+	}
+	return db
+}
+
+func testTempDbFileName(dir string) (string, error) {
+	f, err := ioutil.TempFile(dir, "db")
+	if err != nil {
+		return "", err
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+
+	return f.Name(), nil
+}
@@ -0,0 +1,41 @@
+package hub
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// CommandService wraps a CommandService publishing queued and acknowledged commands to their
+// ewserver.CommandTopic, waking devices long polling for commands and notifying anyone following results.
+type CommandService struct {
+	ewserver.CommandService
+	events ewserver.EventService
+}
+
+// NewCommandService publishes command changes made through service to events
+func NewCommandService(service ewserver.CommandService, events ewserver.EventService) *CommandService {
+	return &CommandService{CommandService: service, events: events}
+}
+
+// Enqueue the command and then notify the device's subscribers.
+func (c *CommandService) Enqueue(command *ewserver.Command, ttl time.Duration) error {
+	if err := c.CommandService.Enqueue(command, ttl); err != nil {
+		return err
+	}
+
+	c.events.Publish(ewserver.CommandTopic(command.DeviceID), command)
+	return nil
+}
+
+// Ack the command and then notify the device's subscribers.
+func (c *CommandService) Ack(deviceID []byte, id uint64, state ewserver.CommandState, result json.RawMessage, actor string) (*ewserver.Command, error) {
+	command, err := c.CommandService.Ack(deviceID, id, state, result, actor)
+	if err != nil {
+		return command, err
+	}
+
+	c.events.Publish(ewserver.CommandTopic(deviceID), command)
+	return command, nil
+}
@@ -0,0 +1,38 @@
+package hub
+
+import (
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	// DeviceLogBufferSize of each log tail's channel, enough for a couple of full batches
+	DeviceLogBufferSize = 2 * ewserver.MaxDeviceLogBatch
+	// DeviceLogReplaySize is how many recent log entries are kept for tails to resume
+	DeviceLogReplaySize = 10 * ewserver.MaxDeviceLogBatch
+)
+
+// DeviceLogService wraps a DeviceLogService publishing every stored entry to its ewserver.LogTopic,
+// so tails of the device's log receive entries as they are shipped. Entries are published to their own
+// hub so busy devices do not push other events out of the replay buffer or fill other subscribers.
+type DeviceLogService struct {
+	ewserver.DeviceLogService
+	events ewserver.EventService
+}
+
+// NewDeviceLogService publishes entries stored by service to events
+func NewDeviceLogService(service ewserver.DeviceLogService, events ewserver.EventService) *DeviceLogService {
+	return &DeviceLogService{DeviceLogService: service, events: events}
+}
+
+// Append stores the entries and then notifies the device's subscribers of each, in order.
+func (l *DeviceLogService) Append(deviceID []byte, entries []*ewserver.DeviceLog) error {
+	if err := l.DeviceLogService.Append(deviceID, entries); err != nil {
+		return err
+	}
+
+	topic := ewserver.LogTopic(deviceID)
+	for _, entry := range entries {
+		l.events.Publish(topic, entry)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package hub
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	// DefaultBufferSize of each subscriber's event channel
+	DefaultBufferSize = 64
+	// DefaultReplaySize is how many recent events are kept for replay
+	DefaultReplaySize = 1024
+)
+
+// Hub is an in process fan out of events to subscribers. Publishing never blocks, if a
+// subscriber's buffer is full the event is dropped for that subscriber only. The most
+// recent events are kept in a bounded ring buffer so reconnecting clients can resume.
+type Hub struct {
+	mu          sync.RWMutex
+	lastID      uint64
+	bufferSize  int
+	subscribers map[*subscription]struct{}
+
+	replayMu sync.RWMutex
+	replay   []*ewserver.Event // ring buffer of the most recent events
+	next     int               // index of the next write into replay
+}
+
+// New creates a new Hub where each subscriber can buffer up to bufferSize events and the
+// last replaySize events are kept for Replay.
+func New(bufferSize, replaySize int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	if replaySize <= 0 {
+		replaySize = DefaultReplaySize
+	}
+	return &Hub{bufferSize: bufferSize, subscribers: make(map[*subscription]struct{}), replay: make([]*ewserver.Event, replaySize)}
+}
+
+// Publish the data to all subscribers of the topic, returning the published event.
+func (h *Hub) Publish(topic string, data interface{}) *ewserver.Event {
+	event := &ewserver.Event{
+		Topic: topic,
+		Time:  time.Now().UTC(),
+		Data:  data,
+	}
+
+	// assign the ID and fan out under the replay lock so the ring buffer and every subscriber see
+	// events in ID order, sends never block so holding it is cheap
+	h.replayMu.Lock()
+	defer h.replayMu.Unlock()
+	h.lastID++
+	event.ID = h.lastID
+	h.replay[h.next] = event
+	h.next = (h.next + 1) % len(h.replay)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers {
+		if !sub.matches(topic) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+	return event
+}
+
+// Replay returns the buffered events after the since ID that match any of the topics, oldest first.
+// If since is newer than any event published the server has restarted, so everything buffered is returned.
+func (h *Hub) Replay(since uint64, topics ...string) []*ewserver.Event {
+	h.replayMu.RLock()
+	defer h.replayMu.RUnlock()
+
+	if since > h.lastID {
+		since = 0
+	}
+
+	events := make([]*ewserver.Event, 0)
+	for i := 0; i < len(h.replay); i++ {
+		event := h.replay[(h.next+i)%len(h.replay)]
+		if event == nil || event.ID <= since {
+			continue
+		}
+
+		for _, pattern := range topics {
+			if Match(pattern, event.Topic) {
+				events = append(events, event)
+				break
+			}
+		}
+	}
+	return events
+}
+
+// Subscribe to one or more topics, topics ending in * match all topics with that prefix.
+func (h *Hub) Subscribe(topics ...string) ewserver.Subscription {
+	sub := &subscription{hub: h, topics: topics, events: make(chan *ewserver.Event, h.bufferSize)}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// unsubscribe removes the subscriber and closes its channel. The write lock guarantees no
+// Publish is sending on the channel while it is closed.
+func (h *Hub) unsubscribe(sub *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; !ok {
+		return
+	}
+	delete(h.subscribers, sub)
+	close(sub.events)
+}
+
+// subscription to a set of topics
+type subscription struct {
+	hub     *Hub
+	topics  []string
+	events  chan *ewserver.Event
+	dropped uint64
+}
+
+// Events channel, closed when the subscription is closed
+func (s *subscription) Events() <-chan *ewserver.Event {
+	return s.events
+}
+
+// Dropped returns how many events were dropped because the subscriber was too slow
+func (s *subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close the subscription, safe to call multiple times
+func (s *subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+func (s *subscription) matches(topic string) bool {
+	for _, pattern := range s.topics {
+		if Match(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the topic matches the pattern, patterns ending in * match by prefix.
+func Match(pattern, topic string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(topic, pattern[:len(pattern)-1])
+	}
+	return pattern == topic
+}
@@ -0,0 +1,172 @@
+package hub
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+func TestHub_Publish(t *testing.T) {
+	h := New(4, 0)
+
+	sub := h.Subscribe("data:abc:temperature")
+	defer sub.Close()
+
+	prefixSub := h.Subscribe("data:abc:*")
+	defer prefixSub.Close()
+
+	h.Publish("data:abc:temperature", 1)
+	h.Publish("data:abc:battery", 2)
+	h.Publish("data:def:temperature", 3)
+
+	event := testReceive(sub, t)
+	if event.Data != 1 || event.Topic != "data:abc:temperature" {
+		t.Fatalf("expected temperature event got: %#v\n", event)
+	}
+
+	if len(sub.Events()) != 0 {
+		t.Fatalf("expected exact topic subscription to only receive one event got: %d more\n", len(sub.Events()))
+	}
+
+	first := testReceive(prefixSub, t)
+	second := testReceive(prefixSub, t)
+	if first.Data != 1 || second.Data != 2 {
+		t.Fatalf("expected prefix subscription to receive events 1 and 2 got: %v and %v\n", first.Data, second.Data)
+	}
+
+	if second.ID <= first.ID {
+		t.Fatalf("expected event ids to increase: %d then %d\n", first.ID, second.ID)
+	}
+}
+
+func TestHub_PublishOrder(t *testing.T) {
+	h := New(1000, 0)
+
+	sub := h.Subscribe("*")
+	defer sub.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.Publish("topic", j)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var lastID uint64
+	for i := 0; i < 1000; i++ {
+		event := testReceive(sub, t)
+		if event.ID <= lastID {
+			t.Fatalf("expected events in id order got: %d after %d\n", event.ID, lastID)
+		}
+		lastID = event.ID
+	}
+}
+
+func TestHub_SlowSubscriber(t *testing.T) {
+	h := New(2, 0)
+
+	slow := h.Subscribe("*")
+	defer slow.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			h.Publish("topic", i)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("publish blocked on a slow subscriber")
+	}
+
+	if slow.Dropped() != 8 {
+		t.Fatalf("expected 8 dropped events got: %d\n", slow.Dropped())
+	}
+}
+
+func TestHub_Close(t *testing.T) {
+	h := New(2, 0)
+
+	sub := h.Subscribe("*")
+	sub.Close()
+	sub.Close()
+
+	if _, ok := <-sub.Events(); ok {
+		t.Fatalf("expected events channel to be closed")
+	}
+
+	// must not panic sending to the closed subscriber
+	h.Publish("topic", 1)
+}
+
+func TestHub_Replay(t *testing.T) {
+	h := New(2, 4)
+
+	if events := h.Replay(0, "*"); len(events) != 0 {
+		t.Fatalf("expected empty replay got: %d\n", len(events))
+	}
+
+	for i := 0; i < 6; i++ {
+		topic := "admin"
+		if i%2 == 0 {
+			topic = "data:abc:temperature"
+		}
+		h.Publish(topic, i)
+	}
+
+	// only the last 4 events (ids 3-6) are kept
+	events := h.Replay(0, "*")
+	if len(events) != 4 || events[0].ID != 3 || events[3].ID != 6 {
+		t.Fatalf("expected events 3 to 6 got: %d events\n", len(events))
+	}
+
+	events = h.Replay(4, "data:*")
+	if len(events) != 1 || events[0].ID != 5 {
+		t.Fatalf("expected only data event 5 after 4, got: %d events\n", len(events))
+	}
+
+	// an id from before a restart replays everything buffered
+	if events := h.Replay(100, "admin"); len(events) != 2 {
+		t.Fatalf("expected 2 admin events for unknown id got: %d\n", len(events))
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"admin", "admin", true},
+		{"admin", "administrator", false},
+		{"data:*", "data:abc:temperature", true},
+		{"data:abc:*", "data:def:temperature", false},
+		{"*", "anything", true},
+	}
+
+	for _, test := range tests {
+		if Match(test.pattern, test.topic) != test.match {
+			t.Fatalf("expected Match(%s, %s) to be %t\n", test.pattern, test.topic, test.match)
+		}
+	}
+}
+
+func testReceive(sub ewserver.Subscription, t *testing.T) *ewserver.Event {
+	select {
+	case event := <-sub.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package hub
+
+import (
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// ShadowService wraps a ShadowService publishing updated shadows to their ewserver.ShadowTopic,
+// waking devices long polling for a new delta.
+type ShadowService struct {
+	ewserver.ShadowService
+	events ewserver.EventService
+}
+
+// NewShadowService publishes shadow changes made through service to events
+func NewShadowService(service ewserver.ShadowService, events ewserver.EventService) *ShadowService {
+	return &ShadowService{ShadowService: service, events: events}
+}
+
+// UpdateDesired updates the shadow and then notifies the device's subscribers.
+func (s *ShadowService) UpdateDesired(deviceID []byte, state ewserver.ShadowState, version uint64) (*ewserver.Shadow, error) {
+	shadow, err := s.ShadowService.UpdateDesired(deviceID, state, version)
+	if err != nil {
+		return nil, err
+	}
+
+	s.events.Publish(ewserver.ShadowTopic(deviceID), shadow)
+	return shadow, nil
+}
+
+// UpdateReported updates the shadow and then notifies the device's subscribers.
+func (s *ShadowService) UpdateReported(deviceID []byte, state ewserver.ShadowState, version uint64) (*ewserver.Shadow, error) {
+	shadow, err := s.ShadowService.UpdateReported(deviceID, state, version)
+	if err != nil {
+		return nil, err
+	}
+
+	s.events.Publish(ewserver.ShadowTopic(deviceID), shadow)
+	return shadow, nil
+}
@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// TelemetryService wraps a TelemetryService publishing every successfully stored point
+// to its ewserver.DataTopic so subscribers are notified of new points however they were ingested.
+type TelemetryService struct {
+	ewserver.TelemetryService
+	events ewserver.EventService
+}
+
+// NewTelemetryService publishes points stored by service to events
+func NewTelemetryService(service ewserver.TelemetryService, events ewserver.EventService) *TelemetryService {
+	return &TelemetryService{TelemetryService: service, events: events}
+}
+
+// Publish stores the point and then notifies subscribers of the device's stream.
+func (t *TelemetryService) Publish(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+	if err := t.TelemetryService.Publish(deviceID, stream, point); err != nil {
+		return err
+	}
+
+	t.events.Publish(ewserver.DataTopic(deviceID, stream), &ewserver.StreamEvent{DeviceID: deviceID, Stream: stream, Point: point})
+	return nil
+}
+
+// PublishBatch stores the points and then notifies subscribers of each accepted point, in the order of the batch.
+func (t *TelemetryService) PublishBatch(deviceID []byte, points []*ewserver.BatchPoint) ([]*ewserver.BatchResult, error) {
+	results, err := t.TelemetryService.PublishBatch(deviceID, points)
+	if err != nil {
+		return results, err
+	}
+
+	for _, result := range results {
+		if !result.Accepted {
+			continue
+		}
+
+		point := points[result.Index]
+		t.events.Publish(ewserver.DataTopic(deviceID, point.Stream), &ewserver.StreamEvent{DeviceID: deviceID, Stream: point.Stream, Point: &point.DataPoint})
+	}
+	return results, nil
+}
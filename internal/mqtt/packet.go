@@ -0,0 +1,165 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// control packet types
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// connack return codes
+const (
+	connectAccepted           = 0x00
+	connectBadProtocolVersion = 0x01
+	connectBadCredentials     = 0x04
+	connectNotAuthorized      = 0x05
+)
+
+// subackFailure is returned for a subscription that was not granted
+const subackFailure = 0x80
+
+// maxPacketSize limits the remaining length of packets we accept
+const maxPacketSize = 256 * 1024
+
+var (
+	// ErrMalformedPacket when a packet can not be decoded
+	ErrMalformedPacket = errors.New("mqtt: malformed packet")
+	// ErrPacketTooLarge when a packet is larger than maxPacketSize
+	ErrPacketTooLarge = errors.New("mqtt: packet too large")
+)
+
+// packet is a decoded fixed header and its variable header + payload bytes
+type packet struct {
+	packetType byte
+	flags      byte
+	body       []byte
+}
+
+// readPacket reads the fixed header and the remaining bytes of the next packet.
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > maxPacketSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{packetType: header >> 4, flags: header & 0x0F, body: body}, nil
+}
+
+// readRemainingLength decodes the variable length encoding of up to 4 bytes.
+func readRemainingLength(r *bufio.Reader) (int, error) {
+	length := 0
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		multiplier *= 128
+	}
+	return 0, ErrMalformedPacket
+}
+
+// encodePacket builds a complete packet from the type, flags and body.
+func encodePacket(packetType, flags byte, body []byte) []byte {
+	buf := []byte{packetType<<4 | flags}
+
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(buf, body...)
+}
+
+// decoder reads the fields of a packet body
+type decoder struct {
+	body []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.body) < 1 {
+		d.err = ErrMalformedPacket
+		return 0
+	}
+	b := d.body[0]
+	d.body = d.body[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.body) < 2 {
+		d.err = ErrMalformedPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.body)
+	d.body = d.body[2:]
+	return v
+}
+
+// bytes reads a 2 byte length prefixed field
+func (d *decoder) bytes() []byte {
+	length := int(d.uint16())
+	if d.err != nil || len(d.body) < length {
+		d.err = ErrMalformedPacket
+		return nil
+	}
+	v := d.body[:length]
+	d.body = d.body[length:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// appendString appends a 2 byte length prefixed string
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+// appendUint16 appends a big endian uint16
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
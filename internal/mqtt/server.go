@@ -0,0 +1,390 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/authz"
+)
+
+const (
+	// TopicPrefix of the topics devices publish and subscribe to, data/<stream> maps to the
+	// device's stream and is authorized as the casbin object /api/v1/data/<stream>.
+	TopicPrefix = "data/"
+
+	connectTimeout = 10 * time.Second // how long a client has to send CONNECT after connecting
+	writeTimeout   = 10 * time.Second // how long a write to a client may block
+)
+
+// Server is a minimal MQTT 3.1.1 broker for devices. Clients authenticate with their API key as the
+// password, published messages are stored through the TelemetryService and subscriptions are served
+// from the EventService. Every packet, including keep alive pings, is activity of the device. Only QoS 0 and 1 publishes are accepted, subscriptions are granted at QoS 0.
+type Server struct {
+	apiUserService   ewserver.APIUserService
+	telemetryService ewserver.TelemetryService
+	eventService     ewserver.EventService
+	presenceService  ewserver.PresenceService
+	authorizer       authz.Authorizer
+	logger           ewserver.LogService
+
+	mu       sync.Mutex
+	listener net.Listener
+	clients  map[*client]struct{}
+}
+
+// New creates a new MQTT server
+func New(apiUserService ewserver.APIUserService, telemetryService ewserver.TelemetryService, eventService ewserver.EventService, presenceService ewserver.PresenceService, authorizer authz.Authorizer, logService ewserver.LogService) *Server {
+	return &Server{
+		apiUserService:   apiUserService,
+		telemetryService: telemetryService,
+		eventService:     eventService,
+		presenceService:  presenceService,
+		authorizer:       authorizer,
+		logger:           logService,
+		clients:          make(map[*client]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address and serves clients until closed.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve clients connecting to the listener until it is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close the listener and disconnect all clients
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		c.conn.Close()
+	}
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// client is a single authenticated connection
+type client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	apiUser *ewserver.APIUser
+	writeMu sync.Mutex
+
+	subMu         sync.Mutex
+	subscriptions map[string]ewserver.Subscription // mqtt topic -> event subscription
+}
+
+func (c *client) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// closeSubscriptions closes all event subscriptions of the client
+func (c *client) closeSubscriptions() {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	for topic, sub := range c.subscriptions {
+		sub.Close()
+		delete(c.subscriptions, topic)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	c := &client{conn: conn, reader: bufio.NewReader(conn), subscriptions: make(map[string]ewserver.Subscription)}
+	defer c.closeSubscriptions()
+
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	keepAlive, ok := s.connect(c)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	s.logger.Info("mqtt client connected", "api_user", c.apiUser.Name, "ipaddr", conn.RemoteAddr().String())
+	s.seen(c.apiUser, conn.RemoteAddr())
+
+	for {
+		// clients must send something within one and a half times their keep alive
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := readPacket(c.reader)
+		if err != nil {
+			s.logger.Info("mqtt client disconnected", "api_user", c.apiUser.Name, "error", err)
+			return
+		}
+		s.seen(c.apiUser, conn.RemoteAddr())
+
+		switch p.packetType {
+		case packetPublish:
+			err = s.publish(c, p)
+		case packetSubscribe:
+			err = s.subscribe(c, p)
+		case packetUnsubscribe:
+			err = s.unsubscribe(c, p)
+		case packetPingreq:
+			err = c.write(encodePacket(packetPingresp, 0, nil))
+		case packetPuback:
+			// we only send QoS 0, nothing to do
+		case packetDisconnect:
+			s.logger.Info("mqtt client disconnected", "api_user", c.apiUser.Name)
+			return
+		default:
+			err = ErrMalformedPacket
+		}
+
+		if err != nil {
+			s.logger.Error("mqtt client error", "api_user", c.apiUser.Name, "error", err)
+			return
+		}
+	}
+}
+
+// connect reads the CONNECT packet and authenticates the client's API key (sent as the password).
+func (s *Server) connect(c *client) (time.Duration, bool) {
+	p, err := readPacket(c.reader)
+	if err != nil || p.packetType != packetConnect {
+		return 0, false
+	}
+
+	d := &decoder{body: p.body}
+	protocol := d.string()
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := time.Duration(d.uint16()) * time.Second
+	d.string() // client id, we identify clients by their API user
+
+	if flags&0x04 != 0 { // will topic and message are accepted but not used
+		d.string()
+		d.bytes()
+	}
+
+	if flags&0x80 != 0 { // user name is not used, the API key identifies the device
+		d.string()
+	}
+
+	var password string
+	if flags&0x40 != 0 {
+		password = d.string()
+	}
+
+	if d.err != nil {
+		return 0, false
+	}
+
+	if protocol != "MQTT" || level != 4 {
+		c.write(encodePacket(packetConnack, 0, []byte{0, connectBadProtocolVersion}))
+		return 0, false
+	}
+
+	apiUser, err := s.apiUserService.APIUser(ewserver.APIKey(password))
+	if password == "" || err != nil || apiUser.Name == "" || apiUser.Disabled {
+		s.logger.Info("mqtt authentication failure", "ipaddr", c.conn.RemoteAddr().String())
+		c.write(encodePacket(packetConnack, 0, []byte{0, connectBadCredentials}))
+		return 0, false
+	}
+	c.apiUser = apiUser
+
+	return keepAlive, c.write(encodePacket(packetConnack, 0, []byte{0, connectAccepted})) == nil
+}
+
+// publish stores the message payload as a data point of the topic's stream. The payload may be
+// a data point ({"timestamp": ..., "value": ...}) or any other JSON value which is used as the value.
+// Invalid data is acknowledged and dropped so QoS 1 clients do not retry it forever.
+func (s *Server) publish(c *client, p *packet) error {
+	qos := (p.flags >> 1) & 0x03
+	if qos > 1 {
+		return ErrMalformedPacket
+	}
+
+	d := &decoder{body: p.body}
+	topic := d.string()
+
+	var packetID uint16
+	if qos == 1 {
+		packetID = d.uint16()
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	stream, ok := topicStream(topic)
+	if !ok || !s.authorizer.Enforce(c.apiUser.Name, dataObject(stream), "POST") {
+		s.logger.Info("mqtt publish denied", "api_user", c.apiUser.Name, "topic", topic)
+		return ackPublish(c, qos, packetID)
+	}
+
+	err := s.telemetryService.Publish(c.apiUser.ID, stream, ewserver.DecodeDataPoint(d.body))
+	switch err {
+	case nil:
+	case ewserver.ErrInvalidDataPoint, ewserver.ErrInvalidStream:
+		s.logger.Info("mqtt publish invalid data", "api_user", c.apiUser.Name, "topic", topic, "error", err)
+	default:
+		return err
+	}
+	return ackPublish(c, qos, packetID)
+}
+
+// ackPublish sends a PUBACK for QoS 1 publishes
+func ackPublish(c *client, qos byte, packetID uint16) error {
+	if qos == 0 {
+		return nil
+	}
+	return c.write(encodePacket(packetPuback, 0, appendUint16(nil, packetID)))
+}
+
+// subscribe the client to the device's streams. Wildcards are not supported.
+func (s *Server) subscribe(c *client, p *packet) error {
+	d := &decoder{body: p.body}
+	packetID := d.uint16()
+
+	granted := make([]byte, 0)
+	for d.err == nil && len(d.body) > 0 {
+		topic := d.string()
+		d.byte() // requested QoS, we only send QoS 0
+		if d.err != nil {
+			break
+		}
+
+		stream, ok := topicStream(topic)
+		if !ok || !s.authorizer.Enforce(c.apiUser.Name, dataObject(stream), "GET") {
+			s.logger.Info("mqtt subscribe denied", "api_user", c.apiUser.Name, "topic", topic)
+			granted = append(granted, subackFailure)
+			continue
+		}
+
+		s.addSubscription(c, topic, stream)
+		granted = append(granted, 0)
+	}
+
+	if d.err != nil || len(granted) == 0 {
+		return ErrMalformedPacket
+	}
+	return c.write(encodePacket(packetSuback, 0, append(appendUint16(nil, packetID), granted...)))
+}
+
+// addSubscription subscribes to the stream's events and forwards them to the client until closed.
+func (s *Server) addSubscription(c *client, topic string, stream ewserver.StreamName) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	if _, exists := c.subscriptions[topic]; exists {
+		return
+	}
+
+	sub := s.eventService.Subscribe(ewserver.DataTopic(c.apiUser.ID, stream))
+	c.subscriptions[topic] = sub
+
+	go func() {
+		for event := range sub.Events() {
+			streamEvent, ok := event.Data.(*ewserver.StreamEvent)
+			if !ok {
+				continue
+			}
+
+			payload, err := json.Marshal(streamEvent.Point)
+			if err != nil {
+				continue
+			}
+
+			body := append(appendString(nil, topic), payload...)
+			if err := c.write(encodePacket(packetPublish, 0, body)); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) unsubscribe(c *client, p *packet) error {
+	d := &decoder{body: p.body}
+	packetID := d.uint16()
+
+	for d.err == nil && len(d.body) > 0 {
+		topic := d.string()
+		c.subMu.Lock()
+		if sub, ok := c.subscriptions[topic]; ok {
+			sub.Close()
+			delete(c.subscriptions, topic)
+		}
+		c.subMu.Unlock()
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	return c.write(encodePacket(packetUnsuback, 0, appendUint16(nil, packetID)))
+}
+
+// topicStream maps an MQTT topic to the device's stream
+func topicStream(topic string) (ewserver.StreamName, bool) {
+	if !strings.HasPrefix(topic, TopicPrefix) {
+		return "", false
+	}
+
+	stream := ewserver.StreamName(strings.TrimPrefix(topic, TopicPrefix))
+	return stream, stream.Valid()
+}
+
+// dataObject returns the casbin object used to authorize access to a stream, the same as the HTTP API.
+func dataObject(stream ewserver.StreamName) string {
+	return "/api/v1/data/" + string(stream)
+}
+
+// seen records the request as activity of the API user's device
+func (s *Server) seen(apiUser *ewserver.APIUser, addr net.Addr) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	if err := s.presenceService.Seen(apiUser.ID, host, "mqtt", time.Now().UTC()); err != nil {
+		s.logger.Error("error tracking presence", "error", err)
+	}
+}
@@ -0,0 +1,197 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/hub"
+	"github.com/wirepair/ewserver/mock"
+)
+
+const testAPIKey = "devicekey"
+
+var testDeviceID = []byte("device1")
+
+func TestServer_Connect(t *testing.T) {
+	server, addr := testServer(nil, t)
+	defer server.Close()
+
+	conn, reader := testDial(addr, t)
+	defer conn.Close()
+
+	testWrite(conn, testConnectPacket("wrongkey"), t)
+	p := testRead(reader, t)
+	if p.packetType != packetConnack || p.body[1] != connectBadCredentials {
+		t.Fatalf("expected bad credentials connack got: %d %v\n", p.packetType, p.body)
+	}
+
+	conn, reader = testDial(addr, t)
+	defer conn.Close()
+
+	testWrite(conn, testConnectPacket(testAPIKey), t)
+	p = testRead(reader, t)
+	if p.packetType != packetConnack || p.body[1] != connectAccepted {
+		t.Fatalf("expected accepted connack got: %d %v\n", p.packetType, p.body)
+	}
+
+	testWrite(conn, encodePacket(packetPingreq, 0, nil), t)
+	if p := testRead(reader, t); p.packetType != packetPingresp {
+		t.Fatalf("expected pingresp got: %d\n", p.packetType)
+	}
+
+	if !server.presenceService.(*mock.PresenceService).SeenInvoked {
+		t.Fatalf("expected the connected device to be seen\n")
+	}
+}
+
+func TestServer_PublishSubscribe(t *testing.T) {
+	published := make(chan *ewserver.DataPoint, 1)
+	telemetry := &mock.TelemetryService{}
+	telemetry.PublishFn = func(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+		if string(deviceID) != string(testDeviceID) || stream != "temperature" {
+			t.Fatalf("unexpected publish to %s %s\n", deviceID, stream)
+		}
+		published <- point
+		return nil
+	}
+
+	server, addr := testServer(telemetry, t)
+	defer server.Close()
+
+	conn, reader := testDial(addr, t)
+	defer conn.Close()
+
+	testWrite(conn, testConnectPacket(testAPIKey), t)
+	testRead(reader, t)
+
+	body := appendUint16(nil, 1)
+	body = append(appendString(body, "data/temperature"), 0)
+	body = append(appendString(body, "data/secret"), 0)
+	body = append(appendString(body, "other/topic"), 0)
+	testWrite(conn, encodePacket(packetSubscribe, 0x02, body), t)
+
+	p := testRead(reader, t)
+	if p.packetType != packetSuback {
+		t.Fatalf("expected suback got: %d\n", p.packetType)
+	}
+
+	if granted := p.body[2:]; len(granted) != 3 || granted[0] != 0 || granted[1] != subackFailure || granted[2] != subackFailure {
+		t.Fatalf("expected only data/temperature to be granted got: %v\n", granted)
+	}
+
+	// QoS 1 publish of a plain value
+	body = appendUint16(appendString(nil, "data/temperature"), 7)
+	body = append(body, []byte(`21.5`)...)
+	testWrite(conn, encodePacket(packetPublish, 0x02, body), t)
+
+	p = testRead(reader, t)
+	if p.packetType != packetPuback || p.body[1] != 7 {
+		t.Fatalf("expected puback for packet 7 got: %d %v\n", p.packetType, p.body)
+	}
+
+	select {
+	case point := <-published:
+		if string(point.Value) != "21.5" {
+			t.Fatalf("expected value 21.5 got: %s\n", point.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("point was not published to telemetry")
+	}
+
+	// the subscription receives the point back
+	p = testRead(reader, t)
+	if p.packetType != packetPublish {
+		t.Fatalf("expected publish got: %d\n", p.packetType)
+	}
+
+	d := &decoder{body: p.body}
+	if topic := d.string(); topic != "data/temperature" {
+		t.Fatalf("expected data/temperature topic got: %s\n", topic)
+	}
+
+	point := ewserver.DecodeDataPoint(d.body)
+	if string(point.Value) != "21.5" {
+		t.Fatalf("expected point with value 21.5 got: %s\n", d.body)
+	}
+}
+
+func TestDecodePoint(t *testing.T) {
+	point := ewserver.DecodeDataPoint([]byte(`{"timestamp": "2018-01-01T00:00:00Z", "value": {"a": 1}}`))
+	if string(point.Value) != `{"a": 1}` || point.Timestamp.Year() != 2018 {
+		t.Fatalf("expected data point to be decoded got: %s %s\n", point.Value, point.Timestamp)
+	}
+
+	point = ewserver.DecodeDataPoint([]byte(`{"celsius": 21}`))
+	if string(point.Value) != `{"celsius": 21}` || !point.Timestamp.IsZero() {
+		t.Fatalf("expected object to be used as the value got: %s\n", point.Value)
+	}
+}
+
+func testServer(telemetry *mock.TelemetryService, t *testing.T) (*Server, string) {
+	apiUsers := &mock.APIUserService{}
+	apiUsers.APIUserFn = func(key ewserver.APIKey) (*ewserver.APIUser, error) {
+		if key != testAPIKey {
+			return nil, ewserver.ErrUserNotFound
+		}
+		return &ewserver.APIUser{Key: key, Name: "device1", ID: testDeviceID}, nil
+	}
+
+	authorizer := &mock.Authorizer{}
+	authorizer.EnforceFn = func(subject, object, action string) bool {
+		return subject == "device1" && object == "/api/v1/data/temperature"
+	}
+
+	if telemetry == nil {
+		telemetry = &mock.TelemetryService{}
+	}
+
+	presence := &mock.PresenceService{}
+	presence.SeenFn = func(deviceID []byte, address, userAgent string, at time.Time) error { return nil }
+
+	events := hub.New(hub.DefaultBufferSize, hub.DefaultReplaySize)
+	server := New(apiUsers, hub.NewTelemetryService(telemetry, events), events, presence, authorizer, &mock.Log{})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	go server.Serve(listener)
+
+	return server, listener.Addr().String()
+}
+
+func testConnectPacket(password string) []byte {
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0xC2) // level 4, user name, password and clean session
+	body = appendUint16(body, 60)
+	body = appendString(body, "client1")
+	body = appendString(body, "device1")
+	body = appendString(body, password)
+	return encodePacket(packetConnect, 0, body)
+}
+
+func testDial(addr string, t *testing.T) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func testWrite(conn net.Conn, data []byte, t *testing.T) {
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("error writing packet: %s\n", err)
+	}
+}
+
+func testRead(reader *bufio.Reader, t *testing.T) *packet {
+	p, err := readPacket(reader)
+	if err != nil {
+		t.Fatalf("error reading packet: %s\n", err)
+	}
+	return p
+}
@@ -0,0 +1,194 @@
+// Package presence coalesces device activity in memory and derives their online/offline state.
+package presence
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// FlushInterval between writes of coalesced activity and checks for devices that timed out
+const FlushInterval = 10 * time.Second
+
+// Tracker is a PresenceService that records activity in memory and periodically saves what changed
+// to the wrapped service in a single batch. A device goes online when it is seen and offline once it
+// has not been seen for the heartbeat timeout, both are published to the device's topic.
+type Tracker struct {
+	ewserver.PresenceService
+	events    ewserver.EventService
+	logger    ewserver.LogService
+	timeout   time.Duration
+	lock      sync.Mutex
+	presences map[string]*ewserver.Presence
+	dirty     map[string]struct{}
+}
+
+// New creates a tracker of the presences stored by service, loading them into memory. Devices that
+// were online when the server stopped stay online until they time out.
+func New(service ewserver.PresenceService, events ewserver.EventService, timeout time.Duration, logger ewserver.LogService) (*Tracker, error) {
+	if timeout <= 0 {
+		timeout = ewserver.DefaultPresenceTimeout
+	}
+
+	presences, err := service.Presences()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tracker{
+		PresenceService: service,
+		events:          events,
+		logger:          logger,
+		timeout:         timeout,
+		presences:       make(map[string]*ewserver.Presence, len(presences)),
+		dirty:           make(map[string]struct{}),
+	}
+
+	for _, presence := range presences {
+		t.presences[string(presence.DeviceID)] = presence
+	}
+	return t, nil
+}
+
+// Run flushes activity and times out devices every interval. It never returns.
+func (t *Tracker) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		t.Sweep(now)
+		if err := t.Flush(); err != nil {
+			t.logger.Error("error saving presence", "error", err)
+		}
+	}
+}
+
+// Seen records activity of the device in memory, publishing it going online if it was offline.
+func (t *Tracker) Seen(deviceID []byte, address, userAgent string, at time.Time) error {
+	if len(deviceID) == 0 {
+		return ewserver.ErrUserNotFound
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := string(deviceID)
+	presence, ok := t.presences[key]
+	if !ok {
+		presence = ewserver.NewPresence(append([]byte{}, deviceID...))
+		t.presences[key] = presence
+	}
+
+	if at.Before(presence.LastSeen) {
+		return nil
+	}
+
+	presence.LastSeen, presence.Address, presence.UserAgent = at, address, userAgent
+	t.dirty[key] = struct{}{}
+
+	if !presence.Online {
+		presence.Online, presence.Since = true, at
+		t.publish(presence)
+	}
+	return nil
+}
+
+// Presence returns a copy of the device's presence, never seen and offline if it is unknown.
+func (t *Tracker) Presence(deviceID []byte) (*ewserver.Presence, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	presence, ok := t.presences[string(deviceID)]
+	if !ok {
+		return ewserver.NewPresence(deviceID), nil
+	}
+
+	p := *presence
+	return &p, nil
+}
+
+// Presences returns a copy of the presence of every device that was seen, ordered by device id
+func (t *Tracker) Presences() ([]*ewserver.Presence, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	presences := make([]*ewserver.Presence, 0, len(t.presences))
+	for _, presence := range t.presences {
+		p := *presence
+		presences = append(presences, &p)
+	}
+
+	sort.Slice(presences, func(i, j int) bool { return bytes.Compare(presences[i].DeviceID, presences[j].DeviceID) < 0 })
+	return presences, nil
+}
+
+// Delete forgets the device's presence in memory and deletes it from the wrapped service. Nothing is
+// published, the device no longer exists.
+func (t *Tracker) Delete(deviceID []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.presences, string(deviceID))
+	delete(t.dirty, string(deviceID))
+	return t.PresenceService.Delete(deviceID)
+}
+
+// Sweep marks devices that have not been seen for the timeout as offline, publishing each change.
+// Returns how many devices went offline.
+func (t *Tracker) Sweep(now time.Time) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	offline := 0
+	for key, presence := range t.presences {
+		if !presence.Online || now.Sub(presence.LastSeen) < t.timeout {
+			continue
+		}
+
+		presence.Online, presence.Since = false, now
+		t.dirty[key] = struct{}{}
+		t.publish(presence)
+		offline++
+	}
+	return offline
+}
+
+// Flush saves the presences that changed since the last flush in one batch. If saving fails they
+// are kept to be retried by the next flush.
+func (t *Tracker) Flush() error {
+	t.lock.Lock()
+	presences := make([]*ewserver.Presence, 0, len(t.dirty))
+	for key := range t.dirty {
+		p := *t.presences[key]
+		presences = append(presences, &p)
+	}
+	t.dirty = make(map[string]struct{})
+	t.lock.Unlock()
+
+	if len(presences) == 0 {
+		return nil
+	}
+
+	err := t.PresenceService.Save(presences)
+	if err != nil {
+		t.lock.Lock()
+		for _, presence := range presences {
+			t.dirty[string(presence.DeviceID)] = struct{}{}
+		}
+		t.lock.Unlock()
+	}
+	return err
+}
+
+// publish the device's online state, must be called with the lock held
+func (t *Tracker) publish(presence *ewserver.Presence) {
+	t.events.Publish(ewserver.DeviceTopic(presence.DeviceID), &ewserver.PresenceEvent{
+		DeviceID: presence.DeviceID,
+		Online:   presence.Online,
+		LastSeen: presence.LastSeen,
+		Address:  presence.Address,
+	})
+}
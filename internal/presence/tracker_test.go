@@ -0,0 +1,112 @@
+package presence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/hub"
+	"github.com/wirepair/ewserver/mock"
+)
+
+func TestTracker_Coalesce(t *testing.T) {
+	saved := make([][]*ewserver.Presence, 0)
+	service := &mock.PresenceService{
+		PresencesFn: func() ([]*ewserver.Presence, error) { return nil, nil },
+		SaveFn: func(presences []*ewserver.Presence) error {
+			saved = append(saved, presences)
+			return nil
+		},
+	}
+
+	tracker, err := New(service, hub.New(4, 0), time.Minute, &mock.Log{})
+	if err != nil {
+		t.Fatalf("error creating tracker: %s\n", err)
+	}
+
+	now := time.Now().UTC()
+	for i := 0; i < 10; i++ {
+		if err := tracker.Seen([]byte("device"), "127.0.0.1", "agent", now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("error recording device as seen: %s\n", err)
+		}
+	}
+
+	if service.SaveInvoked {
+		t.Fatalf("expected activity not to be saved until flushed")
+	}
+
+	if err := tracker.Flush(); err != nil || len(saved) != 1 || len(saved[0]) != 1 || !saved[0][0].LastSeen.Equal(now.Add(9*time.Second)) {
+		t.Fatalf("expected a single save of the latest activity got: %v %#v\n", err, saved)
+	}
+
+	if err := tracker.Flush(); err != nil || len(saved) != 1 {
+		t.Fatalf("expected nothing to save without new activity got: %v %d\n", err, len(saved))
+	}
+
+	service.DeleteFn = func(deviceID []byte) error { return nil }
+	if err := tracker.Seen([]byte("device"), "127.0.0.1", "agent", now.Add(time.Minute)); err != nil {
+		t.Fatalf("error recording device as seen: %s\n", err)
+	}
+
+	if err := tracker.Delete([]byte("device")); err != nil || !service.DeleteInvoked {
+		t.Fatalf("expected the presence to be deleted from the service got: %v\n", err)
+	}
+
+	if err := tracker.Flush(); err != nil || len(saved) != 1 {
+		t.Fatalf("expected activity of a deleted device not to be saved got: %v %d\n", err, len(saved))
+	}
+
+	if presence, _ := tracker.Presence([]byte("device")); presence.Online || !presence.LastSeen.IsZero() {
+		t.Fatalf("expected a deleted device to be unknown got: %#v\n", presence)
+	}
+}
+
+func TestTracker_OnlineOffline(t *testing.T) {
+	now := time.Now().UTC()
+	service := &mock.PresenceService{
+		PresencesFn: func() ([]*ewserver.Presence, error) {
+			return []*ewserver.Presence{{DeviceID: []byte("stale"), LastSeen: now.Add(-time.Hour), Online: true}}, nil
+		},
+		SaveFn: func(presences []*ewserver.Presence) error { return ewserver.ErrInvalidQuery },
+	}
+
+	events := hub.New(4, 0)
+	subscription := events.Subscribe(ewserver.DeviceTopic(nil) + "*")
+	defer subscription.Close()
+
+	tracker, err := New(service, events, time.Minute, &mock.Log{})
+	if err != nil {
+		t.Fatalf("error creating tracker: %s\n", err)
+	}
+
+	if err := tracker.Seen([]byte("device"), "127.0.0.1", "agent", now); err != nil {
+		t.Fatalf("error recording device as seen: %s\n", err)
+	}
+
+	event := <-subscription.Events()
+	if presence := event.Data.(*ewserver.PresenceEvent); event.Topic != ewserver.DeviceTopic([]byte("device")) || !presence.Online {
+		t.Fatalf("expected the device to go online got: %s %#v\n", event.Topic, presence)
+	}
+
+	if offline := tracker.Sweep(now.Add(30 * time.Second)); offline != 1 {
+		t.Fatalf("expected only the stale device to go offline got: %d\n", offline)
+	}
+
+	event = <-subscription.Events()
+	if presence := event.Data.(*ewserver.PresenceEvent); string(presence.DeviceID) != "stale" || presence.Online {
+		t.Fatalf("expected the stale device to go offline got: %#v\n", presence)
+	}
+
+	if offline := tracker.Sweep(now.Add(time.Minute)); offline != 1 {
+		t.Fatalf("expected the device to time out got: %d\n", offline)
+	}
+
+	presence, _ := tracker.Presence([]byte("device"))
+	if presence.Online || !presence.LastSeen.Equal(now) {
+		t.Fatalf("expected the device to be offline got: %#v\n", presence)
+	}
+
+	if err := tracker.Flush(); err == nil || len(tracker.dirty) != 2 {
+		t.Fatalf("expected a failed flush to be retried got: %v %d\n", err, len(tracker.dirty))
+	}
+}
@@ -0,0 +1,215 @@
+// Package ratelimit limits requests per identity and client address with token buckets held in memory.
+package ratelimit
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// FlushInterval between pruning full buckets and, if persisted, saving the others
+const FlushInterval = time.Minute
+
+// Limiter is a RateLimitService that keeps the limits and token buckets in memory. Each API user, UI
+// user and client address has its own bucket, limited by the most specific limit that applies to it.
+// Identities and addresses without any limit are not limited.
+type Limiter struct {
+	ewserver.RateLimitService
+	roles   ewserver.RoleService
+	logger  ewserver.LogService
+	persist bool
+	lock    sync.Mutex
+	limits  map[string]*ewserver.RateLimit
+	buckets map[string]*ewserver.RateBucket
+}
+
+// New creates a limiter of the limits stored by service. If persist is true the buckets saved by
+// the last run are restored, so restarting the server does not reset them.
+func New(service ewserver.RateLimitService, roles ewserver.RoleService, persist bool, logger ewserver.LogService) (*Limiter, error) {
+	limits, err := service.Limits()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Limiter{
+		RateLimitService: service,
+		roles:            roles,
+		logger:           logger,
+		persist:          persist,
+		limits:           make(map[string]*ewserver.RateLimit, len(limits)),
+		buckets:          make(map[string]*ewserver.RateBucket),
+	}
+
+	for _, limit := range limits {
+		l.limits[limit.Key()] = limit
+	}
+
+	if !persist {
+		return l, nil
+	}
+
+	buckets, err := service.Buckets()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bucket := range buckets {
+		l.buckets[bucket.Key] = bucket
+	}
+	return l, nil
+}
+
+// Run prunes full buckets, and saves the rest if persisted, every interval. It never returns.
+func (l *Limiter) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		buckets := l.Prune(now)
+		if !l.persist {
+			continue
+		}
+
+		if err := l.SaveBuckets(buckets); err != nil {
+			l.logger.Error("error saving rate limit buckets", "error", err)
+		}
+	}
+}
+
+// SetLimit stores the limit and applies it to the next requests
+func (l *Limiter) SetLimit(limit *ewserver.RateLimit) error {
+	if err := l.RateLimitService.SetLimit(limit); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	stored := *limit
+	l.limits[limit.Key()] = &stored
+	return nil
+}
+
+// DeleteLimit removes the limit, identities it applied to fall back to a less specific one
+func (l *Limiter) DeleteLimit(scope, subject string) error {
+	if err := l.RateLimitService.DeleteLimit(scope, subject); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.limits, ewserver.RateLimitKey(scope, subject))
+	return nil
+}
+
+// Limits returns copies of the limits ordered by scope and subject
+func (l *Limiter) Limits() ([]*ewserver.RateLimit, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limits := make([]*ewserver.RateLimit, 0, len(l.limits))
+	for _, limit := range l.limits {
+		copied := *limit
+		limits = append(limits, &copied)
+	}
+
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Key() < limits[j].Key() })
+	return limits, nil
+}
+
+// AllowAddress takes a token from the client address's bucket, returning false and how long to
+// wait if it is empty.
+func (l *Limiter) AllowAddress(address string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limit := l.limit(ewserver.RateLimitScopeIP, address, nil)
+	return l.take(ewserver.RateLimitScopeIP, address, limit, now)
+}
+
+// AllowIdentity takes a token from the bucket of the API user (RateLimitScopeAPIUser) or UI user
+// (RateLimitScopeUser) with the name, returning false and how long to wait if it is empty. The
+// user's own limit applies first, then the most generous limit of its roles, then the scope's default.
+func (l *Limiter) AllowIdentity(scope, name string, now time.Time) (bool, time.Duration) {
+	// look up the roles outside the lock, enforcing them is slower than taking a token
+	roles := l.roles.RolesForSubject(name)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limit := l.limit(scope, name, roles)
+	return l.take(scope, name, limit, now)
+}
+
+// Prune removes buckets that refilled, as they are the same as new ones, and returns copies of the rest.
+func (l *Limiter) Prune(now time.Time) []*ewserver.RateBucket {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	remaining := make([]*ewserver.RateBucket, 0, len(l.buckets))
+	for key, bucket := range l.buckets {
+		limit := l.bucketLimit(key)
+		if limit == nil || bucket.Full(limit, now) {
+			delete(l.buckets, key)
+			continue
+		}
+
+		copied := *bucket
+		remaining = append(remaining, &copied)
+	}
+	return remaining
+}
+
+// limit returns the most specific limit of the subject in the scope, nil if none applies. Must hold lock.
+func (l *Limiter) limit(scope, subject string, roles []string) *ewserver.RateLimit {
+	if limit, ok := l.limits[ewserver.RateLimitKey(scope, subject)]; ok {
+		return limit
+	}
+
+	var roleLimit *ewserver.RateLimit
+	for _, role := range roles {
+		limit, ok := l.limits[ewserver.RateLimitKey(ewserver.RateLimitScopeRole, role)]
+		if ok && (roleLimit == nil || limit.Rate > roleLimit.Rate || limit.Rate == roleLimit.Rate && limit.Burst > roleLimit.Burst) {
+			roleLimit = limit
+		}
+	}
+
+	if roleLimit != nil {
+		return roleLimit
+	}
+	return l.limits[ewserver.RateLimitKey(scope, ewserver.RateLimitDefault)]
+}
+
+// bucketLimit returns the limit a bucket is refilled with when pruning. Must hold lock.
+func (l *Limiter) bucketLimit(key string) *ewserver.RateLimit {
+	for _, scope := range []string{ewserver.RateLimitScopeIP, ewserver.RateLimitScopeAPIUser, ewserver.RateLimitScopeUser} {
+		if prefix := ewserver.RateLimitKey(scope, ""); strings.HasPrefix(key, prefix) {
+			subject := strings.TrimPrefix(key, prefix)
+			var roles []string
+			if scope != ewserver.RateLimitScopeIP {
+				roles = l.roles.RolesForSubject(subject)
+			}
+			return l.limit(scope, subject, roles)
+		}
+	}
+	return nil
+}
+
+// take a token from the subject's bucket, creating a full one if it has none. Must hold lock.
+func (l *Limiter) take(scope, subject string, limit *ewserver.RateLimit, now time.Time) (bool, time.Duration) {
+	if limit == nil {
+		return true, 0
+	}
+
+	key := ewserver.RateLimitKey(scope, subject)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = ewserver.NewRateBucket(key, limit, now)
+		l.buckets[key] = bucket
+	}
+	return bucket.Take(limit, now)
+}
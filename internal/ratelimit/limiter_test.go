@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/mock"
+)
+
+func testLimiter(limits []*ewserver.RateLimit, buckets []*ewserver.RateBucket, persist bool, t *testing.T) (*Limiter, *mock.RateLimitService) {
+	service := &mock.RateLimitService{
+		LimitsFn:      func() ([]*ewserver.RateLimit, error) { return limits, nil },
+		BucketsFn:     func() ([]*ewserver.RateBucket, error) { return buckets, nil },
+		SetLimitFn:    func(limit *ewserver.RateLimit) error { return limit.Valid() },
+		DeleteLimitFn: func(scope, subject string) error { return nil },
+	}
+
+	roles := &mock.RoleService{
+		RolesForSubjectFn: func(subject string) []string {
+			if subject == "device1" || subject == "device2" {
+				return []string{"apiuser", "firmware"}
+			}
+			return nil
+		},
+	}
+
+	limiter, err := New(service, roles, persist, &mock.Log{})
+	if err != nil {
+		t.Fatalf("error creating limiter: %s\n", err)
+	}
+	return limiter, service
+}
+
+func TestLimiter_AllowIdentity(t *testing.T) {
+	limits := []*ewserver.RateLimit{
+		{Scope: ewserver.RateLimitScopeRole, Subject: "apiuser", Rate: 1, Burst: 1},
+		{Scope: ewserver.RateLimitScopeRole, Subject: "firmware", Rate: 1, Burst: 2},
+		{Scope: ewserver.RateLimitScopeAPIUser, Subject: "device2", Rate: 1, Burst: 3},
+		{Scope: ewserver.RateLimitScopeAPIUser, Subject: ewserver.RateLimitDefault, Rate: 1, Burst: 4},
+	}
+	limiter, _ := testLimiter(limits, nil, false, t)
+
+	now := time.Now()
+	expected := map[string]int{"device1": 2, "device2": 3, "device3": 4}
+	for name, burst := range expected {
+		for i := 0; i < burst; i++ {
+			if ok, _ := limiter.AllowIdentity(ewserver.RateLimitScopeAPIUser, name, now); !ok {
+				t.Fatalf("expected request %d of %s within its burst to be allowed\n", i, name)
+			}
+		}
+
+		if ok, retryAfter := limiter.AllowIdentity(ewserver.RateLimitScopeAPIUser, name, now); ok || retryAfter != time.Second {
+			t.Fatalf("expected %s to be limited after %d requests got: %v %s\n", name, burst, ok, retryAfter)
+		}
+	}
+
+	if ok, _ := limiter.AllowIdentity(ewserver.RateLimitScopeUser, "device3", now); !ok {
+		t.Fatalf("expected UI users to be unlimited without a user limit\n")
+	}
+
+	if err := limiter.SetLimit(&ewserver.RateLimit{Scope: ewserver.RateLimitScopeUser, Subject: "root", Rate: 1, Burst: 1}); err != nil {
+		t.Fatalf("error setting limit: %s\n", err)
+	}
+
+	limiter.AllowIdentity(ewserver.RateLimitScopeUser, "root", now)
+	if ok, _ := limiter.AllowIdentity(ewserver.RateLimitScopeUser, "root", now); ok {
+		t.Fatalf("expected a new limit to apply to the next request\n")
+	}
+
+	if err := limiter.DeleteLimit(ewserver.RateLimitScopeUser, "root"); err != nil {
+		t.Fatalf("error deleting limit: %s\n", err)
+	}
+
+	if ok, _ := limiter.AllowIdentity(ewserver.RateLimitScopeUser, "root", now); !ok {
+		t.Fatalf("expected a deleted limit to no longer apply\n")
+	}
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	limits := []*ewserver.RateLimit{{Scope: ewserver.RateLimitScopeIP, Subject: ewserver.RateLimitDefault, Rate: 1, Burst: 2}}
+	now := time.Now().UTC()
+	restored := []*ewserver.RateBucket{{Key: "ip:127.0.0.1", Tokens: 0, Updated: now}}
+	limiter, service := testLimiter(limits, restored, true, t)
+
+	if ok, _ := limiter.AllowAddress("127.0.0.1", now); ok {
+		t.Fatalf("expected the restored empty bucket to limit the address\n")
+	}
+
+	limiter.AllowAddress("127.0.0.2", now)
+	saved := make([]*ewserver.RateBucket, 0)
+	service.SaveBucketsFn = func(buckets []*ewserver.RateBucket) error {
+		saved = buckets
+		return nil
+	}
+
+	// the second address refilled its token, the first is still refilling from empty
+	buckets := limiter.Prune(now.Add(time.Second))
+	if err := limiter.SaveBuckets(buckets); err != nil || len(saved) != 1 || saved[0].Key != "ip:127.0.0.1" || saved[0].Tokens != 1 {
+		t.Fatalf("expected only the bucket that did not refill to be saved got: %v %#v\n", err, saved)
+	}
+
+	if buckets := limiter.Prune(now.Add(2 * time.Second)); len(buckets) != 0 {
+		t.Fatalf("expected all buckets to be pruned once refilled got: %d\n", len(buckets))
+	}
+}
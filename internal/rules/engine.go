@@ -0,0 +1,301 @@
+// Package rules evaluates operator defined rules against telemetry as it is ingested.
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// Engine wraps a TelemetryService evaluating the rules of every successfully stored point's stream.
+// Rule failures are logged and never fail the Publish.
+type Engine struct {
+	ewserver.TelemetryService
+	rules    ewserver.RuleService
+	commands ewserver.CommandService
+	events   ewserver.EventService
+	logger   ewserver.LogService
+	client   *http.Client
+
+	lock sync.Mutex // serializes evaluation so concurrent points do not race on a rule's state
+	// expressions compiled since the rules last changed, so it only holds those of the current rules
+	expressions map[string]*govaluate.EvaluableExpression
+
+	cacheLock  sync.Mutex
+	cached     []*ewserver.Rule // nil until loaded and after a rule changes
+	generation uint64           // incremented when a rule changes, so a load racing with it is not cached
+}
+
+// New evaluates rules against points stored by telemetry, queueing rule commands with commands and
+// publishing alerts to events. The rules are cached, changes must be made through NewRuleService.
+func New(telemetry ewserver.TelemetryService, rules ewserver.RuleService, commands ewserver.CommandService, events ewserver.EventService, logger ewserver.LogService) *Engine {
+	return &Engine{
+		TelemetryService: telemetry,
+		rules:            rules,
+		commands:         commands,
+		events:           events,
+		logger:           logger,
+		client:           &http.Client{Timeout: webhookTimeout},
+		expressions:      make(map[string]*govaluate.EvaluableExpression),
+	}
+}
+
+// Publish stores the point and then evaluates the rules matching the device's stream.
+func (e *Engine) Publish(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+	if err := e.TelemetryService.Publish(deviceID, stream, point); err != nil {
+		return err
+	}
+
+	rules, err := e.loadRules()
+	if err != nil {
+		e.logger.Error("error loading rules", "error", err)
+		return nil
+	}
+
+	e.apply(rules, deviceID, stream, point)
+	return nil
+}
+
+// PublishBatch stores the points and then evaluates the matching rules against each accepted point,
+// in the order of the batch.
+func (e *Engine) PublishBatch(deviceID []byte, points []*ewserver.BatchPoint) ([]*ewserver.BatchResult, error) {
+	results, err := e.TelemetryService.PublishBatch(deviceID, points)
+	if err != nil {
+		return results, err
+	}
+
+	rules, err := e.loadRules()
+	if err != nil {
+		e.logger.Error("error loading rules", "error", err)
+		return results, nil
+	}
+
+	for _, result := range results {
+		if result.Accepted {
+			e.apply(rules, deviceID, points[result.Index].Stream, &points[result.Index].DataPoint)
+		}
+	}
+	return results, nil
+}
+
+// loadRules returns the cached rules, loading them if a rule changed since they were cached
+func (e *Engine) loadRules() ([]*ewserver.Rule, error) {
+	e.cacheLock.Lock()
+	cached, generation := e.cached, e.generation
+	e.cacheLock.Unlock()
+
+	if cached != nil {
+		return cached, nil
+	}
+
+	rules, err := e.rules.Rules()
+	if err != nil {
+		return nil, err
+	}
+
+	e.cacheLock.Lock()
+	if generation == e.generation {
+		e.cached = rules
+	}
+	e.cacheLock.Unlock()
+	return rules, nil
+}
+
+// invalidate drops the cached rules and their compiled expressions, the caller must hold lock
+func (e *Engine) invalidate() {
+	e.cacheLock.Lock()
+	e.cached = nil
+	e.generation++
+	e.cacheLock.Unlock()
+
+	e.expressions = make(map[string]*govaluate.EvaluableExpression)
+}
+
+// apply evaluates the rules matching the device's stream against the point
+func (e *Engine) apply(rules []*ewserver.Rule, deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) {
+	var parameters map[string]interface{}
+	var err error
+	for _, rule := range rules {
+		if !rule.Matches(deviceID, stream) {
+			continue
+		}
+
+		if parameters == nil {
+			if parameters, err = ewserver.RuleParameters(stream, point); err != nil {
+				e.logger.Error("error decoding point for rules", "stream", string(stream), "error", err)
+				return
+			}
+		}
+
+		if err := e.evaluate(rule, deviceID, point, parameters); err != nil {
+			e.logger.Error("error evaluating rule", "rule", rule.ID, "error", err)
+		}
+	}
+}
+
+// evaluate moves the rule's state for the device. A true expression makes an ok rule pending, and
+// fires it once it has been true for the rule's For. A firing rule stays firing until it resolves.
+func (e *Engine) evaluate(rule *ewserver.Rule, deviceID []byte, point *ewserver.DataPoint, parameters map[string]interface{}) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	state, err := e.rules.State(rule.ID, deviceID)
+	if err != nil {
+		return err
+	}
+
+	matched := e.match(rule.Expression, parameters)
+
+	switch state.Status {
+	case ewserver.RuleOK:
+		if !matched {
+			return nil
+		}
+
+		state.Status, state.Since, state.Value = ewserver.RulePending, point.Timestamp, point.Value
+		if rule.For == 0 {
+			e.fire(rule, state, point)
+		}
+	case ewserver.RulePending:
+		if !matched {
+			state.Status, state.Since, state.Value = ewserver.RuleOK, point.Timestamp, point.Value
+		} else if point.Timestamp.Sub(state.Since) >= time.Duration(rule.For) {
+			e.fire(rule, state, point)
+		} else {
+			return nil
+		}
+	case ewserver.RuleFiring:
+		resolved := !matched
+		if rule.ResolveExpression != "" {
+			resolved = e.match(rule.ResolveExpression, parameters)
+		}
+
+		if !resolved {
+			return nil
+		}
+		e.resolve(rule, state, point)
+	}
+
+	return e.rules.SetState(state)
+}
+
+// fire runs the rule's actions and sets the state firing.
+func (e *Engine) fire(rule *ewserver.Rule, state *ewserver.RuleState, point *ewserver.DataPoint) {
+	state.Status, state.Since, state.Value = ewserver.RuleFiring, point.Timestamp, point.Value
+	e.logger.Info("rule firing", "rule", rule.ID, "name", rule.Name, "device", state.DeviceID)
+
+	for _, action := range rule.Actions {
+		switch action.Type {
+		case ewserver.RuleActionAlert:
+			alert := ewserver.NewAlert()
+			alert.RuleID, alert.RuleName, alert.DeviceID, alert.Stream = rule.ID, rule.Name, state.DeviceID, rule.Stream
+			alert.Value, alert.FiredAt = point.Value, point.Timestamp
+
+			if err := e.rules.CreateAlert(alert); err != nil {
+				e.logger.Error("error creating alert", "rule", rule.ID, "error", err)
+				continue
+			}
+			state.AlertID = alert.ID
+			e.events.Publish(ewserver.AlertTopic, alert)
+		case ewserver.RuleActionCommand:
+			command := ewserver.NewCommand()
+			command.DeviceID, command.Name, command.Args = state.DeviceID, action.Command, action.Args
+			command.CreatedBy = "rule:" + rule.Name
+
+			if err := e.commands.Enqueue(command, 0); err != nil {
+				e.logger.Error("error queueing rule command", "rule", rule.ID, "error", err)
+			}
+		case ewserver.RuleActionWebhook:
+			go e.notify(action.URL, e.notification(rule, state))
+		}
+	}
+}
+
+// resolve closes the state's alert, notifies the rule's webhooks and sets the state ok.
+func (e *Engine) resolve(rule *ewserver.Rule, state *ewserver.RuleState, point *ewserver.DataPoint) {
+	state.Status, state.Since, state.Value = ewserver.RuleOK, point.Timestamp, point.Value
+	e.logger.Info("rule resolved", "rule", rule.ID, "name", rule.Name, "device", state.DeviceID)
+
+	if state.AlertID != 0 {
+		alert, err := e.rules.ResolveAlert(state.AlertID, point.Value, point.Timestamp)
+		if err != nil {
+			e.logger.Error("error resolving alert", "alert", state.AlertID, "error", err)
+		} else {
+			e.events.Publish(ewserver.AlertTopic, alert)
+		}
+		state.AlertID = 0
+	}
+
+	for _, action := range rule.Actions {
+		if action.Type == ewserver.RuleActionWebhook {
+			go e.notify(action.URL, e.notification(rule, state))
+		}
+	}
+}
+
+func (e *Engine) notification(rule *ewserver.Rule, state *ewserver.RuleState) *ewserver.RuleNotification {
+	return &ewserver.RuleNotification{
+		Rule:     rule.Name,
+		RuleID:   rule.ID,
+		DeviceID: state.DeviceID,
+		Stream:   rule.Stream,
+		Status:   state.Status,
+		Value:    state.Value,
+		Time:     state.Since,
+	}
+}
+
+// notify POSTs the notification to url as JSON, logging failures.
+func (e *Engine) notify(url string, notification *ewserver.RuleNotification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		e.logger.Error("error encoding rule notification", "error", err)
+		return
+	}
+
+	resp, err := e.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.logger.Error("error calling rule webhook", "url", url, "error", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e.logger.Error("rule webhook failed", "url", url, "status", resp.StatusCode)
+	}
+}
+
+// match evaluates the expression, anything other than a true result (including a missing parameter) is false.
+func (e *Engine) match(expression string, parameters map[string]interface{}) (matched bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.logger.Error("rule expression panic", "expression", expression, "error", fmt.Sprint(r))
+			matched = false
+		}
+	}()
+
+	evaluable, ok := e.expressions[expression]
+	if !ok {
+		var err error
+		if evaluable, err = govaluate.NewEvaluableExpression(expression); err != nil {
+			return false
+		}
+		e.expressions[expression] = evaluable
+	}
+
+	result, err := evaluable.Evaluate(parameters)
+	if err != nil {
+		return false
+	}
+
+	matched, _ = result.(bool)
+	return matched
+}
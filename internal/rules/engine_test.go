@@ -0,0 +1,229 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/hub"
+	"github.com/wirepair/ewserver/mock"
+)
+
+var testDeviceID = []byte("device1")
+
+// testRuleService keeps states and alerts in memory
+func testRuleService(rules ...*ewserver.Rule) *mock.RuleService {
+	states := make(map[string]*ewserver.RuleState)
+	alerts := make(map[uint64]*ewserver.Alert)
+
+	return &mock.RuleService{
+		RulesFn: func() ([]*ewserver.Rule, error) {
+			return rules, nil
+		},
+		StateFn: func(ruleID uint64, deviceID []byte) (*ewserver.RuleState, error) {
+			if state, ok := states[fmt.Sprintf("%d:%s", ruleID, deviceID)]; ok {
+				copied := *state
+				return &copied, nil
+			}
+			return ewserver.NewRuleState(ruleID, deviceID), nil
+		},
+		SetStateFn: func(state *ewserver.RuleState) error {
+			states[fmt.Sprintf("%d:%s", state.RuleID, state.DeviceID)] = state
+			return nil
+		},
+		CreateAlertFn: func(alert *ewserver.Alert) error {
+			alert.ID = uint64(len(alerts) + 1)
+			alert.State = ewserver.AlertFiring
+			alerts[alert.ID] = alert
+			return nil
+		},
+		ResolveAlertFn: func(id uint64, value json.RawMessage, at time.Time) (*ewserver.Alert, error) {
+			alert, ok := alerts[id]
+			if !ok {
+				return nil, ewserver.ErrAlertNotFound
+			}
+			alert.State, alert.Value, alert.ResolvedAt = ewserver.AlertResolved, value, at
+			return alert, nil
+		},
+	}
+}
+
+func testEngine(rules *mock.RuleService, commands *mock.CommandService, events ewserver.EventService) *Engine {
+	telemetry := &mock.TelemetryService{
+		PublishFn: func(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+			return nil
+		},
+	}
+	return New(telemetry, rules, commands, events, &mock.Log{})
+}
+
+func testPublish(engine *Engine, stream ewserver.StreamName, at time.Time, value string, t *testing.T) {
+	if err := engine.Publish(testDeviceID, stream, &ewserver.DataPoint{Timestamp: at, Value: json.RawMessage(value)}); err != nil {
+		t.Fatalf("error publishing point: %s\n", err)
+	}
+}
+
+func testStatus(rules *mock.RuleService, ruleID uint64, expected ewserver.RuleStatus, t *testing.T) {
+	state, _ := rules.StateFn(ruleID, testDeviceID)
+	if state.Status != expected {
+		t.Fatalf("expected rule %d to be %s got: %s\n", ruleID, expected, state.Status)
+	}
+}
+
+func TestEngine_For(t *testing.T) {
+	rule := &ewserver.Rule{ID: 1, Name: "hot", Stream: "temperature", Expression: "temperature > 80 for 5m", Actions: []ewserver.RuleAction{{Type: ewserver.RuleActionAlert}}}
+	if err := rule.Valid(); err != nil {
+		t.Fatalf("error validating rule: %s\n", err)
+	}
+
+	events := hub.New(4, 0)
+	sub := events.Subscribe(ewserver.AlertTopic)
+	defer sub.Close()
+
+	rules := testRuleService(rule)
+	engine := testEngine(rules, &mock.CommandService{}, events)
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testPublish(engine, "temperature", start, "81", t)
+	testStatus(rules, 1, ewserver.RulePending, t)
+
+	// dropping below resets the timer
+	testPublish(engine, "temperature", start.Add(time.Minute), "79", t)
+	testStatus(rules, 1, ewserver.RuleOK, t)
+
+	testPublish(engine, "temperature", start.Add(2*time.Minute), "85", t)
+	testPublish(engine, "temperature", start.Add(6*time.Minute), "85", t)
+	testStatus(rules, 1, ewserver.RulePending, t)
+
+	testPublish(engine, "temperature", start.Add(7*time.Minute), "82", t)
+	testStatus(rules, 1, ewserver.RuleFiring, t)
+
+	select {
+	case event := <-sub.Events():
+		if alert := event.Data.(*ewserver.Alert); alert.State != ewserver.AlertFiring || string(alert.Value) != "82" {
+			t.Fatalf("expected a firing alert at 82 got: %v %s\n", alert.State, alert.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected an alert to be published")
+	}
+
+	// still firing, no second alert
+	testPublish(engine, "temperature", start.Add(8*time.Minute), "90", t)
+	if len(sub.Events()) != 0 {
+		t.Fatalf("expected a single alert")
+	}
+
+	testPublish(engine, "temperature", start.Add(9*time.Minute), "70", t)
+	testStatus(rules, 1, ewserver.RuleOK, t)
+
+	event := <-sub.Events()
+	if alert := event.Data.(*ewserver.Alert); alert.State != ewserver.AlertResolved || alert.ID != 1 {
+		t.Fatalf("expected alert 1 to be resolved got: %v %d\n", alert.State, alert.ID)
+	}
+}
+
+func TestEngine_Hysteresis(t *testing.T) {
+	rule := &ewserver.Rule{ID: 1, Name: "hot", Stream: "sensor", Expression: "temperature > 80", ResolveExpression: "temperature < 75"}
+	rules := testRuleService(rule)
+	engine := testEngine(rules, &mock.CommandService{}, hub.New(4, 0))
+	start := time.Now().UTC()
+
+	testPublish(engine, "sensor", start, `{"temperature":81,"humidity":40}`, t)
+	testStatus(rules, 1, ewserver.RuleFiring, t)
+
+	// below the firing threshold but not below the resolve threshold
+	testPublish(engine, "sensor", start.Add(time.Second), `{"temperature":78,"humidity":40}`, t)
+	testStatus(rules, 1, ewserver.RuleFiring, t)
+
+	// a missing parameter does not match
+	testPublish(engine, "sensor", start.Add(2*time.Second), `{"humidity":40}`, t)
+	testStatus(rules, 1, ewserver.RuleFiring, t)
+
+	testPublish(engine, "sensor", start.Add(3*time.Second), `{"temperature":74,"humidity":40}`, t)
+	testStatus(rules, 1, ewserver.RuleOK, t)
+}
+
+func TestEngine_PublishBatch(t *testing.T) {
+	rule := &ewserver.Rule{ID: 1, Name: "hot", Stream: "temperature", Expression: "temperature > 80"}
+	rules := testRuleService(rule)
+	engine := testEngine(rules, &mock.CommandService{}, hub.New(4, 0))
+	engine.TelemetryService.(*mock.TelemetryService).PublishBatchFn = func(deviceID []byte, points []*ewserver.BatchPoint) ([]*ewserver.BatchResult, error) {
+		// the store rejects the second point
+		return []*ewserver.BatchResult{{Index: 0, Accepted: true}, {Index: 1, Error: "rejected"}}, nil
+	}
+
+	start := time.Now().UTC()
+	batch := []*ewserver.BatchPoint{
+		{Stream: "temperature", DataPoint: ewserver.DataPoint{Timestamp: start, Value: json.RawMessage("81")}},
+		{Stream: "temperature", DataPoint: ewserver.DataPoint{Timestamp: start.Add(time.Second), Value: json.RawMessage("70")}},
+	}
+
+	if _, err := engine.PublishBatch(testDeviceID, batch); err != nil {
+		t.Fatalf("error publishing batch: %s\n", err)
+	}
+
+	// only the accepted point is evaluated
+	testStatus(rules, 1, ewserver.RuleFiring, t)
+}
+
+func TestEngine_Actions(t *testing.T) {
+	notifications := make(chan *ewserver.RuleNotification, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := &ewserver.RuleNotification{}
+		if err := json.NewDecoder(r.Body).Decode(notification); err != nil {
+			t.Errorf("error decoding notification: %s\n", err)
+		}
+		notifications <- notification
+	}))
+	defer server.Close()
+
+	rule := &ewserver.Rule{ID: 2, Name: "low battery", Stream: "battery", Expression: "battery < 3.3", Actions: []ewserver.RuleAction{
+		{Type: ewserver.RuleActionCommand, Command: "sleep", Args: json.RawMessage(`{"minutes":60}`)},
+		{Type: ewserver.RuleActionWebhook, URL: server.URL},
+	}}
+	other := &ewserver.Rule{ID: 3, Name: "other device", Stream: "battery", DeviceID: []byte("device2"), Expression: "battery < 5"}
+
+	var queued *ewserver.Command
+	commands := &mock.CommandService{
+		EnqueueFn: func(command *ewserver.Command, ttl time.Duration) error {
+			queued = command
+			return nil
+		},
+	}
+
+	rules := testRuleService(rule, other)
+	engine := testEngine(rules, commands, hub.New(4, 0))
+	start := time.Now().UTC()
+
+	testPublish(engine, "battery", start, "3.2", t)
+	testStatus(rules, 2, ewserver.RuleFiring, t)
+	testStatus(rules, 3, ewserver.RuleOK, t)
+
+	if queued == nil || queued.Name != "sleep" || string(queued.DeviceID) != string(testDeviceID) || queued.CreatedBy != "rule:low battery" {
+		t.Fatalf("expected the sleep command to be queued for the device got: %v\n", queued)
+	}
+
+	testPublish(engine, "battery", start.Add(time.Second), "3.4", t)
+
+	// webhooks are called asynchronously so the two notifications may arrive in either order
+	statuses := make(map[ewserver.RuleStatus]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case notification := <-notifications:
+			if notification.RuleID != 2 {
+				t.Fatalf("expected a notification for rule 2 got: %v\n", notification)
+			}
+			statuses[notification.Status] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 2 webhook notifications got: %d\n", i)
+		}
+	}
+
+	if !statuses[ewserver.RuleFiring] || !statuses[ewserver.RuleOK] {
+		t.Fatalf("expected firing and ok notifications got: %v\n", statuses)
+	}
+}
@@ -0,0 +1,73 @@
+package rules
+
+import (
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// RuleService wraps the engine's RuleService so rule changes made through it reach the engine's cache,
+// and deleting a rule resolves its firing alerts.
+type RuleService struct {
+	ewserver.RuleService
+	engine *Engine
+}
+
+// NewRuleService returns the RuleService to change the engine's rules through
+func NewRuleService(engine *Engine) *RuleService {
+	return &RuleService{RuleService: engine.rules, engine: engine}
+}
+
+// Create stores the rule and drops the engine's cached rules
+func (r *RuleService) Create(rule *ewserver.Rule) error {
+	r.engine.lock.Lock()
+	defer r.engine.lock.Unlock()
+
+	if err := r.RuleService.Create(rule); err != nil {
+		return err
+	}
+	r.engine.invalidate()
+	return nil
+}
+
+// Update replaces the rule and drops the engine's cached rules
+func (r *RuleService) Update(rule *ewserver.Rule) error {
+	r.engine.lock.Lock()
+	defer r.engine.lock.Unlock()
+
+	if err := r.RuleService.Update(rule); err != nil {
+		return err
+	}
+	r.engine.invalidate()
+	return nil
+}
+
+// Delete the rule and its states, resolving the alerts of the devices it is firing for first so their
+// resolve is published and sent to the rule's webhooks.
+func (r *RuleService) Delete(id uint64) error {
+	r.engine.lock.Lock()
+	defer r.engine.lock.Unlock()
+
+	rule, err := r.RuleService.Rule(id)
+	if err != nil {
+		return err
+	}
+
+	states, err := r.RuleService.States(id)
+	if err != nil {
+		return err
+	}
+
+	if err := r.RuleService.Delete(id); err != nil {
+		return err
+	}
+	r.engine.invalidate()
+
+	now := time.Now().UTC()
+	for _, state := range states {
+		if state.Status == ewserver.RuleFiring {
+			r.engine.resolve(rule, state, &ewserver.DataPoint{Timestamp: now, Value: state.Value})
+		}
+	}
+	return nil
+}
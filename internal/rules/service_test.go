@@ -0,0 +1,68 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/hub"
+)
+
+func TestRuleService_Delete(t *testing.T) {
+	rule := &ewserver.Rule{ID: 1, Name: "hot", Stream: "temperature", Expression: "temperature > 80", Actions: []ewserver.RuleAction{{Type: ewserver.RuleActionAlert}}}
+	rules := testRuleService(rule)
+
+	loads := 0
+	loadRules := rules.RulesFn
+	rules.RulesFn = func() ([]*ewserver.Rule, error) {
+		loads++
+		return loadRules()
+	}
+	rules.RuleFn = func(id uint64) (*ewserver.Rule, error) { return rule, nil }
+	rules.StatesFn = func(ruleID uint64) ([]*ewserver.RuleState, error) {
+		state, err := rules.StateFn(ruleID, testDeviceID)
+		return []*ewserver.RuleState{state}, err
+	}
+	rules.DeleteFn = func(id uint64) error { return nil }
+	rules.CreateFn = func(rule *ewserver.Rule) error { return nil }
+
+	events := hub.New(4, 0)
+	alerts := events.Subscribe(ewserver.AlertTopic)
+	defer alerts.Close()
+
+	engine := testEngine(rules, nil, events)
+	service := NewRuleService(engine)
+	start := time.Now().UTC()
+
+	testPublish(engine, "temperature", start, "90", t)
+	testPublish(engine, "temperature", start.Add(time.Second), "91", t)
+	if loads != 1 {
+		t.Fatalf("expected the rules to be loaded once got: %d\n", loads)
+	}
+
+	if err := service.Create(&ewserver.Rule{}); err != nil {
+		t.Fatalf("error creating rule: %s\n", err)
+	}
+
+	testPublish(engine, "temperature", start.Add(2*time.Second), "92", t)
+	if loads != 2 {
+		t.Fatalf("expected the rules to be reloaded after a change got: %d\n", loads)
+	}
+
+	if fired := <-alerts.Events(); fired.Data.(*ewserver.Alert).State != ewserver.AlertFiring {
+		t.Fatalf("expected the alert to fire got: %v\n", fired.Data)
+	}
+
+	if err := service.Delete(rule.ID); err != nil {
+		t.Fatalf("error deleting rule: %s\n", err)
+	}
+
+	select {
+	case resolved := <-alerts.Events():
+		if alert := resolved.Data.(*ewserver.Alert); alert.State != ewserver.AlertResolved || alert.RuleID != rule.ID {
+			t.Fatalf("expected the rule's alert to be resolved got: %#v\n", alert)
+		}
+	default:
+		t.Fatalf("expected the resolved alert to be published when the rule is deleted\n")
+	}
+}
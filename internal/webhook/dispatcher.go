@@ -0,0 +1,240 @@
+// Package webhook queues system events for webhook subscriptions and delivers them signed.
+package webhook
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	// DeliveryTimeout for a single attempt
+	DeliveryTimeout = 10 * time.Second
+	// PollInterval between checks for deliveries that are due for another attempt
+	PollInterval = 5 * time.Second
+	// KeepDeliveries is how long delivered and dead deliveries are kept in the log
+	KeepDeliveries = 7 * 24 * time.Hour
+
+	batchSize = 50
+)
+
+// Dispatcher is an EventService wrapping another. Events published to the admin, auth and alert topics
+// are enqueued for every webhook subscription that wants them before Publish returns, rather than read
+// from a subscription that drops events when it falls behind. Deliveries are persisted before they are
+// attempted so they survive a restart.
+type Dispatcher struct {
+	webhooks ewserver.WebhookService
+	events   ewserver.EventService
+	logger   ewserver.LogService
+	client   *http.Client
+	wake     chan struct{}
+}
+
+// New creates a dispatcher publishing to events and delivering the webhooks of the events published
+// through it.
+func New(webhooks ewserver.WebhookService, events ewserver.EventService, logger ewserver.LogService) *Dispatcher {
+	return &Dispatcher{
+		webhooks: webhooks,
+		events:   events,
+		logger:   logger,
+		client:   &http.Client{Timeout: DeliveryTimeout},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Publish the data to the wrapped event service, then enqueue it for the webhook subscriptions that
+// want it.
+func (d *Dispatcher) Publish(topic string, data interface{}) *ewserver.Event {
+	event := d.events.Publish(topic, data)
+	switch topic {
+	case ewserver.AdminTopic, ewserver.AuthTopic, ewserver.AlertTopic:
+		d.enqueue(event)
+	}
+	return event
+}
+
+// Subscribe to one or more topics of the wrapped event service
+func (d *Dispatcher) Subscribe(topics ...string) ewserver.Subscription {
+	return d.events.Subscribe(topics...)
+}
+
+// Replay recently published events of the wrapped event service
+func (d *Dispatcher) Replay(since uint64, topics ...string) []*ewserver.Event {
+	return d.events.Replay(since, topics...)
+}
+
+// Run delivers queued webhooks, it never returns.
+func (d *Dispatcher) Run() {
+	d.deliverLoop()
+}
+
+func (d *Dispatcher) enqueue(event *ewserver.Event) {
+	eventType, ok := EventType(event)
+	if !ok {
+		return
+	}
+
+	queued, err := d.webhooks.Enqueue(eventType, event.Data, event.Time)
+	if err != nil {
+		d.logger.Error("error queueing webhooks", "event", string(eventType), "error", err)
+		return
+	}
+
+	if len(queued) > 0 {
+		d.Wake()
+	}
+}
+
+// Wake the delivery loop to attempt due deliveries now instead of at the next poll.
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) deliverLoop() {
+	poll := time.NewTicker(PollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-d.wake:
+		case <-poll.C:
+		case <-prune.C:
+			if pruned, err := d.webhooks.Prune(time.Now().UTC().Add(-KeepDeliveries)); err != nil {
+				d.logger.Error("error pruning webhook deliveries", "error", err)
+			} else if pruned > 0 {
+				d.logger.Info("webhook deliveries pruned", "count", pruned)
+			}
+			continue
+		}
+		d.DeliverDue(time.Now().UTC())
+	}
+}
+
+// DeliverDue attempts every delivery that is due at now, returning how many were attempted. Each batch
+// is attempted concurrently so a slow receiver does not hold up the others.
+func (d *Dispatcher) DeliverDue(now time.Time) int {
+	attempted := 0
+
+	for {
+		due, err := d.webhooks.Due(now, batchSize)
+		if err != nil {
+			d.logger.Error("error reading webhook queue", "error", err)
+			return attempted
+		}
+
+		var wg sync.WaitGroup
+		var failed int32
+		for _, delivery := range due {
+			wg.Add(1)
+			go func(delivery *ewserver.WebhookDelivery) {
+				defer wg.Done()
+				if !d.deliver(delivery) {
+					atomic.AddInt32(&failed, 1)
+				}
+			}(delivery)
+		}
+		wg.Wait()
+
+		attempted += len(due)
+		// a delivery that could not be recorded is still due, stop rather than attempting it again
+		if len(due) < batchSize || failed > 0 {
+			return attempted
+		}
+	}
+}
+
+// deliver makes a single attempt and records the outcome, false if it could not be recorded.
+func (d *Dispatcher) deliver(delivery *ewserver.WebhookDelivery) bool {
+	status, message := 0, ""
+
+	subscription, err := d.webhooks.Subscription(delivery.SubscriptionID)
+	if err == nil {
+		status, err = d.post(subscription, delivery)
+	}
+
+	if err != nil {
+		message = err.Error()
+	}
+
+	recorded, err := d.webhooks.Record(delivery.ID, status, message, time.Now().UTC())
+	if err != nil {
+		d.logger.Error("error recording webhook delivery", "delivery", delivery.ID, "error", err)
+		return false
+	}
+
+	if recorded.State == ewserver.WebhookDead {
+		d.logger.Error("webhook delivery dead lettered", "delivery", delivery.ID, "subscription", delivery.SubscriptionID, "status", status, "error", message)
+	}
+	return true
+}
+
+// post sends the delivery's payload signed with the subscription's secret, returning the response status.
+func (d *Dispatcher) post(subscription *ewserver.WebhookSubscription, delivery *ewserver.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ewserver.WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(ewserver.WebhookSignatureHeader, ewserver.SignWebhook(subscription.Secret, timestamp, delivery.Payload))
+	req.Header.Set(ewserver.WebhookEventHeader, string(delivery.Event))
+	req.Header.Set(ewserver.WebhookDeliveryHeader, strconv.FormatUint(delivery.ID, 10))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// drain so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// EventType maps a published event to the webhook event it is, false if webhooks do not deliver it.
+func EventType(event *ewserver.Event) (ewserver.WebhookEventType, bool) {
+	switch data := event.Data.(type) {
+	case *ewserver.AdminEvent:
+		return adminEventType(data), true
+	case *ewserver.AuthEvent:
+		return ewserver.WebhookLoginFailed, !data.Success
+	case *ewserver.Alert:
+		if data.State == ewserver.AlertResolved {
+			return ewserver.WebhookAlertResolved, true
+		}
+		return ewserver.WebhookAlertFired, true
+	}
+	return "", false
+}
+
+// adminEventType classifies an admin request by its route.
+func adminEventType(event *ewserver.AdminEvent) ewserver.WebhookEventType {
+	switch {
+	case event.Method == "PUT" && event.Path == "/api/v1/admin/users/create":
+		return ewserver.WebhookUserCreated
+	case event.Method == "DELETE" && strings.HasPrefix(event.Path, "/api/v1/admin/users/delete/"):
+		return ewserver.WebhookUserDeleted
+	case event.Method == "PUT" && event.Path == "/api/v1/admin/api_users/create":
+		return ewserver.WebhookAPIUserCreated
+	case event.Method == "DELETE" && strings.HasPrefix(event.Path, "/api/v1/admin/api_users/delete/"):
+		return ewserver.WebhookAPIUserDeleted
+	case strings.HasPrefix(event.Path, "/api/v1/admin/roles/"):
+		return ewserver.WebhookRoleChanged
+	}
+	return ewserver.WebhookAdminChanged
+}
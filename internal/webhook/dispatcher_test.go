@@ -0,0 +1,154 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/internal/hub"
+	"github.com/wirepair/ewserver/mock"
+)
+
+func TestEventType(t *testing.T) {
+	expected := map[ewserver.WebhookEventType]interface{}{
+		ewserver.WebhookUserCreated:    &ewserver.AdminEvent{Method: "PUT", Path: "/api/v1/admin/users/create"},
+		ewserver.WebhookUserDeleted:    &ewserver.AdminEvent{Method: "DELETE", Path: "/api/v1/admin/users/delete/bob"},
+		ewserver.WebhookAPIUserCreated: &ewserver.AdminEvent{Method: "PUT", Path: "/api/v1/admin/api_users/create"},
+		ewserver.WebhookAPIUserDeleted: &ewserver.AdminEvent{Method: "DELETE", Path: "/api/v1/admin/api_users/delete/abc"},
+		ewserver.WebhookRoleChanged:    &ewserver.AdminEvent{Method: "POST", Path: "/api/v1/admin/roles/role"},
+		ewserver.WebhookAdminChanged:   &ewserver.AdminEvent{Method: "PUT", Path: "/api/v1/admin/commands/create"},
+		ewserver.WebhookLoginFailed:    &ewserver.AuthEvent{UserName: "bob"},
+		ewserver.WebhookAlertFired:     &ewserver.Alert{State: ewserver.AlertFiring},
+		ewserver.WebhookAlertResolved:  &ewserver.Alert{State: ewserver.AlertResolved},
+	}
+
+	for eventType, data := range expected {
+		if actual, ok := EventType(&ewserver.Event{Data: data}); !ok || actual != eventType {
+			t.Fatalf("expected %s got: %s %v\n", eventType, actual, ok)
+		}
+	}
+
+	if _, ok := EventType(&ewserver.Event{Data: &ewserver.AuthEvent{Success: true}}); ok {
+		t.Fatalf("expected successful logins not to be delivered")
+	}
+
+	if _, ok := EventType(&ewserver.Event{Data: &ewserver.StreamEvent{}}); ok {
+		t.Fatalf("expected stream events not to be delivered")
+	}
+}
+
+func TestDispatcher_DeliverDue(t *testing.T) {
+	subscription := &ewserver.WebhookSubscription{ID: 1, Secret: "secret"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(ewserver.WebhookTimestampHeader), 10, 64)
+
+		if r.Header.Get(ewserver.WebhookSignatureHeader) != ewserver.SignWebhook(subscription.Secret, timestamp, body) {
+			w.WriteHeader(401)
+			return
+		}
+
+		if r.Header.Get(ewserver.WebhookDeliveryHeader) == "2" {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+	subscription.URL = server.URL
+
+	payload, _ := json.Marshal(&ewserver.WebhookPayload{Event: ewserver.WebhookUserCreated})
+	due := []*ewserver.WebhookDelivery{
+		{ID: 1, SubscriptionID: 1, Event: ewserver.WebhookUserCreated, Payload: payload},
+		{ID: 2, SubscriptionID: 1, Event: ewserver.WebhookUserCreated, Payload: payload},
+		{ID: 3, SubscriptionID: 2, Event: ewserver.WebhookUserCreated, Payload: payload},
+	}
+
+	outcomes := make(chan string, len(due))
+	webhooks := &mock.WebhookService{
+		DueFn: func(now time.Time, limit int) ([]*ewserver.WebhookDelivery, error) {
+			return due, nil
+		},
+		SubscriptionFn: func(id uint64) (*ewserver.WebhookSubscription, error) {
+			if id != subscription.ID {
+				return nil, ewserver.ErrWebhookNotFound
+			}
+			return subscription, nil
+		},
+		RecordFn: func(id uint64, status int, message string, at time.Time) (*ewserver.WebhookDelivery, error) {
+			outcomes <- strconv.FormatUint(id, 10) + ":" + strconv.Itoa(status) + ":" + message
+			return &ewserver.WebhookDelivery{ID: id, State: ewserver.WebhookPending}, nil
+		},
+	}
+
+	dispatcher := New(webhooks, hub.New(4, 0), &mock.Log{})
+	if attempted := dispatcher.DeliverDue(time.Now()); attempted != 3 {
+		t.Fatalf("expected 3 deliveries to be attempted got: %d\n", attempted)
+	}
+	close(outcomes)
+
+	recorded := make(map[string]bool)
+	for outcome := range outcomes {
+		recorded[outcome] = true
+	}
+
+	for _, expected := range []string{"1:200:", "2:503:", "3:0:" + ewserver.ErrWebhookNotFound.Error()} {
+		if !recorded[expected] {
+			t.Fatalf("expected outcome %s to be recorded got: %v\n", expected, recorded)
+		}
+	}
+}
+
+func TestDispatcher_Publish(t *testing.T) {
+	enqueued := make([]ewserver.WebhookEventType, 0)
+	webhooks := &mock.WebhookService{
+		EnqueueFn: func(event ewserver.WebhookEventType, data interface{}, at time.Time) ([]*ewserver.WebhookDelivery, error) {
+			enqueued = append(enqueued, event)
+			return nil, nil
+		},
+	}
+
+	// more events than the hub buffers for a subscriber, none may be lost
+	events := hub.New(4, 0)
+	dispatcher := New(webhooks, events, &mock.Log{})
+	subscription := dispatcher.Subscribe(ewserver.AdminTopic)
+	defer subscription.Close()
+
+	for i := 0; i < 10; i++ {
+		dispatcher.Publish(ewserver.AdminTopic, &ewserver.AdminEvent{Method: "PUT", Path: "/api/v1/admin/users/create", Subject: "bob"})
+	}
+	dispatcher.Publish("data:abc:temperature", &ewserver.StreamEvent{})
+
+	if len(enqueued) != 10 || enqueued[0] != ewserver.WebhookUserCreated {
+		t.Fatalf("expected every admin event to be enqueued got: %v\n", enqueued)
+	}
+
+	if len(subscription.Events()) != 4 {
+		t.Fatalf("expected events to still be published to subscribers got: %d\n", len(subscription.Events()))
+	}
+}
+
+func TestDispatcher_PublishLoginFailed(t *testing.T) {
+	enqueued := make([]ewserver.WebhookEventType, 0)
+	webhooks := &mock.WebhookService{
+		EnqueueFn: func(event ewserver.WebhookEventType, data interface{}, at time.Time) ([]*ewserver.WebhookDelivery, error) {
+			enqueued = append(enqueued, event)
+			if authEvent, ok := data.(*ewserver.AuthEvent); !ok || authEvent.UserName != "bob" {
+				t.Fatalf("expected the login attempt to be delivered got: %#v\n", data)
+			}
+			return []*ewserver.WebhookDelivery{{ID: 1, Event: event}}, nil
+		},
+	}
+
+	// logins publish through the dispatcher, publishing to the hub directly skips their webhooks
+	dispatcher := New(webhooks, hub.New(4, 0), &mock.Log{})
+	dispatcher.Publish(ewserver.AuthTopic, &ewserver.AuthEvent{UserName: "bob", Client: "127.0.0.1", Success: true})
+	dispatcher.Publish(ewserver.AuthTopic, &ewserver.AuthEvent{UserName: "bob", Client: "127.0.0.1", Success: false})
+
+	if len(enqueued) != 1 || enqueued[0] != ewserver.WebhookLoginFailed {
+		t.Fatalf("expected only the failed login to be enqueued got: %v\n", enqueued)
+	}
+}
@@ -0,0 +1,168 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func TestAcceptKey(t *testing.T) {
+	// example from RFC 6455 section 1.3
+	if accept := AcceptKey(testKey); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("expected s3pPLMBiTxaQ9kYGzzhZRbK+xOo= got: %s\n", accept)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(testEchoHandler))
+	defer server.Close()
+
+	conn, reader := testDial(server, t)
+	defer conn.Close()
+
+	// fragmented text message with a ping in between
+	testWriteFrame(conn, false, OpText, []byte("hello "), t)
+	testWriteFrame(conn, true, OpPing, []byte("ping"), t)
+	testWriteFrame(conn, true, OpContinuation, []byte("world"), t)
+
+	opcode, payload := testReadFrame(reader, t)
+	if opcode != OpPong || string(payload) != "ping" {
+		t.Fatalf("expected pong with ping payload got: %d %s\n", opcode, payload)
+	}
+
+	opcode, payload = testReadFrame(reader, t)
+	if opcode != OpText || string(payload) != "hello world" {
+		t.Fatalf("expected echo of hello world got: %d %s\n", opcode, payload)
+	}
+
+	large := []byte(strings.Repeat("a", 70000))
+	testWriteFrame(conn, true, OpBinary, large, t)
+	if _, payload := testReadFrame(reader, t); string(payload) != "message too large" {
+		t.Fatalf("expected message too large got: %s\n", payload)
+	}
+}
+
+func TestUpgrade_BadHandshake(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(testEchoHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("error making request: %s\n", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request for non websocket request got: %d\n", resp.StatusCode)
+	}
+}
+
+// testEchoHandler echoes messages back, or the error text if reading fails.
+func testEchoHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		opcode, message, err := conn.ReadMessage()
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			conn.WriteText([]byte(strings.TrimPrefix(err.Error(), "websocket: ")))
+			return
+		}
+		conn.WriteMessage(opcode, message)
+	}
+}
+
+func testDial(server *httptest.Server, t *testing.T) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing server: %s\n", err)
+	}
+
+	handshake := "GET / HTTP/1.1\r\nHost: ewserver\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + testKey + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatalf("error writing handshake: %s\n", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("error reading handshake response: %s\n", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101 got: %d\n", resp.StatusCode)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != AcceptKey(testKey) {
+		t.Fatalf("invalid accept key: %s\n", resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return conn, reader
+}
+
+// testWriteFrame writes a masked client frame
+func testWriteFrame(conn net.Conn, fin bool, opcode byte, payload []byte, t *testing.T) {
+	header := []byte{opcode, 0x80}
+	if fin {
+		header[0] |= 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		header[1] |= byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] |= 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] |= 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+
+	frame := append(append(header, mask...), masked...)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("error writing frame: %s\n", err)
+	}
+}
+
+// testReadFrame reads an unmasked server frame
+func testReadFrame(reader *bufio.Reader, t *testing.T) (byte, []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("error reading frame header: %s\n", err)
+	}
+
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		extended := make([]byte, 2)
+		io.ReadFull(reader, extended)
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("error reading frame payload: %s\n", err)
+	}
+	return header[0] & 0x0F, payload
+}
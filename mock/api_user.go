@@ -16,6 +16,21 @@ type APIUserService struct {
 	APIUsersFn      func() ([]*ewserver.APIUser, error)
 	APIUsersInvoked bool
 
+	ForEachAPIUserFn      func(fn func(*ewserver.APIUser) error) error
+	ForEachAPIUserInvoked bool
+
+	UpdateFn      func(u *ewserver.APIUser) error
+	UpdateInvoked bool
+
+	RotateKeyFn      func(u *ewserver.APIUser, key ewserver.APIKey) error
+	RotateKeyInvoked bool
+
+	SetDisabledFn      func(Key ewserver.APIKey, disabled bool) error
+	SetDisabledInvoked bool
+
+	SearchFn      func(query *ewserver.DeviceQuery) ([]*ewserver.APIUser, error)
+	SearchInvoked bool
+
 	DeleteFn      func(Key ewserver.APIKey) error
 	DeleteInvoked bool
 }
@@ -26,7 +41,7 @@ func (u *APIUserService) APIUser(apiKey ewserver.APIKey) (*ewserver.APIUser, err
 	return u.APIUserFn(apiKey)
 }
 
-// APIUserByID finds the user by their ID this is an O(N) operation, primarly used for admin management.
+// APIUserByID finds the user by their base64 encoded ID
 func (u *APIUserService) APIUserByID(ID []byte) (*ewserver.APIUser, error) {
 	u.APIUserByIDInvoked = true
 	return u.APIUserByIDFn(ID)
@@ -38,12 +53,42 @@ func (u *APIUserService) APIUsers() ([]*ewserver.APIUser, error) {
 	return u.APIUsersFn()
 }
 
+// ForEachAPIUser calls fn with every API user
+func (u *APIUserService) ForEachAPIUser(fn func(*ewserver.APIUser) error) error {
+	u.ForEachAPIUserInvoked = true
+	return u.ForEachAPIUserFn(fn)
+}
+
 // Create adds a new API key if it does not already exist
 func (u *APIUserService) Create(apiUser *ewserver.APIUser) error {
 	u.CreateInvoked = true
 	return u.CreateFn(apiUser)
 }
 
+// Update replaces the stored API user
+func (u *APIUserService) Update(apiUser *ewserver.APIUser) error {
+	u.UpdateInvoked = true
+	return u.UpdateFn(apiUser)
+}
+
+// RotateKey replaces the API user's key
+func (u *APIUserService) RotateKey(apiUser *ewserver.APIUser, key ewserver.APIKey) error {
+	u.RotateKeyInvoked = true
+	return u.RotateKeyFn(apiUser, key)
+}
+
+// SetDisabled changes whether the API user is disabled
+func (u *APIUserService) SetDisabled(key ewserver.APIKey, disabled bool) error {
+	u.SetDisabledInvoked = true
+	return u.SetDisabledFn(key, disabled)
+}
+
+// Search returns the API users matching the query
+func (u *APIUserService) Search(query *ewserver.DeviceQuery) ([]*ewserver.APIUser, error) {
+	u.SearchInvoked = true
+	return u.SearchFn(query)
+}
+
 // Delete a User from the system. Does not return an error if user does not exist
 func (u *APIUserService) Delete(apiKey ewserver.APIKey) error {
 	u.DeleteInvoked = true
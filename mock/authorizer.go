@@ -0,0 +1,73 @@
+package mock
+
+import (
+	"net/http"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// Authorizer represents a mock implementation of authz.Authorizer.
+type Authorizer struct {
+	AuthorizeFn      func(r *http.Request) bool
+	AuthorizeInvoked bool
+
+	AuthorizeRequestFn      func(r *http.Request) (*ewserver.APIUser, bool)
+	AuthorizeRequestInvoked bool
+
+	APIAuthorizeFn      func(r *http.Request, apiKey string) bool
+	APIAuthorizeInvoked bool
+
+	UserAuthorizeFn      func(r *http.Request, username string) bool
+	UserAuthorizeInvoked bool
+
+	CertAuthorizeFn      func(r *http.Request, deviceID []byte) bool
+	CertAuthorizeInvoked bool
+
+	SignatureAuthorizeFn      func(r *http.Request, keyID string) bool
+	SignatureAuthorizeInvoked bool
+
+	EnforceFn      func(subject, object, action string) bool
+	EnforceInvoked bool
+}
+
+// Authorize validates the user data from a request is authorized to access a resource
+func (a *Authorizer) Authorize(r *http.Request) bool {
+	a.AuthorizeInvoked = true
+	return a.AuthorizeFn(r)
+}
+
+// AuthorizeRequest validates the request and returns the API user that made it
+func (a *Authorizer) AuthorizeRequest(r *http.Request) (*ewserver.APIUser, bool) {
+	a.AuthorizeRequestInvoked = true
+	return a.AuthorizeRequestFn(r)
+}
+
+// APIAuthorize for API Users
+func (a *Authorizer) APIAuthorize(r *http.Request, apiKey string) bool {
+	a.APIAuthorizeInvoked = true
+	return a.APIAuthorizeFn(r, apiKey)
+}
+
+// UserAuthorize for regular users
+func (a *Authorizer) UserAuthorize(r *http.Request, username string) bool {
+	a.UserAuthorizeInvoked = true
+	return a.UserAuthorizeFn(r, username)
+}
+
+// CertAuthorize for devices with a client certificate
+func (a *Authorizer) CertAuthorize(r *http.Request, deviceID []byte) bool {
+	a.CertAuthorizeInvoked = true
+	return a.CertAuthorizeFn(r, deviceID)
+}
+
+// SignatureAuthorize for API users signing requests
+func (a *Authorizer) SignatureAuthorize(r *http.Request, keyID string) bool {
+	a.SignatureAuthorizeInvoked = true
+	return a.SignatureAuthorizeFn(r, keyID)
+}
+
+// Enforce a policy directly
+func (a *Authorizer) Enforce(subject, object, action string) bool {
+	a.EnforceInvoked = true
+	return a.EnforceFn(subject, object, action)
+}
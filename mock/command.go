@@ -0,0 +1,92 @@
+package mock
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// CommandService represents a mock implementation of ewserver.CommandService.
+type CommandService struct {
+	InitFn      func() error
+	InitInvoked bool
+
+	EnqueueFn      func(command *ewserver.Command, ttl time.Duration) error
+	EnqueueInvoked bool
+
+	CommandFn      func(deviceID []byte, id uint64) (*ewserver.Command, error)
+	CommandInvoked bool
+
+	CommandsFn      func(deviceID []byte) ([]*ewserver.Command, error)
+	CommandsInvoked bool
+
+	DeliverFn      func(deviceID []byte, actor string) ([]*ewserver.Command, error)
+	DeliverInvoked bool
+
+	AckFn      func(deviceID []byte, id uint64, state ewserver.CommandState, result json.RawMessage, actor string) (*ewserver.Command, error)
+	AckInvoked bool
+
+	ExpireFn      func() (int, error)
+	ExpireInvoked bool
+
+	PruneFn      func(before time.Time) (int, error)
+	PruneInvoked bool
+
+	DeleteFn      func(deviceID []byte) error
+	DeleteInvoked bool
+}
+
+// Init the command service
+func (s *CommandService) Init() error {
+	s.InitInvoked = true
+	return s.InitFn()
+}
+
+// Enqueue a pending command for the command's device
+func (s *CommandService) Enqueue(command *ewserver.Command, ttl time.Duration) error {
+	s.EnqueueInvoked = true
+	return s.EnqueueFn(command, ttl)
+}
+
+// Command returns a single command of the device
+func (s *CommandService) Command(deviceID []byte, id uint64) (*ewserver.Command, error) {
+	s.CommandInvoked = true
+	return s.CommandFn(deviceID, id)
+}
+
+// Commands returns all of the device's commands
+func (s *CommandService) Commands(deviceID []byte) ([]*ewserver.Command, error) {
+	s.CommandsInvoked = true
+	return s.CommandsFn(deviceID)
+}
+
+// Deliver marks the device's pending commands delivered and returns them
+func (s *CommandService) Deliver(deviceID []byte, actor string) ([]*ewserver.Command, error) {
+	s.DeliverInvoked = true
+	return s.DeliverFn(deviceID, actor)
+}
+
+// Ack records the device's result of running a command
+func (s *CommandService) Ack(deviceID []byte, id uint64, state ewserver.CommandState, result json.RawMessage, actor string) (*ewserver.Command, error) {
+	s.AckInvoked = true
+	return s.AckFn(deviceID, id, state, result, actor)
+}
+
+// Expire marks all commands past their TTL expired
+func (s *CommandService) Expire() (int, error) {
+	s.ExpireInvoked = true
+	return s.ExpireFn()
+}
+
+// Prune deletes finished commands queued before the time
+func (s *CommandService) Prune(before time.Time) (int, error) {
+	s.PruneInvoked = true
+	return s.PruneFn(before)
+}
+
+// Delete all of the device's commands
+func (s *CommandService) Delete(deviceID []byte) error {
+	s.DeleteInvoked = true
+	return s.DeleteFn(deviceID)
+}
@@ -0,0 +1,101 @@
+package mock
+
+import (
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// GroupService represents a mock implementation of ewserver.GroupService.
+type GroupService struct {
+	InitFn      func() error
+	InitInvoked bool
+
+	CreateFn      func(group *ewserver.DeviceGroup) error
+	CreateInvoked bool
+
+	GroupFn      func(name string) (*ewserver.DeviceGroup, error)
+	GroupInvoked bool
+
+	GroupsFn      func() ([]*ewserver.DeviceGroup, error)
+	GroupsInvoked bool
+
+	DeleteFn      func(name string) error
+	DeleteInvoked bool
+}
+
+// Init the group service
+func (s *GroupService) Init() error {
+	s.InitInvoked = true
+	return s.InitFn()
+}
+
+// Create a group
+func (s *GroupService) Create(group *ewserver.DeviceGroup) error {
+	s.CreateInvoked = true
+	return s.CreateFn(group)
+}
+
+// Group returns a single group
+func (s *GroupService) Group(name string) (*ewserver.DeviceGroup, error) {
+	s.GroupInvoked = true
+	return s.GroupFn(name)
+}
+
+// Groups returns all groups
+func (s *GroupService) Groups() ([]*ewserver.DeviceGroup, error) {
+	s.GroupsInvoked = true
+	return s.GroupsFn()
+}
+
+// Delete a group
+func (s *GroupService) Delete(name string) error {
+	s.DeleteInvoked = true
+	return s.DeleteFn(name)
+}
+
+// BulkJobService represents a mock implementation of ewserver.BulkJobService.
+type BulkJobService struct {
+	InitFn      func() error
+	InitInvoked bool
+
+	CreateFn      func(job *ewserver.BulkJob) error
+	CreateInvoked bool
+
+	SaveFn      func(job *ewserver.BulkJob) error
+	SaveInvoked bool
+
+	JobFn      func(id uint64) (*ewserver.BulkJob, error)
+	JobInvoked bool
+
+	JobsFn      func() ([]*ewserver.BulkJob, error)
+	JobsInvoked bool
+}
+
+// Init the bulk job service
+func (s *BulkJobService) Init() error {
+	s.InitInvoked = true
+	return s.InitFn()
+}
+
+// Create stores a new job
+func (s *BulkJobService) Create(job *ewserver.BulkJob) error {
+	s.CreateInvoked = true
+	return s.CreateFn(job)
+}
+
+// Save replaces the stored job
+func (s *BulkJobService) Save(job *ewserver.BulkJob) error {
+	s.SaveInvoked = true
+	return s.SaveFn(job)
+}
+
+// Job returns a single job
+func (s *BulkJobService) Job(id uint64) (*ewserver.BulkJob, error) {
+	s.JobInvoked = true
+	return s.JobFn(id)
+}
+
+// Jobs returns all jobs
+func (s *BulkJobService) Jobs() ([]*ewserver.BulkJob, error) {
+	s.JobsInvoked = true
+	return s.JobsFn()
+}
@@ -0,0 +1,64 @@
+package mock
+
+import (
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// PresenceService represents a mock implementation of ewserver.PresenceService.
+type PresenceService struct {
+	InitFn      func() error
+	InitInvoked bool
+
+	SeenFn      func(deviceID []byte, address, userAgent string, at time.Time) error
+	SeenInvoked bool
+
+	PresenceFn      func(deviceID []byte) (*ewserver.Presence, error)
+	PresenceInvoked bool
+
+	PresencesFn      func() ([]*ewserver.Presence, error)
+	PresencesInvoked bool
+
+	SaveFn      func(presences []*ewserver.Presence) error
+	SaveInvoked bool
+
+	DeleteFn      func(deviceID []byte) error
+	DeleteInvoked bool
+}
+
+// Init the presence service
+func (p *PresenceService) Init() error {
+	p.InitInvoked = true
+	return p.InitFn()
+}
+
+// Seen records activity of the device
+func (p *PresenceService) Seen(deviceID []byte, address, userAgent string, at time.Time) error {
+	p.SeenInvoked = true
+	return p.SeenFn(deviceID, address, userAgent, at)
+}
+
+// Presence returns the device's presence
+func (p *PresenceService) Presence(deviceID []byte) (*ewserver.Presence, error) {
+	p.PresenceInvoked = true
+	return p.PresenceFn(deviceID)
+}
+
+// Presences returns the presence of every device that was seen
+func (p *PresenceService) Presences() ([]*ewserver.Presence, error) {
+	p.PresencesInvoked = true
+	return p.PresencesFn()
+}
+
+// Save stores a batch of presences
+func (p *PresenceService) Save(presences []*ewserver.Presence) error {
+	p.SaveInvoked = true
+	return p.SaveFn(presences)
+}
+
+// Delete the device's presence
+func (p *PresenceService) Delete(deviceID []byte) error {
+	p.DeleteInvoked = true
+	return p.DeleteFn(deviceID)
+}
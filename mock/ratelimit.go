@@ -0,0 +1,60 @@
+package mock
+
+import "github.com/wirepair/ewserver/ewserver"
+
+// RateLimitService represents a mock implementation of ewserver.RateLimitService.
+type RateLimitService struct {
+	InitFn      func() error
+	InitInvoked bool
+
+	SetLimitFn      func(limit *ewserver.RateLimit) error
+	SetLimitInvoked bool
+
+	DeleteLimitFn      func(scope, subject string) error
+	DeleteLimitInvoked bool
+
+	LimitsFn      func() ([]*ewserver.RateLimit, error)
+	LimitsInvoked bool
+
+	BucketsFn      func() ([]*ewserver.RateBucket, error)
+	BucketsInvoked bool
+
+	SaveBucketsFn      func(buckets []*ewserver.RateBucket) error
+	SaveBucketsInvoked bool
+}
+
+// Init the rate limit service
+func (r *RateLimitService) Init() error {
+	r.InitInvoked = true
+	return r.InitFn()
+}
+
+// SetLimit creates or replaces a limit
+func (r *RateLimitService) SetLimit(limit *ewserver.RateLimit) error {
+	r.SetLimitInvoked = true
+	return r.SetLimitFn(limit)
+}
+
+// DeleteLimit removes a limit
+func (r *RateLimitService) DeleteLimit(scope, subject string) error {
+	r.DeleteLimitInvoked = true
+	return r.DeleteLimitFn(scope, subject)
+}
+
+// Limits returns all limits
+func (r *RateLimitService) Limits() ([]*ewserver.RateLimit, error) {
+	r.LimitsInvoked = true
+	return r.LimitsFn()
+}
+
+// Buckets returns the saved bucket state
+func (r *RateLimitService) Buckets() ([]*ewserver.RateBucket, error) {
+	r.BucketsInvoked = true
+	return r.BucketsFn()
+}
+
+// SaveBuckets replaces the saved bucket state
+func (r *RateLimitService) SaveBuckets(buckets []*ewserver.RateBucket) error {
+	r.SaveBucketsInvoked = true
+	return r.SaveBucketsFn(buckets)
+}
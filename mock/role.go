@@ -0,0 +1,112 @@
+package mock
+
+// RoleService represents a mock implementation of ewserver.RoleService.
+type RoleService struct {
+	RoleNamesFn      func() []string
+	RoleNamesInvoked bool
+
+	RoleMapFn      func() [][]string
+	RoleMapInvoked bool
+
+	RolesForSubjectFn      func(subject string) []string
+	RolesForSubjectInvoked bool
+
+	SubjectsForRoleFn      func(roleName string) []string
+	SubjectsForRoleInvoked bool
+
+	SubjectExistsFn      func(subject string) bool
+	SubjectExistsInvoked bool
+
+	PermissionsFn      func() [][]string
+	PermissionsInvoked bool
+
+	DeleteRoleFn      func(roleName string) error
+	DeleteRoleInvoked bool
+
+	AddSubjectToRoleFn      func(subject, roleName string) error
+	AddSubjectToRoleInvoked bool
+
+	DeleteSubjectFromRoleFn      func(subject, roleName string) error
+	DeleteSubjectFromRoleInvoked bool
+
+	DeleteSubjectFn      func(subject string) error
+	DeleteSubjectInvoked bool
+
+	AddPermissionFn      func(subject, object, method string) error
+	AddPermissionInvoked bool
+
+	DeletePermissionFn      func(subject, object, method string) error
+	DeletePermissionInvoked bool
+}
+
+// RoleNames lists role names
+func (r *RoleService) RoleNames() []string {
+	r.RoleNamesInvoked = true
+	return r.RoleNamesFn()
+}
+
+// RoleMap lists subject to role mapping
+func (r *RoleService) RoleMap() [][]string {
+	r.RoleMapInvoked = true
+	return r.RoleMapFn()
+}
+
+// RolesForSubject lists the roles of a subject
+func (r *RoleService) RolesForSubject(subject string) []string {
+	r.RolesForSubjectInvoked = true
+	return r.RolesForSubjectFn(subject)
+}
+
+// SubjectsForRole lists the subjects of a role
+func (r *RoleService) SubjectsForRole(roleName string) []string {
+	r.SubjectsForRoleInvoked = true
+	return r.SubjectsForRoleFn(roleName)
+}
+
+// SubjectExists returns true if the subject is in any policy or grouping
+func (r *RoleService) SubjectExists(subject string) bool {
+	r.SubjectExistsInvoked = true
+	return r.SubjectExistsFn(subject)
+}
+
+// Permissions lists permissions for roles
+func (r *RoleService) Permissions() [][]string {
+	r.PermissionsInvoked = true
+	return r.PermissionsFn()
+}
+
+// DeleteRole deletes a role's permissions
+func (r *RoleService) DeleteRole(roleName string) error {
+	r.DeleteRoleInvoked = true
+	return r.DeleteRoleFn(roleName)
+}
+
+// AddSubjectToRole adds a subject to a role
+func (r *RoleService) AddSubjectToRole(subject, roleName string) error {
+	r.AddSubjectToRoleInvoked = true
+	return r.AddSubjectToRoleFn(subject, roleName)
+}
+
+// DeleteSubjectFromRole deletes a subject from a role
+func (r *RoleService) DeleteSubjectFromRole(subject, roleName string) error {
+	r.DeleteSubjectFromRoleInvoked = true
+	return r.DeleteSubjectFromRoleFn(subject, roleName)
+}
+
+// DeleteSubject deletes a subject from all roles
+func (r *RoleService) DeleteSubject(subject string) error {
+	r.DeleteSubjectInvoked = true
+	return r.DeleteSubjectFn(subject)
+}
+
+// AddPermission adds a permission for a subject/role
+func (r *RoleService) AddPermission(subject, object, method string) error {
+	r.AddPermissionInvoked = true
+	return r.AddPermissionFn(subject, object, method)
+}
+
+// DeletePermission deletes a permission
+func (r *RoleService) DeletePermission(subject, object, method string) error {
+	r.DeletePermissionInvoked = true
+	return r.DeletePermissionFn(subject, object, method)
+}
@@ -0,0 +1,119 @@
+package mock
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// RuleService represents a mock implementation of ewserver.RuleService.
+type RuleService struct {
+	InitFn      func() error
+	InitInvoked bool
+
+	CreateFn      func(rule *ewserver.Rule) error
+	CreateInvoked bool
+
+	UpdateFn      func(rule *ewserver.Rule) error
+	UpdateInvoked bool
+
+	RuleFn      func(id uint64) (*ewserver.Rule, error)
+	RuleInvoked bool
+
+	RulesFn      func() ([]*ewserver.Rule, error)
+	RulesInvoked bool
+
+	DeleteFn      func(id uint64) error
+	DeleteInvoked bool
+
+	StateFn      func(ruleID uint64, deviceID []byte) (*ewserver.RuleState, error)
+	StateInvoked bool
+
+	StatesFn      func(ruleID uint64) ([]*ewserver.RuleState, error)
+	StatesInvoked bool
+
+	SetStateFn      func(state *ewserver.RuleState) error
+	SetStateInvoked bool
+
+	CreateAlertFn      func(alert *ewserver.Alert) error
+	CreateAlertInvoked bool
+
+	ResolveAlertFn      func(id uint64, value json.RawMessage, at time.Time) (*ewserver.Alert, error)
+	ResolveAlertInvoked bool
+
+	AlertsFn      func(state ewserver.AlertState) ([]*ewserver.Alert, error)
+	AlertsInvoked bool
+}
+
+// Init the rule service
+func (r *RuleService) Init() error {
+	r.InitInvoked = true
+	return r.InitFn()
+}
+
+// Create stores a new rule
+func (r *RuleService) Create(rule *ewserver.Rule) error {
+	r.CreateInvoked = true
+	return r.CreateFn(rule)
+}
+
+// Update replaces an existing rule
+func (r *RuleService) Update(rule *ewserver.Rule) error {
+	r.UpdateInvoked = true
+	return r.UpdateFn(rule)
+}
+
+// Rule returns a single rule
+func (r *RuleService) Rule(id uint64) (*ewserver.Rule, error) {
+	r.RuleInvoked = true
+	return r.RuleFn(id)
+}
+
+// Rules returns all rules
+func (r *RuleService) Rules() ([]*ewserver.Rule, error) {
+	r.RulesInvoked = true
+	return r.RulesFn()
+}
+
+// Delete the rule and its states
+func (r *RuleService) Delete(id uint64) error {
+	r.DeleteInvoked = true
+	return r.DeleteFn(id)
+}
+
+// State returns the rule's state for the device
+func (r *RuleService) State(ruleID uint64, deviceID []byte) (*ewserver.RuleState, error) {
+	r.StateInvoked = true
+	return r.StateFn(ruleID, deviceID)
+}
+
+// States returns the rule's state for every device
+func (r *RuleService) States(ruleID uint64) ([]*ewserver.RuleState, error) {
+	r.StatesInvoked = true
+	return r.StatesFn(ruleID)
+}
+
+// SetState stores the rule's state for the device
+func (r *RuleService) SetState(state *ewserver.RuleState) error {
+	r.SetStateInvoked = true
+	return r.SetStateFn(state)
+}
+
+// CreateAlert stores a new firing alert
+func (r *RuleService) CreateAlert(alert *ewserver.Alert) error {
+	r.CreateAlertInvoked = true
+	return r.CreateAlertFn(alert)
+}
+
+// ResolveAlert marks the alert resolved
+func (r *RuleService) ResolveAlert(id uint64, value json.RawMessage, at time.Time) (*ewserver.Alert, error) {
+	r.ResolveAlertInvoked = true
+	return r.ResolveAlertFn(id, value, at)
+}
+
+// Alerts returns the alerts in the state
+func (r *RuleService) Alerts(state ewserver.AlertState) ([]*ewserver.Alert, error) {
+	r.AlertsInvoked = true
+	return r.AlertsFn(state)
+}
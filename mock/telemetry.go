@@ -0,0 +1,82 @@
+package mock
+
+import (
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// TelemetryService represents a mock implementation of ewserver.TelemetryService.
+type TelemetryService struct {
+	InitFn      func() error
+	InitInvoked bool
+
+	PublishFn      func(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error
+	PublishInvoked bool
+
+	PublishBatchFn      func(deviceID []byte, points []*ewserver.BatchPoint) ([]*ewserver.BatchResult, error)
+	PublishBatchInvoked bool
+
+	PointsFn      func(deviceID []byte, stream ewserver.StreamName, from, to time.Time) ([]*ewserver.DataPoint, error)
+	PointsInvoked bool
+
+	ForEachPointFn      func(deviceID []byte, stream ewserver.StreamName, from, to time.Time, fn func(*ewserver.DataPoint) error) error
+	ForEachPointInvoked bool
+
+	LatestFn      func(deviceID []byte, stream ewserver.StreamName) (*ewserver.DataPoint, error)
+	LatestInvoked bool
+
+	StreamsFn      func(deviceID []byte) ([]ewserver.StreamName, error)
+	StreamsInvoked bool
+
+	SeriesFn      func(deviceID []byte, stream ewserver.StreamName, query *ewserver.SeriesQuery) ([]*ewserver.SeriesBucket, error)
+	SeriesInvoked bool
+}
+
+// Init the telemetry service
+func (t *TelemetryService) Init() error {
+	t.InitInvoked = true
+	return t.InitFn()
+}
+
+// Publish stores the point for the device's stream
+func (t *TelemetryService) Publish(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+	t.PublishInvoked = true
+	return t.PublishFn(deviceID, stream, point)
+}
+
+// PublishBatch stores the valid points of the batch
+func (t *TelemetryService) PublishBatch(deviceID []byte, points []*ewserver.BatchPoint) ([]*ewserver.BatchResult, error) {
+	t.PublishBatchInvoked = true
+	return t.PublishBatchFn(deviceID, points)
+}
+
+// Points returns all points in the range [from, to)
+func (t *TelemetryService) Points(deviceID []byte, stream ewserver.StreamName, from, to time.Time) ([]*ewserver.DataPoint, error) {
+	t.PointsInvoked = true
+	return t.PointsFn(deviceID, stream, from, to)
+}
+
+// ForEachPoint calls fn with the points in the range [from, to)
+func (t *TelemetryService) ForEachPoint(deviceID []byte, stream ewserver.StreamName, from, to time.Time, fn func(*ewserver.DataPoint) error) error {
+	t.ForEachPointInvoked = true
+	return t.ForEachPointFn(deviceID, stream, from, to, fn)
+}
+
+// Latest returns the most recent point of the stream
+func (t *TelemetryService) Latest(deviceID []byte, stream ewserver.StreamName) (*ewserver.DataPoint, error) {
+	t.LatestInvoked = true
+	return t.LatestFn(deviceID, stream)
+}
+
+// Streams returns the names of all streams for the device
+func (t *TelemetryService) Streams(deviceID []byte) ([]ewserver.StreamName, error) {
+	t.StreamsInvoked = true
+	return t.StreamsFn(deviceID)
+}
+
+// Series returns the downsampled points of the stream
+func (t *TelemetryService) Series(deviceID []byte, stream ewserver.StreamName, query *ewserver.SeriesQuery) ([]*ewserver.SeriesBucket, error) {
+	t.SeriesInvoked = true
+	return t.SeriesFn(deviceID, stream, query)
+}
@@ -15,6 +15,9 @@ type UserService struct {
 	UsersFn      func() ([]*ewserver.User, error)
 	UsersInvoked bool
 
+	ForEachUserFn      func(fn func(*ewserver.User) error) error
+	ForEachUserInvoked bool
+
 	AuthenticateFn      func(userName ewserver.UserName, password string) (*ewserver.User, error)
 	AuthenticateInvoked bool
 
@@ -80,3 +83,9 @@ func (u *UserService) Delete(userName ewserver.UserName) error {
 	u.DeleteInvoked = true
 	return u.Delete(userName)
 }
+
+// ForEachUser calls fn with every user
+func (u *UserService) ForEachUser(fn func(*ewserver.User) error) error {
+	u.ForEachUserInvoked = true
+	return u.ForEachUserFn(fn)
+}
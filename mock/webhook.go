@@ -0,0 +1,119 @@
+package mock
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+// WebhookService represents a mock implementation of ewserver.WebhookService. The dispatcher calls it
+// from several goroutines so the Invoked flags are set under a lock.
+type WebhookService struct {
+	mu sync.Mutex
+
+	InitFn      func() error
+	InitInvoked bool
+
+	CreateFn      func(subscription *ewserver.WebhookSubscription) error
+	CreateInvoked bool
+
+	SubscriptionFn      func(id uint64) (*ewserver.WebhookSubscription, error)
+	SubscriptionInvoked bool
+
+	SubscriptionsFn      func() ([]*ewserver.WebhookSubscription, error)
+	SubscriptionsInvoked bool
+
+	DeleteFn      func(id uint64) error
+	DeleteInvoked bool
+
+	EnqueueFn      func(event ewserver.WebhookEventType, data interface{}, at time.Time) ([]*ewserver.WebhookDelivery, error)
+	EnqueueInvoked bool
+
+	DueFn      func(now time.Time, limit int) ([]*ewserver.WebhookDelivery, error)
+	DueInvoked bool
+
+	RecordFn      func(id uint64, status int, message string, at time.Time) (*ewserver.WebhookDelivery, error)
+	RecordInvoked bool
+
+	RetryFn      func(id uint64) (*ewserver.WebhookDelivery, error)
+	RetryInvoked bool
+
+	DeliveriesFn      func(subscriptionID uint64, state ewserver.WebhookDeliveryState) ([]*ewserver.WebhookDelivery, error)
+	DeliveriesInvoked bool
+
+	PruneFn      func(before time.Time) (int, error)
+	PruneInvoked bool
+}
+
+// Init the webhook service
+func (w *WebhookService) Init() error {
+	w.invoked(&w.InitInvoked)
+	return w.InitFn()
+}
+
+// Create stores a new subscription
+func (w *WebhookService) Create(subscription *ewserver.WebhookSubscription) error {
+	w.invoked(&w.CreateInvoked)
+	return w.CreateFn(subscription)
+}
+
+// Subscription returns a single subscription
+func (w *WebhookService) Subscription(id uint64) (*ewserver.WebhookSubscription, error) {
+	w.invoked(&w.SubscriptionInvoked)
+	return w.SubscriptionFn(id)
+}
+
+// Subscriptions returns all subscriptions
+func (w *WebhookService) Subscriptions() ([]*ewserver.WebhookSubscription, error) {
+	w.invoked(&w.SubscriptionsInvoked)
+	return w.SubscriptionsFn()
+}
+
+// Delete the subscription
+func (w *WebhookService) Delete(id uint64) error {
+	w.invoked(&w.DeleteInvoked)
+	return w.DeleteFn(id)
+}
+
+// Enqueue a delivery of the event for every subscription that wants it
+func (w *WebhookService) Enqueue(event ewserver.WebhookEventType, data interface{}, at time.Time) ([]*ewserver.WebhookDelivery, error) {
+	w.invoked(&w.EnqueueInvoked)
+	return w.EnqueueFn(event, data, at)
+}
+
+// Due returns pending deliveries whose next attempt is not after now
+func (w *WebhookService) Due(now time.Time, limit int) ([]*ewserver.WebhookDelivery, error) {
+	w.invoked(&w.DueInvoked)
+	return w.DueFn(now, limit)
+}
+
+// Record the outcome of an attempt
+func (w *WebhookService) Record(id uint64, status int, message string, at time.Time) (*ewserver.WebhookDelivery, error) {
+	w.invoked(&w.RecordInvoked)
+	return w.RecordFn(id, status, message, at)
+}
+
+// Retry requeues a dead delivery
+func (w *WebhookService) Retry(id uint64) (*ewserver.WebhookDelivery, error) {
+	w.invoked(&w.RetryInvoked)
+	return w.RetryFn(id)
+}
+
+// Deliveries returns the delivery log
+func (w *WebhookService) Deliveries(subscriptionID uint64, state ewserver.WebhookDeliveryState) ([]*ewserver.WebhookDelivery, error) {
+	w.invoked(&w.DeliveriesInvoked)
+	return w.DeliveriesFn(subscriptionID, state)
+}
+
+// Prune deletes delivered and dead deliveries last updated before
+func (w *WebhookService) Prune(before time.Time) (int, error) {
+	w.invoked(&w.PruneInvoked)
+	return w.PruneFn(before)
+}
+
+func (w *WebhookService) invoked(flag *bool) {
+	w.mu.Lock()
+	*flag = true
+	w.mu.Unlock()
+}
@@ -3,14 +3,20 @@ package boltdb
 import (
 	"bytes"
 	"encoding/base64"
+	"sort"
+	"strconv"
 
 	"github.com/boltdb/bolt"
 	"github.com/wirepair/ewserver/ewserver"
 )
 
 const (
-	apiKeyBucket = "api_keys"
-	apiIDSize    = 16
+	apiKeyBucket   = "api_keys"
+	apiIndexBucket = "api_user_index" // a bucket per attribute keyed by value NUL api key
+	apiIDBucket    = "api_user_ids"   // api keys keyed by api user ID
+	apiIDSize      = 16
+
+	apiMetadataPrefix = "meta:" // attribute buckets of metadata keys, tags are in the DeviceTagAttribute bucket
 )
 
 // APIUserService implementation that manages access to Users
@@ -24,11 +30,48 @@ func NewAPIUserService(db *bolt.DB) *APIUserService {
 	return u
 }
 
-// Init the API key bucket
+// Init the API key bucket, the ID index and the attribute index, indexing existing API users the first time
 func (u *APIUserService) Init() error {
 	return u.DB.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(apiKeyBucket))
-		return err
+		bucket, err := tx.CreateBucketIfNotExists([]byte(apiKeyBucket))
+		if err != nil {
+			return err
+		}
+
+		if tx.Bucket([]byte(apiIDBucket)) == nil {
+			ids, err := tx.CreateBucket([]byte(apiIDBucket))
+			if err != nil {
+				return err
+			}
+
+			err = bucket.ForEach(func(k, v []byte) error {
+				apiUser, err := ewserver.DecodeAPIUser(v)
+				if err != nil {
+					return err
+				}
+				return ids.Put(apiUser.ID, k)
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if tx.Bucket([]byte(apiIndexBucket)) != nil {
+			return nil
+		}
+
+		if _, err := tx.CreateBucket([]byte(apiIndexBucket)); err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			apiUser, err := ewserver.DecodeAPIUser(v)
+			if err != nil {
+				return err
+			}
+			return indexAPIUser(tx, apiUser)
+		})
 	})
 }
 
@@ -50,7 +93,8 @@ func (u *APIUserService) APIUser(apiKey ewserver.APIKey) (*ewserver.APIUser, err
 	return foundUser, err
 }
 
-// APIUserByID finds the user by their ID this is an O(N) operation, primarly used for admin management.
+// APIUserByID finds the user by their base64 encoded ID through the ID index. Devices authenticating
+// with a certificate or a signature are looked up by ID on every request.
 func (u *APIUserService) APIUserByID(ID []byte) (*ewserver.APIUser, error) {
 	var foundUser *ewserver.APIUser
 
@@ -59,22 +103,24 @@ func (u *APIUserService) APIUserByID(ID []byte) (*ewserver.APIUser, error) {
 		return nil, err
 	}
 
-	err = u.DB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(apiKeyBucket))
-		c := bucket.Cursor()
+	if len(id) == 0 {
+		return nil, ewserver.ErrUserNotFound
+	}
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			apiUser, err := ewserver.DecodeAPIUser(v)
-			if err != nil {
-				return err
-			}
+	err = u.DB.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket([]byte(apiIDBucket)).Get(id)
+		if key == nil {
+			return ewserver.ErrUserNotFound
+		}
 
-			if bytes.Equal(apiUser.ID, id) {
-				foundUser = apiUser
-				return nil
-			}
+		apiUserBytes := tx.Bucket([]byte(apiKeyBucket)).Get(key)
+		if apiUserBytes == nil {
+			return ewserver.ErrUserNotFound
 		}
-		return ewserver.ErrUserNotFound
+
+		var decodeErr error
+		foundUser, decodeErr = ewserver.DecodeAPIUser(apiUserBytes)
+		return decodeErr
 	})
 
 	return foundUser, err
@@ -84,7 +130,18 @@ func (u *APIUserService) APIUserByID(ID []byte) (*ewserver.APIUser, error) {
 func (u *APIUserService) APIUsers() ([]*ewserver.APIUser, error) {
 	foundAPIUsers := make([]*ewserver.APIUser, 0)
 
-	err := u.DB.View(func(tx *bolt.Tx) error {
+	err := u.ForEachAPIUser(func(apiUser *ewserver.APIUser) error {
+		foundAPIUsers = append(foundAPIUsers, apiUser)
+		return nil
+	})
+
+	return foundAPIUsers, err
+}
+
+// ForEachAPIUser calls fn with every API user in a single read transaction so callers can stream them
+// without holding them all in memory. The first error returned by fn stops the iteration.
+func (u *APIUserService) ForEachAPIUser(fn func(*ewserver.APIUser) error) error {
+	return u.DB.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(apiKeyBucket))
 		c := bucket.Cursor()
 
@@ -94,12 +151,12 @@ func (u *APIUserService) APIUsers() ([]*ewserver.APIUser, error) {
 				return err
 			}
 
-			foundAPIUsers = append(foundAPIUsers, apiUser)
+			if err := fn(apiUser); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-
-	return foundAPIUsers, err
 }
 
 // Create adds a new API key if it does not already exist, generates a random ID for API User management.
@@ -108,6 +165,10 @@ func (u *APIUserService) APIUsers() ([]*ewserver.APIUser, error) {
 func (u *APIUserService) Create(apiUser *ewserver.APIUser) error {
 	var err error
 
+	if err := apiUser.ValidAttributes(); err != nil {
+		return err
+	}
+
 	if exists, _ := u.APIUser(apiUser.Key); exists != nil {
 		return ewserver.ErrUserAlreadyExists
 	}
@@ -123,14 +184,281 @@ func (u *APIUserService) Create(apiUser *ewserver.APIUser) error {
 		if err != nil {
 			return err
 		}
-		return bucket.Put(apiUser.Key.Bytes(), userBytes)
+
+		if err := bucket.Put(apiUser.Key.Bytes(), userBytes); err != nil {
+			return err
+		}
+		return indexAPIUser(tx, apiUser)
+	})
+}
+
+// Update replaces the API user stored under its key and re-indexes its attributes
+func (u *APIUserService) Update(apiUser *ewserver.APIUser) error {
+	if err := apiUser.ValidAttributes(); err != nil {
+		return err
+	}
+
+	userBytes, err := apiUser.Encode()
+	if err != nil {
+		return err
+	}
+
+	return u.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(apiKeyBucket))
+		previousBytes := bucket.Get(apiUser.Key.Bytes())
+		if previousBytes == nil {
+			return ewserver.ErrUserNotFound
+		}
+
+		previous, err := ewserver.DecodeAPIUser(previousBytes)
+		if err != nil {
+			return err
+		}
+
+		if err := unindexAPIUser(tx, previous); err != nil {
+			return err
+		}
+
+		if err := bucket.Put(apiUser.Key.Bytes(), userBytes); err != nil {
+			return err
+		}
+		return indexAPIUser(tx, apiUser)
 	})
 }
 
+// RotateKey moves the API user from its current key to key, keeping its ID and attributes. The old
+// key stops working, ErrUserAlreadyExists if the new key is taken.
+func (u *APIUserService) RotateKey(apiUser *ewserver.APIUser, key ewserver.APIKey) error {
+	return u.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(apiKeyBucket))
+		previousBytes := bucket.Get(apiUser.Key.Bytes())
+		if previousBytes == nil {
+			return ewserver.ErrUserNotFound
+		}
+
+		if bucket.Get(key.Bytes()) != nil {
+			return ewserver.ErrUserAlreadyExists
+		}
+
+		previous, err := ewserver.DecodeAPIUser(previousBytes)
+		if err != nil {
+			return err
+		}
+
+		if err := unindexAPIUser(tx, previous); err != nil {
+			return err
+		}
+
+		if err := bucket.Delete(previous.Key.Bytes()); err != nil {
+			return err
+		}
+
+		previous.Key = key
+		userBytes, err := previous.Encode()
+		if err != nil {
+			return err
+		}
+
+		if err := bucket.Put(key.Bytes(), userBytes); err != nil {
+			return err
+		}
+
+		if err := indexAPIUser(tx, previous); err != nil {
+			return err
+		}
+
+		apiUser.Key = key
+		return nil
+	})
+}
+
+// SetDisabled changes only the stored API user's Disabled field, so concurrent changes to its other
+// fields are kept
+func (u *APIUserService) SetDisabled(key ewserver.APIKey, disabled bool) error {
+	return u.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(apiKeyBucket))
+		userBytes := bucket.Get(key.Bytes())
+		if userBytes == nil {
+			return ewserver.ErrUserNotFound
+		}
+
+		apiUser, err := ewserver.DecodeAPIUser(userBytes)
+		if err != nil {
+			return err
+		}
+
+		apiUser.Disabled = disabled
+		if userBytes, err = apiUser.Encode(); err != nil {
+			return err
+		}
+		return bucket.Put(key.Bytes(), userBytes)
+	})
+}
+
+// Search returns the API users matching all conditions of the query, ordered like APIUsers. Each condition
+// reads only the index bucket of its attribute, equality on a string value seeks directly to it.
+func (u *APIUserService) Search(query *ewserver.DeviceQuery) ([]*ewserver.APIUser, error) {
+	if len(query.Conditions) == 0 {
+		return u.APIUsers()
+	}
+
+	foundAPIUsers := make([]*ewserver.APIUser, 0)
+	err := u.DB.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(apiIndexBucket))
+
+		var matches map[string]struct{}
+		for _, condition := range query.Conditions {
+			keys := indexMatches(index, condition)
+			if matches != nil {
+				for key := range matches {
+					if _, ok := keys[key]; !ok {
+						delete(matches, key)
+					}
+				}
+			} else {
+				matches = keys
+			}
+
+			if len(matches) == 0 {
+				return nil
+			}
+		}
+
+		keys := make([]string, 0, len(matches))
+		for key := range matches {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		bucket := tx.Bucket([]byte(apiKeyBucket))
+		for _, key := range keys {
+			apiUserBytes := bucket.Get([]byte(key))
+			if apiUserBytes == nil {
+				continue
+			}
+
+			apiUser, err := ewserver.DecodeAPIUser(apiUserBytes)
+			if err != nil {
+				return err
+			}
+			foundAPIUsers = append(foundAPIUsers, apiUser)
+		}
+		return nil
+	})
+	return foundAPIUsers, err
+}
+
 // Delete a User from the system. Does not return an error if user does not exist
 func (u *APIUserService) Delete(apiKey ewserver.APIKey) error {
 	return u.DB.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(apiKeyBucket))
+		if apiUserBytes := bucket.Get(apiKey.Bytes()); apiUserBytes != nil {
+			apiUser, err := ewserver.DecodeAPIUser(apiUserBytes)
+			if err != nil {
+				return err
+			}
+
+			if err := unindexAPIUser(tx, apiUser); err != nil {
+				return err
+			}
+		}
 		return bucket.Delete(apiKey.Bytes())
 	})
 }
+
+// apiUserIndexEntries returns the attribute bucket names and index keys of the API user's metadata and tags
+func apiUserIndexEntries(apiUser *ewserver.APIUser) map[string][][]byte {
+	entries := make(map[string][][]byte, len(apiUser.Metadata)+1)
+	for key, value := range apiUser.Metadata {
+		attribute := apiMetadataPrefix + key
+		entries[attribute] = append(entries[attribute], apiIndexKey(value, apiUser.Key))
+	}
+
+	for _, tag := range apiUser.Tags {
+		entries[ewserver.DeviceTagAttribute] = append(entries[ewserver.DeviceTagAttribute], apiIndexKey(tag, apiUser.Key))
+	}
+	return entries
+}
+
+func apiIndexKey(value string, apiKey ewserver.APIKey) []byte {
+	return append([]byte(value+"\x00"), apiKey.Bytes()...)
+}
+
+// indexAPIUser adds the API user's ID and attributes to the indexes
+func indexAPIUser(tx *bolt.Tx, apiUser *ewserver.APIUser) error {
+	if len(apiUser.ID) > 0 {
+		if err := tx.Bucket([]byte(apiIDBucket)).Put(apiUser.ID, apiUser.Key.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	index := tx.Bucket([]byte(apiIndexBucket))
+	for attribute, keys := range apiUserIndexEntries(apiUser) {
+		bucket, err := index.CreateBucketIfNotExists([]byte(attribute))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := bucket.Put(key, []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unindexAPIUser removes the API user's ID and attributes from the indexes
+func unindexAPIUser(tx *bolt.Tx, apiUser *ewserver.APIUser) error {
+	if len(apiUser.ID) > 0 {
+		if err := tx.Bucket([]byte(apiIDBucket)).Delete(apiUser.ID); err != nil {
+			return err
+		}
+	}
+
+	index := tx.Bucket([]byte(apiIndexBucket))
+	for attribute, keys := range apiUserIndexEntries(apiUser) {
+		bucket := index.Bucket([]byte(attribute))
+		if bucket == nil {
+			continue
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexMatches returns the API keys whose attribute value meets the condition
+func indexMatches(index *bolt.Bucket, condition *ewserver.DeviceCondition) map[string]struct{} {
+	attribute := apiMetadataPrefix + condition.Attribute
+	if condition.Attribute == ewserver.DeviceTagAttribute {
+		attribute = ewserver.DeviceTagAttribute
+	}
+
+	keys := make(map[string]struct{})
+	bucket := index.Bucket([]byte(attribute))
+	if bucket == nil {
+		return keys
+	}
+
+	c := bucket.Cursor()
+	if _, err := strconv.ParseFloat(condition.Value, 64); err != nil && condition.Operator == "=" {
+		prefix := []byte(condition.Value + "\x00")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys[string(k[len(prefix):])] = struct{}{}
+		}
+		return keys
+	}
+
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		separator := bytes.IndexByte(k, 0)
+		if separator >= 0 && condition.Match(string(k[:separator])) {
+			keys[string(k[separator+1:])] = struct{}{}
+		}
+	}
+	return keys
+}
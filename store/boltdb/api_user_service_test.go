@@ -1,9 +1,11 @@
 package boltdb_test
 
 import (
+	"encoding/base64"
 	"fmt"
 	"testing"
 
+	"github.com/boltdb/bolt"
 	"github.com/wirepair/ewserver/ewserver"
 	"github.com/wirepair/ewserver/store/boltdb"
 )
@@ -150,6 +152,95 @@ func TestAPIUserService_Delete(t *testing.T) {
 
 }
 
+func TestAPIUserService_Search(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewAPIUserService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing API user service: %s\n", err)
+	}
+
+	devices := []*ewserver.APIUser{
+		{Key: "key1", Name: "berlin-hw2", Metadata: map[string]string{"site": "berlin", "hw": "2"}},
+		{Key: "key2", Name: "berlin-hw3", Metadata: map[string]string{"site": "berlin", "hw": "3"}, Tags: []string{"outdoor"}},
+		{Key: "key3", Name: "berlin-hw10", Metadata: map[string]string{"site": "berlin", "hw": "10"}, Tags: []string{"outdoor", "beta"}},
+		{Key: "key4", Name: "paris-hw3", Metadata: map[string]string{"site": "paris", "hw": "3"}},
+	}
+
+	for _, device := range devices {
+		if err := service.Create(device); err != nil {
+			t.Fatalf("error creating API user: %s\n", err)
+		}
+	}
+
+	searches := map[string][]string{
+		"site=berlin AND hw>=3":      {"berlin-hw3", "berlin-hw10"},
+		"site = berlin and hw < 3":   {"berlin-hw2"},
+		"hw=3.0":                     {"berlin-hw3", "paris-hw3"},
+		"site!=berlin":               {"paris-hw3"},
+		"tag=outdoor AND tag=beta":   {"berlin-hw10"},
+		"owner=alice":                {},
+		"":                           {"berlin-hw2", "berlin-hw3", "berlin-hw10", "paris-hw3"},
+		"site=berlin AND site=paris": {},
+	}
+
+	for search, expected := range searches {
+		query, err := ewserver.ParseDeviceQuery(search)
+		if err != nil {
+			t.Fatalf("error parsing %q: %s\n", search, err)
+		}
+
+		found, err := service.Search(query)
+		if err != nil {
+			t.Fatalf("error searching %q: %s\n", search, err)
+		}
+
+		names := make([]string, 0, len(found))
+		for _, apiUser := range found {
+			names = append(names, apiUser.Name)
+		}
+
+		if fmt.Sprint(names) != fmt.Sprint(expected) {
+			t.Fatalf("expected %q to find %v got: %v\n", search, expected, names)
+		}
+	}
+
+	if _, err := ewserver.ParseDeviceQuery("site berlin"); err != ewserver.ErrInvalidSearch {
+		t.Fatalf("expected ErrInvalidSearch without an operator got: %v\n", err)
+	}
+
+	// updating and deleting keep the index consistent
+	updated := devices[3]
+	updated.Metadata = map[string]string{"site": "berlin", "hw": "4"}
+	if err := service.Update(updated); err != nil {
+		t.Fatalf("error updating API user: %s\n", err)
+	}
+
+	if err := service.Delete(devices[0].Key); err != nil {
+		t.Fatalf("error deleting API user: %s\n", err)
+	}
+
+	query, _ := ewserver.ParseDeviceQuery("site=berlin AND hw<=4")
+	if found, err := service.Search(query); err != nil || len(found) != 2 || found[0].Name != "berlin-hw3" || found[1].Name != "paris-hw3" {
+		t.Fatalf("expected the updated device and not the deleted one got: %d %v\n", len(found), err)
+	}
+
+	if err := service.Update(&ewserver.APIUser{Key: "unknown"}); err != ewserver.ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound updating an unknown API user got: %v\n", err)
+	}
+
+	if err := service.Update(&ewserver.APIUser{Key: "key2", Tags: []string{""}}); err != ewserver.ErrInvalidMetadata {
+		t.Fatalf("expected ErrInvalidMetadata for an empty tag got: %v\n", err)
+	}
+}
+
 func testCreateAPIUser(service *boltdb.APIUserService, t *testing.T) {
 	var err error
 
@@ -173,3 +264,142 @@ func testCreateAPIUsers(service *boltdb.APIUserService, t *testing.T) {
 		}
 	}
 }
+
+func TestAPIUserService_APIUserByID(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewAPIUserService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing API user service: %s\n", err)
+	}
+
+	device := &ewserver.APIUser{Key: "key1", Name: "device1"}
+	if err := service.Create(device); err != nil {
+		t.Fatalf("error creating API user: %s\n", err)
+	}
+	id := []byte(base64.StdEncoding.EncodeToString(device.ID))
+
+	if found, err := service.APIUserByID(id); err != nil || found.Key != "key1" {
+		t.Fatalf("expected the API user to be found by ID got: %v %#v\n", err, found)
+	}
+
+	if _, err := service.APIUserByID([]byte(base64.StdEncoding.EncodeToString([]byte("unknown")))); err != ewserver.ErrUserNotFound {
+		t.Fatalf("expected not found for an unknown ID got: %v\n", err)
+	}
+
+	// databases created before the ID index are indexed on Init
+	if err := db.DB().Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte("api_user_ids")) }); err != nil {
+		t.Fatalf("error deleting the ID index: %s\n", err)
+	}
+
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing API user service: %s\n", err)
+	}
+
+	if found, err := service.APIUserByID(id); err != nil || found.Key != "key1" {
+		t.Fatalf("expected the API user to be found by ID after indexing got: %v %#v\n", err, found)
+	}
+
+	if err := service.Delete("key1"); err != nil {
+		t.Fatalf("error deleting API user: %s\n", err)
+	}
+
+	if _, err := service.APIUserByID(id); err != ewserver.ErrUserNotFound {
+		t.Fatalf("expected not found after delete got: %v\n", err)
+	}
+}
+
+func TestAPIUserService_RotateKey(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewAPIUserService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing API user service: %s\n", err)
+	}
+
+	device := &ewserver.APIUser{Key: "key1", Name: "device1", Tags: []string{"outdoor"}}
+	if err := service.Create(device); err != nil {
+		t.Fatalf("error creating API user: %s\n", err)
+	}
+
+	if err := service.Create(&ewserver.APIUser{Key: "key2", Name: "device2"}); err != nil {
+		t.Fatalf("error creating API user: %s\n", err)
+	}
+
+	if err := service.RotateKey(device, "key2"); err != ewserver.ErrUserAlreadyExists {
+		t.Fatalf("expected ErrUserAlreadyExists rotating to a taken key got: %v\n", err)
+	}
+
+	id := device.ID
+	if err := service.RotateKey(device, "key3"); err != nil || device.Key != "key3" {
+		t.Fatalf("error rotating key: %v %s\n", err, device.Key)
+	}
+
+	if _, err := service.APIUser("key1"); err != ewserver.ErrUserNotFound {
+		t.Fatalf("expected the old key to stop working got: %v\n", err)
+	}
+
+	rotated, err := service.APIUserByID([]byte(base64.StdEncoding.EncodeToString(id)))
+	if err != nil || rotated.Key != "key3" || rotated.Name != "device1" {
+		t.Fatalf("expected the API user to keep its ID with the new key got: %v %#v\n", err, rotated)
+	}
+
+	query, _ := ewserver.ParseDeviceQuery("tag=outdoor")
+	if found, err := service.Search(query); err != nil || len(found) != 1 || found[0].Key != "key3" {
+		t.Fatalf("expected the index to follow the new key got: %v %d\n", err, len(found))
+	}
+}
+
+func TestAPIUserService_SetDisabled(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewAPIUserService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing API user service: %s\n", err)
+	}
+
+	if err := service.SetDisabled("key1", true); err != ewserver.ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound got: %v\n", err)
+	}
+
+	device := &ewserver.APIUser{Key: "key1", Name: "device1"}
+	if err := service.Create(device); err != nil {
+		t.Fatalf("error creating API user: %s\n", err)
+	}
+
+	// a change made after the caller read the API user is kept
+	device.Tags = []string{"outdoor"}
+	if err := service.Update(device); err != nil {
+		t.Fatalf("error updating API user: %s\n", err)
+	}
+
+	if err := service.SetDisabled("key1", true); err != nil {
+		t.Fatalf("error disabling API user: %s\n", err)
+	}
+
+	disabled, err := service.APIUser("key1")
+	if err != nil || !disabled.Disabled || len(disabled.Tags) != 1 {
+		t.Fatalf("expected the API user to be disabled with its tags got: %v %#v\n", err, disabled)
+	}
+}
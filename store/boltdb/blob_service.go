@@ -0,0 +1,414 @@
+package boltdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	blobBucket = "blobs" // blob metadata keyed by blob ID, the bytes are files in the blob directory
+	blobIDSize = 16
+)
+
+// BlobService implementation storing blob metadata in bolt and the blobs as files named by their ID in Dir.
+// Chunks are synced to disk before the committed offset is stored, so a crash never commits bytes that
+// were not written. Changes to a blob are serialized by its own lock so concurrent retries of a chunk can
+// not interleave, while hashing a large blob does not hold up the others.
+type BlobService struct {
+	DB   *bolt.DB
+	Dir  string
+	lock sync.Mutex // serializes Create so a device's quota can not be passed by concurrent uploads
+
+	locksLock sync.Mutex
+	locks     map[string]*blobLock // locks of the blobs being changed by ID
+}
+
+// blobLock serializes changes to a blob, it is dropped once no one holds or waits for it
+type blobLock struct {
+	sync.Mutex
+	holders int
+}
+
+// NewBlobService creates a new blob service backed by an already open boltdb, storing the blobs in dir
+// or, if dir is empty, the blobs directory next to the database file.
+func NewBlobService(db *bolt.DB, dir string) *BlobService {
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(db.Path()), "blobs")
+	}
+	b := &BlobService{DB: db, Dir: dir, locks: make(map[string]*blobLock)}
+	return b
+}
+
+// Init the blob bucket and directory
+func (b *BlobService) Init() error {
+	if err := os.MkdirAll(b.Dir, 0700); err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(blobBucket))
+		return err
+	})
+}
+
+// Create starts the upload of the blob with an empty file, assigning its ID. ErrBlobQuota if the device
+// already has MaxBlobUploads in progress or the blob would take it past MaxDeviceBlobBytes.
+func (b *BlobService) Create(blob *ewserver.Blob) error {
+	if err := blob.Valid(); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	blobs, err := b.Blobs(blob.DeviceID)
+	if err != nil {
+		return err
+	}
+
+	uploads, size := 0, blob.Size
+	for _, existing := range blobs {
+		if existing.State == ewserver.BlobUploading {
+			uploads++
+		}
+		size += existing.Size
+	}
+
+	if uploads >= ewserver.MaxBlobUploads || size > ewserver.MaxDeviceBlobBytes {
+		return ewserver.ErrBlobQuota
+	}
+
+	id, err := ewserver.GenerateRandomBytes(blobIDSize)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	blob.ID = hex.EncodeToString(id)
+	blob.Offset = 0
+	blob.SHA256 = ""
+	blob.State = ewserver.BlobUploading
+	blob.CreatedAt = now
+	blob.UpdatedAt = now
+
+	file, err := os.OpenFile(b.path(blob.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := b.save(blob); err != nil {
+		os.Remove(b.path(blob.ID))
+		return err
+	}
+	return nil
+}
+
+// Blob returns a single blob, ErrBlobNotFound if it does not exist
+func (b *BlobService) Blob(id string) (*ewserver.Blob, error) {
+	if !ewserver.ValidBlobID(id) {
+		return nil, ewserver.ErrBlobNotFound
+	}
+
+	var blob *ewserver.Blob
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		blobBytes := tx.Bucket([]byte(blobBucket)).Get([]byte(id))
+		if blobBytes == nil {
+			return ewserver.ErrBlobNotFound
+		}
+
+		var err error
+		blob, err = ewserver.DecodeBlob(blobBytes)
+		return err
+	})
+	return blob, err
+}
+
+// Blobs returns the device's blobs newest first, or the blobs of all devices if deviceID is nil
+func (b *BlobService) Blobs(deviceID []byte) ([]*ewserver.Blob, error) {
+	blobs := make([]*ewserver.Blob, 0)
+
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(blobBucket)).ForEach(func(k, v []byte) error {
+			blob, err := ewserver.DecodeBlob(v)
+			if err != nil {
+				return err
+			}
+
+			if deviceID == nil || string(blob.DeviceID) == string(deviceID) {
+				blobs = append(blobs, blob)
+			}
+			return nil
+		})
+	})
+
+	sort.SliceStable(blobs, func(i, j int) bool { return blobs[i].CreatedAt.After(blobs[j].CreatedAt) })
+	return blobs, err
+}
+
+// WriteChunk commits the chunk at offset. A chunk starting before the committed offset is a retry, only
+// its bytes past the committed offset are written. ErrBlobOffset if the chunk starts past the committed
+// offset, ErrInvalidBlob if it is too large or ends past the blob's size.
+func (b *BlobService) WriteChunk(id string, offset int64, chunk []byte) (*ewserver.Blob, error) {
+	if offset < 0 || len(chunk) > ewserver.MaxBlobChunkSize {
+		return nil, ewserver.ErrInvalidBlob
+	}
+
+	defer b.lockBlob(id)()
+
+	blob, err := b.Blob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > blob.Offset {
+		return blob, ewserver.ErrBlobOffset
+	}
+
+	end := offset + int64(len(chunk))
+	if end > blob.Size {
+		return blob, ewserver.ErrInvalidBlob
+	}
+
+	if end <= blob.Offset {
+		return blob, nil
+	}
+	chunk = chunk[blob.Offset-offset:]
+
+	file, err := os.OpenFile(b.path(id), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// drop bytes written past the committed offset before a crash
+	if err := file.Truncate(blob.Offset); err != nil {
+		return nil, err
+	}
+
+	if _, err := file.WriteAt(chunk, blob.Offset); err != nil {
+		return nil, err
+	}
+
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+
+	blob.Offset = end
+	blob.UpdatedAt = time.Now().UTC()
+	if err := b.save(blob); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// Finalize completes the upload if the SHA-256 of the committed bytes matches, so it may be downloaded.
+// On a mismatch the upload is reset to offset 0 for the device to send it again and ErrBlobChecksum is
+// returned. Finalizing a complete blob again succeeds if the SHA-256 matches.
+func (b *BlobService) Finalize(id string, sum string) (*ewserver.Blob, error) {
+	defer b.lockBlob(id)()
+
+	blob, err := b.Blob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sum = strings.ToLower(sum)
+	if blob.State == ewserver.BlobComplete {
+		if blob.SHA256 != sum {
+			return blob, ewserver.ErrBlobChecksum
+		}
+		return blob, nil
+	}
+
+	if blob.Offset != blob.Size {
+		return blob, ewserver.ErrBlobIncomplete
+	}
+
+	computed, err := b.fileSHA256(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	blob.UpdatedAt = now
+	if computed != sum {
+		if err := os.Truncate(b.path(id), 0); err != nil {
+			return nil, err
+		}
+
+		blob.Offset = 0
+		if err := b.save(blob); err != nil {
+			return nil, err
+		}
+		return blob, ewserver.ErrBlobChecksum
+	}
+
+	blob.SHA256 = computed
+	blob.State = ewserver.BlobComplete
+	blob.CompletedAt = now
+	if err := b.save(blob); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// Open returns a complete blob and its file for reading, ErrBlobIncomplete if it is still uploading
+func (b *BlobService) Open(id string) (*ewserver.Blob, *os.File, error) {
+	blob, err := b.Blob(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if blob.State != ewserver.BlobComplete {
+		return blob, nil, ewserver.ErrBlobIncomplete
+	}
+
+	file, err := os.Open(b.path(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return blob, file, nil
+}
+
+// Delete the blob's metadata and file, ErrBlobNotFound if it does not exist
+func (b *BlobService) Delete(id string) error {
+	defer b.lockBlob(id)()
+
+	if _, err := b.Blob(id); err != nil {
+		return err
+	}
+	return b.delete(id)
+}
+
+// ExpireUploads deletes the uploads that did not receive a chunk since before, returning how many
+func (b *BlobService) ExpireUploads(before time.Time) (int, error) {
+	return b.expire(func(blob *ewserver.Blob) bool {
+		return blob.State == ewserver.BlobUploading && blob.UpdatedAt.Before(before)
+	})
+}
+
+// ExpireComplete deletes the complete blobs that were completed before before, returning how many
+func (b *BlobService) ExpireComplete(before time.Time) (int, error) {
+	return b.expire(func(blob *ewserver.Blob) bool {
+		return blob.State == ewserver.BlobComplete && blob.CompletedAt.Before(before)
+	})
+}
+
+// expire deletes the blobs expired returns true for, checking each again under its lock in case it
+// changed since they were listed
+func (b *BlobService) expire(expired func(blob *ewserver.Blob) bool) (int, error) {
+	blobs, err := b.Blobs(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, listed := range blobs {
+		if !expired(listed) {
+			continue
+		}
+
+		deleted, err := func() (bool, error) {
+			defer b.lockBlob(listed.ID)()
+
+			blob, err := b.Blob(listed.ID)
+			if err == ewserver.ErrBlobNotFound || (err == nil && !expired(blob)) {
+				return false, nil
+			}
+
+			if err != nil {
+				return false, err
+			}
+			return true, b.delete(blob.ID)
+		}()
+
+		if err != nil {
+			return count, err
+		}
+
+		if deleted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// lockBlob locks the blob's changes, returning the function to unlock them
+func (b *BlobService) lockBlob(id string) func() {
+	b.locksLock.Lock()
+	lock, ok := b.locks[id]
+	if !ok {
+		lock = &blobLock{}
+		b.locks[id] = lock
+	}
+	lock.holders++
+	b.locksLock.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		b.locksLock.Lock()
+		if lock.holders--; lock.holders == 0 {
+			delete(b.locks, id)
+		}
+		b.locksLock.Unlock()
+	}
+}
+
+func (b *BlobService) path(id string) string {
+	return filepath.Join(b.Dir, id)
+}
+
+func (b *BlobService) save(blob *ewserver.Blob) error {
+	blobBytes, err := blob.Encode()
+	if err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(blobBucket)).Put([]byte(blob.ID), blobBytes)
+	})
+}
+
+// delete removes the metadata first, a file left behind by a failed remove is never served
+func (b *BlobService) delete(id string) error {
+	if err := b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(blobBucket)).Delete([]byte(id))
+	}); err != nil {
+		return err
+	}
+
+	if err := os.Remove(b.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *BlobService) fileSHA256(id string) (string, error) {
+	file, err := os.Open(b.path(id))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,229 @@
+package boltdb_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func testBlobService(t *testing.T) (*boltdb.BlobService, func()) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+
+	dir, err := ioutil.TempDir("testdata/", "blobs")
+	if err != nil {
+		t.Fatalf("error creating blob dir for testing: %s\n", err)
+	}
+
+	db := testOpenDb(dbFileName, t)
+	service := boltdb.NewBlobService(db.DB(), dir)
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing blob service: %s\n", err)
+	}
+
+	return service, func() {
+		testCloseDb(db, t)
+		testRemoveDbFile(dbFileName, t)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBlobService_WriteChunk(t *testing.T) {
+	service, cleanup := testBlobService(t)
+	defer cleanup()
+
+	for _, blob := range []*ewserver.Blob{{Name: "../image.jpg", Size: 10}, {Name: "image.jpg"}, {Name: "image.jpg", Size: ewserver.MaxBlobSize + 1}} {
+		if err := service.Create(blob); err != ewserver.ErrInvalidBlob {
+			t.Fatalf("expected ErrInvalidBlob creating %#v got: %v\n", blob, err)
+		}
+	}
+
+	data := []byte("0123456789abcdef")
+	blob := &ewserver.Blob{DeviceID: []byte("device1"), Name: "log.tar.gz", Size: int64(len(data))}
+	if err := service.Create(blob); err != nil || !ewserver.ValidBlobID(blob.ID) || blob.State != ewserver.BlobUploading {
+		t.Fatalf("error creating blob: %v %#v\n", err, blob)
+	}
+
+	if _, err := service.WriteChunk(blob.ID, 4, data[4:8]); err != ewserver.ErrBlobOffset {
+		t.Fatalf("expected ErrBlobOffset writing past the committed offset got: %v\n", err)
+	}
+
+	if _, err := service.WriteChunk(blob.ID, 0, data[:6]); err != nil {
+		t.Fatalf("error writing chunk: %s\n", err)
+	}
+
+	// a resent chunk is accepted without changing the offset, an overlapping one only appends its new bytes
+	if written, err := service.WriteChunk(blob.ID, 0, data[:6]); err != nil || written.Offset != 6 {
+		t.Fatalf("expected a resent chunk to keep the offset got: %v %#v\n", err, written)
+	}
+
+	if written, err := service.WriteChunk(blob.ID, 4, data[4:12]); err != nil || written.Offset != 12 {
+		t.Fatalf("expected an overlapping chunk to commit up to its end got: %v %#v\n", err, written)
+	}
+
+	if _, err := service.WriteChunk(blob.ID, 12, append(data[12:], 'x')); err != ewserver.ErrInvalidBlob {
+		t.Fatalf("expected ErrInvalidBlob writing past the size got: %v\n", err)
+	}
+
+	if _, err := service.Finalize(blob.ID, "00"); err != ewserver.ErrBlobIncomplete {
+		t.Fatalf("expected ErrBlobIncomplete finalizing early got: %v\n", err)
+	}
+
+	if _, _, err := service.Open(blob.ID); err != ewserver.ErrBlobIncomplete {
+		t.Fatalf("expected ErrBlobIncomplete opening an upload got: %v\n", err)
+	}
+
+	if _, err := service.WriteChunk(blob.ID, 12, data[12:]); err != nil {
+		t.Fatalf("error writing last chunk: %s\n", err)
+	}
+
+	sum := sha256.Sum256(data)
+	finalized, err := service.Finalize(blob.ID, hex.EncodeToString(sum[:]))
+	if err != nil || finalized.State != ewserver.BlobComplete || finalized.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("error finalizing blob: %v %#v\n", err, finalized)
+	}
+
+	_, file, err := service.Open(blob.ID)
+	if err != nil {
+		t.Fatalf("error opening blob: %s\n", err)
+	}
+	defer file.Close()
+
+	if stored, err := ioutil.ReadAll(file); err != nil || string(stored) != string(data) {
+		t.Fatalf("expected the blob to hold the chunks in order got: %q %v\n", stored, err)
+	}
+}
+
+func TestBlobService_Finalize(t *testing.T) {
+	service, cleanup := testBlobService(t)
+	defer cleanup()
+
+	data := []byte("image bytes")
+	blob := &ewserver.Blob{DeviceID: []byte("device1"), Name: "image.jpg", Size: int64(len(data))}
+	if err := service.Create(blob); err != nil {
+		t.Fatalf("error creating blob: %s\n", err)
+	}
+
+	if _, err := service.WriteChunk(blob.ID, 0, data); err != nil {
+		t.Fatalf("error writing chunk: %s\n", err)
+	}
+
+	reset, err := service.Finalize(blob.ID, hex.EncodeToString(make([]byte, sha256.Size)))
+	if err != ewserver.ErrBlobChecksum || reset.Offset != 0 || reset.State != ewserver.BlobUploading {
+		t.Fatalf("expected a mismatching sha256 to reset the upload got: %v %#v\n", err, reset)
+	}
+
+	if _, err := service.WriteChunk(blob.ID, 0, data); err != nil {
+		t.Fatalf("error writing chunk again: %s\n", err)
+	}
+
+	sum := sha256.Sum256(data)
+	for i := 0; i < 2; i++ {
+		if _, err := service.Finalize(blob.ID, hex.EncodeToString(sum[:])); err != nil {
+			t.Fatalf("expected finalizing to succeed and be repeatable got: %v\n", err)
+		}
+	}
+
+	other := &ewserver.Blob{DeviceID: []byte("device2"), Name: "image.jpg", Size: 1}
+	if err := service.Create(other); err != nil {
+		t.Fatalf("error creating blob: %s\n", err)
+	}
+
+	if blobs, err := service.Blobs([]byte("device1")); err != nil || len(blobs) != 1 || blobs[0].ID != blob.ID {
+		t.Fatalf("expected only device1's blob got: %v %d\n", err, len(blobs))
+	}
+
+	if blobs, err := service.Blobs(nil); err != nil || len(blobs) != 2 || blobs[0].ID != other.ID {
+		t.Fatalf("expected both blobs newest first got: %v %d\n", err, len(blobs))
+	}
+
+	expired, err := service.ExpireUploads(time.Now().Add(time.Minute))
+	if err != nil || expired != 1 {
+		t.Fatalf("expected only the unfinished upload to expire got: %d %v\n", expired, err)
+	}
+
+	if _, err := service.Blob(other.ID); err != ewserver.ErrBlobNotFound {
+		t.Fatalf("expected the expired upload to be deleted got: %v\n", err)
+	}
+
+	if expired, err := service.ExpireComplete(time.Now().Add(-time.Minute)); err != nil || expired != 0 {
+		t.Fatalf("expected a recently completed blob to be kept got: %d %v\n", expired, err)
+	}
+
+	if err := service.Delete(blob.ID); err != nil {
+		t.Fatalf("error deleting blob: %s\n", err)
+	}
+
+	if err := service.Delete(blob.ID); err != ewserver.ErrBlobNotFound {
+		t.Fatalf("expected ErrBlobNotFound deleting twice got: %v\n", err)
+	}
+}
+
+func TestBlobService_ExpireComplete(t *testing.T) {
+	service, cleanup := testBlobService(t)
+	defer cleanup()
+
+	data := []byte("x")
+	blob := &ewserver.Blob{DeviceID: []byte("device1"), Name: "image.jpg", Size: 1}
+	if err := service.Create(blob); err != nil {
+		t.Fatalf("error creating blob: %s\n", err)
+	}
+
+	if _, err := service.WriteChunk(blob.ID, 0, data); err != nil {
+		t.Fatalf("error writing chunk: %s\n", err)
+	}
+
+	sum := sha256.Sum256(data)
+	if _, err := service.Finalize(blob.ID, hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("error finalizing blob: %s\n", err)
+	}
+
+	if expired, err := service.ExpireUploads(time.Now().Add(time.Minute)); err != nil || expired != 0 {
+		t.Fatalf("expected complete blobs not to expire as uploads got: %d %v\n", expired, err)
+	}
+
+	if expired, err := service.ExpireComplete(time.Now().Add(time.Minute)); err != nil || expired != 1 {
+		t.Fatalf("expected the complete blob to expire got: %d %v\n", expired, err)
+	}
+
+	if _, err := service.Blob(blob.ID); err != ewserver.ErrBlobNotFound {
+		t.Fatalf("expected the expired blob to be deleted got: %v\n", err)
+	}
+}
+
+func TestBlobService_Quota(t *testing.T) {
+	service, cleanup := testBlobService(t)
+	defer cleanup()
+
+	for i := 0; i < ewserver.MaxBlobUploads; i++ {
+		if err := service.Create(&ewserver.Blob{DeviceID: []byte("device1"), Name: "image.jpg", Size: 1}); err != nil {
+			t.Fatalf("error creating blob %d: %s\n", i, err)
+		}
+	}
+
+	if err := service.Create(&ewserver.Blob{DeviceID: []byte("device1"), Name: "image.jpg", Size: 1}); err != ewserver.ErrBlobQuota {
+		t.Fatalf("expected ErrBlobQuota past the open uploads got: %v\n", err)
+	}
+
+	for i := 0; i < ewserver.MaxDeviceBlobBytes/ewserver.MaxBlobSize; i++ {
+		if err := service.Create(&ewserver.Blob{DeviceID: []byte("device2"), Name: "archive.tgz", Size: ewserver.MaxBlobSize}); err != nil {
+			t.Fatalf("error creating blob %d: %s\n", i, err)
+		}
+	}
+
+	if err := service.Create(&ewserver.Blob{DeviceID: []byte("device2"), Name: "archive.tgz", Size: 1}); err != ewserver.ErrBlobQuota {
+		t.Fatalf("expected ErrBlobQuota past the device's bytes got: %v\n", err)
+	}
+
+	if err := service.Create(&ewserver.Blob{DeviceID: []byte("device3"), Name: "image.jpg", Size: 1}); err != nil {
+		t.Fatalf("expected other devices to have their own quota got: %v\n", err)
+	}
+}
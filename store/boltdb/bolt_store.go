@@ -1,13 +1,24 @@
 package boltdb
 
 import (
+	"io/ioutil"
+	"os"
+	"time"
+
 	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
 	"github.com/wirepair/ewserver/store"
 )
 
+const (
+	compactMarkerSuffix = ".compact"    // file next to the database requesting compaction on the next Open
+	compactTempSuffix   = ".compacting" // the compacted copy while it is being written
+)
+
 // BoltStore for saving data to a Bolt DB file.
 type BoltStore struct {
-	db *bolt.DB
+	db         *bolt.DB
+	compaction *ewserver.Compaction
 }
 
 // NewBoltStore for saving data to a bolt DB
@@ -16,11 +27,18 @@ func NewBoltStore() *BoltStore {
 	return b
 }
 
-// Open the database file for writing
+// Open the database file for writing, compacting it first if a compaction was scheduled.
 func (b *BoltStore) Open(config *store.Config) error {
 	var err error
 
-	b.db, err = bolt.Open(config.Options["database"], 0600, nil)
+	path := config.Options["database"]
+	if _, err := os.Stat(path + compactMarkerSuffix); err == nil {
+		if err := b.compact(path); err != nil {
+			return err
+		}
+	}
+
+	b.db, err = bolt.Open(path, 0600, nil)
 	return err
 }
 
@@ -36,3 +54,113 @@ func (b *BoltStore) Close() error {
 	}
 	return b.db.Close()
 }
+
+// Stats returns the size of the database file, how much of it is free and the number of keys in each bucket.
+func (b *BoltStore) Stats() (*ewserver.StorageStats, error) {
+	stats := &ewserver.StorageStats{Path: b.db.Path(), Buckets: make(map[string]int), LastCompaction: b.compaction}
+
+	info, err := os.Stat(stats.Path)
+	if err != nil {
+		return nil, err
+	}
+	stats.FileSize = info.Size()
+
+	if _, err := os.Stat(stats.Path + compactMarkerSuffix); err == nil {
+		stats.CompactionPending = true
+	}
+
+	dbStats := b.db.Stats()
+	stats.FreeSize = int64(dbStats.FreePageN+dbStats.PendingPageN) * int64(b.db.Info().PageSize)
+
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			stats.Buckets[string(name)] = bucket.Stats().KeyN
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// ScheduleCompaction schedules the database file to be rewritten the next time it is opened. Bolt never
+// shrinks its file and the services hold the open database, so the copy can only be swapped in at startup.
+func (b *BoltStore) ScheduleCompaction() error {
+	return ioutil.WriteFile(b.db.Path()+compactMarkerSuffix, []byte(time.Now().UTC().Format(time.RFC3339)), 0600)
+}
+
+// compact copies every bucket of the database at path into a new file and replaces it, dropping free pages.
+func (b *BoltStore) compact(path string) error {
+	before, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tempPath := path + compactTempSuffix
+	os.Remove(tempPath)
+
+	if err := copyDB(path, tempPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	after, err := os.Stat(tempPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+
+	b.compaction = &ewserver.Compaction{Time: time.Now().UTC(), SizeBefore: before.Size(), SizeAfter: after.Size()}
+	return os.Remove(path + compactMarkerSuffix)
+}
+
+// copyDB writes each top level bucket of the source database to the destination in its own transaction.
+func copyDB(sourcePath, destinationPath string) error {
+	source, err := bolt.Open(sourcePath, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := bolt.Open(destinationPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	err = source.View(func(sourceTx *bolt.Tx) error {
+		return sourceTx.ForEach(func(name []byte, sourceBucket *bolt.Bucket) error {
+			return destination.Update(func(tx *bolt.Tx) error {
+				bucket, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(bucket, sourceBucket)
+			})
+		})
+	})
+
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyBucket recursively copies the keys, nested buckets and sequence of source into destination.
+func copyBucket(destination, source *bolt.Bucket) error {
+	if err := destination.SetSequence(source.Sequence()); err != nil {
+		return err
+	}
+
+	return source.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return destination.Put(k, v)
+		}
+
+		nested, err := destination.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, source.Bucket(k))
+	})
+}
@@ -1,10 +1,14 @@
 package boltdb_test
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/wirepair/ewserver/ewserver"
 	"github.com/wirepair/ewserver/store"
 	"github.com/wirepair/ewserver/store/boltdb"
 )
@@ -19,6 +23,71 @@ func TestBoltStore_Open(t *testing.T) {
 	testCloseDb(db, t)
 }
 
+func TestBoltStore_Compact(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	telemetry := boltdb.NewTelemetryService(db.DB())
+	if err := telemetry.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+
+	value := json.RawMessage(`"` + strings.Repeat("a", 1024) + `"`)
+	for i := 0; i < 1000; i++ {
+		point := &ewserver.DataPoint{Timestamp: time.Unix(int64(i), 0), Value: value}
+		if err := telemetry.Publish(testDeviceID, "temperature", point); err != nil {
+			t.Fatalf("error publishing point: %s\n", err)
+		}
+	}
+
+	retention := boltdb.NewRetentionService(db.DB())
+	if err := retention.Init(); err != nil {
+		t.Fatalf("error initializing retention service: %s\n", err)
+	}
+
+	policy := ewserver.NewRetentionPolicy()
+	policy.Tiers = []ewserver.RetentionTier{{Keep: ewserver.Duration(time.Hour)}}
+	if err := retention.SetPolicy(policy); err != nil {
+		t.Fatalf("error setting policy: %s\n", err)
+	}
+
+	// leave a single point
+	if _, err := retention.Apply(time.Unix(999, 0).Add(time.Hour)); err != nil {
+		t.Fatalf("error applying retention: %s\n", err)
+	}
+
+	if err := db.ScheduleCompaction(); err != nil {
+		t.Fatalf("error scheduling compaction: %s\n", err)
+	}
+
+	before, err := db.Stats()
+	if err != nil || !before.CompactionPending || before.FreeSize == 0 {
+		t.Fatalf("expected a pending compaction and free space got: %v %v\n", before, err)
+	}
+	testCloseDb(db, t)
+
+	db = testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	after, err := db.Stats()
+	if err != nil || after.CompactionPending || after.LastCompaction == nil {
+		t.Fatalf("expected the compaction to run on open got: %v %v\n", after, err)
+	}
+
+	if after.FileSize >= before.FileSize || after.LastCompaction.SizeBefore != before.FileSize {
+		t.Fatalf("expected the file to shrink got: %d >= %d\n", after.FileSize, before.FileSize)
+	}
+
+	points, err := boltdb.NewTelemetryService(db.DB()).Points(testDeviceID, "temperature", time.Unix(0, 0), time.Time{})
+	if err != nil || len(points) != 1 {
+		t.Fatalf("expected the remaining point to be copied got: %d %v\n", len(points), err)
+	}
+}
+
 func testRemoveDbFile(dbFileName string, t *testing.T) {
 	if err := os.Remove(dbFileName); err != nil {
 		t.Fatalf("error removing file: %s\n", err)
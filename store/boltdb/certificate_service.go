@@ -0,0 +1,408 @@
+package boltdb
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	certificateBucket   = "certificates"          // device certificates keyed by serial number
+	certificateCABucket = "certificate_authority" // the CA certificate and key
+	certificateCAKey    = "key"
+	certificateCACert   = "certificate"
+
+	caValidity     = 20 * 365 * 24 * time.Hour
+	crlValidity    = 24 * time.Hour
+	serialSize     = 16
+	clockSkewGrace = time.Minute // certificates are valid from slightly before they are issued
+)
+
+// CertificateService implementation acting as the CA for device certificates. The ECDSA P-256 CA
+// is generated on first Init and kept in the database, devices are identified by a SPIFFE-style URI SAN.
+type CertificateService struct {
+	DB   *bolt.DB
+	ca   *x509.Certificate
+	key  crypto.Signer
+	name string
+}
+
+// NewCertificateService creates a new certificate service backed by an already open boltdb, the CA's
+// subject is named after host.
+func NewCertificateService(db *bolt.DB, host string) *CertificateService {
+	c := &CertificateService{DB: db, name: host}
+	return c
+}
+
+// Init the certificate buckets and load or generate the CA
+func (c *CertificateService) Init() error {
+	return c.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(certificateBucket)); err != nil {
+			return err
+		}
+
+		authority, err := tx.CreateBucketIfNotExists([]byte(certificateCABucket))
+		if err != nil {
+			return err
+		}
+
+		if der := authority.Get([]byte(certificateCAKey)); der != nil {
+			return c.loadCA(der, authority.Get([]byte(certificateCACert)))
+		}
+
+		keyDER, certDER, err := c.generateCA()
+		if err != nil {
+			return err
+		}
+
+		if err := authority.Put([]byte(certificateCAKey), keyDER); err != nil {
+			return err
+		}
+
+		if err := authority.Put([]byte(certificateCACert), certDER); err != nil {
+			return err
+		}
+		return c.loadCA(keyDER, certDER)
+	})
+}
+
+// CA returns the certificate devices' certificates are issued by
+func (c *CertificateService) CA() *x509.Certificate {
+	return c.ca
+}
+
+// Issue a certificate to the API user for the public key of the PEM encoded csr. If csr is empty a key is
+// generated and returned PEM encoded in the certificate's PrivateKey, it is not stored.
+func (c *CertificateService) Issue(apiUser *ewserver.APIUser, csr []byte, validity time.Duration, createdBy string) (*ewserver.DeviceCertificate, error) {
+	if apiUser == nil || len(apiUser.ID) == 0 {
+		return nil, ewserver.ErrUserNotFound
+	}
+
+	publicKey, privateKey, err := requestPublicKey(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := c.issue(apiUser.ID, apiUser.Name, publicKey, validity)
+	if err != nil {
+		return nil, err
+	}
+	certificate.CreatedBy, certificate.PrivateKey = createdBy, privateKey
+
+	return certificate, c.DB.Update(func(tx *bolt.Tx) error {
+		return putCertificate(tx.Bucket([]byte(certificateBucket)), certificate)
+	})
+}
+
+// Renew issues a new certificate for the same device and subject as the certificate with the serial, for
+// the key of the PEM encoded csr or the previous certificate's key if csr is empty. The previous certificate
+// stays valid until it expires or is revoked. Revoked certificates can not be renewed.
+func (c *CertificateService) Renew(serial string, csr []byte, validity time.Duration, createdBy string) (*ewserver.DeviceCertificate, error) {
+	previous, err := c.Certificate(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	if previous.Revoked {
+		return nil, ewserver.ErrCertRevoked
+	}
+
+	var publicKey crypto.PublicKey
+	if len(csr) == 0 {
+		cert, err := parseCertificatePEM(previous.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		publicKey = cert.PublicKey
+	} else if publicKey, _, err = requestPublicKey(csr); err != nil {
+		return nil, err
+	}
+
+	certificate, err := c.issue(previous.DeviceID, previous.Subject, publicKey, validity)
+	if err != nil {
+		return nil, err
+	}
+	certificate.CreatedBy, certificate.RenewedFrom = createdBy, previous.Serial
+
+	return certificate, c.DB.Update(func(tx *bolt.Tx) error {
+		return putCertificate(tx.Bucket([]byte(certificateBucket)), certificate)
+	})
+}
+
+// Revoke the certificate, revoking it again keeps the original revocation time.
+func (c *CertificateService) Revoke(serial string, at time.Time) (*ewserver.DeviceCertificate, error) {
+	var certificate *ewserver.DeviceCertificate
+
+	err := c.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certificateBucket))
+
+		var err error
+		if certificate, err = getCertificate(bucket, serial); err != nil {
+			return err
+		}
+
+		if certificate.Revoked {
+			return nil
+		}
+
+		certificate.Revoked, certificate.RevokedAt = true, at
+		return putCertificate(bucket, certificate)
+	})
+	return certificate, err
+}
+
+// Certificate returns a single certificate by its hex serial number
+func (c *CertificateService) Certificate(serial string) (*ewserver.DeviceCertificate, error) {
+	var certificate *ewserver.DeviceCertificate
+
+	err := c.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		certificate, err = getCertificate(tx.Bucket([]byte(certificateBucket)), serial)
+		return err
+	})
+	return certificate, err
+}
+
+// Certificates returns the certificates issued to the device, or to every device if deviceID is nil
+func (c *CertificateService) Certificates(deviceID []byte) ([]*ewserver.DeviceCertificate, error) {
+	certificates := make([]*ewserver.DeviceCertificate, 0)
+
+	err := c.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(certificateBucket)).ForEach(func(k, v []byte) error {
+			certificate, err := ewserver.DecodeDeviceCertificate(v)
+			if err != nil {
+				return err
+			}
+
+			if deviceID == nil || bytes.Equal(certificate.DeviceID, deviceID) {
+				certificates = append(certificates, certificate)
+			}
+			return nil
+		})
+	})
+	return certificates, err
+}
+
+// Revoked returns true if the certificate with the serial was revoked. Serials the CA never issued are
+// treated as revoked.
+func (c *CertificateService) Revoked(serial *big.Int) (bool, error) {
+	revoked := true
+
+	err := c.DB.View(func(tx *bolt.Tx) error {
+		certificate, err := getCertificate(tx.Bucket([]byte(certificateBucket)), hex.EncodeToString(serial.Bytes()))
+		if err == ewserver.ErrCertNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+		revoked = certificate.Revoked
+		return nil
+	})
+	return revoked, err
+}
+
+// CRL returns the DER encoded list of revoked certificates that have not expired, signed by the CA and
+// valid for a day.
+func (c *CertificateService) CRL(now time.Time) ([]byte, error) {
+	list := &x509.RevocationList{
+		Number:     big.NewInt(now.Unix()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(crlValidity),
+	}
+
+	err := c.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(certificateBucket)).ForEach(func(k, v []byte) error {
+			certificate, err := ewserver.DecodeDeviceCertificate(v)
+			if err != nil {
+				return err
+			}
+
+			if certificate.Revoked && certificate.NotAfter.After(now) {
+				list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{
+					SerialNumber:   new(big.Int).SetBytes(k),
+					RevocationTime: certificate.RevokedAt,
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return x509.CreateRevocationList(rand.Reader, list, c.ca, c.key)
+}
+
+// issue signs a client certificate for the device's public key, valid for at most as long as the CA.
+func (c *CertificateService) issue(deviceID []byte, subject string, publicKey crypto.PublicKey, validity time.Duration) (*ewserver.DeviceCertificate, error) {
+	if validity == 0 {
+		validity = ewserver.DefaultCertificateValidity
+	}
+
+	if validity < 0 {
+		return nil, ewserver.ErrInvalidCSR
+	}
+
+	serial, err := ewserver.GenerateRandomBytes(serialSize)
+	if err != nil {
+		return nil, err
+	}
+	serial[0] &= 0x7f // serials must be positive
+
+	now := time.Now().UTC()
+	notAfter := now.Add(validity)
+	if notAfter.After(c.ca.NotAfter) {
+		notAfter = c.ca.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(serial),
+		Subject:      pkix.Name{CommonName: subject},
+		URIs:         []*url.URL{ewserver.DeviceIdentity(deviceID)},
+		NotBefore:    now.Add(-clockSkewGrace),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.ca, publicKey, c.key)
+	if err != nil {
+		return nil, ewserver.ErrInvalidCSR
+	}
+
+	return &ewserver.DeviceCertificate{
+		Serial:      hex.EncodeToString(template.SerialNumber.Bytes()),
+		DeviceID:    deviceID,
+		Subject:     subject,
+		NotBefore:   template.NotBefore,
+		NotAfter:    template.NotAfter,
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+// generateCA creates the CA's key and self signed certificate, returning them DER encoded
+func (c *CertificateService) generateCA() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := ewserver.GenerateRandomBytes(serialSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes(serial),
+		Subject:               pkix.Name{CommonName: c.name + " device CA"},
+		NotBefore:             now.Add(-clockSkewGrace),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	return keyDER, certDER, err
+}
+
+// loadCA parses the CA's DER encoded key and certificate
+func (c *CertificateService) loadCA(keyDER, certDER []byte) error {
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return err
+	}
+
+	ca, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return err
+	}
+
+	c.key, c.ca = key.(crypto.Signer), ca
+	return nil
+}
+
+// requestPublicKey returns the public key of the PEM encoded csr after checking its signature, or generates
+// an ECDSA P-256 key returning its private key PEM encoded if csr is empty.
+func requestPublicKey(csr []byte) (crypto.PublicKey, []byte, error) {
+	if len(csr) == 0 {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key.Public(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+	}
+
+	block, _ := pem.Decode(csr)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, nil, ewserver.ErrInvalidCSR
+	}
+
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || request.CheckSignature() != nil {
+		return nil, nil, ewserver.ErrInvalidCSR
+	}
+	return request.PublicKey, nil, nil
+}
+
+// parseCertificatePEM parses a stored PEM encoded certificate
+func parseCertificatePEM(certificate []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certificate)
+	if block == nil {
+		return nil, ewserver.ErrCertNotFound
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// getCertificate reads and decodes the certificate with the hex serial
+func getCertificate(bucket *bolt.Bucket, serial string) (*ewserver.DeviceCertificate, error) {
+	key, err := hex.DecodeString(serial)
+	if err != nil {
+		return nil, ewserver.ErrCertNotFound
+	}
+
+	certificateBytes := bucket.Get(key)
+	if certificateBytes == nil {
+		return nil, ewserver.ErrCertNotFound
+	}
+	return ewserver.DecodeDeviceCertificate(certificateBytes)
+}
+
+// putCertificate encodes and stores the certificate keyed by its serial
+func putCertificate(bucket *bolt.Bucket, certificate *ewserver.DeviceCertificate) error {
+	key, err := hex.DecodeString(certificate.Serial)
+	if err != nil {
+		return err
+	}
+
+	certificateBytes, err := certificate.Encode()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, certificateBytes)
+}
@@ -0,0 +1,145 @@
+package boltdb_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestCertificateService_Issue(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewCertificateService(db.DB(), "localhost")
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing certificate service: %s\n", err)
+	}
+
+	// the CA is generated once and loaded afterwards
+	reloaded := boltdb.NewCertificateService(db.DB(), "localhost")
+	if err := reloaded.Init(); err != nil || !bytes.Equal(reloaded.CA().Raw, service.CA().Raw) {
+		t.Fatalf("expected the CA to be loaded on the next Init got: %v\n", err)
+	}
+
+	apiUser := &ewserver.APIUser{Name: "device1", ID: []byte("device1 id")}
+	generated, err := service.Issue(apiUser, nil, time.Hour, "root")
+	if err != nil || len(generated.PrivateKey) == 0 {
+		t.Fatalf("expected a certificate with a generated key got: %v %#v\n", err, generated)
+	}
+
+	cert := testParseCertificate(generated.Certificate, t)
+	roots := x509.NewCertPool()
+	roots.AddCert(service.CA())
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatalf("expected the certificate to verify with the CA got: %s\n", err)
+	}
+
+	if deviceID, ok := ewserver.CertificateDeviceID(cert); !ok || !bytes.Equal(deviceID, apiUser.ID) || cert.Subject.CommonName != apiUser.Name {
+		t.Fatalf("expected the certificate to identify the device got: %s %v %s\n", deviceID, ok, cert.Subject.CommonName)
+	}
+
+	if stored, err := service.Certificate(generated.Serial); err != nil || len(stored.PrivateKey) != 0 {
+		t.Fatalf("expected the private key not to be stored got: %v\n", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrDER, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	requested, err := service.Issue(apiUser, csr, 0, "root")
+	if err != nil || len(requested.PrivateKey) != 0 || !testParseCertificate(requested.Certificate, t).PublicKey.(*ecdsa.PublicKey).Equal(key.Public()) {
+		t.Fatalf("expected a certificate for the CSR's key got: %v\n", err)
+	}
+
+	if _, err := service.Issue(apiUser, []byte("not a csr"), 0, "root"); err != ewserver.ErrInvalidCSR {
+		t.Fatalf("expected ErrInvalidCSR got: %v\n", err)
+	}
+
+	renewed, err := service.Renew(requested.Serial, nil, time.Hour, "device1")
+	if err != nil || renewed.RenewedFrom != requested.Serial || !testParseCertificate(renewed.Certificate, t).PublicKey.(*ecdsa.PublicKey).Equal(key.Public()) {
+		t.Fatalf("expected the renewed certificate to keep the key got: %v %#v\n", err, renewed)
+	}
+
+	if certificates, err := service.Certificates(apiUser.ID); err != nil || len(certificates) != 3 {
+		t.Fatalf("expected 3 certificates for the device got: %d %v\n", len(certificates), err)
+	}
+}
+
+func TestCertificateService_Revoke(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewCertificateService(db.DB(), "localhost")
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing certificate service: %s\n", err)
+	}
+
+	certificate, err := service.Issue(&ewserver.APIUser{Name: "device1", ID: []byte("device1 id")}, nil, time.Hour, "root")
+	if err != nil {
+		t.Fatalf("error issuing certificate: %s\n", err)
+	}
+	serial := testParseCertificate(certificate.Certificate, t).SerialNumber
+
+	if revoked, err := service.Revoked(serial); err != nil || revoked {
+		t.Fatalf("expected the certificate not to be revoked got: %v %v\n", revoked, err)
+	}
+
+	now := time.Now().UTC()
+	if _, err := service.Revoke(certificate.Serial, now); err != nil {
+		t.Fatalf("error revoking certificate: %s\n", err)
+	}
+
+	if revoked, err := service.Revoked(serial); err != nil || !revoked {
+		t.Fatalf("expected the certificate to be revoked got: %v %v\n", revoked, err)
+	}
+
+	if _, err := service.Renew(certificate.Serial, nil, 0, "root"); err != ewserver.ErrCertRevoked {
+		t.Fatalf("expected a revoked certificate not to be renewed got: %v\n", err)
+	}
+
+	crlDER, err := service.CRL(now)
+	if err != nil {
+		t.Fatalf("error creating CRL: %s\n", err)
+	}
+
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil || crl.CheckSignatureFrom(service.CA()) != nil || len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(serial) != 0 {
+		t.Fatalf("expected a signed CRL listing the certificate got: %v\n", err)
+	}
+
+	if _, err := service.Revoke("00", now); err != ewserver.ErrCertNotFound {
+		t.Fatalf("expected ErrCertNotFound revoking an unknown serial got: %v\n", err)
+	}
+}
+
+func testParseCertificate(certificate []byte, t *testing.T) *x509.Certificate {
+	block, _ := pem.Decode(certificate)
+	if block == nil {
+		t.Fatalf("expected a PEM encoded certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s\n", err)
+	}
+	return cert
+}
@@ -0,0 +1,404 @@
+package boltdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	commandBucket      = "commands"      // bucket holding a nested bucket per device of commands keyed by their big endian ID
+	commandIndexBucket = "command_index" // bucket holding a nested bucket per device of its unfinished commands' state and expiry
+	systemActor        = "system"        // actor recorded in the history of changes made by the server itself
+)
+
+// CommandService implementation that queues commands per device. IDs come from the device
+// bucket's sequence so cursors iterate a device's commands in the order they were queued.
+// Unfinished commands are also indexed per device so delivering and expiring them does not
+// decode the device's whole history.
+type CommandService struct {
+	DB *bolt.DB
+}
+
+// NewCommandService creates a new command service backed by an already open boltdb
+func NewCommandService(db *bolt.DB) *CommandService {
+	c := &CommandService{DB: db}
+	return c
+}
+
+// Init the commands buckets, indexing the unfinished commands of databases created before the index
+func (s *CommandService) Init() error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		commands, err := tx.CreateBucketIfNotExists([]byte(commandBucket))
+		if err != nil {
+			return err
+		}
+
+		if tx.Bucket([]byte(commandIndexBucket)) != nil {
+			return nil
+		}
+
+		if _, err := tx.CreateBucket([]byte(commandIndexBucket)); err != nil {
+			return err
+		}
+
+		return commands.ForEach(func(k, v []byte) error {
+			device := commands.Bucket(k)
+			if device == nil {
+				return nil
+			}
+
+			return device.ForEach(func(k, v []byte) error {
+				command, err := ewserver.DecodeCommand(v)
+				if err != nil {
+					return err
+				}
+				return indexCommand(tx, command)
+			})
+		})
+	})
+}
+
+// Enqueue a pending command for the command's device which expires after ttl, DefaultCommandTTL if 0.
+func (s *CommandService) Enqueue(command *ewserver.Command, ttl time.Duration) error {
+	if len(command.DeviceID) == 0 {
+		return ewserver.ErrUserNotFound
+	}
+
+	if err := command.Valid(); err != nil {
+		return err
+	}
+
+	if ttl == 0 {
+		ttl = ewserver.DefaultCommandTTL
+	}
+
+	if ttl < 0 || ttl > ewserver.MaxCommandTTL {
+		return ewserver.ErrInvalidCommand
+	}
+
+	now := time.Now().UTC()
+	command.State = ""
+	command.History = nil
+	command.Result = nil
+	command.CreatedAt = now
+	command.ExpiresAt = now.Add(ttl)
+	command.Transition(ewserver.CommandPending, command.CreatedBy, "", now)
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		device, err := tx.Bucket([]byte(commandBucket)).CreateBucketIfNotExists(command.DeviceID)
+		if err != nil {
+			return err
+		}
+
+		if command.ID, err = device.NextSequence(); err != nil {
+			return err
+		}
+		return putCommand(tx, command)
+	})
+}
+
+// Command returns a single command of the device
+func (s *CommandService) Command(deviceID []byte, id uint64) (*ewserver.Command, error) {
+	var command *ewserver.Command
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		command, err = getCommand(tx.Bucket([]byte(commandBucket)).Bucket(deviceID), id)
+		return err
+	})
+	return command, err
+}
+
+// Commands returns all of the device's commands in the order they were queued
+func (s *CommandService) Commands(deviceID []byte) ([]*ewserver.Command, error) {
+	commands := make([]*ewserver.Command, 0)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		device := tx.Bucket([]byte(commandBucket)).Bucket(deviceID)
+		if device == nil {
+			return nil
+		}
+
+		return device.ForEach(func(k, v []byte) error {
+			command, err := ewserver.DecodeCommand(v)
+			if err != nil {
+				return err
+			}
+			commands = append(commands, command)
+			return nil
+		})
+	})
+	return commands, err
+}
+
+// Deliver marks the device's pending commands as delivered and returns them oldest first,
+// commands whose TTL passed are expired instead. The actor is recorded in their history.
+func (s *CommandService) Deliver(deviceID []byte, actor string) ([]*ewserver.Command, error) {
+	commands := make([]*ewserver.Command, 0)
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		now := time.Now().UTC()
+		return updateIndexed(tx, deviceID, func(state ewserver.CommandState, expiresAt time.Time) bool {
+			return state == ewserver.CommandPending
+		}, func(command *ewserver.Command) {
+			if command.Expired(now) {
+				command.Transition(ewserver.CommandExpired, systemActor, "", now)
+				return
+			}
+
+			command.Transition(ewserver.CommandDelivered, actor, "", now)
+			commands = append(commands, command)
+		})
+	})
+	return commands, err
+}
+
+// Ack records the result the device reported for the command, state must be CommandSucceeded or
+// CommandFailed. Returns ErrCommandState if the command was not delivered, already finished or expired.
+func (s *CommandService) Ack(deviceID []byte, id uint64, state ewserver.CommandState, result json.RawMessage, actor string) (*ewserver.Command, error) {
+	if state != ewserver.CommandSucceeded && state != ewserver.CommandFailed {
+		return nil, ewserver.ErrCommandState
+	}
+
+	if len(result) > 0 && !json.Valid(result) {
+		return nil, ewserver.ErrInvalidCommand
+	}
+
+	var command *ewserver.Command
+	var expired bool
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+
+		if command, err = getCommand(tx.Bucket([]byte(commandBucket)).Bucket(deviceID), id); err != nil {
+			return err
+		}
+
+		// an ack that arrives too late expires the command, returning an error here would roll that back
+		now := time.Now().UTC()
+		if expired = command.Expired(now); expired {
+			command.Transition(ewserver.CommandExpired, systemActor, "", now)
+			return putCommand(tx, command)
+		}
+
+		// only a command the device fetched can have been run by it
+		if command.State != ewserver.CommandDelivered {
+			return ewserver.ErrCommandState
+		}
+
+		if err := command.Transition(state, actor, "", now); err != nil {
+			return err
+		}
+		command.Result = result
+		return putCommand(tx, command)
+	})
+
+	if err == nil && expired {
+		err = ewserver.ErrCommandState
+	}
+	return command, err
+}
+
+// Expire marks every command whose TTL has passed as expired and returns how many were.
+func (s *CommandService) Expire() (int, error) {
+	expired := 0
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		now := time.Now().UTC()
+
+		deviceIDs := make([][]byte, 0)
+		if err := tx.Bucket([]byte(commandIndexBucket)).ForEach(func(k, v []byte) error {
+			deviceIDs = append(deviceIDs, k)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, deviceID := range deviceIDs {
+			err := updateIndexed(tx, deviceID, func(state ewserver.CommandState, expiresAt time.Time) bool {
+				return !expiresAt.IsZero() && now.After(expiresAt)
+			}, func(command *ewserver.Command) {
+				command.Transition(ewserver.CommandExpired, systemActor, "", now)
+				expired++
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// Prune deletes the finished commands queued before the time and returns how many were. Commands are
+// stored in the order they were queued so each device's commands are only read up to the first newer one.
+func (s *CommandService) Prune(before time.Time) (int, error) {
+	pruned := 0
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		commands := tx.Bucket([]byte(commandBucket))
+		return commands.ForEach(func(k, v []byte) error {
+			device := commands.Bucket(k)
+			if device == nil {
+				return nil
+			}
+
+			finished := make([][]byte, 0)
+			cursor := device.Cursor()
+			for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+				command, err := ewserver.DecodeCommand(v)
+				if err != nil {
+					return err
+				}
+
+				if !command.CreatedAt.Before(before) {
+					break
+				}
+
+				if command.State.Final() {
+					finished = append(finished, k)
+				}
+			}
+
+			// the device bucket is kept so its sequence, and so command IDs, are never reused
+			for _, k := range finished {
+				if err := device.Delete(k); err != nil {
+					return err
+				}
+			}
+			pruned += len(finished)
+			return nil
+		})
+	})
+	return pruned, err
+}
+
+// Delete removes all of the device's commands and its index. Unlike Prune the device bucket is deleted
+// too, a deleted device's ID is not reused so neither are its command IDs.
+func (s *CommandService) Delete(deviceID []byte) error {
+	if len(deviceID) == 0 {
+		return ewserver.ErrUserNotFound
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(commandBucket)).DeleteBucket(deviceID); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		if err := tx.Bucket([]byte(commandIndexBucket)).DeleteBucket(deviceID); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// updateIndexed calls update for each of the device's unfinished commands whose indexed state and expiry
+// match, storing them after.
+func updateIndexed(tx *bolt.Tx, deviceID []byte, match func(state ewserver.CommandState, expiresAt time.Time) bool, update func(command *ewserver.Command)) error {
+	index := tx.Bucket([]byte(commandIndexBucket)).Bucket(deviceID)
+	if index == nil {
+		return nil
+	}
+
+	// bolt does not allow modifying a bucket while iterating it
+	ids := make([]uint64, 0)
+	err := index.ForEach(func(k, v []byte) error {
+		state, expiresAt := decodeCommandIndex(v)
+		if match(state, expiresAt) {
+			ids = append(ids, binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	device := tx.Bucket([]byte(commandBucket)).Bucket(deviceID)
+	for _, id := range ids {
+		command, err := getCommand(device, id)
+		if err != nil {
+			return err
+		}
+
+		update(command)
+		if err := putCommand(tx, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getCommand decodes the command from the device bucket, returning ErrCommandNotFound if either does not exist.
+func getCommand(device *bolt.Bucket, id uint64) (*ewserver.Command, error) {
+	if device == nil {
+		return nil, ewserver.ErrCommandNotFound
+	}
+
+	commandBytes := device.Get(sequenceKey(id))
+	if commandBytes == nil {
+		return nil, ewserver.ErrCommandNotFound
+	}
+	return ewserver.DecodeCommand(commandBytes)
+}
+
+// putCommand stores the command in its device's bucket and updates the index of unfinished commands.
+func putCommand(tx *bolt.Tx, command *ewserver.Command) error {
+	commandBytes, err := command.Encode()
+	if err != nil {
+		return err
+	}
+
+	device := tx.Bucket([]byte(commandBucket)).Bucket(command.DeviceID)
+	if device == nil {
+		return ewserver.ErrCommandNotFound
+	}
+
+	if err := device.Put(sequenceKey(command.ID), commandBytes); err != nil {
+		return err
+	}
+	return indexCommand(tx, command)
+}
+
+// indexCommand adds an unfinished command with its state and expiry to its device's index, or removes a finished one.
+func indexCommand(tx *bolt.Tx, command *ewserver.Command) error {
+	if command.State.Final() {
+		index := tx.Bucket([]byte(commandIndexBucket)).Bucket(command.DeviceID)
+		if index == nil {
+			return nil
+		}
+		return index.Delete(sequenceKey(command.ID))
+	}
+
+	index, err := tx.Bucket([]byte(commandIndexBucket)).CreateBucketIfNotExists(command.DeviceID)
+	if err != nil {
+		return err
+	}
+
+	value := make([]byte, 8, 8+len(command.State))
+	if !command.ExpiresAt.IsZero() {
+		binary.BigEndian.PutUint64(value, uint64(command.ExpiresAt.UnixNano()))
+	}
+	return index.Put(sequenceKey(command.ID), append(value, command.State...))
+}
+
+// decodeCommandIndex returns the state and expiry of an index entry, the expiry is zero if the command has none.
+func decodeCommandIndex(value []byte) (ewserver.CommandState, time.Time) {
+	var expiresAt time.Time
+	if nanos := binary.BigEndian.Uint64(value[:8]); nanos != 0 {
+		expiresAt = time.Unix(0, int64(nanos)).UTC()
+	}
+	return ewserver.CommandState(value[8:]), expiresAt
+}
+
+// sequenceKey encodes a bucket sequence ID big endian so keys sort in the order they were created.
+func sequenceKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
@@ -0,0 +1,299 @@
+package boltdb_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestCommandService_Enqueue(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewCommandService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing command service: %s\n", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		command := testCommand("reboot")
+		if err := service.Enqueue(command, 0); err != nil {
+			t.Fatalf("error enqueuing command: %s\n", err)
+		}
+
+		if command.ID != uint64(i+1) || command.State != ewserver.CommandPending || len(command.History) != 1 {
+			t.Fatalf("expected pending command %d got: %d %s\n", i+1, command.ID, command.State)
+		}
+
+		if !command.ExpiresAt.Equal(command.CreatedAt.Add(ewserver.DefaultCommandTTL)) {
+			t.Fatalf("expected default ttl to be used")
+		}
+	}
+
+	if err := service.Enqueue(testCommand("bad name"), 0); err != ewserver.ErrInvalidCommand {
+		t.Fatalf("expected invalid command error got: %v\n", err)
+	}
+
+	command := testCommand("set_interval")
+	command.Args = json.RawMessage(`{"seconds": `)
+	if err := service.Enqueue(command, 0); err != ewserver.ErrInvalidCommand {
+		t.Fatalf("expected invalid command error for bad args got: %v\n", err)
+	}
+
+	if err := service.Enqueue(testCommand("reboot"), ewserver.MaxCommandTTL+time.Second); err != ewserver.ErrInvalidCommand {
+		t.Fatalf("expected invalid command error for long ttl got: %v\n", err)
+	}
+
+	commands, err := service.Commands(testDeviceID)
+	if err != nil {
+		t.Fatalf("error listing commands: %s\n", err)
+	}
+
+	if len(commands) != 3 {
+		t.Fatalf("expected 3 commands got: %d\n", len(commands))
+	}
+}
+
+func TestCommandService_DeliverAck(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewCommandService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing command service: %s\n", err)
+	}
+
+	command := testCommand("toggle_relay")
+	command.Args = json.RawMessage(`{"relay": 1}`)
+	if err := service.Enqueue(command, 0); err != nil {
+		t.Fatalf("error enqueuing command: %s\n", err)
+	}
+
+	if _, err := service.Ack(testDeviceID, command.ID, ewserver.CommandSucceeded, nil, "device1"); err != ewserver.ErrCommandState {
+		t.Fatalf("expected command state error for ack before delivery got: %v\n", err)
+	}
+
+	delivered, err := service.Deliver(testDeviceID, "device1")
+	if err != nil {
+		t.Fatalf("error delivering commands: %s\n", err)
+	}
+
+	if len(delivered) != 1 || delivered[0].State != ewserver.CommandDelivered || string(delivered[0].Args) != `{"relay": 1}` {
+		t.Fatalf("expected the command to be delivered got: %#v\n", delivered)
+	}
+
+	if delivered, _ = service.Deliver(testDeviceID, "device1"); len(delivered) != 0 {
+		t.Fatalf("expected delivered commands not to be delivered again")
+	}
+
+	if _, err := service.Ack(testDeviceID, command.ID, ewserver.CommandPending, nil, "device1"); err != ewserver.ErrCommandState {
+		t.Fatalf("expected command state error for ack with pending got: %v\n", err)
+	}
+
+	acked, err := service.Ack(testDeviceID, command.ID, ewserver.CommandSucceeded, json.RawMessage(`{"relay": "on"}`), "device1")
+	if err != nil {
+		t.Fatalf("error acking command: %s\n", err)
+	}
+
+	if acked.State != ewserver.CommandSucceeded || string(acked.Result) != `{"relay": "on"}` {
+		t.Fatalf("expected succeeded command with result got: %s %s\n", acked.State, acked.Result)
+	}
+
+	if _, err := service.Ack(testDeviceID, command.ID, ewserver.CommandFailed, nil, "device1"); err != ewserver.ErrCommandState {
+		t.Fatalf("expected command state error for second ack got: %v\n", err)
+	}
+
+	if _, err := service.Ack(testDeviceID, 100, ewserver.CommandFailed, nil, "device1"); err != ewserver.ErrCommandNotFound {
+		t.Fatalf("expected command not found error got: %v\n", err)
+	}
+
+	stored, err := service.Command(testDeviceID, command.ID)
+	if err != nil {
+		t.Fatalf("error getting command: %s\n", err)
+	}
+
+	states := []ewserver.CommandState{ewserver.CommandPending, ewserver.CommandDelivered, ewserver.CommandSucceeded}
+	if len(stored.History) != len(states) {
+		t.Fatalf("expected %d history entries got: %d\n", len(states), len(stored.History))
+	}
+
+	for i, state := range states {
+		if stored.History[i].State != state {
+			t.Fatalf("expected history %d to be %s got: %s\n", i, state, stored.History[i].State)
+		}
+	}
+
+	if stored.History[0].Actor != "admin" || stored.History[2].Actor != "device1" {
+		t.Fatalf("expected history actors admin and device1 got: %s %s\n", stored.History[0].Actor, stored.History[2].Actor)
+	}
+}
+
+func TestCommandService_Expire(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewCommandService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing command service: %s\n", err)
+	}
+
+	short := testCommand("reboot")
+	if err := service.Enqueue(short, time.Millisecond); err != nil {
+		t.Fatalf("error enqueuing command: %s\n", err)
+	}
+
+	long := testCommand("reboot")
+	if err := service.Enqueue(long, time.Hour); err != nil {
+		t.Fatalf("error enqueuing command: %s\n", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	expired, err := service.Expire()
+	if err != nil {
+		t.Fatalf("error expiring commands: %s\n", err)
+	}
+
+	if expired != 1 {
+		t.Fatalf("expected 1 command to expire got: %d\n", expired)
+	}
+
+	if _, err := service.Ack(testDeviceID, short.ID, ewserver.CommandSucceeded, nil, "device1"); err != ewserver.ErrCommandState {
+		t.Fatalf("expected command state error acking expired command got: %v\n", err)
+	}
+
+	delivered, err := service.Deliver(testDeviceID, "device1")
+	if err != nil {
+		t.Fatalf("error delivering commands: %s\n", err)
+	}
+
+	if len(delivered) != 1 || delivered[0].ID != long.ID {
+		t.Fatalf("expected only the unexpired command to be delivered got: %d\n", len(delivered))
+	}
+}
+
+func TestCommandService_Prune(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewCommandService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing command service: %s\n", err)
+	}
+
+	finished := testCommand("reboot")
+	if err := service.Enqueue(finished, 0); err != nil {
+		t.Fatalf("error enqueuing command: %s\n", err)
+	}
+
+	if _, err := service.Deliver(testDeviceID, "device1"); err != nil {
+		t.Fatalf("error delivering commands: %s\n", err)
+	}
+
+	if _, err := service.Ack(testDeviceID, finished.ID, ewserver.CommandSucceeded, nil, "device1"); err != nil {
+		t.Fatalf("error acking command: %s\n", err)
+	}
+
+	pending := testCommand("reboot")
+	if err := service.Enqueue(pending, 0); err != nil {
+		t.Fatalf("error enqueuing command: %s\n", err)
+	}
+
+	if pruned, err := service.Prune(finished.CreatedAt); err != nil || pruned != 0 {
+		t.Fatalf("expected nothing queued before the time to be pruned got: %d %v\n", pruned, err)
+	}
+
+	if pruned, err := service.Prune(time.Now().Add(time.Second)); err != nil || pruned != 1 {
+		t.Fatalf("expected only the finished command to be pruned got: %d %v\n", pruned, err)
+	}
+
+	if _, err := service.Command(testDeviceID, finished.ID); err != ewserver.ErrCommandNotFound {
+		t.Fatalf("expected the pruned command to be deleted got: %v\n", err)
+	}
+
+	next := testCommand("reboot")
+	if err := service.Enqueue(next, 0); err != nil || next.ID != pending.ID+1 {
+		t.Fatalf("expected command IDs not to be reused got: %d %v\n", next.ID, err)
+	}
+
+	if delivered, _ := service.Deliver(testDeviceID, "device1"); len(delivered) != 2 {
+		t.Fatalf("expected the unfinished commands to still be delivered got: %d\n", len(delivered))
+	}
+}
+
+func TestCommandService_Delete(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewCommandService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing command service: %s\n", err)
+	}
+
+	if err := service.Delete(testDeviceID); err != nil {
+		t.Fatalf("expected deleting a device without commands to succeed got: %v\n", err)
+	}
+
+	pending := testCommand("reboot")
+	if err := service.Enqueue(pending, time.Millisecond); err != nil {
+		t.Fatalf("error enqueuing command: %s\n", err)
+	}
+
+	if err := service.Delete(testDeviceID); err != nil {
+		t.Fatalf("error deleting commands: %s\n", err)
+	}
+
+	if commands, err := service.Commands(testDeviceID); err != nil || len(commands) != 0 {
+		t.Fatalf("expected no commands after delete got: %d %v\n", len(commands), err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if expired, err := service.Expire(); err != nil || expired != 0 {
+		t.Fatalf("expected the deleted command not to be indexed got: %d %v\n", expired, err)
+	}
+
+	if err := service.Delete(nil); err != ewserver.ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound without a device got: %v\n", err)
+	}
+}
+
+func testCommand(name string) *ewserver.Command {
+	command := ewserver.NewCommand()
+	command.DeviceID = testDeviceID
+	command.Name = name
+	command.CreatedBy = "admin"
+	return command
+}
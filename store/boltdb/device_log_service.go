@@ -0,0 +1,198 @@
+package boltdb
+
+import (
+	"container/heap"
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	deviceLogBucket  = "device_logs" // bucket holding a nested bucket per device of log entries keyed by sequence
+	maxDeviceLogScan = 100000        // entries a search looks at before it returns what it found
+)
+
+// DeviceLogService implementation keeping the latest MaxEntries log entries of each device in a nested
+// bucket keyed by sequence, so appending drops the oldest entries from the front of the bucket.
+type DeviceLogService struct {
+	DB         *bolt.DB
+	MaxEntries int
+}
+
+// NewDeviceLogService creates a new device log service backed by an already open boltdb, keeping
+// maxEntries per device or ewserver.DefaultDeviceLogEntries if it is not positive.
+func NewDeviceLogService(db *bolt.DB, maxEntries int) *DeviceLogService {
+	if maxEntries <= 0 {
+		maxEntries = ewserver.DefaultDeviceLogEntries
+	}
+	l := &DeviceLogService{DB: db, MaxEntries: maxEntries}
+	return l
+}
+
+// Init the device log bucket
+func (l *DeviceLogService) Init() error {
+	return l.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(deviceLogBucket))
+		return err
+	})
+}
+
+// Append stores the entries in order, assigning their device ID and sequence, then drops the device's
+// entries beyond MaxEntries oldest first. The entries must be normalized.
+func (l *DeviceLogService) Append(deviceID []byte, entries []*ewserver.DeviceLog) error {
+	if len(deviceID) == 0 {
+		return ewserver.ErrUserNotFound
+	}
+
+	for _, entry := range entries {
+		if !entry.Severity.Valid() || entry.Message == "" {
+			return ewserver.ErrInvalidDeviceLog
+		}
+	}
+
+	return l.DB.Update(func(tx *bolt.Tx) error {
+		device, err := tx.Bucket([]byte(deviceLogBucket)).CreateBucketIfNotExists(deviceID)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.Sequence, err = device.NextSequence(); err != nil {
+				return err
+			}
+			entry.DeviceID = deviceID
+
+			entryBytes, err := entry.Encode()
+			if err != nil {
+				return err
+			}
+
+			if err := device.Put(sequenceKey(entry.Sequence), entryBytes); err != nil {
+				return err
+			}
+		}
+
+		return l.trim(device)
+	})
+}
+
+// trim deletes the entries with a sequence more than MaxEntries before the latest
+func (l *DeviceLogService) trim(device *bolt.Bucket) error {
+	latest := device.Sequence()
+	if latest <= uint64(l.MaxEntries) {
+		return nil
+	}
+	oldest := latest - uint64(l.MaxEntries)
+
+	c := device.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= oldest; {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		// deleting moves the cursor to the next key
+		k, _ = c.Seek(k)
+	}
+	return nil
+}
+
+// Search returns up to the query's limit of matching entries, newest received first. Entries of all devices
+// are merged by when they were received, so only the entries newer than the last match are decoded. At most
+// maxDeviceLogScan entries are looked at so searches for rare entries stay cheap.
+func (l *DeviceLogService) Search(query *ewserver.DeviceLogQuery) ([]*ewserver.DeviceLog, error) {
+	if err := query.Valid(); err != nil {
+		return nil, err
+	}
+
+	found := make([]*ewserver.DeviceLog, 0)
+	err := l.DB.View(func(tx *bolt.Tx) error {
+		logs := tx.Bucket([]byte(deviceLogBucket))
+		newest := make(deviceLogCursors, 0)
+		add := func(device *bolt.Bucket) error {
+			cursor := &deviceLogCursor{cursor: device.Cursor()}
+			_, v := cursor.cursor.Last()
+			if v == nil {
+				return nil
+			}
+
+			if err := cursor.decode(v); err != nil {
+				return err
+			}
+			newest = append(newest, cursor)
+			return nil
+		}
+
+		if query.DeviceID != nil {
+			if device := logs.Bucket(query.DeviceID); device != nil {
+				if err := add(device); err != nil {
+					return err
+				}
+			}
+		} else if err := logs.ForEach(func(k, v []byte) error { return add(logs.Bucket(k)) }); err != nil {
+			return err
+		}
+
+		heap.Init(&newest)
+		for scanned := 0; newest.Len() > 0 && len(found) < query.Limit && scanned < maxDeviceLogScan; scanned++ {
+			cursor := newest[0]
+			if query.Match(cursor.entry) {
+				found = append(found, cursor.entry)
+			}
+
+			_, v := cursor.cursor.Prev()
+			if v == nil {
+				heap.Pop(&newest)
+				continue
+			}
+
+			if err := cursor.decode(v); err != nil {
+				return err
+			}
+			heap.Fix(&newest, 0)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Delete all of the device's entries, its sequence starts over
+func (l *DeviceLogService) Delete(deviceID []byte) error {
+	return l.DB.Update(func(tx *bolt.Tx) error {
+		logs := tx.Bucket([]byte(deviceLogBucket))
+		if logs.Bucket(deviceID) == nil {
+			return nil
+		}
+		return logs.DeleteBucket(deviceID)
+	})
+}
+
+// deviceLogCursor walks a device's entries newest first
+type deviceLogCursor struct {
+	cursor *bolt.Cursor
+	entry  *ewserver.DeviceLog
+}
+
+func (d *deviceLogCursor) decode(v []byte) (err error) {
+	d.entry, err = ewserver.DecodeDeviceLog(v)
+	return err
+}
+
+// deviceLogCursors is a heap of device cursors with the newest received entry first
+type deviceLogCursors []*deviceLogCursor
+
+func (d deviceLogCursors) Len() int { return len(d) }
+func (d deviceLogCursors) Less(i, j int) bool {
+	return d[i].entry.ReceivedAt.After(d[j].entry.ReceivedAt)
+}
+func (d deviceLogCursors) Swap(i, j int)       { d[i], d[j] = d[j], d[i] }
+func (d *deviceLogCursors) Push(x interface{}) { *d = append(*d, x.(*deviceLogCursor)) }
+func (d *deviceLogCursors) Pop() interface{} {
+	old := *d
+	cursor := old[len(old)-1]
+	*d = old[:len(old)-1]
+	return cursor
+}
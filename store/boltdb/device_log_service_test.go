@@ -0,0 +1,154 @@
+package boltdb_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestDeviceLogService_Append(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewDeviceLogService(db.DB(), 3)
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing device log service: %s\n", err)
+	}
+
+	if err := service.Append([]byte("device1"), []*ewserver.DeviceLog{{Severity: ewserver.SeverityInfo}}); err != ewserver.ErrInvalidDeviceLog {
+		t.Fatalf("expected ErrInvalidDeviceLog without a message got: %v\n", err)
+	}
+
+	now := time.Now().UTC()
+	for i := 1; i <= 5; i++ {
+		entry := &ewserver.DeviceLog{Severity: ewserver.SeverityInfo, Message: "entry " + strconv.Itoa(i)}
+		entry.Normalize(now.Add(time.Duration(i) * time.Second))
+		if err := service.Append([]byte("device1"), []*ewserver.DeviceLog{entry}); err != nil {
+			t.Fatalf("error appending entry: %s\n", err)
+		}
+	}
+
+	query := ewserver.NewDeviceLogQuery()
+	query.DeviceID = []byte("device1")
+	entries, err := service.Search(query)
+	if err != nil || len(entries) != 3 || entries[0].Message != "entry 5" || entries[2].Message != "entry 3" || entries[0].Sequence != 5 {
+		t.Fatalf("expected only the latest 3 entries newest first got: %v %d\n", err, len(entries))
+	}
+
+	if err := service.Delete([]byte("device1")); err != nil {
+		t.Fatalf("error deleting entries: %s\n", err)
+	}
+
+	if entries, err := service.Search(query); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no entries after delete got: %v %d\n", err, len(entries))
+	}
+}
+
+func TestDeviceLogService_Search(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewDeviceLogService(db.DB(), 0)
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing device log service: %s\n", err)
+	}
+
+	received := time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC)
+	lines := []string{
+		`<11>1 2024-01-02T10:00:00Z cam1 camd 42 - [meta frame="17" reason="sensor \"timeout\""] capture failed`,
+		`<30>Dec 31 23:59:00 cam1 watchdog[7]: heartbeat ok`,
+		`plain line without priority`,
+	}
+
+	entries := make([]*ewserver.DeviceLog, 0, len(lines))
+	for _, line := range lines {
+		entry, err := ewserver.ParseSyslogLine(line, received)
+		if err != nil {
+			t.Fatalf("error parsing %q: %s\n", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if entry := entries[0]; entry.Severity != ewserver.SeverityError || entry.App != "camd" || entry.Message != "capture failed" || entry.Fields["reason"] != `sensor "timeout"` || entry.Timestamp.Hour() != 10 {
+		t.Fatalf("expected the RFC 5424 line to be parsed got: %#v\n", entry)
+	}
+
+	if entry := entries[1]; entry.Severity != ewserver.SeverityInfo || entry.Host != "cam1" || entry.App != "watchdog" || entry.Message != "heartbeat ok" || entry.Timestamp.Year() != 2023 {
+		t.Fatalf("expected the RFC 3164 line to be parsed from last year got: %#v\n", entry)
+	}
+
+	if entry := entries[2]; entry.Severity != ewserver.SeverityNotice || entry.Message != lines[2] {
+		t.Fatalf("expected a line without priority to be kept whole got: %#v\n", entry)
+	}
+
+	if err := service.Append([]byte("device1"), entries); err != nil {
+		t.Fatalf("error appending entries: %s\n", err)
+	}
+
+	other := &ewserver.DeviceLog{Severity: ewserver.SeverityError, Message: "Capture failed on device2"}
+	other.Normalize(received.Add(time.Second))
+	if err := service.Append([]byte("device2"), []*ewserver.DeviceLog{other}); err != nil {
+		t.Fatalf("error appending entries: %s\n", err)
+	}
+
+	query := ewserver.NewDeviceLogQuery()
+	query.Severity = ewserver.SeverityWarning
+	query.Contains = "CAPTURE"
+	if found, err := service.Search(query); err != nil || len(found) != 2 || found[0].Message != other.Message {
+		t.Fatalf("expected the errors of both devices newest received first got: %v %d\n", err, len(found))
+	}
+
+	query = ewserver.NewDeviceLogQuery()
+	query.DeviceID = []byte("device1")
+	query.From = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	query.To = received
+	if found, err := service.Search(query); err != nil || len(found) != 2 {
+		t.Fatalf("expected the entries logged in the time range got: %v %d\n", err, len(found))
+	}
+
+	query.Limit = 0
+	if _, err := service.Search(query); err != ewserver.ErrInvalidQuery {
+		t.Fatalf("expected ErrInvalidQuery without a limit got: %v\n", err)
+	}
+}
+
+func TestDeviceLog_Normalize(t *testing.T) {
+	entry := &ewserver.DeviceLog{Severity: ewserver.SeverityInfo, Message: "a" + strings.Repeat("é", ewserver.MaxDeviceLogMessage), App: strings.Repeat("x", 2*ewserver.MaxDeviceLogName)}
+	if err := entry.Normalize(time.Now()); err != nil {
+		t.Fatalf("error normalizing entry: %s\n", err)
+	}
+
+	if len(entry.Message) != ewserver.MaxDeviceLogMessage-1 || !utf8.ValidString(entry.Message) {
+		t.Fatalf("expected the message truncated on a rune boundary got: %d bytes\n", len(entry.Message))
+	}
+
+	if len(entry.App) != ewserver.MaxDeviceLogName {
+		t.Fatalf("expected the app truncated got: %d bytes\n", len(entry.App))
+	}
+
+	entry = &ewserver.DeviceLog{Severity: ewserver.SeverityInfo, Message: "fields", Fields: make(map[string]string)}
+	for i := 0; i <= ewserver.MaxDeviceLogFields; i++ {
+		entry.Fields[strconv.Itoa(i)] = "value"
+	}
+
+	if err := entry.Normalize(time.Now()); err != ewserver.ErrInvalidDeviceLog {
+		t.Fatalf("expected ErrInvalidDeviceLog with too many fields got: %v\n", err)
+	}
+}
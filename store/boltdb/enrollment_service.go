@@ -0,0 +1,160 @@
+package boltdb
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const enrollmentBucket = "enrollment_tokens" // tokens keyed by their big endian ID
+
+// EnrollmentService implementation storing enrollment tokens by the hash of their secret
+type EnrollmentService struct {
+	DB *bolt.DB
+}
+
+// NewEnrollmentService creates a new enrollment service backed by an already open boltdb
+func NewEnrollmentService(db *bolt.DB) *EnrollmentService {
+	s := &EnrollmentService{DB: db}
+	return s
+}
+
+// Init the enrollment token bucket
+func (s *EnrollmentService) Init() error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(enrollmentBucket))
+		return err
+	})
+}
+
+// Create validates and stores a new token, its secret is only set on the token passed in.
+func (s *EnrollmentService) Create(token *ewserver.EnrollmentToken) error {
+	if err := token.Valid(); err != nil {
+		return err
+	}
+
+	token.Uses = 0
+	token.CreatedAt = time.Now().UTC()
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(enrollmentBucket))
+
+		var err error
+		if token.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		return putEnrollmentToken(bucket, token)
+	})
+}
+
+// EnrollmentToken returns a single token
+func (s *EnrollmentService) EnrollmentToken(id uint64) (*ewserver.EnrollmentToken, error) {
+	var token *ewserver.EnrollmentToken
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		tokenBytes := tx.Bucket([]byte(enrollmentBucket)).Get(sequenceKey(id))
+		if tokenBytes == nil {
+			return ewserver.ErrTokenNotFound
+		}
+
+		var err error
+		token, err = ewserver.DecodeEnrollmentToken(tokenBytes)
+		return err
+	})
+	return token, err
+}
+
+// EnrollmentTokens returns all tokens ordered by ID, including used up and expired ones
+func (s *EnrollmentService) EnrollmentTokens() ([]*ewserver.EnrollmentToken, error) {
+	tokens := make([]*ewserver.EnrollmentToken, 0)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(enrollmentBucket)).ForEach(func(k, v []byte) error {
+			token, err := ewserver.DecodeEnrollmentToken(v)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// Delete the token so it can no longer be redeemed
+func (s *EnrollmentService) Delete(id uint64) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(enrollmentBucket))
+		if bucket.Get(sequenceKey(id)) == nil {
+			return ewserver.ErrTokenNotFound
+		}
+		return bucket.Delete(sequenceKey(id))
+	})
+}
+
+// Lookup returns the token if it can be redeemed at the time without using it. Returns ErrEnrollmentDenied
+// for unknown, used up or expired tokens.
+func (s *EnrollmentService) Lookup(secret string, at time.Time) (*ewserver.EnrollmentToken, error) {
+	var token *ewserver.EnrollmentToken
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		token, err = usableEnrollmentToken(tx.Bucket([]byte(enrollmentBucket)), secret, at)
+		return err
+	})
+	return token, err
+}
+
+// Redeem finds the token by its hash and uses it once in the same transaction, so concurrent
+// enrollments can not exceed its MaxUses. Returns ErrEnrollmentDenied for unknown, used up or expired tokens.
+func (s *EnrollmentService) Redeem(secret string, at time.Time) (*ewserver.EnrollmentToken, error) {
+	var token *ewserver.EnrollmentToken
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(enrollmentBucket))
+
+		var err error
+		if token, err = usableEnrollmentToken(bucket, secret, at); err != nil {
+			return err
+		}
+
+		token.Uses++
+		return putEnrollmentToken(bucket, token)
+	})
+	return token, err
+}
+
+// usableEnrollmentToken finds the token by the hash of its secret, ErrEnrollmentDenied if there is none or it
+// can not be used at the time.
+func usableEnrollmentToken(bucket *bolt.Bucket, secret string, at time.Time) (*ewserver.EnrollmentToken, error) {
+	hash := ewserver.HashEnrollmentToken(secret)
+
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		token, err := ewserver.DecodeEnrollmentToken(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if subtle.ConstantTimeCompare(token.Hash, hash) != 1 {
+			continue
+		}
+
+		if !token.Usable(at) {
+			return nil, ewserver.ErrEnrollmentDenied
+		}
+		return token, nil
+	}
+	return nil, ewserver.ErrEnrollmentDenied
+}
+
+// putEnrollmentToken encodes and stores the token under its ID
+func putEnrollmentToken(bucket *bolt.Bucket, token *ewserver.EnrollmentToken) error {
+	tokenBytes, err := token.Encode()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(sequenceKey(token.ID), tokenBytes)
+}
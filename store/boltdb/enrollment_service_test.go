@@ -0,0 +1,107 @@
+package boltdb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestEnrollmentToken_Valid(t *testing.T) {
+	token := ewserver.NewEnrollmentToken()
+	if err := token.Valid(); err != nil || len(token.Token) != 2*ewserver.EnrollmentTokenSize || token.Role != ewserver.DefaultEnrollmentRole {
+		t.Fatalf("expected token to be valid with a generated secret and default role got: %v %#v\n", err, token)
+	}
+
+	if token.NamePrefix != ewserver.DefaultEnrollmentPrefix {
+		t.Fatalf("expected the default name prefix got: %q\n", token.NamePrefix)
+	}
+
+	invalid := []*ewserver.EnrollmentToken{
+		{MaxUses: 0, ExpiresAt: time.Now().Add(time.Hour)},
+		{MaxUses: 1, ExpiresAt: time.Now().Add(-time.Hour)},
+		{MaxUses: 1, ExpiresAt: time.Now().Add(time.Hour), NamePrefix: "group:"},
+		{MaxUses: 1, ExpiresAt: time.Now().Add(time.Hour), NamePrefix: "-site"},
+	}
+
+	for i, token := range invalid {
+		if err := token.Valid(); err != ewserver.ErrInvalidEnrollment {
+			t.Fatalf("expected token %d to be invalid got: %v\n", i, err)
+		}
+	}
+
+	if name, err := token.DeviceName("sn-1234"); err != nil || name != "device-sn-1234" {
+		t.Fatalf("expected the device name to be prefixed got: %q %v\n", name, err)
+	}
+
+	for _, name := range []string{"", "../root", "a b", "group:beta"} {
+		if _, err := token.DeviceName(name); err != ewserver.ErrInvalidEnrollment {
+			t.Fatalf("expected device name %q to be invalid got: %v\n", name, err)
+		}
+	}
+}
+
+func TestEnrollmentService_Redeem(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewEnrollmentService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing enrollment service: %s\n", err)
+	}
+
+	token := ewserver.NewEnrollmentToken()
+	token.MaxUses = 2
+	token.Metadata = map[string]string{"site": "berlin"}
+	if err := service.Create(token); err != nil {
+		t.Fatalf("error creating token: %s\n", err)
+	}
+
+	stored, err := service.EnrollmentToken(token.ID)
+	if err != nil || stored.Token != "" || len(stored.Hash) == 0 {
+		t.Fatalf("expected only the token's hash to be stored got: %v %#v\n", err, stored)
+	}
+
+	now := time.Now().UTC()
+	if _, err := service.Redeem("not the token", now); err != ewserver.ErrEnrollmentDenied {
+		t.Fatalf("expected an unknown token to be denied got: %v\n", err)
+	}
+
+	if _, err := service.Redeem(token.Token, token.ExpiresAt); err != ewserver.ErrEnrollmentDenied {
+		t.Fatalf("expected an expired token to be denied got: %v\n", err)
+	}
+
+	if looked, err := service.Lookup(token.Token, now); err != nil || looked.ID != token.ID || looked.Uses != 0 {
+		t.Fatalf("expected lookup not to use the token got: %v %#v\n", err, looked)
+	}
+
+	for i := 1; i <= 2; i++ {
+		redeemed, err := service.Redeem(token.Token, now)
+		if err != nil || redeemed.Uses != i || redeemed.Metadata["site"] != "berlin" {
+			t.Fatalf("expected use %d of the token got: %v %#v\n", i, err, redeemed)
+		}
+	}
+
+	if _, err := service.Redeem(token.Token, now); err != ewserver.ErrEnrollmentDenied {
+		t.Fatalf("expected a used up token to be denied got: %v\n", err)
+	}
+
+	if err := service.Delete(token.ID); err != nil {
+		t.Fatalf("error deleting token: %s\n", err)
+	}
+
+	if tokens, err := service.EnrollmentTokens(); err != nil || len(tokens) != 0 {
+		t.Fatalf("expected no tokens after delete got: %d %v\n", len(tokens), err)
+	}
+
+	if err := service.Delete(token.ID); err != ewserver.ErrTokenNotFound {
+		t.Fatalf("expected ErrTokenNotFound deleting twice got: %v\n", err)
+	}
+}
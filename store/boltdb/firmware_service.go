@@ -0,0 +1,323 @@
+package boltdb
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	firmwareBucket       = "firmware"        // firmware metadata keyed by version
+	firmwareImageBucket  = "firmware_images" // firmware images keyed by version, only read to move them to files
+	firmwareStatusBucket = "firmware_status" // the last reported status keyed by device id
+	firmwareKeyBucket    = "firmware_keys"   // the manifest signing key
+	firmwareSigningKey   = "ed25519"
+)
+
+// FirmwareService implementation that stores firmware metadata in bolt and the images as files in Dir,
+// so downloads are served from the file and listing and update checks never load images. The Ed25519
+// signing key is generated on first Init.
+type FirmwareService struct {
+	DB  *bolt.DB
+	Dir string
+	key ed25519.PrivateKey
+}
+
+// NewFirmwareService creates a new firmware service backed by an already open boltdb, storing the images
+// in dir or, if dir is empty, the firmware directory next to the database file.
+func NewFirmwareService(db *bolt.DB, dir string) *FirmwareService {
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(db.Path()), "firmware")
+	}
+	f := &FirmwareService{DB: db, Dir: dir}
+	return f
+}
+
+// Init the firmware buckets and directory, moving images stored in bolt by earlier versions to files,
+// and load or generate the signing key
+func (f *FirmwareService) Init() error {
+	if err := os.MkdirAll(f.Dir, 0700); err != nil {
+		return err
+	}
+
+	return f.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{firmwareBucket, firmwareStatusBucket, firmwareKeyBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		if images := tx.Bucket([]byte(firmwareImageBucket)); images != nil {
+			err := images.ForEach(func(k, v []byte) error {
+				return ioutil.WriteFile(f.path(ewserver.FirmwareVersion(k)), v, 0600)
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if err := tx.DeleteBucket([]byte(firmwareImageBucket)); err != nil {
+				return err
+			}
+		}
+
+		keys := tx.Bucket([]byte(firmwareKeyBucket))
+		if seed := keys.Get([]byte(firmwareSigningKey)); seed != nil {
+			f.key = ed25519.NewKeyFromSeed(seed)
+			return nil
+		}
+
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		f.key = key
+		return keys.Put([]byte(firmwareSigningKey), key.Seed())
+	})
+}
+
+// Upload stores a new firmware version, setting its size, SHA-256 and upload time.
+func (f *FirmwareService) Upload(firmware *ewserver.Firmware, image []byte) error {
+	if !firmware.Version.Valid() || len(image) == 0 || len(image) > ewserver.MaxFirmwareSize {
+		return ewserver.ErrInvalidFirmware
+	}
+
+	sum := sha256.Sum256(image)
+	firmware.Size = int64(len(image))
+	firmware.SHA256 = hex.EncodeToString(sum[:])
+	firmware.UploadedAt = time.Now().UTC()
+	firmware.Rollout = nil
+
+	// the image is written outside of the transaction and only renamed into place once the version is known to be new
+	file, err := ioutil.TempFile(f.Dir, "upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(image); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return f.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(firmwareBucket))
+		if bucket.Get([]byte(firmware.Version)) != nil {
+			return ewserver.ErrFirmwareExists
+		}
+
+		if err := os.Rename(file.Name(), f.path(firmware.Version)); err != nil {
+			return err
+		}
+
+		if err := putFirmware(bucket, firmware); err != nil {
+			os.Remove(f.path(firmware.Version))
+			return err
+		}
+		return nil
+	})
+}
+
+// Firmware returns the metadata of the version
+func (f *FirmwareService) Firmware(version ewserver.FirmwareVersion) (*ewserver.Firmware, error) {
+	var firmware *ewserver.Firmware
+
+	err := f.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		firmware, err = getFirmware(tx.Bucket([]byte(firmwareBucket)), version)
+		return err
+	})
+	return firmware, err
+}
+
+// Firmwares returns the metadata of all versions
+func (f *FirmwareService) Firmwares() ([]*ewserver.Firmware, error) {
+	firmwares := make([]*ewserver.Firmware, 0)
+
+	err := f.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(firmwareBucket)).ForEach(func(k, v []byte) error {
+			firmware, err := ewserver.DecodeFirmware(v)
+			if err != nil {
+				return err
+			}
+			firmwares = append(firmwares, firmware)
+			return nil
+		})
+	})
+	return firmwares, err
+}
+
+// Open returns the version's metadata and its image's file for reading
+func (f *FirmwareService) Open(version ewserver.FirmwareVersion) (*ewserver.Firmware, *os.File, error) {
+	firmware, err := f.Firmware(version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(f.path(version))
+	if os.IsNotExist(err) {
+		return nil, nil, ewserver.ErrFirmwareNotFound
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+	return firmware, file, nil
+}
+
+// Delete the version's image and metadata. Does not return an error if it does not exist.
+func (f *FirmwareService) Delete(version ewserver.FirmwareVersion) error {
+	return f.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(firmwareBucket)).Delete([]byte(version)); err != nil {
+			return err
+		}
+
+		if err := os.Remove(f.path(version)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// SetRollout replaces the rollout of the version
+func (f *FirmwareService) SetRollout(version ewserver.FirmwareVersion, rollout *ewserver.Rollout) error {
+	if err := rollout.Valid(); err != nil {
+		return err
+	}
+
+	rollout.UpdatedAt = time.Now().UTC()
+
+	return f.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(firmwareBucket))
+		firmware, err := getFirmware(bucket, version)
+		if err != nil {
+			return err
+		}
+
+		firmware.Rollout = rollout
+		return putFirmware(bucket, firmware)
+	})
+}
+
+// Update returns the firmware the device should update to: the highest of the versions rolled out to it.
+// Returns nil unless it is higher than the version the device runs, so devices running a newer build are
+// never downgraded. A device that does not report its version is offered the highest.
+func (f *FirmwareService) Update(deviceID []byte, groups []string, current ewserver.FirmwareVersion) (*ewserver.Firmware, error) {
+	var latest *ewserver.Firmware
+
+	err := f.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(firmwareBucket)).ForEach(func(k, v []byte) error {
+			firmware, err := ewserver.DecodeFirmware(v)
+			if err != nil {
+				return err
+			}
+
+			if !firmware.Rollout.Targets(firmware.Version, deviceID, groups) {
+				return nil
+			}
+
+			// versions are iterated by name, so of those differing only in build metadata the last is offered
+			if latest == nil || firmware.Version.Compare(latest.Version) >= 0 {
+				latest = firmware
+			}
+			return nil
+		})
+	})
+
+	if err != nil || latest == nil || (current != "" && latest.Version.Compare(current) <= 0) {
+		return nil, err
+	}
+	return latest, nil
+}
+
+// Sign the manifest with the server's Ed25519 key
+func (f *FirmwareService) Sign(manifest *ewserver.FirmwareManifest) error {
+	if f.key == nil {
+		return ewserver.ErrInvalidFirmware
+	}
+	manifest.Signature = ed25519.Sign(f.key, manifest.SigningBytes())
+	return nil
+}
+
+// PublicKey returns the public key manifests are signed with
+func (f *FirmwareService) PublicKey() ed25519.PublicKey {
+	if f.key == nil {
+		return nil
+	}
+	return f.key.Public().(ed25519.PublicKey)
+}
+
+// ReportStatus stores the device's update status, replacing the previous one.
+func (f *FirmwareService) ReportStatus(status *ewserver.FirmwareStatus) error {
+	if len(status.DeviceID) == 0 {
+		return ewserver.ErrUserNotFound
+	}
+
+	if !status.Version.Valid() || !status.State.Valid() {
+		return ewserver.ErrInvalidFirmware
+	}
+
+	status.UpdatedAt = time.Now().UTC()
+
+	return f.DB.Update(func(tx *bolt.Tx) error {
+		statusBytes, err := status.Encode()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(firmwareStatusBucket)).Put(status.DeviceID, statusBytes)
+	})
+}
+
+// Statuses returns the status of every device updating to version, or of all devices if version is empty.
+func (f *FirmwareService) Statuses(version ewserver.FirmwareVersion) ([]*ewserver.FirmwareStatus, error) {
+	statuses := make([]*ewserver.FirmwareStatus, 0)
+
+	err := f.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(firmwareStatusBucket)).ForEach(func(k, v []byte) error {
+			status, err := ewserver.DecodeFirmwareStatus(v)
+			if err != nil {
+				return err
+			}
+
+			if version == "" || status.Version == version {
+				statuses = append(statuses, status)
+			}
+			return nil
+		})
+	})
+	return statuses, err
+}
+
+// path of the version's image, the suffix keeps versions such as ".." from naming a directory
+func (f *FirmwareService) path(version ewserver.FirmwareVersion) string {
+	return filepath.Join(f.Dir, string(version)+".bin")
+}
+
+// getFirmware decodes the version's metadata, returning ErrFirmwareNotFound if it does not exist.
+func getFirmware(bucket *bolt.Bucket, version ewserver.FirmwareVersion) (*ewserver.Firmware, error) {
+	firmwareBytes := bucket.Get([]byte(version))
+	if firmwareBytes == nil {
+		return nil, ewserver.ErrFirmwareNotFound
+	}
+	return ewserver.DecodeFirmware(firmwareBytes)
+}
+
+func putFirmware(bucket *bolt.Bucket, firmware *ewserver.Firmware) error {
+	firmwareBytes, err := firmware.Encode()
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(firmware.Version), firmwareBytes)
+}
@@ -0,0 +1,361 @@
+package boltdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestFirmwareService_Upload(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	dir := testFirmwareDir(t)
+	defer os.RemoveAll(dir)
+
+	service := boltdb.NewFirmwareService(db.DB(), dir)
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing firmware service: %s\n", err)
+	}
+
+	image := []byte("firmware image")
+	firmware := &ewserver.Firmware{Version: "1.0.0"}
+	if err := service.Upload(firmware, image); err != nil {
+		t.Fatalf("error uploading firmware: %s\n", err)
+	}
+
+	if firmware.Size != int64(len(image)) || firmware.SHA256 != "1df2f3853d10a305aa52d36fd4a03f5721d7ce7daef6f7e5e8d51074d31361f1" {
+		t.Fatalf("expected size and sha256 to be set got: %d %s\n", firmware.Size, firmware.SHA256)
+	}
+
+	if err := service.Upload(&ewserver.Firmware{Version: "1.0.0"}, image); err != ewserver.ErrFirmwareExists {
+		t.Fatalf("expected firmware exists error got: %v\n", err)
+	}
+
+	if err := service.Upload(&ewserver.Firmware{Version: "../1.0"}, image); err != ewserver.ErrInvalidFirmware {
+		t.Fatalf("expected invalid firmware error for bad version got: %v\n", err)
+	}
+
+	stored, file, err := service.Open("1.0.0")
+	if err != nil {
+		t.Fatalf("error opening image: %s\n", err)
+	}
+
+	storedImage, _ := ioutil.ReadAll(file)
+	file.Close()
+	if stored.SHA256 != firmware.SHA256 || !bytes.Equal(storedImage, image) {
+		t.Fatalf("expected stored image to match got: %s\n", storedImage)
+	}
+
+	if err := service.Delete("1.0.0"); err != nil {
+		t.Fatalf("error deleting firmware: %s\n", err)
+	}
+
+	if _, err := service.Firmware("1.0.0"); err != ewserver.ErrFirmwareNotFound {
+		t.Fatalf("expected firmware not found after delete got: %v\n", err)
+	}
+
+	if _, _, err := service.Open("1.0.0"); err != ewserver.ErrFirmwareNotFound {
+		t.Fatalf("expected image not found after delete got: %v\n", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected no files after delete got: %d\n", len(files))
+	}
+}
+
+func TestFirmwareService_MoveImages(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	dir := testFirmwareDir(t)
+	defer os.RemoveAll(dir)
+
+	// images were stored in bolt before they were stored as files
+	firmware := &ewserver.Firmware{Version: "1.0.0", Size: 5}
+	err = db.DB().Update(func(tx *bolt.Tx) error {
+		firmwareBytes, _ := firmware.Encode()
+		for name, value := range map[string][]byte{"firmware": firmwareBytes, "firmware_images": []byte("image")} {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			if err := bucket.Put([]byte(firmware.Version), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("error storing firmware in bolt: %s\n", err)
+	}
+
+	service := boltdb.NewFirmwareService(db.DB(), dir)
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing firmware service: %s\n", err)
+	}
+
+	_, file, err := service.Open("1.0.0")
+	if err != nil {
+		t.Fatalf("error opening moved image: %s\n", err)
+	}
+	defer file.Close()
+
+	if image, _ := ioutil.ReadAll(file); string(image) != "image" {
+		t.Fatalf("expected the image to be moved to a file got: %s\n", image)
+	}
+
+	db.DB().View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("firmware_images")) != nil {
+			t.Fatalf("expected the images bucket to be deleted")
+		}
+		return nil
+	})
+}
+
+func TestFirmwareService_Rollout(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	dir := testFirmwareDir(t)
+	defer os.RemoveAll(dir)
+
+	service := boltdb.NewFirmwareService(db.DB(), dir)
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing firmware service: %s\n", err)
+	}
+
+	for _, version := range []ewserver.FirmwareVersion{"1.0.0", "1.1.0"} {
+		if err := service.Upload(&ewserver.Firmware{Version: version}, []byte(version)); err != nil {
+			t.Fatalf("error uploading firmware: %s\n", err)
+		}
+	}
+
+	if firmware, _ := service.Update(testDeviceID, nil, "0.9.0"); firmware != nil {
+		t.Fatalf("expected no update before a rollout got: %s\n", firmware.Version)
+	}
+
+	// target the device by group
+	if err := service.SetRollout("1.0.0", &ewserver.Rollout{Groups: []string{"sensors"}, Percentage: 100}); err != nil {
+		t.Fatalf("error setting rollout: %s\n", err)
+	}
+
+	if firmware, _ := service.Update(testDeviceID, []string{"relays"}, "0.9.0"); firmware != nil {
+		t.Fatalf("expected no update for a device outside the group")
+	}
+
+	firmware, err := service.Update(testDeviceID, []string{"sensors"}, "0.9.0")
+	if err != nil || firmware == nil || firmware.Version != "1.0.0" {
+		t.Fatalf("expected update to 1.0.0 got: %v %v\n", firmware, err)
+	}
+
+	if firmware, _ := service.Update(testDeviceID, []string{"sensors"}, "1.0.0"); firmware != nil {
+		t.Fatalf("expected no update for a device already running 1.0.0")
+	}
+
+	// the highest version rolled out wins, not the most recent rollout
+	if err := service.SetRollout("1.1.0", &ewserver.Rollout{Devices: [][]byte{testDeviceID}, Percentage: 100}); err != nil {
+		t.Fatalf("error setting rollout: %s\n", err)
+	}
+
+	if err := service.SetRollout("1.0.0", &ewserver.Rollout{Groups: []string{"sensors"}, Percentage: 100}); err != nil {
+		t.Fatalf("error setting rollout: %s\n", err)
+	}
+
+	if firmware, _ := service.Update(testDeviceID, []string{"sensors"}, "1.0.0"); firmware == nil || firmware.Version != "1.1.0" {
+		t.Fatalf("expected update to 1.1.0")
+	}
+
+	// devices running a newer build or the same version with other build metadata are not offered an update
+	for _, current := range []ewserver.FirmwareVersion{"1.1.0", "1.1.0+build.7", "1.2.0-dev"} {
+		if firmware, _ := service.Update(testDeviceID, []string{"sensors"}, current); firmware != nil {
+			t.Fatalf("expected no update for a device running %s got: %s\n", current, firmware.Version)
+		}
+	}
+
+	if firmware, _ := service.Update(testDeviceID, []string{"sensors"}, ""); firmware == nil || firmware.Version != "1.1.0" {
+		t.Fatalf("expected a device without a version to be offered 1.1.0")
+	}
+
+	if err := service.SetRollout("1.1.0", &ewserver.Rollout{Percentage: 101}); err != ewserver.ErrInvalidFirmware {
+		t.Fatalf("expected invalid firmware error for percentage got: %v\n", err)
+	}
+}
+
+func TestFirmwareVersion_Compare(t *testing.T) {
+	// versions in the same group only differ in build metadata and are equal
+	ordered := [][]ewserver.FirmwareVersion{{"0.9.0"}, {"1.0"}, {"1.0.0-alpha"}, {"1.0.0-alpha.2"}, {"1.0.0-alpha.10"}, {"1.0.0-beta"}, {"1.0.0", "1.0.0+build.2"}, {"1.2.0"}, {"1.10.0"}, {"2.0.0"}}
+	for i := range ordered {
+		for j := range ordered {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+
+			for _, a := range ordered[i] {
+				for _, b := range ordered[j] {
+					if c := a.Compare(b); c != expected {
+						t.Fatalf("expected %s compared to %s to be %d got: %d\n", a, b, expected, c)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFirmwareService_StagedRollout(t *testing.T) {
+	rollout := &ewserver.Rollout{Percentage: 25}
+
+	targeted := 0
+	for i := 0; i < 1000; i++ {
+		deviceID := []byte(fmt.Sprintf("device%d", i))
+		if rollout.Targets("1.0.0", deviceID, nil) {
+			targeted++
+
+			rollout.Percentage = 50
+			if !rollout.Targets("1.0.0", deviceID, nil) {
+				t.Fatalf("expected raising the percentage to keep targeting the device")
+			}
+			rollout.Percentage = 25
+		}
+	}
+
+	if targeted < 200 || targeted > 300 {
+		t.Fatalf("expected about 25%% of devices to be targeted got: %d\n", targeted)
+	}
+
+	rollout.Percentage = 0
+	if rollout.Targets("1.0.0", testDeviceID, nil) {
+		t.Fatalf("expected a 0%% rollout to target no devices")
+	}
+}
+
+func TestFirmwareService_Manifest(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	dir := testFirmwareDir(t)
+	defer os.RemoveAll(dir)
+
+	service := boltdb.NewFirmwareService(db.DB(), dir)
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing firmware service: %s\n", err)
+	}
+
+	manifest := &ewserver.FirmwareManifest{Version: "1.0.0", URL: "https://localhost/api/v1/firmware/download/1.0.0", SHA256: "abc", Size: 10}
+	if err := service.Sign(manifest); err != nil {
+		t.Fatalf("error signing manifest: %s\n", err)
+	}
+
+	if !manifest.Verify(service.PublicKey()) {
+		t.Fatalf("expected manifest signature to verify")
+	}
+
+	manifest.Size = 11
+	if manifest.Verify(service.PublicKey()) {
+		t.Fatalf("expected modified manifest not to verify")
+	}
+
+	// the key is kept across restarts
+	restarted := boltdb.NewFirmwareService(db.DB(), dir)
+	if err := restarted.Init(); err != nil {
+		t.Fatalf("error initializing firmware service: %s\n", err)
+	}
+
+	if !bytes.Equal(restarted.PublicKey(), service.PublicKey()) {
+		t.Fatalf("expected the signing key to be loaded on init")
+	}
+}
+
+func TestFirmwareService_Status(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	dir := testFirmwareDir(t)
+	defer os.RemoveAll(dir)
+
+	service := boltdb.NewFirmwareService(db.DB(), dir)
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing firmware service: %s\n", err)
+	}
+
+	status := &ewserver.FirmwareStatus{DeviceID: testDeviceID, Version: "1.0.0", State: ewserver.FirmwareDownloading}
+	if err := service.ReportStatus(status); err != nil {
+		t.Fatalf("error reporting status: %s\n", err)
+	}
+
+	status = &ewserver.FirmwareStatus{DeviceID: testDeviceID, Version: "1.0.0", State: ewserver.FirmwareInstalled}
+	if err := service.ReportStatus(status); err != nil {
+		t.Fatalf("error reporting status: %s\n", err)
+	}
+
+	status = &ewserver.FirmwareStatus{DeviceID: []byte("device2"), Version: "0.9.0", State: ewserver.FirmwareFailed, Message: "bad checksum"}
+	if err := service.ReportStatus(status); err != nil {
+		t.Fatalf("error reporting status: %s\n", err)
+	}
+
+	if err := service.ReportStatus(&ewserver.FirmwareStatus{DeviceID: testDeviceID, Version: "1.0.0", State: "done"}); err != ewserver.ErrInvalidFirmware {
+		t.Fatalf("expected invalid firmware error for unknown state got: %v\n", err)
+	}
+
+	statuses, err := service.Statuses("1.0.0")
+	if err != nil {
+		t.Fatalf("error getting statuses: %s\n", err)
+	}
+
+	if len(statuses) != 1 || statuses[0].State != ewserver.FirmwareInstalled {
+		t.Fatalf("expected the latest status of one device got: %d\n", len(statuses))
+	}
+
+	if statuses, _ = service.Statuses(""); len(statuses) != 2 {
+		t.Fatalf("expected statuses of all devices got: %d\n", len(statuses))
+	}
+}
+
+func testFirmwareDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("testdata/", "firmware")
+	if err != nil {
+		t.Fatalf("error creating firmware dir for testing: %s\n", err)
+	}
+	return dir
+}
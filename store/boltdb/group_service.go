@@ -0,0 +1,181 @@
+package boltdb
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	groupBucket   = "device_groups" // device groups keyed by name
+	bulkJobBucket = "bulk_jobs"     // bulk jobs keyed by their big endian ID
+)
+
+// GroupService implementation storing device groups by name
+type GroupService struct {
+	DB *bolt.DB
+}
+
+// NewGroupService creates a new group service backed by an already open boltdb
+func NewGroupService(db *bolt.DB) *GroupService {
+	g := &GroupService{DB: db}
+	return g
+}
+
+// Init the device groups bucket
+func (g *GroupService) Init() error {
+	return g.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(groupBucket))
+		return err
+	})
+}
+
+// Create validates and stores a new group, ErrGroupExists if the name is taken
+func (g *GroupService) Create(group *ewserver.DeviceGroup) error {
+	if err := group.Valid(); err != nil {
+		return err
+	}
+
+	groupBytes, err := group.Encode()
+	if err != nil {
+		return err
+	}
+
+	return g.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(groupBucket))
+		if bucket.Get([]byte(group.Name)) != nil {
+			return ewserver.ErrGroupExists
+		}
+		return bucket.Put([]byte(group.Name), groupBytes)
+	})
+}
+
+// Group returns a single group, ErrGroupNotFound if it does not exist
+func (g *GroupService) Group(name string) (*ewserver.DeviceGroup, error) {
+	var group *ewserver.DeviceGroup
+
+	err := g.DB.View(func(tx *bolt.Tx) error {
+		groupBytes := tx.Bucket([]byte(groupBucket)).Get([]byte(name))
+		if groupBytes == nil {
+			return ewserver.ErrGroupNotFound
+		}
+
+		var err error
+		group, err = ewserver.DecodeDeviceGroup(groupBytes)
+		return err
+	})
+	return group, err
+}
+
+// Groups returns all groups ordered by name
+func (g *GroupService) Groups() ([]*ewserver.DeviceGroup, error) {
+	groups := make([]*ewserver.DeviceGroup, 0)
+
+	err := g.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(groupBucket)).ForEach(func(k, v []byte) error {
+			group, err := ewserver.DecodeDeviceGroup(v)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, group)
+			return nil
+		})
+	})
+	return groups, err
+}
+
+// Delete the group, ErrGroupNotFound if it does not exist
+func (g *GroupService) Delete(name string) error {
+	return g.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(groupBucket))
+		if bucket.Get([]byte(name)) == nil {
+			return ewserver.ErrGroupNotFound
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+// BulkJobService implementation storing bulk jobs with their results
+type BulkJobService struct {
+	DB *bolt.DB
+}
+
+// NewBulkJobService creates a new bulk job service backed by an already open boltdb
+func NewBulkJobService(db *bolt.DB) *BulkJobService {
+	b := &BulkJobService{DB: db}
+	return b
+}
+
+// Init the bulk jobs bucket
+func (b *BulkJobService) Init() error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bulkJobBucket))
+		return err
+	})
+}
+
+// Create stores a new job, assigning its ID from the bucket's sequence
+func (b *BulkJobService) Create(job *ewserver.BulkJob) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bulkJobBucket))
+
+		var err error
+		if job.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		return putBulkJob(bucket, job)
+	})
+}
+
+// Save replaces the stored job, ErrJobNotFound if it was never created
+func (b *BulkJobService) Save(job *ewserver.BulkJob) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bulkJobBucket))
+		if bucket.Get(sequenceKey(job.ID)) == nil {
+			return ewserver.ErrJobNotFound
+		}
+		return putBulkJob(bucket, job)
+	})
+}
+
+// Job returns a single job with its results
+func (b *BulkJobService) Job(id uint64) (*ewserver.BulkJob, error) {
+	var job *ewserver.BulkJob
+
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		jobBytes := tx.Bucket([]byte(bulkJobBucket)).Get(sequenceKey(id))
+		if jobBytes == nil {
+			return ewserver.ErrJobNotFound
+		}
+
+		var err error
+		job, err = ewserver.DecodeBulkJob(jobBytes)
+		return err
+	})
+	return job, err
+}
+
+// Jobs returns all jobs newest first
+func (b *BulkJobService) Jobs() ([]*ewserver.BulkJob, error) {
+	jobs := make([]*ewserver.BulkJob, 0)
+
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bulkJobBucket)).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			job, err := ewserver.DecodeBulkJob(v)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+func putBulkJob(bucket *bolt.Bucket, job *ewserver.BulkJob) error {
+	jobBytes, err := job.Encode()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(sequenceKey(job.ID), jobBytes)
+}
@@ -0,0 +1,104 @@
+package boltdb_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestGroupService_Create(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewGroupService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing group service: %s\n", err)
+	}
+
+	for _, name := range []string{"", "-site", "site/berlin", "group:site"} {
+		if err := service.Create(&ewserver.DeviceGroup{Name: name}); err != ewserver.ErrInvalidGroup {
+			t.Fatalf("expected group %q to be invalid got: %v\n", name, err)
+		}
+	}
+
+	for _, name := range []string{"site-berlin", "outdoor"} {
+		if err := service.Create(&ewserver.DeviceGroup{Name: name, CreatedBy: "root"}); err != nil {
+			t.Fatalf("error creating group: %s\n", err)
+		}
+	}
+
+	if err := service.Create(&ewserver.DeviceGroup{Name: "outdoor"}); err != ewserver.ErrGroupExists {
+		t.Fatalf("expected ErrGroupExists creating twice got: %v\n", err)
+	}
+
+	groups, err := service.Groups()
+	if err != nil || len(groups) != 2 || groups[0].Name != "outdoor" || groups[1].CreatedBy != "root" {
+		t.Fatalf("expected both groups ordered by name got: %d %v\n", len(groups), err)
+	}
+
+	if err := service.Delete("outdoor"); err != nil {
+		t.Fatalf("error deleting group: %s\n", err)
+	}
+
+	if _, err := service.Group("outdoor"); err != ewserver.ErrGroupNotFound {
+		t.Fatalf("expected ErrGroupNotFound after deleting got: %v\n", err)
+	}
+
+	if err := service.Delete("outdoor"); err != ewserver.ErrGroupNotFound {
+		t.Fatalf("expected ErrGroupNotFound deleting twice got: %v\n", err)
+	}
+}
+
+func TestBulkJobService_Save(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewBulkJobService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing bulk job service: %s\n", err)
+	}
+
+	first := ewserver.NewBulkJob("outdoor", ewserver.BulkDisable, nil)
+	second := ewserver.NewBulkJob("outdoor", ewserver.BulkDelete, nil)
+	for _, job := range []*ewserver.BulkJob{first, second} {
+		if err := service.Create(job); err != nil {
+			t.Fatalf("error creating job: %s\n", err)
+		}
+	}
+
+	first.Total = 2
+	first.AddResult(&ewserver.APIUser{Name: "device1", ID: []byte{1}}, nil, nil)
+	first.AddResult(&ewserver.APIUser{Name: "device2", ID: []byte{2}}, nil, errors.New("failed"))
+	first.State = ewserver.BulkCompleted
+	if err := service.Save(first); err != nil {
+		t.Fatalf("error saving job: %s\n", err)
+	}
+
+	job, err := service.Job(first.ID)
+	if err != nil || job.State != ewserver.BulkCompleted || job.Succeeded != 1 || job.Failed != 1 || len(job.Results) != 2 || job.Results[1].Error != "failed" {
+		t.Fatalf("expected the saved progress got: %v %#v\n", err, job)
+	}
+
+	jobs, err := service.Jobs()
+	if err != nil || len(jobs) != 2 || jobs[0].ID != second.ID {
+		t.Fatalf("expected both jobs newest first got: %d %v\n", len(jobs), err)
+	}
+
+	if err := service.Save(&ewserver.BulkJob{ID: 100}); err != ewserver.ErrJobNotFound {
+		t.Fatalf("expected ErrJobNotFound saving an unknown job got: %v\n", err)
+	}
+}
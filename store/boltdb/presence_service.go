@@ -0,0 +1,108 @@
+package boltdb
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const presenceBucket = "presence" // presence keyed by device id
+
+// PresenceService implementation storing the last seen presence of devices. Every Seen is a write,
+// wrap it with presence.Tracker to coalesce them.
+type PresenceService struct {
+	DB *bolt.DB
+}
+
+// NewPresenceService creates a new presence service backed by an already open boltdb
+func NewPresenceService(db *bolt.DB) *PresenceService {
+	p := &PresenceService{DB: db}
+	return p
+}
+
+// Init the presence bucket
+func (p *PresenceService) Init() error {
+	return p.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(presenceBucket))
+		return err
+	})
+}
+
+// Seen stores the device as online, seen at the time from the address
+func (p *PresenceService) Seen(deviceID []byte, address, userAgent string, at time.Time) error {
+	presence, err := p.Presence(deviceID)
+	if err != nil {
+		return err
+	}
+
+	if !presence.Online {
+		presence.Online, presence.Since = true, at
+	}
+	presence.LastSeen, presence.Address, presence.UserAgent = at, address, userAgent
+	return p.Save([]*ewserver.Presence{presence})
+}
+
+// Presence returns the stored presence of the device, a new offline presence if it was never seen.
+func (p *PresenceService) Presence(deviceID []byte) (*ewserver.Presence, error) {
+	presence := ewserver.NewPresence(deviceID)
+
+	err := p.DB.View(func(tx *bolt.Tx) error {
+		presenceBytes := tx.Bucket([]byte(presenceBucket)).Get(deviceID)
+		if presenceBytes == nil {
+			return nil
+		}
+
+		var err error
+		presence, err = ewserver.DecodePresence(presenceBytes)
+		return err
+	})
+	return presence, err
+}
+
+// Presences returns the stored presence of every device that was seen, ordered by device id
+func (p *PresenceService) Presences() ([]*ewserver.Presence, error) {
+	presences := make([]*ewserver.Presence, 0)
+
+	err := p.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(presenceBucket)).ForEach(func(k, v []byte) error {
+			presence, err := ewserver.DecodePresence(v)
+			if err != nil {
+				return err
+			}
+			presences = append(presences, presence)
+			return nil
+		})
+	})
+	return presences, err
+}
+
+// Save stores the presences in a single transaction
+func (p *PresenceService) Save(presences []*ewserver.Presence) error {
+	return p.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(presenceBucket))
+
+		for _, presence := range presences {
+			if len(presence.DeviceID) == 0 {
+				return ewserver.ErrUserNotFound
+			}
+
+			presenceBytes, err := presence.Encode()
+			if err != nil {
+				return err
+			}
+
+			if err := bucket.Put(presence.DeviceID, presenceBytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete the device's presence
+func (p *PresenceService) Delete(deviceID []byte) error {
+	return p.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(presenceBucket)).Delete(deviceID)
+	})
+}
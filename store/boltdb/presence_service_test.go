@@ -0,0 +1,70 @@
+package boltdb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestPresenceService_Seen(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewPresenceService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing presence service: %s\n", err)
+	}
+
+	deviceID := []byte("device")
+	if presence, err := service.Presence(deviceID); err != nil || presence.Online || !presence.LastSeen.IsZero() {
+		t.Fatalf("expected an unknown device to be offline and never seen got: %#v %v\n", presence, err)
+	}
+
+	first := time.Now().UTC()
+	if err := service.Seen(deviceID, "127.0.0.1", "agent/1", first); err != nil {
+		t.Fatalf("error recording device as seen: %s\n", err)
+	}
+
+	if err := service.Seen(deviceID, "127.0.0.2", "agent/2", first.Add(time.Second)); err != nil {
+		t.Fatalf("error recording device as seen: %s\n", err)
+	}
+
+	presence, err := service.Presence(deviceID)
+	if err != nil {
+		t.Fatalf("error getting presence: %s\n", err)
+	}
+
+	if !presence.Online || !presence.Since.Equal(first) || !presence.LastSeen.Equal(first.Add(time.Second)) || presence.Address != "127.0.0.2" || presence.UserAgent != "agent/2" {
+		t.Fatalf("expected the latest activity and online since the first got: %#v\n", presence)
+	}
+
+	offline := &ewserver.Presence{DeviceID: []byte("other"), LastSeen: first}
+	if err := service.Save([]*ewserver.Presence{offline}); err != nil {
+		t.Fatalf("error saving presence: %s\n", err)
+	}
+
+	if err := service.Save([]*ewserver.Presence{{}}); err != ewserver.ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound saving a presence without a device got: %v\n", err)
+	}
+
+	presences, err := service.Presences()
+	if err != nil || len(presences) != 2 || string(presences[0].DeviceID) != "device" || presences[1].Online {
+		t.Fatalf("expected both presences got: %d %v\n", len(presences), err)
+	}
+
+	if err := service.Delete(deviceID); err != nil {
+		t.Fatalf("error deleting presence: %s\n", err)
+	}
+
+	if presence, err := service.Presence(deviceID); err != nil || presence.Online || !presence.LastSeen.IsZero() {
+		t.Fatalf("expected a deleted device to be offline and never seen got: %#v %v\n", presence, err)
+	}
+}
@@ -0,0 +1,122 @@
+package boltdb
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	rateLimitBucket  = "rate_limits"  // rate limits keyed by scope:subject
+	rateBucketBucket = "rate_buckets" // saved token buckets keyed by scope:identity
+)
+
+// RateLimitService implementation storing rate limits and the token buckets of a ratelimit.Limiter
+type RateLimitService struct {
+	DB *bolt.DB
+}
+
+// NewRateLimitService creates a new rate limit service backed by an already open boltdb
+func NewRateLimitService(db *bolt.DB) *RateLimitService {
+	r := &RateLimitService{DB: db}
+	return r
+}
+
+// Init the rate limit buckets
+func (r *RateLimitService) Init() error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(rateLimitBucket)); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists([]byte(rateBucketBucket))
+		return err
+	})
+}
+
+// SetLimit validates and stores the limit, replacing the limit of the same scope and subject
+func (r *RateLimitService) SetLimit(limit *ewserver.RateLimit) error {
+	if err := limit.Valid(); err != nil {
+		return err
+	}
+
+	limitBytes, err := limit.Encode()
+	if err != nil {
+		return err
+	}
+
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(rateLimitBucket)).Put([]byte(limit.Key()), limitBytes)
+	})
+}
+
+// DeleteLimit removes the limit, ErrLimitNotFound if there is none
+func (r *RateLimitService) DeleteLimit(scope, subject string) error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(rateLimitBucket))
+		key := []byte(ewserver.RateLimitKey(scope, subject))
+		if bucket.Get(key) == nil {
+			return ewserver.ErrLimitNotFound
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// Limits returns all limits ordered by scope and subject
+func (r *RateLimitService) Limits() ([]*ewserver.RateLimit, error) {
+	limits := make([]*ewserver.RateLimit, 0)
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(rateLimitBucket)).ForEach(func(k, v []byte) error {
+			limit, err := ewserver.DecodeRateLimit(v)
+			if err != nil {
+				return err
+			}
+			limits = append(limits, limit)
+			return nil
+		})
+	})
+	return limits, err
+}
+
+// Buckets returns the saved token buckets
+func (r *RateLimitService) Buckets() ([]*ewserver.RateBucket, error) {
+	buckets := make([]*ewserver.RateBucket, 0)
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(rateBucketBucket)).ForEach(func(k, v []byte) error {
+			bucket, err := ewserver.DecodeRateBucket(v)
+			if err != nil {
+				return err
+			}
+			buckets = append(buckets, bucket)
+			return nil
+		})
+	})
+	return buckets, err
+}
+
+// SaveBuckets replaces the saved token buckets in a single transaction
+func (r *RateLimitService) SaveBuckets(buckets []*ewserver.RateBucket) error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(rateBucketBucket)); err != nil {
+			return err
+		}
+
+		bucket, err := tx.CreateBucket([]byte(rateBucketBucket))
+		if err != nil {
+			return err
+		}
+
+		for _, rateBucket := range buckets {
+			bucketBytes, err := rateBucket.Encode()
+			if err != nil {
+				return err
+			}
+
+			if err := bucket.Put([]byte(rateBucket.Key), bucketBytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+package boltdb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestRateLimitService_SetLimit(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewRateLimitService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing rate limit service: %s\n", err)
+	}
+
+	invalid := []*ewserver.RateLimit{
+		{Scope: "device", Subject: "*", Rate: 1, Burst: 1},
+		{Scope: ewserver.RateLimitScopeIP, Rate: 1, Burst: 1},
+		{Scope: ewserver.RateLimitScopeIP, Subject: "*", Rate: 0, Burst: 1},
+		{Scope: ewserver.RateLimitScopeIP, Subject: "*", Rate: 1, Burst: 0},
+	}
+
+	for i, limit := range invalid {
+		if err := service.SetLimit(limit); err != ewserver.ErrInvalidRateLimit {
+			t.Fatalf("expected limit %d to be invalid got: %v\n", i, err)
+		}
+	}
+
+	limit := &ewserver.RateLimit{Scope: ewserver.RateLimitScopeIP, Subject: ewserver.RateLimitDefault, Rate: 1, Burst: 5}
+	if err := service.SetLimit(limit); err != nil {
+		t.Fatalf("error setting limit: %s\n", err)
+	}
+
+	limit.Burst = 10
+	if err := service.SetLimit(limit); err != nil {
+		t.Fatalf("error replacing limit: %s\n", err)
+	}
+
+	if err := service.SetLimit(&ewserver.RateLimit{Scope: ewserver.RateLimitScopeRole, Subject: "apiuser", Rate: 0.5, Burst: 2}); err != nil {
+		t.Fatalf("error setting limit: %s\n", err)
+	}
+
+	limits, err := service.Limits()
+	if err != nil || len(limits) != 2 || limits[0].Burst != 10 || limits[1].Subject != "apiuser" {
+		t.Fatalf("expected the replaced limit and the role limit got: %d %v\n", len(limits), err)
+	}
+
+	if err := service.DeleteLimit(ewserver.RateLimitScopeRole, "apiuser"); err != nil {
+		t.Fatalf("error deleting limit: %s\n", err)
+	}
+
+	if err := service.DeleteLimit(ewserver.RateLimitScopeRole, "apiuser"); err != ewserver.ErrLimitNotFound {
+		t.Fatalf("expected ErrLimitNotFound deleting twice got: %v\n", err)
+	}
+}
+
+func TestRateLimitService_SaveBuckets(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewRateLimitService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing rate limit service: %s\n", err)
+	}
+
+	now := time.Now().UTC()
+	first := []*ewserver.RateBucket{{Key: "ip:127.0.0.1", Tokens: 1, Updated: now}, {Key: "api_user:device1", Tokens: 0.5, Updated: now}}
+	if err := service.SaveBuckets(first); err != nil {
+		t.Fatalf("error saving buckets: %s\n", err)
+	}
+
+	if err := service.SaveBuckets([]*ewserver.RateBucket{{Key: "ip:127.0.0.2", Tokens: 2, Updated: now}}); err != nil {
+		t.Fatalf("error saving buckets: %s\n", err)
+	}
+
+	buckets, err := service.Buckets()
+	if err != nil || len(buckets) != 1 || buckets[0].Key != "ip:127.0.0.2" || buckets[0].Tokens != 2 || !buckets[0].Updated.Equal(now) {
+		t.Fatalf("expected saving to replace the buckets got: %d %v\n", len(buckets), err)
+	}
+}
+
+func TestRateBucket_Take(t *testing.T) {
+	limit := &ewserver.RateLimit{Scope: ewserver.RateLimitScopeIP, Subject: ewserver.RateLimitDefault, Rate: 2, Burst: 2}
+	now := time.Now()
+	bucket := ewserver.NewRateBucket("ip:127.0.0.1", limit, now)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := bucket.Take(limit, now); !ok {
+			t.Fatalf("expected request %d within the burst to be allowed\n", i)
+		}
+	}
+
+	if ok, retryAfter := bucket.Take(limit, now); ok || retryAfter != 500*time.Millisecond {
+		t.Fatalf("expected an empty bucket to deny for half a second got: %v %s\n", ok, retryAfter)
+	}
+
+	if ok, _ := bucket.Take(limit, now.Add(500*time.Millisecond)); !ok {
+		t.Fatalf("expected the bucket to refill a token after half a second\n")
+	}
+
+	if bucket.Full(limit, now.Add(time.Second)) || !bucket.Full(limit, now.Add(2*time.Second)) {
+		t.Fatalf("expected the bucket to be full only after refilling the burst\n")
+	}
+}
@@ -0,0 +1,433 @@
+package boltdb
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	retentionBucket    = "retention"     // retention policies keyed by policyKey
+	retentionRunBucket = "retention_run" // the outcome of the last run
+	rollupBucket       = "rollups"       // rollups under rollups/<device id>/<stream>/<resolution> keyed by window start
+	lastRunKey         = "last"
+)
+
+// RetentionService implementation that rolls up and deletes the points stored by the TelemetryService.
+// Rollups of a stream are stored per resolution as JSON ewserver.Rollups keyed by their window's start
+// time, which TelemetryService.Series reads once the raw points are deleted.
+type RetentionService struct {
+	DB *bolt.DB
+}
+
+// NewRetentionService creates a new retention service backed by an already open boltdb
+func NewRetentionService(db *bolt.DB) *RetentionService {
+	r := &RetentionService{DB: db}
+	return r
+}
+
+// Init the retention and rollup buckets
+func (r *RetentionService) Init() error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{retentionBucket, retentionRunBucket, rollupBucket, telemetryBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetPolicy validates and stores the policy, replacing any policy for the same device and stream.
+func (r *RetentionService) SetPolicy(policy *ewserver.RetentionPolicy) error {
+	if err := policy.Valid(); err != nil {
+		return err
+	}
+
+	policy.UpdatedAt = time.Now().UTC()
+
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		policyBytes, err := policy.Encode()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(retentionBucket)).Put(policyKey(policy.DeviceID, policy.Stream), policyBytes)
+	})
+}
+
+// DeletePolicy removes the policy for the device and stream. Does not return an error if it does not exist.
+func (r *RetentionService) DeletePolicy(deviceID []byte, stream ewserver.StreamName) error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(retentionBucket)).Delete(policyKey(deviceID, stream))
+	})
+}
+
+// Policies returns all retention policies
+func (r *RetentionService) Policies() ([]*ewserver.RetentionPolicy, error) {
+	policies := make([]*ewserver.RetentionPolicy, 0)
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(retentionBucket)).ForEach(func(k, v []byte) error {
+			policy, err := ewserver.DecodeRetentionPolicy(v)
+			if err != nil {
+				return err
+			}
+			policies = append(policies, policy)
+			return nil
+		})
+	})
+	return policies, err
+}
+
+// Policy returns the most specific policy for the device's stream, nil if none applies.
+func (r *RetentionService) Policy(deviceID []byte, stream ewserver.StreamName) (*ewserver.RetentionPolicy, error) {
+	var policy *ewserver.RetentionPolicy
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		policy, err = getPolicy(tx, deviceID, stream)
+		return err
+	})
+	return policy, err
+}
+
+// Apply the retention policies as of now. Each stream is rolled up and then has its expired data
+// deleted in its own transaction. Points published into a window after it was rolled up update the
+// rollup as they are stored, see findLateRollups.
+func (r *RetentionService) Apply(now time.Time) (*ewserver.RetentionRun, error) {
+	run := &ewserver.RetentionRun{Started: now}
+	started := time.Now()
+
+	// find the streams with a policy first so only they take a write transaction
+	type deviceStream struct {
+		deviceID []byte
+		stream   ewserver.StreamName
+		policy   *ewserver.RetentionPolicy
+	}
+	streams := make([]deviceStream, 0)
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		telemetry := tx.Bucket([]byte(telemetryBucket))
+		return telemetry.ForEach(func(deviceID, v []byte) error {
+			device := telemetry.Bucket(deviceID)
+			if device == nil {
+				return nil
+			}
+
+			return device.ForEach(func(stream, v []byte) error {
+				policy, err := getPolicy(tx, deviceID, ewserver.StreamName(stream))
+				if err != nil || policy == nil {
+					return err
+				}
+				streams = append(streams, deviceStream{append([]byte{}, deviceID...), ewserver.StreamName(stream), policy})
+				return nil
+			})
+		})
+	})
+
+	for i := 0; err == nil && i < len(streams); i++ {
+		err = r.DB.Update(func(tx *bolt.Tx) error {
+			return applyPolicy(tx, streams[i].deviceID, streams[i].stream, streams[i].policy, now, run)
+		})
+
+		if err == nil {
+			run.Streams++
+		}
+	}
+
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.Duration = ewserver.Duration(time.Since(started))
+
+	if storeErr := r.DB.Update(func(tx *bolt.Tx) error {
+		runBytes, err := run.Encode()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(retentionRunBucket)).Put([]byte(lastRunKey), runBytes)
+	}); err == nil {
+		err = storeErr
+	}
+	return run, err
+}
+
+// LastRun returns the outcome of the last Apply, nil if it never ran.
+func (r *RetentionService) LastRun() (*ewserver.RetentionRun, error) {
+	var run *ewserver.RetentionRun
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		runBytes := tx.Bucket([]byte(retentionRunBucket)).Get([]byte(lastRunKey))
+		if runBytes == nil {
+			return nil
+		}
+
+		var err error
+		run, err = ewserver.DecodeRetentionRun(runBytes)
+		return err
+	})
+	return run, err
+}
+
+// applyPolicy rolls up the complete windows of each rollup tier from the next finer tier, then deletes
+// expired data. Deletes are cut at the next tier's window boundaries so that Series never sees a
+// window both in raw points and a rollup.
+func applyPolicy(tx *bolt.Tx, deviceID []byte, stream ewserver.StreamName, policy *ewserver.RetentionPolicy, now time.Time, run *ewserver.RetentionRun) error {
+	raw := streamBucket(tx, deviceID, stream)
+	if raw == nil {
+		return nil
+	}
+
+	buckets := []*bolt.Bucket{raw}
+	for _, resolution := range policy.Rollups() {
+		bucket, err := createRollupBucket(tx, deviceID, stream, resolution)
+		if err != nil {
+			return err
+		}
+
+		rolledUp, err := rollup(buckets[len(buckets)-1], bucket, len(buckets) == 1, resolution, now)
+		if err != nil {
+			return err
+		}
+		run.RolledUp += rolledUp
+		buckets = append(buckets, bucket)
+	}
+
+	for i, tier := range policy.Tiers {
+		if tier.Keep == 0 {
+			continue
+		}
+
+		cutoff := now.Add(-time.Duration(tier.Keep))
+		if i+1 < len(policy.Tiers) {
+			cutoff = cutoff.Truncate(time.Duration(policy.Tiers[i+1].Resolution))
+		}
+
+		deleted, err := deleteBefore(buckets[i], cutoff)
+		if err != nil {
+			return err
+		}
+		run.Deleted += deleted
+	}
+	return nil
+}
+
+// rollup aggregates the source into windows of resolution, continuing after the last window already
+// in the destination and stopping at the window now is in. Returns the number of windows written.
+func rollup(source, destination *bolt.Bucket, raw bool, resolution time.Duration, now time.Time) (int, error) {
+	var from time.Time
+	if k, _ := destination.Cursor().Last(); k != nil {
+		from = keyTimestamp(k).Add(resolution)
+	}
+	to := now.Truncate(resolution)
+
+	written := 0
+	var window time.Time
+	var current *ewserver.Rollup
+
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+
+		rollupBytes, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		written++
+		return destination.Put(timestampKey(window), rollupBytes)
+	}
+
+	c := source.Cursor()
+	for k, v := c.Seek(timestampKey(from)); k != nil && inRange(k, to); k, v = c.Next() {
+		if start := keyTimestamp(k).Truncate(resolution); current == nil || !start.Equal(window) {
+			if err := flush(); err != nil {
+				return written, err
+			}
+			window, current = start, &ewserver.Rollup{}
+		}
+
+		if raw {
+			current.Add(v)
+			continue
+		}
+
+		finer := &ewserver.Rollup{}
+		if err := json.Unmarshal(v, finer); err != nil {
+			return written, err
+		}
+		current.Merge(finer)
+	}
+	return written, flush()
+}
+
+// lateRollup is a window of a rollup tier that was already rolled up when a point was published into it.
+// Complete is true if the source the tier is rolled up from still has the window's data.
+type lateRollup struct {
+	rollupTier
+	window   time.Time
+	complete bool
+}
+
+// lateRollups is the window of each tier, from the finest, that the point at ts falls into and was already rolled up
+type lateRollups []lateRollup
+
+// findLateRollups returns the rolled up windows a point at ts is late for. It must be called before the point is stored,
+// deletes are cut at window boundaries so a window's source either has all of its data or none.
+func findLateRollups(tx *bolt.Tx, deviceID []byte, stream ewserver.StreamName, raw *bolt.Bucket, ts time.Time) lateRollups {
+	late := make(lateRollups, 0)
+	source := raw
+	for _, tier := range rollupTiers(tx, deviceID, stream) {
+		window := ts.Truncate(tier.resolution)
+		if k, _ := tier.bucket.Cursor().Last(); k == nil || keyTimestamp(k).Before(window) {
+			break
+		}
+
+		k, _ := source.Cursor().Seek(timestampKey(window))
+		complete := k != nil && inRange(k, window.Add(tier.resolution))
+		late = append(late, lateRollup{rollupTier: tier, window: window, complete: complete})
+		source = tier.bucket
+	}
+	return late
+}
+
+// update the late windows with the stored point. Windows with a complete source are rolled up again, the
+// others only had their source deleted so the point is merged into them.
+func (l lateRollups) update(raw *bolt.Bucket, point *ewserver.DataPoint) error {
+	source := raw
+	for i, late := range l {
+		current := &ewserver.Rollup{}
+		if late.complete {
+			c := source.Cursor()
+			for k, v := c.Seek(timestampKey(late.window)); k != nil && inRange(k, late.window.Add(late.resolution)); k, v = c.Next() {
+				if i == 0 {
+					current.Add(v)
+					continue
+				}
+
+				finer := &ewserver.Rollup{}
+				if err := json.Unmarshal(v, finer); err != nil {
+					return err
+				}
+				current.Merge(finer)
+			}
+		} else {
+			if rollupBytes := late.bucket.Get(timestampKey(late.window)); rollupBytes != nil {
+				if err := json.Unmarshal(rollupBytes, current); err != nil {
+					return err
+				}
+			}
+			current.Add(point.Value)
+		}
+
+		rollupBytes, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		if err := late.bucket.Put(timestampKey(late.window), rollupBytes); err != nil {
+			return err
+		}
+		source = late.bucket
+	}
+	return nil
+}
+
+// deleteBefore deletes all keys of the bucket before cutoff, returning how many were deleted.
+func deleteBefore(bucket *bolt.Bucket, cutoff time.Time) (int, error) {
+	deleted := 0
+
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil && keyTimestamp(k).Before(cutoff); k, _ = c.First() {
+		if err := bucket.Delete(k); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// getPolicy returns the first policy found for the device's stream, the device, the stream name and
+// then the default policy.
+func getPolicy(tx *bolt.Tx, deviceID []byte, stream ewserver.StreamName) (*ewserver.RetentionPolicy, error) {
+	bucket := tx.Bucket([]byte(retentionBucket))
+
+	for _, key := range [][]byte{policyKey(deviceID, stream), policyKey(deviceID, ""), policyKey(nil, stream), policyKey(nil, "")} {
+		if policyBytes := bucket.Get(key); policyBytes != nil {
+			return ewserver.DecodeRetentionPolicy(policyBytes)
+		}
+	}
+	return nil, nil
+}
+
+// policyKey is the base64 device id and the stream name separated by a /, either may be empty.
+func policyKey(deviceID []byte, stream ewserver.StreamName) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(deviceID) + "/" + string(stream))
+}
+
+// rollupTier is a bucket of rollups of a single resolution
+type rollupTier struct {
+	resolution time.Duration
+	bucket     *bolt.Bucket
+}
+
+// rollupTiers returns the rollup buckets of the device's stream ordered from the finest resolution.
+func rollupTiers(tx *bolt.Tx, deviceID []byte, stream ewserver.StreamName) []rollupTier {
+	tiers := make([]rollupTier, 0)
+
+	rollups := tx.Bucket([]byte(rollupBucket))
+	if rollups == nil {
+		return tiers
+	}
+
+	device := rollups.Bucket(deviceID)
+	if device == nil {
+		return tiers
+	}
+
+	streamRollups := device.Bucket(stream.Bytes())
+	if streamRollups == nil {
+		return tiers
+	}
+
+	streamRollups.ForEach(func(k, v []byte) error {
+		if bucket := streamRollups.Bucket(k); bucket != nil {
+			tiers = append(tiers, rollupTier{resolution: time.Duration(binary.BigEndian.Uint64(k)), bucket: bucket})
+		}
+		return nil
+	})
+	return tiers
+}
+
+// createRollupBucket returns the bucket for the resolution's rollups of the device's stream, creating it as necessary.
+func createRollupBucket(tx *bolt.Tx, deviceID []byte, stream ewserver.StreamName, resolution time.Duration) (*bolt.Bucket, error) {
+	device, err := tx.Bucket([]byte(rollupBucket)).CreateBucketIfNotExists(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	streamRollups, err := device.CreateBucketIfNotExists(stream.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return streamRollups.CreateBucketIfNotExists(resolutionKey(resolution))
+}
+
+// resolutionKey encodes the resolution as big endian nanoseconds so rollup tiers sort from the finest.
+func resolutionKey(resolution time.Duration) []byte {
+	key := make([]byte, timestampSize)
+	binary.BigEndian.PutUint64(key, uint64(resolution))
+	return key
+}
+
+// earliest returns the time of the bucket's first key if it is before end, otherwise end.
+func earliest(end time.Time, bucket *bolt.Bucket) time.Time {
+	if k, _ := bucket.Cursor().First(); k != nil && keyTimestamp(k).Before(end) {
+		return keyTimestamp(k)
+	}
+	return end
+}
@@ -0,0 +1,195 @@
+package boltdb_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func testRetentionPolicy(tiers ...ewserver.RetentionTier) *ewserver.RetentionPolicy {
+	policy := ewserver.NewRetentionPolicy()
+	policy.Tiers = tiers
+	return policy
+}
+
+func TestRetentionPolicy_Valid(t *testing.T) {
+	minute, hour, day := ewserver.Duration(time.Minute), ewserver.Duration(time.Hour), ewserver.Duration(24*time.Hour)
+
+	valid := testRetentionPolicy(ewserver.RetentionTier{Keep: 7 * day}, ewserver.RetentionTier{Resolution: minute, Keep: 90 * day}, ewserver.RetentionTier{Resolution: hour})
+	if err := valid.Valid(); err != nil {
+		t.Fatalf("expected policy to be valid got: %s\n", err)
+	}
+
+	invalid := []*ewserver.RetentionPolicy{
+		testRetentionPolicy(),
+		testRetentionPolicy(ewserver.RetentionTier{Resolution: minute}),
+		testRetentionPolicy(ewserver.RetentionTier{}, ewserver.RetentionTier{Resolution: hour}, ewserver.RetentionTier{Resolution: minute}),
+		testRetentionPolicy(ewserver.RetentionTier{}, ewserver.RetentionTier{Resolution: hour}, ewserver.RetentionTier{Resolution: 90 * minute}),
+		testRetentionPolicy(ewserver.RetentionTier{Keep: minute}, ewserver.RetentionTier{Resolution: hour}),
+	}
+
+	for i, policy := range invalid {
+		if err := policy.Valid(); err != ewserver.ErrInvalidRetention {
+			t.Fatalf("expected policy %d to be invalid got: %v\n", i, err)
+		}
+	}
+
+	var tier ewserver.RetentionTier
+	if err := json.Unmarshal([]byte(`{"resolution":"1m","keep":"90d"}`), &tier); err != nil || tier.Keep != 90*day || tier.Resolution != minute {
+		t.Fatalf("expected durations to be parsed got: %v %v\n", tier, err)
+	}
+}
+
+func TestRetentionService_Policy(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewRetentionService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing retention service: %s\n", err)
+	}
+
+	if policy, _ := service.Policy(testDeviceID, "temperature"); policy != nil {
+		t.Fatalf("expected no policy to apply")
+	}
+
+	defaultPolicy := testRetentionPolicy(ewserver.RetentionTier{Keep: ewserver.Duration(time.Hour)})
+	devicePolicy := testRetentionPolicy(ewserver.RetentionTier{Keep: ewserver.Duration(2 * time.Hour)})
+	devicePolicy.DeviceID = testDeviceID
+	streamPolicy := testRetentionPolicy(ewserver.RetentionTier{Keep: ewserver.Duration(3 * time.Hour)})
+	streamPolicy.DeviceID = testDeviceID
+	streamPolicy.Stream = "temperature"
+
+	for _, policy := range []*ewserver.RetentionPolicy{defaultPolicy, devicePolicy, streamPolicy} {
+		if err := service.SetPolicy(policy); err != nil {
+			t.Fatalf("error setting policy: %s\n", err)
+		}
+	}
+
+	expected := map[ewserver.StreamName]time.Duration{"temperature": 3 * time.Hour, "humidity": 2 * time.Hour}
+	for stream, keep := range expected {
+		policy, err := service.Policy(testDeviceID, stream)
+		if err != nil || policy == nil || time.Duration(policy.Tiers[0].Keep) != keep {
+			t.Fatalf("expected %s to be kept for %s got: %v %v\n", stream, keep, policy, err)
+		}
+	}
+
+	if policy, _ := service.Policy([]byte("device2"), "temperature"); policy == nil || time.Duration(policy.Tiers[0].Keep) != time.Hour {
+		t.Fatalf("expected the default policy for another device")
+	}
+
+	if err := service.DeletePolicy(testDeviceID, "temperature"); err != nil {
+		t.Fatalf("error deleting policy: %s\n", err)
+	}
+
+	if policies, _ := service.Policies(); len(policies) != 2 {
+		t.Fatalf("expected 2 policies after delete got: %d\n", len(policies))
+	}
+}
+
+func TestRetentionService_Apply(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	telemetry := boltdb.NewTelemetryService(db.DB())
+	if err := telemetry.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+
+	service := boltdb.NewRetentionService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing retention service: %s\n", err)
+	}
+
+	// a point every minute for 6 hours with the values 0 to 359
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	start := now.Add(-6 * time.Hour)
+	for i := 0; i < 360; i++ {
+		point := &ewserver.DataPoint{Timestamp: start.Add(time.Duration(i) * time.Minute), Value: json.RawMessage(fmt.Sprintf("%d", i))}
+		if err := telemetry.Publish(testDeviceID, "temperature", point); err != nil {
+			t.Fatalf("error publishing point: %s\n", err)
+		}
+	}
+
+	// raw for 1 hour, 10 minute rollups for 3 hours, hourly forever
+	policy := testRetentionPolicy(
+		ewserver.RetentionTier{Keep: ewserver.Duration(time.Hour)},
+		ewserver.RetentionTier{Resolution: ewserver.Duration(10 * time.Minute), Keep: ewserver.Duration(3 * time.Hour)},
+		ewserver.RetentionTier{Resolution: ewserver.Duration(time.Hour)},
+	)
+	if err := service.SetPolicy(policy); err != nil {
+		t.Fatalf("error setting policy: %s\n", err)
+	}
+
+	run, err := service.Apply(now)
+	if err != nil {
+		t.Fatalf("error applying retention: %s\n", err)
+	}
+
+	// 36 ten minute and 6 hourly rollups, 300 raw points and 18 ten minute rollups deleted
+	if run.Streams != 1 || run.RolledUp != 42 || run.Deleted != 318 {
+		t.Fatalf("expected 1 stream, 42 rollups and 318 deletes got: %d %d %d\n", run.Streams, run.RolledUp, run.Deleted)
+	}
+
+	points, _ := telemetry.Points(testDeviceID, "temperature", start, now)
+	if len(points) != 60 {
+		t.Fatalf("expected the last hour of raw points got: %d\n", len(points))
+	}
+
+	// the whole range is still queryable from the rollups
+	for _, aggregation := range []ewserver.Aggregation{ewserver.AggregateCount, ewserver.AggregateSum, ewserver.AggregateMin, ewserver.AggregateMax, ewserver.AggregateLast} {
+		series, err := telemetry.Series(testDeviceID, "temperature", &ewserver.SeriesQuery{From: start, To: now, Step: 6 * time.Hour, Aggregation: aggregation})
+		if err != nil || len(series) != 1 {
+			t.Fatalf("expected a single bucket for %s got: %d %v\n", aggregation, len(series), err)
+		}
+
+		expected := map[ewserver.Aggregation]float64{ewserver.AggregateCount: 360, ewserver.AggregateSum: 359 * 360 / 2, ewserver.AggregateMin: 0, ewserver.AggregateMax: 359, ewserver.AggregateLast: 359}
+		if series[0].Value != expected[aggregation] {
+			t.Fatalf("expected %s of %v got: %v\n", aggregation, expected[aggregation], series[0].Value)
+		}
+	}
+
+	// nothing new to roll up or delete
+	if run, _ = service.Apply(now); run.RolledUp != 0 || run.Deleted != 0 {
+		t.Fatalf("expected a second run to do nothing got: %d %d\n", run.RolledUp, run.Deleted)
+	}
+
+	if lastRun, _ := service.LastRun(); lastRun == nil || !lastRun.Started.Equal(now) {
+		t.Fatalf("expected the last run to be stored")
+	}
+
+	// late points into windows already rolled up, with and without their raw points
+	for _, late := range []time.Time{now.Add(-30*time.Minute - 30*time.Second), start.Add(90*time.Minute + 30*time.Second)} {
+		if err := telemetry.Publish(testDeviceID, "temperature", &ewserver.DataPoint{Timestamp: late, Value: json.RawMessage("1000")}); err != nil {
+			t.Fatalf("error publishing late point: %s\n", err)
+		}
+	}
+
+	if _, err := service.Apply(now); err != nil {
+		t.Fatalf("error applying retention: %s\n", err)
+	}
+
+	expected := map[ewserver.Aggregation]float64{ewserver.AggregateCount: 362, ewserver.AggregateSum: 359*360/2 + 2000, ewserver.AggregateMax: 1000}
+	for aggregation, value := range expected {
+		series, err := telemetry.Series(testDeviceID, "temperature", &ewserver.SeriesQuery{From: start, To: now, Step: 6 * time.Hour, Aggregation: aggregation})
+		if err != nil || len(series) != 1 || series[0].Value != value {
+			t.Fatalf("expected %s of %v including the late points got: %v %v\n", aggregation, value, series, err)
+		}
+	}
+}
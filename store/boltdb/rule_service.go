@@ -0,0 +1,276 @@
+package boltdb
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	ruleBucket      = "rules"       // rules keyed by their big endian ID
+	ruleStateBucket = "rule_states" // a nested bucket per rule ID of states keyed by device id
+	alertBucket     = "alerts"      // alerts keyed by their big endian ID
+)
+
+// RuleService implementation storing rules, their per device state and alerts. Rule and alert IDs
+// come from their bucket's sequence.
+type RuleService struct {
+	DB *bolt.DB
+}
+
+// NewRuleService creates a new rule service backed by an already open boltdb
+func NewRuleService(db *bolt.DB) *RuleService {
+	r := &RuleService{DB: db}
+	return r
+}
+
+// Init the rule, state and alert buckets
+func (r *RuleService) Init() error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{ruleBucket, ruleStateBucket, alertBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Create validates and stores a new rule, setting its ID and creation time
+func (r *RuleService) Create(rule *ewserver.Rule) error {
+	if err := rule.Valid(); err != nil {
+		return err
+	}
+
+	rule.CreatedAt = time.Now().UTC()
+	rule.UpdatedAt = rule.CreatedAt
+
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ruleBucket))
+
+		var err error
+		if rule.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		return putRule(bucket, rule)
+	})
+}
+
+// Update validates and replaces an existing rule, keeping who created it and when.
+func (r *RuleService) Update(rule *ewserver.Rule) error {
+	if err := rule.Valid(); err != nil {
+		return err
+	}
+
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ruleBucket))
+		existing, err := getRule(bucket, rule.ID)
+		if err != nil {
+			return err
+		}
+
+		rule.CreatedBy = existing.CreatedBy
+		rule.CreatedAt = existing.CreatedAt
+		rule.UpdatedAt = time.Now().UTC()
+		return putRule(bucket, rule)
+	})
+}
+
+// Rule returns a single rule
+func (r *RuleService) Rule(id uint64) (*ewserver.Rule, error) {
+	var rule *ewserver.Rule
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		rule, err = getRule(tx.Bucket([]byte(ruleBucket)), id)
+		return err
+	})
+	return rule, err
+}
+
+// Rules returns all rules ordered by ID
+func (r *RuleService) Rules() ([]*ewserver.Rule, error) {
+	rules := make([]*ewserver.Rule, 0)
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(ruleBucket)).ForEach(func(k, v []byte) error {
+			rule, err := ewserver.DecodeRule(v)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+			return nil
+		})
+	})
+	return rules, err
+}
+
+// Delete the rule and its states. Alerts it raised are kept. Returns ErrRuleNotFound if it does not exist.
+func (r *RuleService) Delete(id uint64) error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ruleBucket))
+		if bucket.Get(sequenceKey(id)) == nil {
+			return ewserver.ErrRuleNotFound
+		}
+
+		if err := bucket.Delete(sequenceKey(id)); err != nil {
+			return err
+		}
+
+		states := tx.Bucket([]byte(ruleStateBucket))
+		if states.Bucket(sequenceKey(id)) == nil {
+			return nil
+		}
+		return states.DeleteBucket(sequenceKey(id))
+	})
+}
+
+// State returns the rule's state for the device, a new ok state if it has none.
+func (r *RuleService) State(ruleID uint64, deviceID []byte) (*ewserver.RuleState, error) {
+	state := ewserver.NewRuleState(ruleID, deviceID)
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		states := tx.Bucket([]byte(ruleStateBucket)).Bucket(sequenceKey(ruleID))
+		if states == nil {
+			return nil
+		}
+
+		stateBytes := states.Get(deviceID)
+		if stateBytes == nil {
+			return nil
+		}
+
+		var err error
+		state, err = ewserver.DecodeRuleState(stateBytes)
+		return err
+	})
+	return state, err
+}
+
+// States returns the rule's state for every device it was evaluated for
+func (r *RuleService) States(ruleID uint64) ([]*ewserver.RuleState, error) {
+	states := make([]*ewserver.RuleState, 0)
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ruleStateBucket)).Bucket(sequenceKey(ruleID))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			state, err := ewserver.DecodeRuleState(v)
+			if err != nil {
+				return err
+			}
+			states = append(states, state)
+			return nil
+		})
+	})
+	return states, err
+}
+
+// SetState stores the rule's state for the device
+func (r *RuleService) SetState(state *ewserver.RuleState) error {
+	if len(state.DeviceID) == 0 {
+		return ewserver.ErrUserNotFound
+	}
+
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		states, err := tx.Bucket([]byte(ruleStateBucket)).CreateBucketIfNotExists(sequenceKey(state.RuleID))
+		if err != nil {
+			return err
+		}
+
+		stateBytes, err := state.Encode()
+		if err != nil {
+			return err
+		}
+		return states.Put(state.DeviceID, stateBytes)
+	})
+}
+
+// CreateAlert stores a new firing alert, setting its ID
+func (r *RuleService) CreateAlert(alert *ewserver.Alert) error {
+	alert.State = ewserver.AlertFiring
+
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(alertBucket))
+
+		var err error
+		if alert.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		return putAlert(bucket, alert)
+	})
+}
+
+// ResolveAlert marks the alert resolved at the time with the value that resolved it
+func (r *RuleService) ResolveAlert(id uint64, value json.RawMessage, at time.Time) (*ewserver.Alert, error) {
+	var alert *ewserver.Alert
+
+	err := r.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(alertBucket))
+		alertBytes := bucket.Get(sequenceKey(id))
+		if alertBytes == nil {
+			return ewserver.ErrAlertNotFound
+		}
+
+		var err error
+		if alert, err = ewserver.DecodeAlert(alertBytes); err != nil {
+			return err
+		}
+
+		alert.State = ewserver.AlertResolved
+		alert.Value = value
+		alert.ResolvedAt = at
+		return putAlert(bucket, alert)
+	})
+	return alert, err
+}
+
+// Alerts returns the alerts in the state ordered by ID, all alerts if state is empty
+func (r *RuleService) Alerts(state ewserver.AlertState) ([]*ewserver.Alert, error) {
+	alerts := make([]*ewserver.Alert, 0)
+
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(alertBucket)).ForEach(func(k, v []byte) error {
+			alert, err := ewserver.DecodeAlert(v)
+			if err != nil {
+				return err
+			}
+
+			if state == "" || alert.State == state {
+				alerts = append(alerts, alert)
+			}
+			return nil
+		})
+	})
+	return alerts, err
+}
+
+// getRule decodes the rule, returning ErrRuleNotFound if it does not exist.
+func getRule(bucket *bolt.Bucket, id uint64) (*ewserver.Rule, error) {
+	ruleBytes := bucket.Get(sequenceKey(id))
+	if ruleBytes == nil {
+		return nil, ewserver.ErrRuleNotFound
+	}
+	return ewserver.DecodeRule(ruleBytes)
+}
+
+func putRule(bucket *bolt.Bucket, rule *ewserver.Rule) error {
+	ruleBytes, err := rule.Encode()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(sequenceKey(rule.ID), ruleBytes)
+}
+
+func putAlert(bucket *bolt.Bucket, alert *ewserver.Alert) error {
+	alertBytes, err := alert.Encode()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(sequenceKey(alert.ID), alertBytes)
+}
@@ -0,0 +1,137 @@
+package boltdb_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestRule_Valid(t *testing.T) {
+	rule := &ewserver.Rule{Name: "hot", Stream: "temperature", Expression: "temperature > 80 for 5m"}
+	if err := rule.Valid(); err != nil {
+		t.Fatalf("expected rule to be valid got: %s\n", err)
+	}
+
+	if rule.Expression != "temperature > 80" || time.Duration(rule.For) != 5*time.Minute {
+		t.Fatalf("expected the for clause to be split out got: %s %v\n", rule.Expression, rule.For)
+	}
+
+	invalid := []*ewserver.Rule{
+		{Stream: "temperature", Expression: "value > 1"},
+		{Name: "bad", Stream: "temperature", Expression: "value >"},
+		{Name: "bad", Stream: "temperature", Expression: "value > 1", ResolveExpression: "(value"},
+		{Name: "bad", Stream: "temperature", Expression: "value > 1 for 30d"},
+		{Name: "bad", Stream: "temperature", Expression: "value > 1", Actions: []ewserver.RuleAction{{Type: "email"}}},
+		{Name: "bad", Stream: "temperature", Expression: "value > 1", Actions: []ewserver.RuleAction{{Type: ewserver.RuleActionWebhook, URL: "ftp://example.com"}}},
+	}
+
+	for i, rule := range invalid {
+		if err := rule.Valid(); err != ewserver.ErrInvalidRule {
+			t.Fatalf("expected rule %d to be invalid got: %v\n", i, err)
+		}
+	}
+}
+
+func TestRuleService_Rules(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewRuleService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing rule service: %s\n", err)
+	}
+
+	rule := &ewserver.Rule{Name: "low battery", Stream: "battery", Expression: "battery < 3.3", CreatedBy: "admin"}
+	if err := service.Create(rule); err != nil {
+		t.Fatalf("error creating rule: %s\n", err)
+	}
+
+	update := &ewserver.Rule{ID: rule.ID, Name: "low battery", Stream: "battery", Expression: "battery < 3.2", CreatedBy: "someone"}
+	if err := service.Update(update); err != nil {
+		t.Fatalf("error updating rule: %s\n", err)
+	}
+
+	stored, err := service.Rule(rule.ID)
+	if err != nil || stored.Expression != "battery < 3.2" || stored.CreatedBy != "admin" {
+		t.Fatalf("expected the updated rule keeping its creator got: %v %v\n", stored, err)
+	}
+
+	state, err := service.State(rule.ID, testDeviceID)
+	if err != nil || state.Status != ewserver.RuleOK {
+		t.Fatalf("expected an ok state got: %v %v\n", state, err)
+	}
+
+	state.Status = ewserver.RuleFiring
+	if err := service.SetState(state); err != nil {
+		t.Fatalf("error setting state: %s\n", err)
+	}
+
+	if states, _ := service.States(rule.ID); len(states) != 1 || states[0].Status != ewserver.RuleFiring {
+		t.Fatalf("expected a single firing state got: %v\n", states)
+	}
+
+	if err := service.Delete(rule.ID); err != nil {
+		t.Fatalf("error deleting rule: %s\n", err)
+	}
+
+	if _, err := service.Rule(rule.ID); err != ewserver.ErrRuleNotFound {
+		t.Fatalf("expected rule not found got: %v\n", err)
+	}
+
+	if states, _ := service.States(rule.ID); len(states) != 0 {
+		t.Fatalf("expected states to be deleted with the rule got: %d\n", len(states))
+	}
+
+	if err := service.Update(update); err != ewserver.ErrRuleNotFound {
+		t.Fatalf("expected updating a deleted rule to fail got: %v\n", err)
+	}
+}
+
+func TestRuleService_Alerts(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewRuleService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing rule service: %s\n", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		alert := &ewserver.Alert{RuleID: 1, DeviceID: testDeviceID, Stream: "temperature", Value: json.RawMessage(`81`), FiredAt: time.Now().UTC()}
+		if err := service.CreateAlert(alert); err != nil || alert.ID != uint64(i+1) {
+			t.Fatalf("error creating alert %d: %v\n", alert.ID, err)
+		}
+	}
+
+	alert, err := service.ResolveAlert(1, json.RawMessage(`70`), time.Now().UTC())
+	if err != nil || alert.State != ewserver.AlertResolved || string(alert.Value) != "70" {
+		t.Fatalf("expected alert to be resolved got: %v %v\n", alert, err)
+	}
+
+	if _, err := service.ResolveAlert(3, nil, time.Now()); err != ewserver.ErrAlertNotFound {
+		t.Fatalf("expected alert not found got: %v\n", err)
+	}
+
+	if firing, _ := service.Alerts(ewserver.AlertFiring); len(firing) != 1 || firing[0].ID != 2 {
+		t.Fatalf("expected alert 2 to be firing got: %v\n", firing)
+	}
+
+	if all, _ := service.Alerts(""); len(all) != 2 {
+		t.Fatalf("expected 2 alerts got: %d\n", len(all))
+	}
+}
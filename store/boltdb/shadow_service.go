@@ -0,0 +1,106 @@
+package boltdb
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const shadowBucket = "shadows" // shadow documents keyed by device id
+
+// ShadowService implementation that stores each device's shadow document in a single key so
+// desired and reported updates share one version.
+type ShadowService struct {
+	DB *bolt.DB
+}
+
+// NewShadowService creates a new shadow service backed by an already open boltdb
+func NewShadowService(db *bolt.DB) *ShadowService {
+	s := &ShadowService{DB: db}
+	return s
+}
+
+// Init the shadow bucket
+func (s *ShadowService) Init() error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(shadowBucket))
+		return err
+	})
+}
+
+// Shadow returns the device's shadow, or an empty shadow at version 0 if it has none.
+func (s *ShadowService) Shadow(deviceID []byte) (*ewserver.Shadow, error) {
+	var shadow *ewserver.Shadow
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		shadow, err = getShadow(tx.Bucket([]byte(shadowBucket)), deviceID)
+		return err
+	})
+	return shadow, err
+}
+
+// UpdateDesired merges state into the device's desired section, see ewserver.Shadow.UpdateDesired
+func (s *ShadowService) UpdateDesired(deviceID []byte, state ewserver.ShadowState, version uint64) (*ewserver.Shadow, error) {
+	return s.update(deviceID, func(shadow *ewserver.Shadow, now time.Time) error {
+		return shadow.UpdateDesired(state, version, now)
+	})
+}
+
+// UpdateReported merges state into the device's reported section, see ewserver.Shadow.UpdateReported
+func (s *ShadowService) UpdateReported(deviceID []byte, state ewserver.ShadowState, version uint64) (*ewserver.Shadow, error) {
+	return s.update(deviceID, func(shadow *ewserver.Shadow, now time.Time) error {
+		return shadow.UpdateReported(state, version, now)
+	})
+}
+
+// Delete the device's shadow. Does not return an error if it does not exist.
+func (s *ShadowService) Delete(deviceID []byte) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(shadowBucket)).Delete(deviceID)
+	})
+}
+
+// update applies fn to the device's shadow and stores it, all in one transaction so the version
+// check can not race another writer.
+func (s *ShadowService) update(deviceID []byte, fn func(shadow *ewserver.Shadow, now time.Time) error) (*ewserver.Shadow, error) {
+	if len(deviceID) == 0 {
+		return nil, ewserver.ErrUserNotFound
+	}
+
+	var shadow *ewserver.Shadow
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(shadowBucket))
+
+		var err error
+		if shadow, err = getShadow(bucket, deviceID); err != nil {
+			return err
+		}
+
+		if err := fn(shadow, time.Now().UTC()); err != nil {
+			return err
+		}
+
+		shadowBytes, err := shadow.Encode()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(deviceID, shadowBytes)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return shadow, nil
+}
+
+// getShadow decodes the device's shadow, returning a new empty one if it does not exist.
+func getShadow(bucket *bolt.Bucket, deviceID []byte) (*ewserver.Shadow, error) {
+	shadowBytes := bucket.Get(deviceID)
+	if shadowBytes == nil {
+		return ewserver.NewShadow(deviceID), nil
+	}
+	return ewserver.DecodeShadow(shadowBytes)
+}
@@ -0,0 +1,78 @@
+package boltdb_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestShadowService_Update(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewShadowService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing shadow service: %s\n", err)
+	}
+
+	shadow, err := service.Shadow(testDeviceID)
+	if err != nil || shadow.Version != 0 {
+		t.Fatalf("expected an empty shadow got: %v %v\n", shadow, err)
+	}
+
+	desired := ewserver.ShadowState{"led": json.RawMessage(`"on"`), "config": json.RawMessage(`{"a":1,"b":2}`)}
+	if shadow, err = service.UpdateDesired(testDeviceID, desired, 0); err != nil {
+		t.Fatalf("error updating desired state: %s\n", err)
+	}
+
+	if shadow.Version != 1 || len(shadow.Delta()) != 2 || shadow.Metadata.Desired["led"].IsZero() {
+		t.Fatalf("expected version 1 with both fields in the delta got: %d %d\n", shadow.Version, len(shadow.Delta()))
+	}
+
+	// formatting and key order do not matter when comparing values
+	reported := ewserver.ShadowState{"led": json.RawMessage(`"on"`), "config": json.RawMessage(`{ "b": 2, "a": 1 }`)}
+	if _, err := service.UpdateReported(testDeviceID, reported, 2); err != ewserver.ErrVersionConflict {
+		t.Fatalf("expected version conflict got: %v\n", err)
+	}
+
+	if shadow, err = service.UpdateReported(testDeviceID, reported, 1); err != nil {
+		t.Fatalf("error updating reported state: %s\n", err)
+	}
+
+	if shadow.Version != 2 || len(shadow.Delta()) != 0 {
+		t.Fatalf("expected version 2 and no delta got: %d %d\n", shadow.Version, len(shadow.Delta()))
+	}
+
+	// null deletes the field
+	if shadow, err = service.UpdateDesired(testDeviceID, ewserver.ShadowState{"config": json.RawMessage(`null`)}, 0); err != nil {
+		t.Fatalf("error updating desired state: %s\n", err)
+	}
+
+	if shadow, err = service.Shadow(testDeviceID); err != nil {
+		t.Fatalf("error getting shadow: %s\n", err)
+	}
+
+	if _, ok := shadow.Desired["config"]; ok || shadow.Version != 3 {
+		t.Fatalf("expected config to be deleted at version 3 got: %d\n", shadow.Version)
+	}
+
+	if _, err := service.UpdateDesired(testDeviceID, ewserver.ShadowState{"led": json.RawMessage(`{`)}, 0); err != ewserver.ErrInvalidShadow {
+		t.Fatalf("expected invalid shadow error got: %v\n", err)
+	}
+
+	if err := service.Delete(testDeviceID); err != nil {
+		t.Fatalf("error deleting shadow: %s\n", err)
+	}
+
+	if shadow, _ = service.Shadow(testDeviceID); shadow.Version != 0 {
+		t.Fatalf("expected an empty shadow after delete got: %d\n", shadow.Version)
+	}
+}
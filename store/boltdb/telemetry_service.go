@@ -0,0 +1,341 @@
+package boltdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	telemetryBucket = "telemetry" // bucket holding a nested bucket per device, which holds a nested bucket per stream
+	timestampSize   = 8
+)
+
+// TelemetryService implementation that stores device data points. Points are stored
+// under telemetry/<device id>/<stream> keyed by their big endian nanosecond timestamp so
+// cursors can seek directly to the start of a time range. BatchSize is how many points of
+// a batch are written per transaction, 0 writes the whole batch in one.
+type TelemetryService struct {
+	DB        *bolt.DB
+	BatchSize int
+}
+
+// NewTelemetryService creates a new telemetry service backed by an already open boltdb
+func NewTelemetryService(db *bolt.DB) *TelemetryService {
+	t := &TelemetryService{DB: db}
+	return t
+}
+
+// Init the telemetry bucket
+func (t *TelemetryService) Init() error {
+	return t.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(telemetryBucket))
+		return err
+	})
+}
+
+// Publish stores the point for the device's stream. If the point has no timestamp the current
+// time is used. Points published with the exact same timestamp replace the previous value.
+func (t *TelemetryService) Publish(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+	if err := validatePoint(deviceID, stream, point); err != nil {
+		return err
+	}
+
+	return t.DB.Update(func(tx *bolt.Tx) error {
+		return putPoint(tx, deviceID, stream, point)
+	})
+}
+
+// PublishBatch validates each point, rejecting invalid ones with the reason, and stores the rest in
+// transactions of BatchSize points. If a transaction fails only its points are rejected. Returns
+// ErrInvalidBatch if the batch is empty or has more than MaxBatchSize points.
+func (t *TelemetryService) PublishBatch(deviceID []byte, points []*ewserver.BatchPoint) ([]*ewserver.BatchResult, error) {
+	if len(deviceID) == 0 {
+		return nil, ewserver.ErrUserNotFound
+	}
+
+	if len(points) == 0 || len(points) > ewserver.MaxBatchSize {
+		return nil, ewserver.ErrInvalidBatch
+	}
+
+	results := make([]*ewserver.BatchResult, len(points))
+	valid := make([]int, 0, len(points))
+	for i, point := range points {
+		results[i] = &ewserver.BatchResult{Index: i}
+		if point == nil {
+			results[i].Error = ewserver.ErrInvalidDataPoint.Error()
+			continue
+		}
+
+		results[i].Stream = point.Stream
+		if err := validatePoint(deviceID, point.Stream, &point.DataPoint); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Timestamp = point.Timestamp
+		valid = append(valid, i)
+	}
+
+	size := t.BatchSize
+	if size <= 0 {
+		size = len(valid)
+	}
+
+	for start := 0; start < len(valid); start += size {
+		end := start + size
+		if end > len(valid) {
+			end = len(valid)
+		}
+
+		chunk := valid[start:end]
+		err := t.DB.Update(func(tx *bolt.Tx) error {
+			for _, i := range chunk {
+				if err := putPoint(tx, deviceID, points[i].Stream, &points[i].DataPoint); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		for _, i := range chunk {
+			if err != nil {
+				results[i].Error = err.Error()
+			} else {
+				results[i].Accepted = true
+			}
+		}
+	}
+	return results, nil
+}
+
+// Points returns all points for the device's stream in the range [from, to) ordered by time.
+// A zero to time means no upper bound. Returns an empty slice if the stream does not exist.
+func (t *TelemetryService) Points(deviceID []byte, stream ewserver.StreamName, from, to time.Time) ([]*ewserver.DataPoint, error) {
+	points := make([]*ewserver.DataPoint, 0)
+
+	err := t.ForEachPoint(deviceID, stream, from, to, func(point *ewserver.DataPoint) error {
+		points = append(points, point)
+		return nil
+	})
+	return points, err
+}
+
+// ForEachPoint calls fn with each point of the device's stream in the range [from, to) ordered by time,
+// in a single read transaction so callers can stream them. A zero to time means no upper bound. The first
+// error returned by fn stops the iteration.
+func (t *TelemetryService) ForEachPoint(deviceID []byte, stream ewserver.StreamName, from, to time.Time, fn func(*ewserver.DataPoint) error) error {
+	return t.DB.View(func(tx *bolt.Tx) error {
+		bucket := streamBucket(tx, deviceID, stream)
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek(timestampKey(from)); k != nil && inRange(k, to); k, v = c.Next() {
+			if err := fn(decodePoint(k, v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Latest returns the most recent point of the device's stream, or ErrPointNotFound if the stream is empty.
+func (t *TelemetryService) Latest(deviceID []byte, stream ewserver.StreamName) (*ewserver.DataPoint, error) {
+	var point *ewserver.DataPoint
+
+	err := t.DB.View(func(tx *bolt.Tx) error {
+		bucket := streamBucket(tx, deviceID, stream)
+		if bucket == nil {
+			return ewserver.ErrPointNotFound
+		}
+
+		k, v := bucket.Cursor().Last()
+		if k == nil {
+			return ewserver.ErrPointNotFound
+		}
+		point = decodePoint(k, v)
+		return nil
+	})
+	return point, err
+}
+
+// Series downsamples the device's stream into buckets as described by the query, aggregating
+// while iterating the cursors so points are never held in memory. Once raw points were deleted by
+// a retention policy the range they covered is served from the finest rollups that remain.
+// Empty buckets are omitted.
+func (t *TelemetryService) Series(deviceID []byte, stream ewserver.StreamName, query *ewserver.SeriesQuery) ([]*ewserver.SeriesBucket, error) {
+	if err := query.Valid(); err != nil {
+		return nil, err
+	}
+
+	aggregators := make(map[int64]*ewserver.Aggregator)
+	aggregator := func(ts time.Time) *ewserver.Aggregator {
+		start := query.BucketStart(ts).UnixNano()
+		if _, ok := aggregators[start]; !ok {
+			aggregators[start] = ewserver.NewAggregator(query.Aggregation)
+		}
+		return aggregators[start]
+	}
+
+	err := t.DB.View(func(tx *bolt.Tx) error {
+		raw := streamBucket(tx, deviceID, stream)
+		if raw == nil {
+			return nil
+		}
+
+		// each tier covers the windows that end before the next finer tier's data starts
+		rollups := rollupTiers(tx, deviceID, stream)
+		ends := make([]time.Time, len(rollups))
+		end := earliest(query.To, raw)
+		for i, rollup := range rollups {
+			ends[i] = end
+			end = earliest(end, rollup.bucket)
+		}
+
+		// add the oldest data first so the last aggregation sees points in order
+		for i := len(rollups) - 1; i >= 0; i-- {
+			c := rollups[i].bucket.Cursor()
+			for k, v := c.Seek(timestampKey(query.From)); k != nil; k, v = c.Next() {
+				ts := keyTimestamp(k)
+				if ts.Add(rollups[i].resolution).After(ends[i]) {
+					break
+				}
+
+				rollup := &ewserver.Rollup{}
+				if err := json.Unmarshal(v, rollup); err != nil {
+					return err
+				}
+				aggregator(ts).AddRollup(rollup)
+			}
+		}
+
+		c := raw.Cursor()
+		for k, v := c.Seek(timestampKey(query.From)); k != nil && inRange(k, query.To); k, v = c.Next() {
+			aggregator(keyTimestamp(k)).Add(v)
+		}
+		return nil
+	})
+
+	starts := make([]int64, 0, len(aggregators))
+	for start := range aggregators {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	buckets := make([]*ewserver.SeriesBucket, 0, len(starts))
+	for _, start := range starts {
+		if !aggregators[start].Empty() {
+			buckets = append(buckets, aggregators[start].Bucket(time.Unix(0, start).UTC()))
+		}
+	}
+	return buckets, err
+}
+
+// Streams returns the names of all streams the device has published to.
+func (t *TelemetryService) Streams(deviceID []byte) ([]ewserver.StreamName, error) {
+	streams := make([]ewserver.StreamName, 0)
+
+	err := t.DB.View(func(tx *bolt.Tx) error {
+		device := tx.Bucket([]byte(telemetryBucket)).Bucket(deviceID)
+		if device == nil {
+			return nil
+		}
+
+		return device.ForEach(func(k, v []byte) error {
+			streams = append(streams, ewserver.StreamName(k))
+			return nil
+		})
+	})
+	return streams, err
+}
+
+// validatePoint ensures the device, stream and point are valid prior to storing, setting the
+// point's timestamp to now if it is missing.
+func validatePoint(deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+	if len(deviceID) == 0 {
+		return ewserver.ErrUserNotFound
+	}
+
+	if !stream.Valid() {
+		return ewserver.ErrInvalidStream
+	}
+
+	if point == nil || len(point.Value) == 0 || !json.Valid(point.Value) {
+		return ewserver.ErrInvalidDataPoint
+	}
+
+	if point.Timestamp.IsZero() {
+		point.Timestamp = time.Now().UTC()
+	}
+
+	// timestamps are stored as unsigned integers, anything prior to the epoch would sort incorrectly.
+	if point.Timestamp.UnixNano() < 0 {
+		return ewserver.ErrInvalidDataPoint
+	}
+	return nil
+}
+
+// putPoint writes the point inside an existing writable transaction, creating the device and stream buckets as necessary.
+func putPoint(tx *bolt.Tx, deviceID []byte, stream ewserver.StreamName, point *ewserver.DataPoint) error {
+	device, err := tx.Bucket([]byte(telemetryBucket)).CreateBucketIfNotExists(deviceID)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := device.CreateBucketIfNotExists(stream.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// points published into windows that were already rolled up update the rollups with them
+	late := findLateRollups(tx, deviceID, stream, bucket, point.Timestamp)
+	if err := bucket.Put(timestampKey(point.Timestamp), point.Value); err != nil {
+		return err
+	}
+	return late.update(bucket, point)
+}
+
+// streamBucket returns the bucket for the device's stream, or nil if it does not exist.
+func streamBucket(tx *bolt.Tx, deviceID []byte, stream ewserver.StreamName) *bolt.Bucket {
+	device := tx.Bucket([]byte(telemetryBucket)).Bucket(deviceID)
+	if device == nil {
+		return nil
+	}
+	return device.Bucket(stream.Bytes())
+}
+
+// timestampKey encodes the time as a big endian nanosecond timestamp so keys sort by time.
+func timestampKey(ts time.Time) []byte {
+	key := make([]byte, timestampSize)
+	if ts.IsZero() || ts.UnixNano() < 0 {
+		return key
+	}
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	return key
+}
+
+// keyTimestamp decodes a timestampKey back to a UTC time.
+func keyTimestamp(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key))).UTC()
+}
+
+// inRange returns true if the key is before the end time, a zero end time is unbounded.
+func inRange(key []byte, to time.Time) bool {
+	if to.IsZero() {
+		return true
+	}
+	return keyTimestamp(key).Before(to)
+}
+
+// decodePoint copies the key and value out of the bolt transaction into a new DataPoint.
+func decodePoint(key, value []byte) *ewserver.DataPoint {
+	point := ewserver.NewDataPoint()
+	point.Timestamp = keyTimestamp(key)
+	point.Value = append(json.RawMessage{}, value...)
+	return point
+}
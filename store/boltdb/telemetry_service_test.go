@@ -0,0 +1,379 @@
+package boltdb_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+const testStream = ewserver.StreamName("temperature")
+
+var (
+	testDeviceID  = []byte("device1")
+	testStartTime = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func TestTelemetryService_Publish(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewTelemetryService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+
+	point := &ewserver.DataPoint{Value: json.RawMessage(`{"celsius": 21.5}`)}
+	if err := service.Publish(testDeviceID, testStream, point); err != nil {
+		t.Fatalf("error publishing point: %s\n", err)
+	}
+
+	if point.Timestamp.IsZero() {
+		t.Fatalf("expected missing timestamp to be set on publish")
+	}
+
+	point = &ewserver.DataPoint{Value: json.RawMessage(`{"celsius": `)}
+	if err := service.Publish(testDeviceID, testStream, point); err != ewserver.ErrInvalidDataPoint {
+		t.Fatalf("expected invalid data point error for bad json, got: %v\n", err)
+	}
+
+	point = &ewserver.DataPoint{Value: json.RawMessage(`1`)}
+	if err := service.Publish(testDeviceID, "../bad", point); err != ewserver.ErrInvalidStream {
+		t.Fatalf("expected invalid stream error, got: %v\n", err)
+	}
+
+	if err := service.Publish(nil, testStream, point); err != ewserver.ErrUserNotFound {
+		t.Fatalf("expected user not found error for empty device id, got: %v\n", err)
+	}
+}
+
+func TestTelemetryService_PublishBatch(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewTelemetryService(db.DB())
+	service.BatchSize = 2
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+
+	batch := []*ewserver.BatchPoint{
+		{Stream: testStream, DataPoint: ewserver.DataPoint{Timestamp: testStartTime, Value: json.RawMessage(`20`)}},
+		{Stream: "humidity", DataPoint: ewserver.DataPoint{Timestamp: testStartTime, Value: json.RawMessage(`40`)}},
+		{Stream: "../bad", DataPoint: ewserver.DataPoint{Value: json.RawMessage(`1`)}},
+		{Stream: testStream, DataPoint: ewserver.DataPoint{Timestamp: testStartTime.Add(time.Minute), Value: json.RawMessage(`{"celsius": `)}},
+		nil,
+		{Stream: testStream, DataPoint: ewserver.DataPoint{Timestamp: testStartTime.Add(time.Minute), Value: json.RawMessage(`21`)}},
+	}
+
+	results, err := service.PublishBatch(testDeviceID, batch)
+	if err != nil || len(results) != len(batch) {
+		t.Fatalf("error publishing batch: %v %d\n", err, len(results))
+	}
+
+	expected := []string{"", "", ewserver.ErrInvalidStream.Error(), ewserver.ErrInvalidDataPoint.Error(), ewserver.ErrInvalidDataPoint.Error(), ""}
+	for i, result := range results {
+		if result.Index != i || result.Accepted != (expected[i] == "") || result.Error != expected[i] {
+			t.Fatalf("expected point %d to have error %q got: %#v\n", i, expected[i], result)
+		}
+	}
+
+	points, err := service.Points(testDeviceID, testStream, testStartTime, time.Time{})
+	if err != nil || len(points) != 2 || string(points[1].Value) != "21" {
+		t.Fatalf("expected both valid temperature points to be stored got: %d %v\n", len(points), err)
+	}
+
+	if _, err := service.PublishBatch(testDeviceID, nil); err != ewserver.ErrInvalidBatch {
+		t.Fatalf("expected ErrInvalidBatch for an empty batch got: %v\n", err)
+	}
+
+	if _, err := service.PublishBatch(testDeviceID, make([]*ewserver.BatchPoint, ewserver.MaxBatchSize+1)); err != ewserver.ErrInvalidBatch {
+		t.Fatalf("expected ErrInvalidBatch for a batch that is too large got: %v\n", err)
+	}
+}
+
+func TestTelemetryService_Points(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewTelemetryService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+
+	points, err := service.Points(testDeviceID, testStream, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("got error when stream is empty: %s\n", err)
+	}
+
+	if len(points) != 0 {
+		t.Fatalf("points should be empty")
+	}
+
+	testPublishPoints(service, 10, t)
+
+	points, err = service.Points(testDeviceID, testStream, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("error getting points: %s\n", err)
+	}
+
+	if len(points) != 10 {
+		t.Fatalf("expected 10 points got: %d\n", len(points))
+	}
+
+	from := testStartTime.Add(2 * time.Second)
+	to := testStartTime.Add(5 * time.Second)
+	points, err = service.Points(testDeviceID, testStream, from, to)
+	if err != nil {
+		t.Fatalf("error getting points in range: %s\n", err)
+	}
+
+	if len(points) != 3 {
+		t.Fatalf("expected 3 points in range got: %d\n", len(points))
+	}
+
+	if !points[0].Timestamp.Equal(from) {
+		t.Fatalf("expected first point at %s got: %s\n", from, points[0].Timestamp)
+	}
+
+	if string(points[0].Value) != "2" {
+		t.Fatalf("expected first point value 2 got: %s\n", points[0].Value)
+	}
+
+	points, err = service.Points([]byte("otherdevice"), testStream, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("error getting points for other device: %s\n", err)
+	}
+
+	if len(points) != 0 {
+		t.Fatalf("expected points to be isolated per device, got: %d\n", len(points))
+	}
+}
+
+func TestTelemetryService_Series(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewTelemetryService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+
+	// 0..59 one per second
+	testPublishPoints(service, 60, t)
+
+	query := &ewserver.SeriesQuery{
+		From:        testStartTime,
+		To:          testStartTime.Add(time.Minute),
+		Step:        10 * time.Second,
+		Aggregation: ewserver.AggregateAvg,
+	}
+
+	expected := map[ewserver.Aggregation][]float64{
+		ewserver.AggregateAvg:   {4.5, 14.5, 24.5, 34.5, 44.5, 54.5},
+		ewserver.AggregateMin:   {0, 10, 20, 30, 40, 50},
+		ewserver.AggregateMax:   {9, 19, 29, 39, 49, 59},
+		ewserver.AggregateSum:   {45, 145, 245, 345, 445, 545},
+		ewserver.AggregateCount: {10, 10, 10, 10, 10, 10},
+		ewserver.AggregateLast:  {9, 19, 29, 39, 49, 59},
+	}
+
+	for aggregation, values := range expected {
+		query.Aggregation = aggregation
+		series, err := service.Series(testDeviceID, testStream, query)
+		if err != nil {
+			t.Fatalf("error getting %s series: %s\n", aggregation, err)
+		}
+
+		if len(series) != len(values) {
+			t.Fatalf("expected %d %s buckets got: %d\n", len(values), aggregation, len(series))
+		}
+
+		for i, bucket := range series {
+			if bucket.Value != values[i] {
+				t.Fatalf("expected %s bucket %d to be %f got: %f\n", aggregation, i, values[i], bucket.Value)
+			}
+
+			if !bucket.Timestamp.Equal(testStartTime.Add(time.Duration(i) * query.Step)) {
+				t.Fatalf("bucket %d has unaligned timestamp: %s\n", i, bucket.Timestamp)
+			}
+		}
+	}
+
+	// non numeric values only count
+	point := &ewserver.DataPoint{Timestamp: testStartTime.Add(90 * time.Second), Value: json.RawMessage(`"text"`)}
+	if err := service.Publish(testDeviceID, testStream, point); err != nil {
+		t.Fatalf("error publishing point: %s\n", err)
+	}
+
+	query.To = testStartTime.Add(2 * time.Minute)
+	query.Aggregation = ewserver.AggregateMax
+	series, err := service.Series(testDeviceID, testStream, query)
+	if err != nil {
+		t.Fatalf("error getting series: %s\n", err)
+	}
+
+	if len(series) != 6 {
+		t.Fatalf("expected non numeric bucket to be omitted from max, got %d buckets\n", len(series))
+	}
+
+	query.Aggregation = ewserver.AggregateCount
+	series, err = service.Series(testDeviceID, testStream, query)
+	if err != nil {
+		t.Fatalf("error getting series: %s\n", err)
+	}
+
+	if len(series) != 7 {
+		t.Fatalf("expected non numeric bucket to be counted, got %d buckets\n", len(series))
+	}
+
+	query.Step = time.Millisecond
+	if _, err := service.Series(testDeviceID, testStream, query); err != ewserver.ErrInvalidQuery {
+		t.Fatalf("expected invalid query for too many buckets, got: %v\n", err)
+	}
+
+	query.Step = time.Second
+	query.Aggregation = "median"
+	if _, err := service.Series(testDeviceID, testStream, query); err != ewserver.ErrInvalidQuery {
+		t.Fatalf("expected invalid query for unknown aggregation, got: %v\n", err)
+	}
+}
+
+func TestTelemetryService_Streams(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewTelemetryService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+
+	testPublishPoints(service, 1, t)
+	point := &ewserver.DataPoint{Value: json.RawMessage(`3.3`)}
+	if err := service.Publish(testDeviceID, "battery", point); err != nil {
+		t.Fatalf("error publishing point: %s\n", err)
+	}
+
+	streams, err := service.Streams(testDeviceID)
+	if err != nil {
+		t.Fatalf("error getting streams: %s\n", err)
+	}
+
+	if len(streams) != 2 {
+		t.Fatalf("expected 2 streams got: %d\n", len(streams))
+	}
+}
+
+func TestTelemetryService_Latest(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewTelemetryService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+
+	if _, err := service.Latest(testDeviceID, testStream); err != ewserver.ErrPointNotFound {
+		t.Fatalf("expected point not found for empty stream got: %v\n", err)
+	}
+
+	testPublishPoints(service, 10, t)
+
+	point, err := service.Latest(testDeviceID, testStream)
+	if err != nil {
+		t.Fatalf("error getting latest point: %s\n", err)
+	}
+
+	if string(point.Value) != "9" || !point.Timestamp.Equal(testStartTime.Add(9*time.Second)) {
+		t.Fatalf("expected last point got: %s at %s\n", point.Value, point.Timestamp)
+	}
+}
+
+func TestTelemetryService_ForEachPoint(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewTelemetryService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing telemetry service: %s\n", err)
+	}
+	testPublishPoints(service, 10, t)
+
+	var values []string
+	err = service.ForEachPoint(testDeviceID, testStream, testStartTime.Add(2*time.Second), time.Time{}, func(point *ewserver.DataPoint) error {
+		values = append(values, string(point.Value))
+		return nil
+	})
+	if err != nil || len(values) != 8 || values[0] != "2" || values[7] != "9" {
+		t.Fatalf("expected points 2 to 9 got: %v %v\n", values, err)
+	}
+
+	// an error from fn stops the iteration and is returned
+	count := 0
+	err = service.ForEachPoint(testDeviceID, testStream, testStartTime, time.Time{}, func(point *ewserver.DataPoint) error {
+		if count++; count == 3 {
+			return ewserver.ErrInvalidQuery
+		}
+		return nil
+	})
+	if err != ewserver.ErrInvalidQuery || count != 3 {
+		t.Fatalf("expected iteration to stop at the third point got: %d %v\n", count, err)
+	}
+}
+
+// testPublishPoints publishes count points, one per second from testStartTime, valued by their index.
+func testPublishPoints(service *boltdb.TelemetryService, count int, t *testing.T) {
+	for i := 0; i < count; i++ {
+		point := ewserver.NewDataPoint()
+		point.Timestamp = testStartTime.Add(time.Duration(i) * time.Second)
+		point.Value, _ = json.Marshal(i)
+
+		if err := service.Publish(testDeviceID, testStream, point); err != nil {
+			t.Fatalf("error publishing point: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package boltdb
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	uploadSequenceBucket = "upload_sequences" // upload sequences keyed by device ID
+	uploadKeyBucket      = "upload_keys"      // bucket holding a nested bucket per device of idempotency keys and when they were accepted
+)
+
+// UploadService implementation storing each device's upload sequence and idempotency keys
+type UploadService struct {
+	DB *bolt.DB
+}
+
+// NewUploadService creates a new upload service backed by an already open boltdb
+func NewUploadService(db *bolt.DB) *UploadService {
+	u := &UploadService{DB: db}
+	return u
+}
+
+// Init the upload sequence and key buckets
+func (u *UploadService) Init() error {
+	return u.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(uploadSequenceBucket)); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists([]byte(uploadKeyBucket))
+		return err
+	})
+}
+
+// Sequence returns the device's upload sequence, a new one if it never uploaded with a sequence number
+func (u *UploadService) Sequence(deviceID []byte) (*ewserver.UploadSequence, error) {
+	var sequence *ewserver.UploadSequence
+
+	err := u.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		sequence, err = getUploadSequence(tx.Bucket([]byte(uploadSequenceBucket)), deviceID)
+		return err
+	})
+	return sequence, err
+}
+
+// AcceptSequence records the sequence number of the epoch as received and returns the updated sequence,
+// ErrDuplicateUpload if it was already received or ErrStaleSequence if it can no longer be told.
+func (u *UploadService) AcceptSequence(deviceID []byte, epoch, number uint64) (*ewserver.UploadSequence, error) {
+	if len(deviceID) == 0 {
+		return nil, ewserver.ErrUserNotFound
+	}
+
+	if number == 0 {
+		return nil, ewserver.ErrInvalidSequence
+	}
+
+	var sequence *ewserver.UploadSequence
+	err := u.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(uploadSequenceBucket))
+
+		var err error
+		if sequence, err = getUploadSequence(bucket, deviceID); err != nil {
+			return err
+		}
+
+		if err := sequence.Check(epoch, number); err != nil {
+			return err
+		}
+
+		sequence.Accept(epoch, number, time.Now().UTC())
+		sequenceBytes, err := sequence.Encode()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(deviceID, sequenceBytes)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return sequence, nil
+}
+
+// ResetSequence forgets the device's sequence, its next upload sets the starting point again
+func (u *UploadService) ResetSequence(deviceID []byte) error {
+	return u.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(uploadSequenceBucket)).Delete(deviceID)
+	})
+}
+
+// KeySeen returns true if the device's idempotency key was accepted within the last IdempotencyKeyTTL
+func (u *UploadService) KeySeen(deviceID []byte, key string) (bool, error) {
+	seen := false
+
+	err := u.DB.View(func(tx *bolt.Tx) error {
+		device := tx.Bucket([]byte(uploadKeyBucket)).Bucket(deviceID)
+		if device == nil {
+			return nil
+		}
+
+		seen = keyLive(device.Get([]byte(key)), time.Now())
+		return nil
+	})
+	return seen, err
+}
+
+// AcceptKey records the idempotency key as accepted at the time, ErrDuplicateUpload if it already was
+func (u *UploadService) AcceptKey(deviceID []byte, key string, at time.Time) error {
+	if len(deviceID) == 0 {
+		return ewserver.ErrUserNotFound
+	}
+
+	if len(key) == 0 || len(key) > ewserver.MaxIdempotencyKeyLength {
+		return ewserver.ErrInvalidSequence
+	}
+
+	return u.DB.Update(func(tx *bolt.Tx) error {
+		device, err := tx.Bucket([]byte(uploadKeyBucket)).CreateBucketIfNotExists(deviceID)
+		if err != nil {
+			return err
+		}
+
+		if keyLive(device.Get([]byte(key)), at) {
+			return ewserver.ErrDuplicateUpload
+		}
+		return device.Put([]byte(key), timestampKey(at))
+	})
+}
+
+// ExpireKeys deletes the idempotency keys of all devices accepted before the time, returning how many
+func (u *UploadService) ExpireKeys(before time.Time) (int, error) {
+	expired := 0
+
+	err := u.DB.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket([]byte(uploadKeyBucket))
+		devices := make([][]byte, 0)
+		if err := keys.ForEach(func(k, v []byte) error {
+			devices = append(devices, k)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, deviceID := range devices {
+			device := keys.Bucket(deviceID)
+			c := device.Cursor()
+			for k, v := c.First(); k != nil; {
+				if len(v) != timestampSize || !keyTimestamp(v).Before(before) {
+					k, v = c.Next()
+					continue
+				}
+
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				expired++
+				// deleting moves the cursor to the next key
+				k, v = c.Seek(k)
+			}
+
+			if k, _ := device.Cursor().First(); k == nil {
+				if err := keys.DeleteBucket(deviceID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// getUploadSequence returns the device's stored sequence or a new one
+func getUploadSequence(bucket *bolt.Bucket, deviceID []byte) (*ewserver.UploadSequence, error) {
+	sequenceBytes := bucket.Get(deviceID)
+	if sequenceBytes == nil {
+		return ewserver.NewUploadSequence(deviceID), nil
+	}
+	return ewserver.DecodeUploadSequence(sequenceBytes)
+}
+
+// keyLive returns true if the key was accepted (value holds when) within IdempotencyKeyTTL of now
+func keyLive(value []byte, now time.Time) bool {
+	if len(value) != timestampSize {
+		return false
+	}
+	acceptedAt := time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+	return now.Sub(acceptedAt) < ewserver.IdempotencyKeyTTL
+}
@@ -0,0 +1,158 @@
+package boltdb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestUploadService_AcceptSequence(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewUploadService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing upload service: %s\n", err)
+	}
+
+	deviceID := []byte("device1")
+	if _, err := service.AcceptSequence(deviceID, 0, 0); err != ewserver.ErrInvalidSequence {
+		t.Fatalf("expected ErrInvalidSequence for sequence 0 got: %v\n", err)
+	}
+
+	// the first upload sets the starting point, devices may have uploaded before being tracked
+	for _, number := range []uint64{5, 6, 10, 13} {
+		if _, err := service.AcceptSequence(deviceID, 0, number); err != nil {
+			t.Fatalf("error accepting sequence %d: %s\n", number, err)
+		}
+	}
+
+	if _, err := service.AcceptSequence(deviceID, 0, 6); err != ewserver.ErrDuplicateUpload {
+		t.Fatalf("expected ErrDuplicateUpload accepting twice got: %v\n", err)
+	}
+
+	if _, err := service.AcceptSequence(deviceID, 0, 3); err != ewserver.ErrStaleSequence {
+		t.Fatalf("expected numbers before the starting point to be stale got: %v\n", err)
+	}
+
+	sequence, err := service.Sequence(deviceID)
+	if err != nil || sequence.HighWater != 13 || len(sequence.Gaps) != 2 || sequence.Gaps[0].From != 7 || sequence.Gaps[0].To != 9 || sequence.Gaps[1].From != 11 || sequence.Gaps[1].To != 12 {
+		t.Fatalf("expected high water 13 with gaps 7-9,11-12 got: %v %#v\n", err, sequence)
+	}
+
+	// late uploads fill their gap, splitting it if they are in the middle
+	for _, number := range []uint64{8, 11, 12} {
+		if _, err := service.AcceptSequence(deviceID, 0, number); err != nil {
+			t.Fatalf("error accepting late sequence %d: %s\n", number, err)
+		}
+	}
+
+	sequence, err = service.AcceptSequence(deviceID, 0, 7)
+	if err != nil || len(sequence.Gaps) != 1 || sequence.Gaps[0].From != 9 || sequence.Gaps[0].To != 9 {
+		t.Fatalf("expected only gap 9-9 to remain got: %v %#v\n", err, sequence)
+	}
+
+	if err := service.ResetSequence(deviceID); err != nil {
+		t.Fatalf("error resetting sequence: %s\n", err)
+	}
+
+	if sequence, err = service.AcceptSequence(deviceID, 0, 1); err != nil || sequence.HighWater != 1 || len(sequence.Gaps) != 0 {
+		t.Fatalf("expected a reset sequence to start again got: %v %#v\n", err, sequence)
+	}
+
+	// a new epoch starts the sequence over, the old epoch's numbers can no longer be told apart
+	if sequence, err = service.AcceptSequence(deviceID, 1, 1); err != nil || sequence.Epoch != 1 || sequence.HighWater != 1 {
+		t.Fatalf("expected a new epoch to start again got: %v %#v\n", err, sequence)
+	}
+
+	if _, err := service.AcceptSequence(deviceID, 0, 2); err != ewserver.ErrStaleSequence {
+		t.Fatalf("expected numbers of an old epoch to be stale got: %v\n", err)
+	}
+
+	// numbers in forgotten gaps are stale rather than duplicates
+	for number := uint64(3); number <= 2*ewserver.MaxSequenceGaps+3; number += 2 {
+		if _, err := service.AcceptSequence(deviceID, 1, number); err != nil {
+			t.Fatalf("error accepting sequence %d: %s\n", number, err)
+		}
+	}
+
+	if _, err := service.AcceptSequence(deviceID, 1, 2); err != ewserver.ErrStaleSequence {
+		t.Fatalf("expected a number in a forgotten gap to be stale got: %v\n", err)
+	}
+
+	if _, err := service.AcceptSequence(deviceID, 1, 2*ewserver.MaxSequenceGaps+2); err != nil {
+		t.Fatalf("expected a number in a tracked gap to be accepted got: %v\n", err)
+	}
+
+	if sequence, err = service.Sequence([]byte("device2")); err != nil || sequence.HighWater != 0 {
+		t.Fatalf("expected sequences to be per device got: %v %#v\n", err, sequence)
+	}
+}
+
+func TestUploadService_AcceptKey(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewUploadService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing upload service: %s\n", err)
+	}
+
+	deviceID := []byte("device1")
+	now := time.Now().UTC()
+	if err := service.AcceptKey(deviceID, string(make([]byte, ewserver.MaxIdempotencyKeyLength+1)), now); err != ewserver.ErrInvalidSequence {
+		t.Fatalf("expected ErrInvalidSequence for a long key got: %v\n", err)
+	}
+
+	if err := service.AcceptKey(deviceID, "upload-1", now); err != nil {
+		t.Fatalf("error accepting key: %s\n", err)
+	}
+
+	if err := service.AcceptKey(deviceID, "upload-1", now); err != ewserver.ErrDuplicateUpload {
+		t.Fatalf("expected ErrDuplicateUpload accepting twice got: %v\n", err)
+	}
+
+	if seen, err := service.KeySeen(deviceID, "upload-1"); err != nil || !seen {
+		t.Fatalf("expected key to be seen got: %v %v\n", seen, err)
+	}
+
+	if seen, err := service.KeySeen([]byte("device2"), "upload-1"); err != nil || seen {
+		t.Fatalf("expected keys to be per device got: %v %v\n", seen, err)
+	}
+
+	old := now.Add(-ewserver.IdempotencyKeyTTL - time.Minute)
+	if err := service.AcceptKey(deviceID, "upload-0", old); err != nil {
+		t.Fatalf("error accepting old key: %s\n", err)
+	}
+
+	if err := service.AcceptKey([]byte("device2"), "upload-0", old); err != nil {
+		t.Fatalf("error accepting old key: %s\n", err)
+	}
+
+	if seen, err := service.KeySeen(deviceID, "upload-0"); err != nil || seen {
+		t.Fatalf("expected a key older than the TTL to not be seen got: %v %v\n", seen, err)
+	}
+
+	expired, err := service.ExpireKeys(now.Add(-ewserver.IdempotencyKeyTTL))
+	if err != nil || expired != 2 {
+		t.Fatalf("expected both old keys to expire got: %d %v\n", expired, err)
+	}
+
+	if seen, err := service.KeySeen(deviceID, "upload-1"); err != nil || !seen {
+		t.Fatalf("expected a recent key to be kept got: %v %v\n", seen, err)
+	}
+}
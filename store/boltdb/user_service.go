@@ -156,7 +156,17 @@ func (u *UserService) User(userName ewserver.UserName) (*ewserver.User, error) {
 func (u *UserService) Users() ([]*ewserver.User, error) {
 	foundUsers := make([]*ewserver.User, 0)
 
-	err := u.DB.View(func(tx *bolt.Tx) error {
+	err := u.ForEachUser(func(user *ewserver.User) error {
+		foundUsers = append(foundUsers, user)
+		return nil
+	})
+	return foundUsers, err
+}
+
+// ForEachUser calls fn with every user in a single read transaction so callers can stream them
+// without holding them all in memory. The first error returned by fn stops the iteration.
+func (u *UserService) ForEachUser(fn func(*ewserver.User) error) error {
+	return u.DB.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(userBucket))
 		c := bucket.Cursor()
 
@@ -166,11 +176,12 @@ func (u *UserService) Users() ([]*ewserver.User, error) {
 				return err
 			}
 
-			foundUsers = append(foundUsers, user)
+			if err := fn(user); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	return foundUsers, err
 }
 
 // Create adds a new user if it does not already exist
@@ -0,0 +1,359 @@
+package boltdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wirepair/ewserver/ewserver"
+)
+
+const (
+	webhookBucket         = "webhooks"           // subscriptions keyed by their big endian ID
+	webhookDeliveryBucket = "webhook_deliveries" // the delivery log keyed by big endian delivery ID
+	webhookQueueBucket    = "webhook_queue"      // pending deliveries keyed by their next attempt time and ID
+)
+
+// WebhookService implementation storing subscriptions and a persistent delivery queue. Pending deliveries
+// are indexed by their next attempt so Due only reads what is ready to be sent.
+type WebhookService struct {
+	DB *bolt.DB
+}
+
+// NewWebhookService creates a new webhook service backed by an already open boltdb
+func NewWebhookService(db *bolt.DB) *WebhookService {
+	w := &WebhookService{DB: db}
+	return w
+}
+
+// Init the subscription, delivery and queue buckets
+func (w *WebhookService) Init() error {
+	return w.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{webhookBucket, webhookDeliveryBucket, webhookQueueBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Create validates and stores a new subscription, generating its secret if it has none.
+func (w *WebhookService) Create(subscription *ewserver.WebhookSubscription) error {
+	if err := subscription.Valid(); err != nil {
+		return err
+	}
+
+	subscription.CreatedAt = time.Now().UTC()
+
+	return w.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(webhookBucket))
+
+		var err error
+		if subscription.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+
+		subscriptionBytes, err := subscription.Encode()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(sequenceKey(subscription.ID), subscriptionBytes)
+	})
+}
+
+// Subscription returns a single subscription
+func (w *WebhookService) Subscription(id uint64) (*ewserver.WebhookSubscription, error) {
+	var subscription *ewserver.WebhookSubscription
+
+	err := w.DB.View(func(tx *bolt.Tx) error {
+		subscriptionBytes := tx.Bucket([]byte(webhookBucket)).Get(sequenceKey(id))
+		if subscriptionBytes == nil {
+			return ewserver.ErrWebhookNotFound
+		}
+
+		var err error
+		subscription, err = ewserver.DecodeWebhookSubscription(subscriptionBytes)
+		return err
+	})
+	return subscription, err
+}
+
+// Subscriptions returns all subscriptions ordered by ID
+func (w *WebhookService) Subscriptions() ([]*ewserver.WebhookSubscription, error) {
+	subscriptions := make([]*ewserver.WebhookSubscription, 0)
+
+	err := w.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(webhookBucket)).ForEach(func(k, v []byte) error {
+			subscription, err := ewserver.DecodeWebhookSubscription(v)
+			if err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+			return nil
+		})
+	})
+	return subscriptions, err
+}
+
+// Delete the subscription and dead letter its pending deliveries, the delivery log is kept.
+func (w *WebhookService) Delete(id uint64) error {
+	return w.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(webhookBucket))
+		if bucket.Get(sequenceKey(id)) == nil {
+			return ewserver.ErrWebhookNotFound
+		}
+
+		if err := bucket.Delete(sequenceKey(id)); err != nil {
+			return err
+		}
+
+		deliveries := tx.Bucket([]byte(webhookDeliveryBucket))
+		queue := tx.Bucket([]byte(webhookQueueBucket))
+
+		// collect first, deleting while iterating skips keys
+		var queued [][]byte
+		queue.ForEach(func(k, v []byte) error {
+			queued = append(queued, k)
+			return nil
+		})
+
+		for _, key := range queued {
+			delivery, err := getDelivery(deliveries, binary.BigEndian.Uint64(key[8:]))
+			if err != nil {
+				return err
+			}
+
+			if delivery.SubscriptionID != id {
+				continue
+			}
+
+			delivery.State = ewserver.WebhookDead
+			delivery.LastError = ewserver.ErrWebhookNotFound.Error()
+			delivery.UpdatedAt = time.Now().UTC()
+
+			if err := queue.Delete(key); err != nil {
+				return err
+			}
+
+			if err := putDelivery(deliveries, delivery); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Enqueue a delivery of the event for every subscription that wants it, due immediately.
+func (w *WebhookService) Enqueue(event ewserver.WebhookEventType, data interface{}, at time.Time) ([]*ewserver.WebhookDelivery, error) {
+	queued := make([]*ewserver.WebhookDelivery, 0)
+
+	err := w.DB.Update(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket([]byte(webhookDeliveryBucket))
+		queue := tx.Bucket([]byte(webhookQueueBucket))
+
+		return tx.Bucket([]byte(webhookBucket)).ForEach(func(k, v []byte) error {
+			subscription, err := ewserver.DecodeWebhookSubscription(v)
+			if err != nil {
+				return err
+			}
+
+			if !subscription.Subscribed(event) {
+				return nil
+			}
+
+			delivery := ewserver.NewWebhookDelivery()
+			if delivery.ID, err = deliveries.NextSequence(); err != nil {
+				return err
+			}
+
+			payload := &ewserver.WebhookPayload{Delivery: delivery.ID, Event: event, Time: at, Data: data}
+			if delivery.Payload, err = json.Marshal(payload); err != nil {
+				return err
+			}
+
+			delivery.SubscriptionID, delivery.Event, delivery.State = subscription.ID, event, ewserver.WebhookPending
+			delivery.NextAttempt, delivery.CreatedAt, delivery.UpdatedAt = at, at, at
+
+			if err := queue.Put(queueKey(delivery.NextAttempt, delivery.ID), []byte{}); err != nil {
+				return err
+			}
+
+			queued = append(queued, delivery)
+			return putDelivery(deliveries, delivery)
+		})
+	})
+	return queued, err
+}
+
+// Due returns up to limit pending deliveries whose next attempt is not after now, oldest first.
+func (w *WebhookService) Due(now time.Time, limit int) ([]*ewserver.WebhookDelivery, error) {
+	due := make([]*ewserver.WebhookDelivery, 0)
+
+	err := w.DB.View(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket([]byte(webhookDeliveryBucket))
+		c := tx.Bucket([]byte(webhookQueueBucket)).Cursor()
+
+		for k, _ := c.First(); k != nil && len(due) < limit; k, _ = c.Next() {
+			if int64(binary.BigEndian.Uint64(k[:8])) > now.UnixNano() {
+				break
+			}
+
+			delivery, err := getDelivery(deliveries, binary.BigEndian.Uint64(k[8:]))
+			if err != nil {
+				return err
+			}
+			due = append(due, delivery)
+		}
+		return nil
+	})
+	return due, err
+}
+
+// Record the outcome of an attempt. A 2xx status without a message is delivered, anything else is
+// attempted again after WebhookBackoff or dead lettered after MaxWebhookAttempts.
+func (w *WebhookService) Record(id uint64, status int, message string, at time.Time) (*ewserver.WebhookDelivery, error) {
+	var delivery *ewserver.WebhookDelivery
+
+	err := w.DB.Update(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket([]byte(webhookDeliveryBucket))
+		queue := tx.Bucket([]byte(webhookQueueBucket))
+
+		var err error
+		if delivery, err = getDelivery(deliveries, id); err != nil {
+			return err
+		}
+
+		if delivery.State != ewserver.WebhookPending {
+			return ewserver.ErrDeliveryState
+		}
+
+		if err := queue.Delete(queueKey(delivery.NextAttempt, delivery.ID)); err != nil {
+			return err
+		}
+
+		delivery.Attempts++
+		delivery.LastStatus, delivery.LastError, delivery.UpdatedAt = status, message, at
+
+		switch {
+		case status >= 200 && status <= 299 && message == "":
+			delivery.State = ewserver.WebhookDelivered
+		case delivery.Attempts >= ewserver.MaxWebhookAttempts:
+			delivery.State = ewserver.WebhookDead
+		default:
+			delivery.NextAttempt = at.Add(ewserver.WebhookBackoff(delivery.Attempts))
+			if err := queue.Put(queueKey(delivery.NextAttempt, delivery.ID), []byte{}); err != nil {
+				return err
+			}
+		}
+		return putDelivery(deliveries, delivery)
+	})
+	return delivery, err
+}
+
+// Retry requeues a dead delivery with its attempts reset, due immediately.
+func (w *WebhookService) Retry(id uint64) (*ewserver.WebhookDelivery, error) {
+	var delivery *ewserver.WebhookDelivery
+
+	err := w.DB.Update(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket([]byte(webhookDeliveryBucket))
+
+		var err error
+		if delivery, err = getDelivery(deliveries, id); err != nil {
+			return err
+		}
+
+		if delivery.State != ewserver.WebhookDead {
+			return ewserver.ErrDeliveryState
+		}
+
+		delivery.State, delivery.Attempts = ewserver.WebhookPending, 0
+		delivery.NextAttempt, delivery.UpdatedAt = time.Now().UTC(), time.Now().UTC()
+
+		if err := tx.Bucket([]byte(webhookQueueBucket)).Put(queueKey(delivery.NextAttempt, delivery.ID), []byte{}); err != nil {
+			return err
+		}
+		return putDelivery(deliveries, delivery)
+	})
+	return delivery, err
+}
+
+// Deliveries returns the delivery log ordered by ID, only the subscription's and in the state if they are set.
+func (w *WebhookService) Deliveries(subscriptionID uint64, state ewserver.WebhookDeliveryState) ([]*ewserver.WebhookDelivery, error) {
+	deliveries := make([]*ewserver.WebhookDelivery, 0)
+
+	err := w.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(webhookDeliveryBucket)).ForEach(func(k, v []byte) error {
+			delivery, err := ewserver.DecodeWebhookDelivery(v)
+			if err != nil {
+				return err
+			}
+
+			if (subscriptionID == 0 || delivery.SubscriptionID == subscriptionID) && (state == "" || delivery.State == state) {
+				deliveries = append(deliveries, delivery)
+			}
+			return nil
+		})
+	})
+	return deliveries, err
+}
+
+// Prune deletes delivered and dead deliveries last updated before, pending deliveries are always kept.
+func (w *WebhookService) Prune(before time.Time) (int, error) {
+	pruned := 0
+
+	err := w.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(webhookDeliveryBucket))
+
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			delivery, err := ewserver.DecodeWebhookDelivery(v)
+			if err != nil {
+				return err
+			}
+
+			if delivery.State != ewserver.WebhookPending && delivery.UpdatedAt.Before(before) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		pruned = len(keys)
+		return nil
+	})
+	return pruned, err
+}
+
+// getDelivery decodes the delivery, returning ErrDeliveryNotFound if it does not exist.
+func getDelivery(bucket *bolt.Bucket, id uint64) (*ewserver.WebhookDelivery, error) {
+	deliveryBytes := bucket.Get(sequenceKey(id))
+	if deliveryBytes == nil {
+		return nil, ewserver.ErrDeliveryNotFound
+	}
+	return ewserver.DecodeWebhookDelivery(deliveryBytes)
+}
+
+func putDelivery(bucket *bolt.Bucket, delivery *ewserver.WebhookDelivery) error {
+	deliveryBytes, err := delivery.Encode()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(sequenceKey(delivery.ID), deliveryBytes)
+}
+
+// queueKey orders the queue by next attempt time, the delivery ID keeps keys unique.
+func queueKey(next time.Time, id uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(next.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], id)
+	return key
+}
@@ -0,0 +1,127 @@
+package boltdb_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wirepair/ewserver/ewserver"
+	"github.com/wirepair/ewserver/store/boltdb"
+)
+
+func TestWebhookSubscription_Valid(t *testing.T) {
+	subscription := &ewserver.WebhookSubscription{URL: "https://example.com/hook", Events: []ewserver.WebhookEventType{ewserver.WebhookUserCreated}}
+	if err := subscription.Valid(); err != nil || len(subscription.Secret) != 2*ewserver.WebhookSecretSize {
+		t.Fatalf("expected subscription to be valid with a generated secret got: %v %d\n", err, len(subscription.Secret))
+	}
+
+	invalid := []*ewserver.WebhookSubscription{
+		{URL: "https://example.com/hook"},
+		{URL: "ftp://example.com/hook", Events: []ewserver.WebhookEventType{ewserver.WebhookAll}},
+		{URL: "https://example.com/hook", Events: []ewserver.WebhookEventType{"user.renamed"}},
+	}
+
+	for i, subscription := range invalid {
+		if err := subscription.Valid(); err != ewserver.ErrInvalidWebhook {
+			t.Fatalf("expected subscription %d to be invalid got: %v\n", i, err)
+		}
+	}
+
+	if ewserver.WebhookBackoff(1) != 30*time.Second || ewserver.WebhookBackoff(3) != 2*time.Minute || ewserver.WebhookBackoff(20) != time.Hour {
+		t.Fatalf("expected exponential backoff capped at an hour")
+	}
+}
+
+func TestWebhookService_Queue(t *testing.T) {
+	dbFileName, err := testTempDbFileName("testdata/")
+	if err != nil {
+		t.Fatalf("error opening db file for testing")
+	}
+	defer testRemoveDbFile(dbFileName, t)
+
+	db := testOpenDb(dbFileName, t)
+	defer testCloseDb(db, t)
+
+	service := boltdb.NewWebhookService(db.DB())
+	if err := service.Init(); err != nil {
+		t.Fatalf("error initializing webhook service: %s\n", err)
+	}
+
+	users := &ewserver.WebhookSubscription{URL: "https://example.com/users", Events: []ewserver.WebhookEventType{ewserver.WebhookUserCreated}}
+	all := &ewserver.WebhookSubscription{URL: "https://example.com/all", Events: []ewserver.WebhookEventType{ewserver.WebhookAll}}
+	for _, subscription := range []*ewserver.WebhookSubscription{users, all} {
+		if err := service.Create(subscription); err != nil {
+			t.Fatalf("error creating subscription: %s\n", err)
+		}
+	}
+
+	now := time.Now().UTC()
+	if queued, err := service.Enqueue(ewserver.WebhookUserCreated, map[string]string{"username": "bob"}, now); err != nil || len(queued) != 2 {
+		t.Fatalf("expected a delivery for both subscriptions got: %d %v\n", len(queued), err)
+	}
+
+	if queued, _ := service.Enqueue(ewserver.WebhookLoginFailed, nil, now); len(queued) != 1 || queued[0].SubscriptionID != all.ID {
+		t.Fatalf("expected a single delivery for the all subscription got: %v\n", queued)
+	}
+
+	due, err := service.Due(now, 10)
+	if err != nil || len(due) != 3 {
+		t.Fatalf("expected 3 due deliveries got: %d %v\n", len(due), err)
+	}
+
+	payload := &ewserver.WebhookPayload{}
+	if err := json.Unmarshal(due[0].Payload, payload); err != nil || payload.Delivery != due[0].ID || payload.Event != ewserver.WebhookUserCreated {
+		t.Fatalf("expected the payload to identify the delivery got: %s %v\n", due[0].Payload, err)
+	}
+
+	if delivery, err := service.Record(due[0].ID, 200, "", now); err != nil || delivery.State != ewserver.WebhookDelivered {
+		t.Fatalf("expected delivery to be delivered got: %v %v\n", delivery, err)
+	}
+
+	if _, err := service.Record(due[0].ID, 200, "", now); err != ewserver.ErrDeliveryState {
+		t.Fatalf("expected recording a delivered delivery to fail got: %v\n", err)
+	}
+
+	// fail until dead lettered, each failure moves the next attempt further out
+	at := now
+	for attempt := 1; attempt <= ewserver.MaxWebhookAttempts; attempt++ {
+		delivery, err := service.Record(due[1].ID, 500, "", at)
+		if err != nil {
+			t.Fatalf("error recording attempt %d: %s\n", attempt, err)
+		}
+
+		if attempt < ewserver.MaxWebhookAttempts {
+			if delivery.State != ewserver.WebhookPending || !delivery.NextAttempt.Equal(at.Add(ewserver.WebhookBackoff(attempt))) {
+				t.Fatalf("expected attempt %d to be retried after backoff got: %v %v\n", attempt, delivery.State, delivery.NextAttempt)
+			}
+
+			if due, _ := service.Due(at, 10); len(due) != 1 {
+				t.Fatalf("expected only the third delivery to be due while backing off got: %d\n", len(due))
+			}
+			at = delivery.NextAttempt
+		} else if delivery.State != ewserver.WebhookDead {
+			t.Fatalf("expected delivery to be dead after %d attempts got: %s\n", attempt, delivery.State)
+		}
+	}
+
+	if dead, _ := service.Deliveries(0, ewserver.WebhookDead); len(dead) != 1 || dead[0].ID != due[1].ID {
+		t.Fatalf("expected a single dead delivery got: %v\n", dead)
+	}
+
+	if delivery, err := service.Retry(due[1].ID); err != nil || delivery.State != ewserver.WebhookPending || delivery.Attempts != 0 {
+		t.Fatalf("expected dead delivery to be requeued got: %v %v\n", delivery, err)
+	}
+
+	// deleting the subscription dead letters its queued deliveries
+	if err := service.Delete(all.ID); err != nil {
+		t.Fatalf("error deleting subscription: %s\n", err)
+	}
+
+	if due, _ := service.Due(time.Now().UTC(), 10); len(due) != 0 {
+		t.Fatalf("expected nothing due after deleting the subscription got: %d\n", len(due))
+	}
+
+	if pruned, err := service.Prune(time.Now().UTC().Add(time.Hour)); err != nil || pruned != 3 {
+		t.Fatalf("expected all 3 deliveries to be pruned got: %d %v\n", pruned, err)
+	}
+}